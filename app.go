@@ -8,7 +8,7 @@ package main // 定义包名为 main，表示这是一个可执行程序的包
      * 使用`log.Println`打印可执行文件路径错误日志
      * 返回包含错误信息的字符串（"Executable:" + 错误详情）
    - 如果没有错误，继续执行：
-     * 构建目标可执行文件路径`exeDstPath`（在`exPath`后追加"\\wechatDataBackup.exe"）
+     * 构建目标可执行文件路径`exeDstPath`（在`exPath`下追加与当前程序同扩展名的"wechatDataBackup"）
      * 打印源路径到目标路径的复制信息
      * 调用`utils.CopyFile`复制文件
      * 如果复制出错，打印并返回错误信息
@@ -51,14 +51,18 @@ package main // 定义包名为 main，表示这是一个可执行程序的包
 import (
 	"context"      // 导入 context 包，用于管理请求的生命周期和取消信号。
 	"encoding/json" // 导入 encoding/json 包，用于 JSON 数据的编码和解码。
+	"errors"       // 导入 errors 包，用于创建和判断错误。
 	"fmt"          // 导入 fmt 包，用于格式化输入输出。
+	"io"           // 导入 io 包，用于读取文件头。
+	"io/fs"        // 导入 io/fs 包，用于判断文件是否存在。
 	"log"          // 导入 log 包，用于记录程序运行时的日志信息。
 	"mime"         // 导入 mime 包，用于处理 MIME 类型。
 	"net/http"     // 导入 net/http 包，提供了 HTTP 客户端和服务器的实现。
 	"os"           // 导入 os 包，提供了与操作系统交互的函数，如文件操作、环境变量等。
 	"path/filepath" // 导入 path/filepath 包，用于处理文件路径。
-	"strconv"      // 导入 strconv 包，用于字符串和基本数据类型之间的转换。
 	"strings"      // 导入 strings 包，用于字符串操作。
+	"sync"         // 导入 sync 包，用于保护导出状态。
+	"time"         // 导入 time 包，用于记录进度事件的时间。
 	"wechatDataBackup/pkg/utils" // 导入自定义的 utils 包，包含一些工具函数。
 	"wechatDataBackup/pkg/wechat" // 导入自定义的 wechat 包，包含微信数据处理相关逻辑。
 
@@ -72,40 +76,112 @@ const (
 	configDefaultUserKey = "userConfig.defaultUser" // 配置文件中默认用户键名。
 	configUsersKey       = "userConfig.users"       // 配置文件中用户列表键名。
 	configExportPathKey  = "exportPath"       // 配置文件中导出路径键名。
+	configLazyDatKey     = "lazyDat"          // 配置文件中是否只拷贝 .dat 原文件的键名，默认关闭。
+	configDatAESKey      = "datAesKey"        // 配置文件中新版 V2 .dat 图片 AES 密钥的键名。
+	configDatXorKey      = "datXorByte"       // 配置文件中新版 .dat 图片尾部异或字节的键名，不设置时自动推断。
+	configEncryptBackupKey = "encryptBackup"  // 配置文件中导出后是否用口令加密数据库的键名。
+	configSnapshotKey      = "snapshot.enable"      // 配置文件中导出后是否保存带日期快照的键名。
+	configSnapshotLastKey  = "snapshot.keepLast"    // 配置文件中保留最近几个快照的键名。
+	configSnapshotDailyKey = "snapshot.keepDaily"   // 配置文件中按天保留快照天数的键名。
+	configSnapshotWeekKey  = "snapshot.keepWeekly"  // 配置文件中按周保留快照周数的键名。
+	configSnapshotMonthKey = "snapshot.keepMonthly" // 配置文件中按月保留快照月数的键名。
+	backupPassphraseEnv  = "WECHAT_BACKUP_PASSPHRASE" // 加密备份口令的环境变量，口令不写入配置文件。
 	appVersion           = "v1.2.4"           // 应用程序的版本号。
+	exportShutdownWait   = 30 * time.Second   // 退出时等待导出写完当前文件(以及加密)的最长时间。
 )
 
 // FileLoader 结构体用于处理静态文件的加载和 HTTP 服务。
 type FileLoader struct {
 	http.Handler // 嵌入 http.Handler 接口，使其可以作为 HTTP 处理程序。
 	FilePrefix string     // 文件路径前缀，用于构建完整的文件路径。
+	DatCache   *wechat.DatCache // 未解码的 .dat 图片在请求时解码，解码结果缓存在这里。
 }
 
 // NewFileLoader 函数创建一个新的 FileLoader 实例。
 // prefix 参数指定文件加载器的文件路径前缀。
 func NewFileLoader(prefix string) *FileLoader {
 	mime.AddExtensionType(".mp3", "audio/mpeg") // 为 .mp3 文件添加 MIME 类型，确保浏览器能正确识别和播放。
-	return &FileLoader{FilePrefix: prefix}      // 返回一个新的 FileLoader 实例，并设置文件前缀。
+	return &FileLoader{FilePrefix: prefix, DatCache: wechat.NewDatCache("", 0)} // 返回一个新的 FileLoader 实例，并设置文件前缀。
 }
 
 // SetFilePrefix 方法用于设置 FileLoader 的文件路径前缀。
 // prefix 参数是新的文件路径前缀。
 func (h *FileLoader) SetFilePrefix(prefix string) {
-	h.FilePrefix = prefix                 // 更新文件前缀。
+	h.FilePrefix = filepath.Clean(filepath.FromSlash(utils.SlashPath(prefix))) // 更新文件前缀，兼容旧配置中的 ".\\"。
 	log.Println("SetFilePrefix", h.FilePrefix) // 记录设置文件前缀的日志。
 }
 
+// fileLoaderSniffExts 中的扩展名不能说明文件内容：.headimg 是头像图片，
+// 导出时解码后的 .dat 可能是 jpg、png、gif 等，需要读取文件头判断 MIME 类型。
+var fileLoaderSniffExts = map[string]bool{
+	".headimg": true,
+	".dat":     true,
+}
+
+// errFileLoaderForbidden 表示请求的路径超出了导出目录。
+var errFileLoaderForbidden = errors.New("path escapes export root")
+
+// resolve 方法把 URL 路径转换为导出目录下的本地路径。
+// 拒绝包含 .. 的路径、绝对路径以及通过符号链接指向导出目录之外的文件。
+func (h *FileLoader) resolve(urlPath string) (string, error) {
+	relPath := strings.TrimLeft(utils.SlashPath(urlPath), "/")
+	for _, elem := range strings.Split(relPath, "/") {
+		if elem == ".." {
+			return "", errFileLoaderForbidden // 不允许返回上级目录。
+		}
+	}
+	localRel := filepath.FromSlash(relPath)
+	if filepath.IsAbs(localRel) || filepath.VolumeName(localRel) != "" {
+		return "", errFileLoaderForbidden // 不允许绝对路径和盘符。
+	}
+
+	root, err := filepath.Abs(h.FilePrefix)
+	if err != nil {
+		return "", err
+	}
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+
+	// 解析符号链接后再检查一次，文件必须仍在导出目录内。
+	realPath, err := filepath.EvalSymlinks(filepath.Join(root, localRel))
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, realPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errFileLoaderForbidden
+	}
+
+	return realPath, nil
+}
+
 // ServeHTTP 方法实现了 http.Handler 接口，用于处理 HTTP 请求。
-// 它根据请求的 Range 头处理文件分片下载。
+// 文件内容由 http.ServeContent 返回，支持 ETag/If-None-Match、If-Modified-Since 以及单个和多个 Range 的分片下载。
 func (h *FileLoader) ServeHTTP(res http.ResponseWriter, req *http.Request) {
-	// 构建请求的文件名，通过拼接文件前缀和去除 URL 路径前导斜杠后的部分。
-	requestedFilename := h.FilePrefix + "\\" + strings.TrimPrefix(req.URL.Path, "/")
+	// 构建请求的文件名，URL 路径以 / 分隔，转换为本地路径后限制在文件前缀下。
+	requestedFilename, err := h.resolve(req.URL.Path)
+	if err != nil {
+		if errors.Is(err, errFileLoaderForbidden) {
+			log.Println("FileLoader forbidden:", req.URL.Path)
+			http.Error(res, "Forbidden", http.StatusForbidden)
+		} else if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(res, req) // 文件不存在返回 404。
+		} else {
+			http.Error(res, fmt.Sprintf("Could not load file %s", req.URL.Path), http.StatusInternalServerError)
+		}
+		return
+	}
 
 	// 尝试打开请求的文件。
 	file, err := os.Open(requestedFilename)
 	if err != nil {
-		// 如果文件打开失败，返回 400 Bad Request 错误。
-		http.Error(res, fmt.Sprintf("Could not load file %s", requestedFilename), http.StatusBadRequest)
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(res, req)
+			return
+		}
+		http.Error(res, fmt.Sprintf("Could not load file %s", req.URL.Path), http.StatusInternalServerError)
 		return
 	}
 	defer file.Close() // 确保在函数返回前关闭文件句柄。
@@ -117,67 +193,51 @@ func (h *FileLoader) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 		http.Error(res, "Could not retrieve file info", http.StatusInternalServerError)
 		return
 	}
-
-	fileSize := fileInfo.Size()           // 获取文件大小。
-	rangeHeader := req.Header.Get("Range") // 获取请求头中的 Range 字段。
-	if rangeHeader == "" {
-		// 如果没有 Range 请求头，表示请求整个文件。
-		res.Header().Set("Content-Length", strconv.FormatInt(fileSize, 10)) // 设置 Content-Length 响应头。
-		// 使用 http.ServeContent 直接返回整个文件内容。
-		http.ServeContent(res, req, requestedFilename, fileInfo.ModTime(), file)
+	if fileInfo.IsDir() {
+		http.NotFound(res, req) // 不提供目录列表。
 		return
 	}
 
-	var start, end int64
-	// 检查 Range 请求头是否以 "bytes=" 开头。
-	if strings.HasPrefix(rangeHeader, "bytes=") {
-		// 解析 Range 请求头，获取请求的字节范围。
-		ranges := strings.Split(strings.TrimPrefix(rangeHeader, "bytes="), "-")
-		start, _ = strconv.ParseInt(ranges[0], 10, 64) // 解析起始字节。
-
-		if len(ranges) > 1 && ranges[1] != "" {
-			end, _ = strconv.ParseInt(ranges[1], 10, 64) // 解析结束字节。
-		} else {
-			end = fileSize - 1 // 如果结束字节为空，则表示到文件末尾。
+	// 导出时没有解码的 .dat 图片，解码后从缓存目录返回。
+	if strings.ToLower(filepath.Ext(requestedFilename)) == ".dat" && h.DatCache != nil {
+		decodedPath, err := h.DatCache.Decoded(requestedFilename, fileInfo)
+		if err != nil {
+			log.Println("DatCache.Decoded failed:", err)
+			var decErr *wechat.DatDecodeError
+			if errors.As(err, &decErr) {
+				// 无法识别的格式或缺少 V2 密钥。
+				http.Error(res, fmt.Sprintf("Could not decode %s .dat file: %v", wechat.DatVersionName(decErr.Version), decErr.Err), http.StatusUnsupportedMediaType)
+				return
+			}
+			http.Error(res, "Could not decode file", http.StatusInternalServerError)
+			return
+		}
+		if decodedPath != requestedFilename {
+			decodedFile, err := os.Open(decodedPath)
+			if err != nil {
+				http.Error(res, "Could not decode file", http.StatusInternalServerError)
+				return
+			}
+			defer decodedFile.Close()
+			file = decodedFile
 		}
-	} else {
-		// 如果 Range 请求头格式无效，返回 416 Requested Range Not Satisfiable 错误。
-		http.Error(res, "Invalid Range header", http.StatusRequestedRangeNotSatisfiable)
-		return
 	}
 
-	// 检查请求的字节范围是否有效。
-	if start < 0 || end >= fileSize || start > end {
-		// 如果范围无效，返回 416 Requested Range Not Satisfiable 错误。
-		http.Error(res, "Requested range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
-		return
-	}
+	// 使用文件大小和修改时间生成 ETag，ServeContent 会据此处理 If-None-Match 和 If-Range。
+	res.Header().Set("ETag", fmt.Sprintf("\"%x-%x\"", fileInfo.ModTime().UnixNano(), fileInfo.Size()))
 
-	// 根据文件扩展名获取 MIME 类型。
-	contentType := mime.TypeByExtension(filepath.Ext(requestedFilename))
-	if contentType == "" {
-		contentType = "application/octet-stream" // 如果无法确定 MIME 类型，则使用默认的二进制流类型。
-	}
-	res.Header().Set("Content-Type", contentType)                                     // 设置 Content-Type 响应头。
-	res.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, fileSize)) // 设置 Content-Range 响应头。
-	res.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))            // 设置 Content-Length 响应头。
-	res.WriteHeader(http.StatusPartialContent)                                        // 设置 HTTP 状态码为 206 Partial Content。
-	buffer := make([]byte, 102400)                                                    // 创建一个缓冲区用于读取文件内容。
-	file.Seek(start, 0)                                                               // 将文件指针移动到请求的起始位置。
-	for current := start; current <= end; {
-		readSize := int64(len(buffer))
-		if end-current+1 < readSize {
-			readSize = end - current + 1 // 调整读取大小，确保不超过请求的范围。
-		}
-
-		n, err := file.Read(buffer[:readSize]) // 从文件中读取数据到缓冲区。
-		if err != nil {
-			break // 如果读取出错，则退出循环。
+	if fileLoaderSniffExts[strings.ToLower(filepath.Ext(requestedFilename))] {
+		// 读取文件头判断实际的图片类型。
+		buffer := make([]byte, 512)
+		n, _ := io.ReadFull(file, buffer)
+		res.Header().Set("Content-Type", http.DetectContentType(buffer[:n]))
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			http.Error(res, "Could not read file", http.StatusInternalServerError)
+			return
 		}
-
-		res.Write(buffer[:n]) // 将读取到的数据写入 HTTP 响应。
-		current += int64(n)   // 更新当前读取位置。
 	}
+
+	http.ServeContent(res, req, requestedFilename, fileInfo.ModTime(), file)
 }
 
 // App 结构体表示应用程序的主体，包含应用程序的上下文、数据提供者、用户信息等。
@@ -190,6 +250,11 @@ type App struct {
 	firstStart  bool                        // 标记应用程序是否是第一次启动。
 	firstInit   bool                        // 标记应用程序是否是第一次初始化。
 	FLoader     *FileLoader                 // 文件加载器，用于处理静态文件服务。
+	passphrase  []byte                      // 加密备份的口令。
+	exportMtx    sync.Mutex                 // 保护 exportCancel。
+	exportCancel context.CancelFunc         // 取消正在进行的导出，没有导出时为 nil。
+	exportSeq    int                        // 每次导出加 1，用于区分 exportCancel 属于哪次导出。
+	exportWG     sync.WaitGroup             // 正在进行的导出，退出时等待它结束。
 }
 
 // WeChatInfo 结构体定义了单个微信实例的详细信息。
@@ -225,7 +290,7 @@ func NewApp() *App {
 	a := &App{}                                  // 创建 App 结构体的实例。
 	log.Println("App version:", appVersion)          // 打印应用程序的版本号。
 	a.firstInit = true                             // 设置 firstInit 标志为 true，表示首次初始化。
-	a.FLoader = NewFileLoader(".\\")                // 创建 FileLoader 实例，用于加载文件。
+	a.FLoader = NewFileLoader(".")                   // 创建 FileLoader 实例，用于加载文件。
 	viper.SetConfigName(defaultConfig)               // 设置配置文件的名称为 "config"。
 	viper.SetConfigType("json")                      // 设置配置文件的类型为 JSON。
 	viper.AddConfigPath(".")                         // 添加当前目录作为配置文件的搜索路径。
@@ -237,9 +302,20 @@ func NewApp() *App {
 			log.Println("SetFilePrefix", prefix)                  // 打印设置的文件前缀。
 			a.FLoader.SetFilePrefix(prefix)                      // 设置文件加载器的文件前缀。
 		}
+		xorByte := -1
+		if viper.IsSet(configDatXorKey) {
+			xorByte = viper.GetInt(configDatXorKey)
+		}
+		if err := wechat.SetDatImageKey([]byte(viper.GetString(configDatAESKey)), xorByte); err != nil { // 设置新版 .dat 图片的密钥。
+			log.Println("SetDatImageKey failed:", err)
+		}
 	} else {
 		log.Println("not config exist") // 如果配置文件不存在，打印日志。
 	}
+	if passphrase := os.Getenv(backupPassphraseEnv); passphrase != "" {
+		a.passphrase = []byte(passphrase)
+		wechat.SetBackupPassphrase(a.passphrase) // 设置加密备份的口令，打开账号时解密到内存中。
+	}
 	log.Printf("default: %s users: %v\n", a.defaultUser, a.users) // 打印默认用户和用户列表。
 	if len(a.users) == 0 {                                       // 如果用户列表为空。
 		a.firstStart = true // 设置 firstStart 标志为 true，表示应用程序是第一次启动。
@@ -263,6 +339,9 @@ func (a *App) beforeClose(ctx context.Context) (prevent bool) {
 // shutdown 方法在应用程序关闭时被调用。
 // 用于清理资源，例如关闭数据提供者。
 func (a *App) shutdown(ctx context.Context) {
+	if a.CancelExport() { // 停止正在进行的导出，不再开始新的文件。
+		a.waitExport(exportShutdownWait) // 等待正在写的文件写完，导出目录才能在下次导出时继续。
+	}
 	if a.provider != nil {
 		a.provider.WechatWechatDataProviderClose() // 关闭微信数据提供者。
 		a.provider = nil                           // 将数据提供者设置为 nil。
@@ -304,15 +383,31 @@ func (a *App) GetWeChatAllInfo() string {
 
 // ExportWeChatAllData 方法用于导出指定微信账户的所有数据。
 // full 参数表示是否完全导出（包括消息），acountName 参数是需要导出的账户名。
+// 同一时间只能有一个导出，正在导出时再次调用直接返回并记录日志，
+// 不发送事件，前端仍然显示正在进行的导出的进度。
 func (a *App) ExportWeChatAllData(full bool, acountName string) {
+	a.exportMtx.Lock()
+	if a.exportCancel != nil {
+		a.exportMtx.Unlock()
+		log.Println("ExportWeChatAllData: export already running, ignore", acountName)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background()) // CancelExport 通过 cancel 停止导出。
+	a.exportSeq += 1
+	seq := a.exportSeq
+	a.exportCancel = cancel
+	a.exportMtx.Unlock()
 
 	if a.provider != nil {
 		a.provider.WechatWechatDataProviderClose() // 如果数据提供者已存在，则先关闭。
 		a.provider = nil                           // 将数据提供者设置为 nil。
 	}
 
-	progress := make(chan string) // 创建一个字符串类型的通道，用于接收导出进度信息。
+	progress := make(chan wechat.ProgressEvent) // 创建一个通道，用于接收导出进度事件。
+	a.exportWG.Add(1)
 	go func() {                   // 在新的 Goroutine 中执行导出操作，避免阻塞主线程。
+		defer a.exportWG.Done()
+		defer a.clearExportCancel(seq, cancel)
 		var pInfo *wechat.WeChatInfo
 		for i := range a.infoList.Info {
 			if a.infoList.Info[i].AcountName == acountName {
@@ -324,24 +419,22 @@ func (a *App) ExportWeChatAllData(full bool, acountName string) {
 		if pInfo == nil {
 			close(progress) // 关闭进度通道。
 			// 发送错误事件到前端。
-			runtime.EventsEmit(a.ctx, "exportData", fmt.Sprintf("{\"status\":\"error\", \"result\":\"%s error\"}", acountName))
+			a.exportProgressSink().Send(exportErrorEvent(acountName + " error"))
 			return
 		}
 
-		prefixExportPath := a.FLoader.FilePrefix + "\\User\\" // 构建导出路径前缀。
+		prefixExportPath := filepath.Join(a.FLoader.FilePrefix, "User") // 构建导出路径前缀。
 		_, err := os.Stat(prefixExportPath)                   // 检查导出路径是否存在。
 		if err != nil {
 			os.Mkdir(prefixExportPath, os.ModeDir) // 如果不存在，则创建目录。
 		}
 
-		expPath := prefixExportPath + pInfo.AcountName // 构建完整的导出路径。
+		expPath := filepath.Join(prefixExportPath, pInfo.AcountName) // 构建完整的导出路径。
 		_, err = os.Stat(expPath)                      // 检查目标导出路径是否存在。
-		if err == nil {
-			if !full {
-				os.RemoveAll(expPath + "\\Msg") // 如果不是完全导出，则只删除 Msg 目录。
-			} else {
-				os.RemoveAll(expPath) // 如果是完全导出，则删除整个目录。
-			}
+		if err == nil && full {
+			// 如果是完全导出，则删除整个目录，包括上次没有完成的导出和它的检查点清单；
+			// 否则保留 Msg 目录，数据库只重写变化的页，上次没有完成时按检查点清单继续。
+			os.RemoveAll(expPath)
 		}
 
 		_, err = os.Stat(expPath)
@@ -349,12 +442,29 @@ func (a *App) ExportWeChatAllData(full bool, acountName string) {
 			os.Mkdir(expPath, os.ModeDir) // 再次检查并创建目录，以防被删除后不存在。
 		}
 
-		go wechat.ExportWeChatAllData(*pInfo, expPath, progress) // 在新的 Goroutine 中开始导出微信数据。
-
-		for p := range progress { // 循环接收进度通道中的信息。
-			log.Println(p)                 // 打印进度信息到日志。
-			runtime.EventsEmit(a.ctx, "exportData", p) // 发送进度事件到前端。
+		opts := wechat.ExportOptions{}
+		opts.LazyDat = viper.GetBool(configLazyDatKey) // 开启后 .dat 图片在查看时才解码。
+		if viper.GetBool(configEncryptBackupKey) {
+			if len(a.passphrase) == 0 {
+				close(progress)
+				a.exportProgressSink().Send(exportErrorEvent("encryptBackup needs a passphrase"))
+				return
+			}
+			opts.Passphrase = a.passphrase // 导出后用口令加密数据库。
 		}
+		if viper.GetBool(configSnapshotKey) {
+			// 导出目录仍然只有一份，每次导出完成后另存一个快照，媒体文件在快照间共享。
+			opts.SnapshotDir = a.snapshotDir(pInfo.AcountName)
+			opts.Retention = wechat.SnapshotRetention{
+				KeepLast:    viper.GetInt(configSnapshotLastKey),
+				KeepDaily:   viper.GetInt(configSnapshotDailyKey),
+				KeepWeekly:  viper.GetInt(configSnapshotWeekKey),
+				KeepMonthly: viper.GetInt(configSnapshotMonthKey),
+			}
+		}
+		go wechat.ExportWeChatAllData(ctx, *pInfo, expPath, opts, progress) // 在新的 Goroutine 中开始导出微信数据。
+
+		wechat.DrainProgress(progress, a.exportProgressSink()) // 把进度事件分发到日志和前端。
 
 		a.defaultUser = pInfo.AcountName // 设置当前导出的账户为默认用户。
 		hasUser := false
@@ -371,6 +481,72 @@ func (a *App) ExportWeChatAllData(full bool, acountName string) {
 	}()
 }
 
+// CancelExport 方法取消正在进行的导出，返回是否有导出被取消。
+// 正在处理的文件会写完，导出目录标记为未完成，再次导出时从中断处继续。
+// 目前打包的前端没有取消按钮，界面中只有退出程序时会调用，命令行导出用 Ctrl+C 取消。
+func (a *App) CancelExport() bool {
+	a.exportMtx.Lock()
+	defer a.exportMtx.Unlock()
+	if a.exportCancel == nil {
+		return false
+	}
+
+	log.Println("CancelExport")
+	a.exportCancel()
+	return true
+}
+
+// waitExport 方法等待正在进行的导出结束，最多等待 timeout，返回导出是否已经结束。
+func (a *App) waitExport(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		a.exportWG.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		log.Println("export still running after", timeout)
+		return false
+	}
+}
+
+// clearExportCancel 方法在第 seq 次导出结束后释放它的 cancel，之后开始的导出不受影响。
+func (a *App) clearExportCancel(seq int, cancel context.CancelFunc) {
+	cancel()
+	a.exportMtx.Lock()
+	defer a.exportMtx.Unlock()
+	if a.exportSeq == seq {
+		a.exportCancel = nil
+	}
+}
+
+// exportProgressSink 方法返回界面导出时进度事件的去向：写入日志并发送 exportData 事件到前端。
+func (a *App) exportProgressSink() wechat.ProgressSink {
+	return wechat.ProgressSinks{
+		wechat.ProgressSinkFunc(func(event wechat.ProgressEvent) {
+			log.Println(event.JSON()) // 打印进度信息到日志。
+		}),
+		wechat.ProgressSinkFunc(func(event wechat.ProgressEvent) {
+			runtime.EventsEmit(a.ctx, "exportData", event.JSON()) // 发送进度事件到前端。
+		}),
+	}
+}
+
+// exportErrorEvent 函数构建导出开始前就失败时的错误事件。
+func exportErrorEvent(result string) wechat.ProgressEvent {
+	return wechat.ProgressEvent{
+		Status: wechat.ProgressStatusError,
+		Result: result,
+		Stage:  wechat.ProgressStageExport,
+		ETA:    -1,
+		Error:  &wechat.ProgressError{Message: result},
+		Time:   time.Now(),
+	}
+}
+
 // createWechatDataProvider 方法用于创建微信数据提供者实例。
 // resPath 参数是资源路径，prefix 参数是前缀。
 func (a *App) createWechatDataProvider(resPath string, prefix string) error {
@@ -398,6 +574,17 @@ func (a *App) createWechatDataProvider(resPath string, prefix string) error {
 	return nil // 返回 nil 表示成功。
 }
 
+// SetBackupPassphrase 方法设置加密备份的口令，并关闭当前的数据提供者，
+// 下次初始化时用新口令重新打开账号。口令只保存在内存中。
+func (a *App) SetBackupPassphrase(passphrase string) {
+	if a.provider != nil {
+		a.provider.WechatWechatDataProviderClose() // 关闭用旧口令打开的数据提供者。
+		a.provider = nil
+	}
+	a.passphrase = []byte(passphrase)
+	wechat.SetBackupPassphrase(a.passphrase)
+}
+
 // WeChatInit 方法用于初始化微信相关功能。
 func (a *App) WeChatInit() {
 
@@ -412,8 +599,8 @@ func (a *App) WeChatInit() {
 		return
 	}
 
-	expPath := a.FLoader.FilePrefix + "\\User\\" + a.defaultUser // 构建导出路径。
-	prefixPath := "\\User\\" + a.defaultUser                     // 构建前缀路径。
+	expPath := filepath.Join(a.FLoader.FilePrefix, "User", a.defaultUser) // 构建导出路径。
+	prefixPath := "/User/" + a.defaultUser                                 // 构建前缀路径。
 	wechat.ExportWeChatHeadImage(expPath)                        // 导出微信头像。
 	if a.createWechatDataProvider(expPath, prefixPath) == nil {  // 创建微信数据提供者。
 		infoJson, _ := json.Marshal(a.provider.SelfInfo) // 将自身信息转换为 JSON 字符串。
@@ -528,6 +715,43 @@ func (a *App) GetWechatMessageListByKeyWord(userName string, time int64, keyword
 	return string(listStr) // 返回 JSON 字符串。
 }
 
+// GetWechatSearchAllMessages 方法用于在所有会话中搜索关键词。
+// keyword 参数是关键词，cursor 参数是上一页返回的游标（首页传空字符串），pageSize 参数是每页大小。
+// 返回一个 JSON 字符串，包含按会话分组的搜索结果和下一页游标。
+func (a *App) GetWechatSearchAllMessages(keyword string, cursor string, pageSize int) string {
+	log.Println("GetWechatSearchAllMessages:", keyword, cursor, pageSize) // 打印参数。
+	if a.provider == nil || len(keyword) == 0 {
+		return "{\"Total\":0, \"Sessions\":[]}" // 如果数据提供者未初始化或关键词为空，返回空结果。
+	}
+	result, err := a.provider.WeChatSearchAllMessages(keyword, cursor, pageSize) // 搜索所有会话。
+	if err != nil {
+		log.Println("WeChatSearchAllMessages failed:", err) // 如果搜索失败，打印错误日志。
+		return ""                                           // 返回空字符串。
+	}
+	resultStr, _ := json.Marshal(result) // 将结果转换为 JSON 字符串。
+	log.Println("WeChatSearchAllMessages:", result.Total, result.Cursor) // 打印命中总数和游标。
+
+	return string(resultStr) // 返回 JSON 字符串。
+}
+
+// GetWechatSearchContacts 方法用于按昵称、备注、微信号搜索联系人。
+// keyword 参数是关键词。
+// 返回一个 JSON 字符串，包含匹配的联系人列表。
+func (a *App) GetWechatSearchContacts(keyword string) string {
+	if a.provider == nil || len(keyword) == 0 {
+		return "{\"Total\":0, \"Users\":[]}" // 如果数据提供者未初始化或关键词为空，返回空列表。
+	}
+	list, err := a.provider.WeChatSearchContacts(keyword) // 搜索联系人。
+	if err != nil {
+		log.Println("WeChatSearchContacts failed:", err) // 如果搜索失败，打印错误日志。
+		return "{\"Total\":0, \"Users\":[]}"
+	}
+	listStr, _ := json.Marshal(list) // 将列表转换为 JSON 字符串。
+	log.Println("WeChatSearchContacts:", list.Total) // 打印联系人数量。
+
+	return string(listStr) // 返回 JSON 字符串。
+}
+
 // GetWechatMessageDate 方法用于获取微信消息的日期列表。
 // userName 参数是用户名。
 // 返回一个 JSON 字符串，包含消息日期信息。
@@ -590,7 +814,7 @@ func (a *App) OpenFileOrExplorer(filePath string, explorer bool) string {
 	// }
 	// log.Println("OpenFileOrExplorer:", filePath)
 
-	path := a.FLoader.FilePrefix + filePath // 构建完整的文件路径。
+	path := utils.LocalPath(a.FLoader.FilePrefix, filePath) // 构建完整的文件路径。
 	err := utils.OpenFileOrExplorer(path, explorer) // 调用工具函数打开文件或资源管理器。
 	if err != nil {
 		return "{\"result\": \"OpenFileOrExplorer failed\", \"status\":\"failed\"}" // 如果操作失败，返回失败信息。
@@ -635,13 +859,13 @@ func (a *App) GetWechatLocalAccountInfo() string {
 	infos.Total = 0                                                    // 初始化微信账户信息总数为 0。
 	infos.CurrentAccount = a.defaultUser                               // 设置当前账户。
 	for i := range a.users {                                           // 遍历用户列表。
-		resPath := a.FLoader.FilePrefix + "\\User\\" + a.users[i]       // 构建资源路径。
+		resPath := filepath.Join(a.FLoader.FilePrefix, "User", a.users[i]) // 构建资源路径。
 		if _, err := os.Stat(resPath); err != nil {                     // 检查资源路径是否存在。
 			log.Println("GetWechatLocalAccountInfo:", resPath, err)          // 打印错误日志。
 			continue                                                     // 继续下一个循环。
 		}
 
-		prefixResPath := "\\User\\" + a.users[i]
+		prefixResPath := "/User/" + a.users[i]
 		info, err := wechat.WechatGetAccountInfo(resPath, prefixResPath, a.users[i]) // 获取微信账户信息。
 		if err != nil {
 			log.Println("GetWechatLocalAccountInfo", err) // 如果获取失败，打印错误日志。
@@ -697,6 +921,90 @@ func (a *App) GetExportPathStat() string {
 	return string(statString) // 返回 JSON 字符串。
 }
 
+// snapshotDir 函数返回账户快照的保存目录。
+func (a *App) snapshotDir(acountName string) string {
+	return filepath.Join(a.FLoader.FilePrefix, "Snapshots", acountName)
+}
+
+// GetWechatSnapshotList 函数用于获取指定账户的快照列表，从旧到新排列。
+// 每个快照目录都是完整的导出目录，可以直接打开查看。
+func (a *App) GetWechatSnapshotList(acountName string) string {
+	snapshots, err := wechat.ListSnapshots(a.snapshotDir(acountName)) // 读取快照目录。
+	if err != nil {
+		log.Println("ListSnapshots error:", err) // 打印错误日志。
+		var msg ErrorMessage
+		msg.ErrorStr = err.Error()
+		msgStr, _ := json.Marshal(msg)
+		return string(msgStr)
+	}
+
+	listStr, _ := json.Marshal(snapshots) // 将快照列表转换为 JSON 字符串。
+	return string(listStr)
+}
+
+// GetWechatHealthReport 函数用于检查当前账户的备份是否完整。
+// 对打开的每个数据库执行 integrity_check，并检查每条消息引用的媒体文件是否存在。
+// 返回一个 JSON 字符串，按会话和媒体类型列出缺失的文件。
+func (a *App) GetWechatHealthReport() string {
+	if a.provider == nil {
+		log.Println("provider not init") // 如果数据提供者未初始化，打印日志。
+		return "{\"Missing\":0}"
+	}
+	report, err := a.provider.WeChatHealthCheck() // 执行检查。
+	if err != nil {
+		log.Println("WeChatHealthCheck failed:", err) // 打印错误日志。
+		var msg ErrorMessage
+		msg.ErrorStr = err.Error()
+		msgStr, _ := json.Marshal(msg)
+		return string(msgStr)
+	}
+
+	reportStr, _ := json.Marshal(report) // 将检查结果转换为 JSON 字符串。
+	log.Println("WeChatHealthCheck missing:", report.Missing) // 打印缺失的文件数量。
+	return string(reportStr)
+}
+
+// RecoverWechatMessages 函数用于从当前账户的快照 snapshotName 中找回在微信里删除的消息。
+// 找回的消息保存在导出目录的 Recovered.db 中，获取消息列表时会带上 DeletedInClient 标记。
+// 返回一个 JSON 字符串，包含找回的消息数和涉及的会话。
+func (a *App) RecoverWechatMessages(snapshotName string) string {
+	if a.provider == nil {
+		log.Println("provider not init") // 如果数据提供者未初始化，打印日志。
+		return "{\"Recovered\":0}"
+	}
+	fromPath := filepath.Join(a.snapshotDir(a.defaultUser), filepath.Base(snapshotName)) // 构建快照路径。
+	report, err := a.provider.WeChatRecoverMessages(fromPath)                            // 对比快照并找回消息。
+	if err != nil {
+		log.Println("WeChatRecoverMessages failed:", err) // 打印错误日志。
+		var msg ErrorMessage
+		msg.ErrorStr = err.Error()
+		msgStr, _ := json.Marshal(msg)
+		return string(msgStr)
+	}
+
+	reportStr, _ := json.Marshal(report) // 将结果转换为 JSON 字符串。
+	log.Println("WeChatRecoverMessages recovered:", report.Recovered) // 打印找回的消息数量。
+	return string(reportStr)
+}
+
+// VerifyExport 函数用于校验指定账户的导出目录与导出时写入的清单是否一致。
+// 返回一个 JSON 字符串，包含缺失、被修改和多出的文件。
+func (a *App) VerifyExport(acountName string) string {
+	expPath := filepath.Join(a.FLoader.FilePrefix, "User", acountName) // 构建导出路径。
+	report, err := wechat.VerifyExport(expPath)                         // 重新计算所有文件的 SHA-256 并比较。
+	if err != nil {
+		log.Println("VerifyExport error:", expPath, err) // 打印错误日志。
+		var msg ErrorMessage
+		msg.ErrorStr = fmt.Sprintf("%s:%v", expPath, err)
+		msgStr, _ := json.Marshal(msg)
+		return string(msgStr)
+	}
+
+	reportString, _ := json.Marshal(report) // 将校验结果转换为 JSON 字符串。
+
+	return string(reportString)
+}
+
 // ExportPathIsCanWrite 函数用于判断导出路径是否可写。
 // 返回一个布尔值，true 表示可写，false 表示不可写。
 func (a *App) ExportPathIsCanWrite() bool {
@@ -752,7 +1060,7 @@ func (a *App) scanAccountByPath(path string) error {
 	infos.Total = 0                                                    // 初始化微信账户信息总数为 0。
 	infos.CurrentAccount = ""                                          // 初始化当前账户为空字符串。
 
-	userPath := path + "\\User\\" // 构建用户数据路径。
+	userPath := filepath.Join(path, "User") // 构建用户数据路径。
 	if _, err := os.Stat(userPath); err != nil {
 		return err // 如果用户路径不存在，返回错误。
 	}
@@ -768,8 +1076,8 @@ func (a *App) scanAccountByPath(path string) error {
 			continue // 如果不是目录，则跳过。
 		}
 		log.Println("dirs[i].Name():", dirs[i].Name()) // 打印目录名。
-		resPath := path + "\\User\\" + dirs[i].Name()  // 构建资源路径。
-		prefixResPath := "\\User\\" + dirs[i].Name()
+		resPath := filepath.Join(userPath, dirs[i].Name()) // 构建资源路径。
+		prefixResPath := "/User/" + dirs[i].Name()
 		info, err := wechat.WechatGetAccountInfo(resPath, prefixResPath, dirs[i].Name()) // 获取微信账户信息。
 		if err != nil {
 			log.Println("GetWechatLocalAccountInfo", err) // 如果获取失败，打印错误日志。
@@ -809,7 +1117,7 @@ func (a *App) scanAccountByPath(path string) error {
 
 // OepnLogFileExplorer 函数用于打开日志文件所在目录。
 func (a *App) OepnLogFileExplorer() {
-	utils.OpenFileOrExplorer(".\\app.log", true) // 打开日志文件所在目录。
+	utils.OpenFileOrExplorer(filepath.Join(".", "app.log"), true) // 打开日志文件所在目录。
 }
 
 // SaveFileDialog 函数用于打开保存文件对话框。
@@ -975,7 +1283,7 @@ func (a *App) ExportWeChatDataByUserName(userName, path string) string {
 		return "PathIsCanWriteFile: " + path       // 返回错误信息。
 	}
 
-	exPath := path + "\\" + "wechatDataBackup_" + userName // 构建导出目录路径。
+	exPath := filepath.Join(path, "wechatDataBackup_"+userName) // 构建导出目录路径。
 	if _, err := os.Stat(exPath); err != nil {
 		os.MkdirAll(exPath, os.ModePerm) // 如果目录不存在，则创建所有必要的目录。
 	} else {
@@ -990,7 +1298,7 @@ func (a *App) ExportWeChatDataByUserName(userName, path string) string {
 	}
 
 	config := map[string]interface{}{ // 构建配置映射。
-		"exportpath": ".\\",
+		"exportpath": ".",
 		"userconfig": map[string]interface{}{
 			"defaultuser": a.defaultUser,
 			"users":       []string{a.defaultUser},
@@ -1003,7 +1311,7 @@ func (a *App) ExportWeChatDataByUserName(userName, path string) string {
 		return "MarshalIndent:" + err.Error() // 返回错误信息。
 	}
 
-	configPath := exPath + "\\" + "config.json" // 构建配置文件路径。
+	configPath := filepath.Join(exPath, "config.json") // 构建配置文件路径。
 	err = os.WriteFile(configPath, configJson, os.ModePerm) // 写入配置文件。
 	if err != nil {
 		log.Println("WriteFile:", err) // 如果写入失败，打印错误日志。
@@ -1016,7 +1324,7 @@ func (a *App) ExportWeChatDataByUserName(userName, path string) string {
 		return "Executable:" + err.Error()     // 返回错误信息。
 	}
 
-	exeDstPath := exPath + "\\" + "wechatDataBackup.exe" // 构建目标可执行文件路径。
+	exeDstPath := filepath.Join(exPath, "wechatDataBackup"+filepath.Ext(exeSrcPath)) // 构建目标可执行文件路径。
 	log.Printf("Copy [%s] -> [%s]\n", exeSrcPath, exeDstPath) // 打印复制信息。
 	_, err = utils.CopyFile(exeSrcPath, exeDstPath) // 复制可执行文件。
 	if err != nil {
@@ -0,0 +1,803 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"wechatDataBackup/pkg/utils"
+	"wechatDataBackup/pkg/wechat"
+)
+
+// cliCommand 是一个命令行子命令，不启动界面，方便在服务器上写脚本备份。
+type cliCommand struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+type cliFileError struct {
+	Path  string `json:"Path"`
+	Error string `json:"Error"`
+}
+
+type cliDecryptResult struct {
+	Files     int                     `json:"Files"`
+	Decrypted int                     `json:"Decrypted"`
+	Failed    []cliFileError          `json:"Failed"`
+	Corrupted []*wechat.DecryptReport `json:"Corrupted"`
+}
+
+var cliCommands []cliCommand
+
+func init() {
+	cliCommands = []cliCommand{
+		{"info", "info [-json]", cliInfo},
+		{"key", "key -dump <memory dump> -db <MicroMsg.db> [-32bit] [-base 0x...] [-profile sqlcipher3|sqlcipher4] [-scan-bytes] [-json]", cliKey},
+		{"decrypt", "decrypt -key <hex> -in <Msg dir> -out <dir> [-corrupt keep|zero|skip] [-check=false] [-incremental] [-wal=false] [-profile auto|sqlcipher3|sqlcipher4] [-json]", cliDecrypt},
+		{"export", "export -key <hex> -src <WeChat Files/wxid_xxx> -out <export dir> [-full] [-lazy-dat] [-img-key k] [-img-xor n] [-encrypt] [-snapshot] [-keep-last n] [-keep-daily n] [-keep-weekly n] [-keep-monthly n] [-progress-log <file>] [-sse <addr>] [-json]", cliExport},
+		{"sessions", "sessions -path <User/wxid_xxx> [-page n] [-size n] [-json]", cliSessions},
+		{"search", "search -path <User/wxid_xxx> -keyword <text> [-user <wxid>] [-cursor c] [-size n] [-json]", cliSearch},
+		{"stats", "stats -path <User/wxid_xxx> [-json]", cliStats},
+		{"verify", "verify -path <User/wxid_xxx> [-json]", cliVerify},
+		{"health", "health -path <User/wxid_xxx> [-json]", cliHealth},
+		{"recover", "recover -path <User/wxid_xxx> -from <older export or snapshot> [-json]", cliRecover},
+		{"merge", "merge -out <User/wxid_xxx> [-json] <export or snapshot> <export or snapshot>...", cliMerge},
+		{"snapshots", "snapshots -root <Snapshots/wxid_xxx> [-create <User/wxid_xxx>] [-prune] [-keep-last n] [-keep-daily n] [-keep-weekly n] [-keep-monthly n] [-dry-run] [-json]", cliSnapshots},
+		{"serve", "serve [-addr 127.0.0.1:8080] [-root <export dir>] [-account wxid_xxx]", cliServe},
+	}
+}
+
+func isCLICommand(name string) bool {
+	if name == "help" || name == "-h" || name == "--help" {
+		return true
+	}
+
+	return findCLICommand(name) != nil
+}
+
+func findCLICommand(name string) *cliCommand {
+	for i := range cliCommands {
+		if cliCommands[i].name == name {
+			return &cliCommands[i]
+		}
+	}
+
+	return nil
+}
+
+// runCLI 执行 args[0] 指定的子命令，返回进程退出码。
+func runCLI(args []string) int {
+	cmd := findCLICommand(args[0])
+	if cmd == nil {
+		cliUsage()
+		return 0
+	}
+
+	// 加密备份的口令只从环境变量读取，不出现在命令行参数中。
+	if passphrase := os.Getenv(backupPassphraseEnv); passphrase != "" {
+		wechat.SetBackupPassphrase([]byte(passphrase))
+	}
+	if err := cmd.run(args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", cmd.name, err)
+		return 1
+	}
+
+	return 0
+}
+
+func cliUsage() {
+	fmt.Fprintln(os.Stderr, "usage: wechatDataBackup <command> [options]")
+	fmt.Fprintln(os.Stderr, "run without a command to start the GUI.")
+	fmt.Fprintln(os.Stderr, "")
+	for _, cmd := range cliCommands {
+		fmt.Fprintln(os.Stderr, "  "+cmd.usage)
+	}
+}
+
+func cliFlagSet(name string) (*flag.FlagSet, *bool) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	jsonOut := fs.Bool("json", false, "print machine-readable JSON")
+	return fs, jsonOut
+}
+
+// cliRetentionFlags 注册快照保留策略的参数，返回的函数在 Parse 之后读取策略。
+func cliRetentionFlags(fs *flag.FlagSet) func() wechat.SnapshotRetention {
+	keepLast := fs.Int("keep-last", 0, "keep the n newest snapshots")
+	keepDaily := fs.Int("keep-daily", 0, "keep the newest snapshot of each of the last n days")
+	keepWeekly := fs.Int("keep-weekly", 0, "keep the newest snapshot of each of the last n weeks")
+	keepMonthly := fs.Int("keep-monthly", 0, "keep the newest snapshot of each of the last n months")
+	return func() wechat.SnapshotRetention {
+		return wechat.SnapshotRetention{KeepLast: *keepLast, KeepDaily: *keepDaily, KeepWeekly: *keepWeekly, KeepMonthly: *keepMonthly}
+	}
+}
+
+func cliPrintJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func cliTime(stamp int64) string {
+	return time.Unix(stamp, 0).Format("2006-01-02 15:04:05")
+}
+
+func cliDecodeKey(key string) ([]byte, error) {
+	dbKey, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %v", err)
+	}
+	if len(dbKey) != 32 {
+		return nil, fmt.Errorf("invalid key length %d, want 32 bytes", len(dbKey))
+	}
+
+	return dbKey, nil
+}
+
+// cliInfo 列出正在运行的微信账号和数据库密钥，只在 Windows 上有结果。
+func cliInfo(args []string) error {
+	fs, jsonOut := cliFlagSet("info")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	list := wechat.GetWeChatAllInfo()
+	if *jsonOut {
+		return cliPrintJSON(list)
+	}
+	if list.Total == 0 {
+		return errors.New("no logged in WeChat found")
+	}
+	for _, info := range list.Info {
+		fmt.Printf("%s  v%s  %s\n  key: %s\n", info.AcountName, info.Version, info.FilePath, info.DBKey)
+	}
+	return nil
+}
+
+// cliKey 从其他工具导出的微信进程内存转储中查找数据库密钥，不需要 Windows 和正在运行的微信。
+func cliKey(args []string) error {
+	fs, jsonOut := cliFlagSet("key")
+	dump := fs.String("dump", "", "memory dump of the WeChat process, minidump or raw")
+	db := fs.String("db", "", "encrypted database to check candidates against, usually Msg/MicroMsg.db")
+	is32Bits := fs.Bool("32bit", false, "the dumped WeChat process is 32-bit")
+	base := fs.String("base", "0", "virtual address of the first byte of a raw dump")
+	profile := fs.String("profile", "sqlcipher3", "database parameters: sqlcipher3 (WeChat 3.x) or sqlcipher4 (WeChat 4.x)")
+	scanBytes := fs.Bool("scan-bytes", false, "also try random-looking 32-byte runs when no pointer leads to the key, slow")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *dump == "" || *db == "" {
+		fs.Usage()
+		return errors.New("-dump and -db are required")
+	}
+
+	opts := wechat.KeyDumpOptions{Is64Bits: !*is32Bits, ScanBytes: *scanBytes}
+	var err error
+	if opts.Base, err = strconv.ParseUint(*base, 0, 64); err != nil {
+		return fmt.Errorf("invalid -base %q", *base)
+	}
+	// 每个候选密钥都要做一次密钥派生，不自动识别，避免每个候选都多算一次 SQLCipher 4。
+	opts.Profile = wechat.DecryptProfileByName(*profile)
+	if opts.Profile == nil {
+		return fmt.Errorf("unknown -profile %q", *profile)
+	}
+
+	result, err := wechat.FindDBKeyInDump(*dump, *db, opts)
+	if err != nil {
+		return err
+	}
+	if *jsonOut {
+		return cliPrintJSON(result)
+	}
+	fmt.Printf("key: %s\n  %s, found by %s at offset 0x%X after %d candidates\n", result.Key, result.Profile, result.Source, result.Offset, result.Tried)
+	return nil
+}
+
+// cliDecrypt 解密目录下所有 .db 文件，保持原有的目录结构。
+func cliDecrypt(args []string) error {
+	fs, jsonOut := cliFlagSet("decrypt")
+	key := fs.String("key", "", "hex database key")
+	in := fs.String("in", "", "directory with encrypted .db files")
+	out := fs.String("out", "", "output directory")
+	corrupt := fs.String("corrupt", "zero", "corrupted pages: keep, zero or skip (skip only works when they are at the end of the file)")
+	check := fs.Bool("check", true, "run PRAGMA quick_check on every decrypted database")
+	incremental := fs.Bool("incremental", false, "only rewrite pages that changed since the last run into -out")
+	wal := fs.Bool("wal", true, "merge the committed frames of <db>-wal into the decrypted database")
+	profile := fs.String("profile", "auto", "database parameters: auto, sqlcipher3 (WeChat 3.x) or sqlcipher4 (WeChat 4.x)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *key == "" || *in == "" || *out == "" {
+		fs.Usage()
+		return errors.New("-key, -in and -out are required")
+	}
+
+	dbKey, err := cliDecodeKey(*key)
+	if err != nil {
+		return err
+	}
+
+	opts := wechat.DecryptOptions{QuickCheck: *check, Incremental: *incremental, WAL: *wal}
+	switch *corrupt {
+	case "keep":
+		opts.Corrupt = wechat.DecryptCorruptKeep
+	case "zero":
+		opts.Corrupt = wechat.DecryptCorruptZero
+	case "skip":
+		opts.Corrupt = wechat.DecryptCorruptSkip
+	default:
+		return fmt.Errorf("unknown -corrupt %q", *corrupt)
+	}
+	if *profile != "auto" {
+		opts.Profile = wechat.DecryptProfileByName(*profile)
+		if opts.Profile == nil {
+			return fmt.Errorf("unknown -profile %q", *profile)
+		}
+	}
+
+	result := cliDecryptResult{Failed: make([]cliFileError, 0), Corrupted: make([]*wechat.DecryptReport, 0)}
+	err = filepath.Walk(*in, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(path, ".db") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(*in, path)
+		if err != nil {
+			return err
+		}
+		expFile := filepath.Join(*out, rel)
+		if err := os.MkdirAll(filepath.Dir(expFile), 0755); err != nil {
+			return err
+		}
+
+		result.Files += 1
+		var report *wechat.DecryptReport
+		if filepath.Base(path) == "xInfo.db" {
+			_, err = utils.CopyFile(path, expFile)
+		} else {
+			report, err = wechat.DecryptDataBase(path, dbKey, expFile, opts)
+		}
+		if err != nil {
+			result.Failed = append(result.Failed, cliFileError{Path: rel, Error: err.Error()})
+			if !*jsonOut {
+				fmt.Printf("FAIL %s: %v\n", rel, err)
+			}
+			return nil
+		}
+
+		result.Decrypted += 1
+		if report != nil && !report.OK() {
+			result.Corrupted = append(result.Corrupted, report)
+			if !*jsonOut {
+				fmt.Printf("BAD  %s: %d of %d pages corrupted %v, quick_check: %s\n", rel, len(report.BadPages), report.Pages, report.BadPages, report.QuickCheck)
+			}
+			return nil
+		}
+		if !*jsonOut {
+			if report != nil && report.WALFrames > 0 {
+				fmt.Printf("OK   %s (%d WAL frames)\n", rel, report.WALFrames)
+			} else {
+				fmt.Printf("OK   %s\n", rel)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if *jsonOut {
+		if err := cliPrintJSON(result); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("%d files, %d decrypted, %d corrupted, %d failed\n", result.Files, result.Decrypted, len(result.Corrupted), len(result.Failed))
+	}
+
+	if len(result.Failed) > 0 {
+		return fmt.Errorf("%d files failed", len(result.Failed))
+	}
+	if len(result.Corrupted) > 0 {
+		return fmt.Errorf("%d files corrupted", len(result.Corrupted))
+	}
+	return nil
+}
+
+// cliExport 从拷贝出来的 WeChat Files\wxid_xxx 目录导出，和界面导出走同一套流程，
+// 结果放在 <out>/User/wxid_xxx 下，界面可以直接打开。
+func cliExport(args []string) error {
+	fs, jsonOut := cliFlagSet("export")
+	key := fs.String("key", "", "hex database key")
+	src := fs.String("src", "", "WeChat Files/wxid_xxx directory")
+	out := fs.String("out", "", "export directory")
+	full := fs.Bool("full", false, "remove the previous export of this account first")
+	lazyDat := fs.Bool("lazy-dat", false, "copy .dat images as they are and decode them when they are viewed")
+	imgKey := fs.String("img-key", "", "AES key of V2 .dat images")
+	imgXor := fs.Int("img-xor", -1, "XOR byte of the .dat image tail, -1 guesses it")
+	encrypt := fs.Bool("encrypt", false, "encrypt the exported databases with the passphrase in $"+backupPassphraseEnv)
+	progressLog := fs.String("progress-log", "", "append every progress event as a JSON line to this file")
+	sseAddr := fs.String("sse", "", "serve progress as server-sent events on this address while exporting, e.g. 127.0.0.1:8081")
+	snapshot := fs.Bool("snapshot", false, "save a dated snapshot to <out>/Snapshots/wxid_xxx after the export")
+	retention := cliRetentionFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *key == "" || *src == "" || *out == "" {
+		fs.Usage()
+		return errors.New("-key, -src and -out are required")
+	}
+	opts := wechat.ExportOptions{LazyDat: *lazyDat}
+	if *snapshot {
+		opts.SnapshotDir = filepath.Join(*out, "Snapshots", filepath.Base(filepath.Clean(*src)))
+		opts.Retention = retention()
+	}
+	if *encrypt {
+		opts.Passphrase = []byte(os.Getenv(backupPassphraseEnv))
+		if len(opts.Passphrase) == 0 {
+			return errors.New("-encrypt needs the passphrase in $" + backupPassphraseEnv)
+		}
+	}
+
+	if _, err := cliDecodeKey(*key); err != nil {
+		return err
+	}
+	if err := wechat.SetDatImageKey([]byte(*imgKey), *imgXor); err != nil {
+		return err
+	}
+
+	info := wechat.WeChatInfo{}
+	info.FilePath = filepath.Clean(*src)
+	info.AcountName = filepath.Base(info.FilePath)
+	info.DBKey = *key
+
+	expPath := filepath.Join(*out, "User", info.AcountName)
+	// -full 总是删除上次的导出重新开始，不指定时上次没有完成的导出按检查点清单继续。
+	if _, err := os.Stat(expPath); err == nil && *full {
+		os.RemoveAll(expPath)
+	}
+	if err := os.MkdirAll(expPath, 0755); err != nil {
+		return err
+	}
+
+	// 进度事件同时输出到终端、JSON 日志文件和 SSE 客户端。
+	sinks := wechat.ProgressSinks{cliProgressSink(*jsonOut)}
+	if *progressLog != "" {
+		logFile, err := os.OpenFile(*progressLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		defer logFile.Close()
+		sinks = append(sinks, wechat.NewProgressJSONLog(logFile))
+	}
+	if *sseAddr != "" {
+		sse := wechat.NewProgressSSE()
+		listener, err := net.Listen("tcp", *sseAddr)
+		if err != nil {
+			return err
+		}
+		server := &http.Server{Handler: sse}
+		go server.Serve(listener)
+		defer server.Close()
+		fmt.Fprintf(os.Stderr, "progress events on http://%s/\n", listener.Addr())
+		sinks = append(sinks, sse)
+	}
+
+	progress := make(chan wechat.ProgressEvent)
+	// Ctrl+C 取消导出，正在处理的文件写完后退出，再次运行同样的命令继续导出。
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	go wechat.ExportWeChatAllData(ctx, info, expPath, opts, progress)
+	errCount := wechat.DrainProgress(progress, sinks)
+
+	if errCount > 0 {
+		return fmt.Errorf("export %s finished with %d errors", expPath, errCount)
+	}
+	return nil
+}
+
+// cliProgressSink 把进度事件打印到标准输出，-json 时每行一个事件。
+func cliProgressSink(jsonOut bool) wechat.ProgressSink {
+	return wechat.ProgressSinkFunc(func(event wechat.ProgressEvent) {
+		if jsonOut {
+			fmt.Println(event.JSON())
+			return
+		}
+
+		line := fmt.Sprintf("[%3d%%] %s %s", event.Progress, event.Status, event.Result)
+		if event.Status == wechat.ProgressStatusProcessing && event.FilesTotal > 0 {
+			line += fmt.Sprintf(" (%d/%d files, %s/s", event.FilesDone, event.FilesTotal, cliBytes(event.BytesPerSec))
+			if event.ETA > 0 {
+				line += fmt.Sprintf(", %v left", time.Duration(event.ETA)*time.Second)
+			}
+			line += ")"
+		}
+		fmt.Println(line)
+	})
+}
+
+func cliBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fGB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+func cliOpenProvider(path string) (*wechat.WechatDataProvider, error) {
+	if path == "" {
+		return nil, errors.New("-path is required")
+	}
+
+	resPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	provider, err := wechat.CreateWechatDataProvider(resPath, "/User/"+filepath.Base(resPath))
+	if err != nil {
+		provider.WechatWechatDataProviderClose()
+		return nil, err
+	}
+
+	return provider, nil
+}
+
+func cliSessions(args []string) error {
+	fs, jsonOut := cliFlagSet("sessions")
+	path := fs.String("path", "", "exported account directory")
+	page := fs.Int("page", 0, "page index")
+	size := fs.Int("size", 100, "page size")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	provider, err := cliOpenProvider(*path)
+	if err != nil {
+		return err
+	}
+	defer provider.WechatWechatDataProviderClose()
+
+	list, err := provider.WeChatGetSessionList(*page, *size)
+	if err != nil {
+		return err
+	}
+
+	if *jsonOut {
+		return cliPrintJSON(list)
+	}
+	for _, session := range list.Rows {
+		name := session.UserInfo.ReMark
+		if name == "" {
+			name = session.UserInfo.NickName
+		}
+		fmt.Printf("%s  %-30s %s: %s\n", cliTime(int64(session.Time)), session.UserName, name, session.Content)
+	}
+	return nil
+}
+
+func cliSearch(args []string) error {
+	fs, jsonOut := cliFlagSet("search")
+	path := fs.String("path", "", "exported account directory")
+	keyWord := fs.String("keyword", "", "text to search")
+	user := fs.String("user", "", "only search this session")
+	cursor := fs.String("cursor", "", "cursor returned by the previous page")
+	size := fs.Int("size", 50, "page size")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *keyWord == "" {
+		fs.Usage()
+		return errors.New("-keyword is required")
+	}
+
+	provider, err := cliOpenProvider(*path)
+	if err != nil {
+		return err
+	}
+	defer provider.WechatWechatDataProviderClose()
+
+	if *user != "" {
+		list, err := provider.WeChatGetMessageListByKeyWord(*user, time.Now().Unix(), *keyWord, "", *size)
+		if err != nil {
+			return err
+		}
+		if *jsonOut {
+			return cliPrintJSON(list)
+		}
+		for _, msg := range list.Rows {
+			fmt.Printf("%s  %s  %s\n", cliTime(msg.CreateTime), msg.Talker, msg.Content)
+		}
+		return nil
+	}
+
+	result, err := provider.WeChatSearchAllMessages(*keyWord, *cursor, *size)
+	if err != nil {
+		return err
+	}
+	if *jsonOut {
+		return cliPrintJSON(result)
+	}
+	for _, session := range result.Sessions {
+		fmt.Printf("%s (%d)\n", session.UserName, session.Count)
+		for _, hit := range session.Hits {
+			fmt.Printf("  %s  %s\n", cliTime(hit.CreateTime), hit.Snippet)
+		}
+	}
+	if result.Cursor != "" {
+		fmt.Printf("more: -cursor %s\n", result.Cursor)
+	}
+	return nil
+}
+
+func cliStats(args []string) error {
+	fs, jsonOut := cliFlagSet("stats")
+	path := fs.String("path", "", "exported account directory")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	provider, err := cliOpenProvider(*path)
+	if err != nil {
+		return err
+	}
+	defer provider.WechatWechatDataProviderClose()
+
+	stats, err := provider.WeChatGetStats()
+	if err != nil {
+		return err
+	}
+
+	if *jsonOut {
+		return cliPrintJSON(stats)
+	}
+	fmt.Printf("account:  %s\n", stats.UserName)
+	fmt.Printf("contacts: %d\n", stats.Contacts)
+	fmt.Printf("sessions: %d\n", stats.Sessions)
+	fmt.Printf("messages: %d\n", stats.Messages)
+	if stats.Messages > 0 {
+		fmt.Printf("range:    %s - %s\n", cliTime(stats.StartTime), cliTime(stats.EndTime))
+	}
+	for _, t := range stats.Types {
+		fmt.Printf("  type %-6d %d\n", t.Type, t.Count)
+	}
+	for _, db := range stats.DBs {
+		fmt.Printf("  %-10s %10d bytes %8d messages\n", db.Name, db.Size, db.Messages)
+	}
+	return nil
+}
+
+// cliRecover 对比旧的导出或快照，把在微信里删除的消息找回到导出目录的 Recovered.db。
+func cliRecover(args []string) error {
+	fs, jsonOut := cliFlagSet("recover")
+	path := fs.String("path", "", "exported account directory")
+	from := fs.String("from", "", "older export or snapshot of the same account")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *from == "" {
+		return errors.New("-from is required")
+	}
+
+	provider, err := cliOpenProvider(*path)
+	if err != nil {
+		return err
+	}
+	defer provider.WechatWechatDataProviderClose()
+
+	report, err := provider.WeChatRecoverMessages(filepath.Clean(*from))
+	if err != nil {
+		return err
+	}
+
+	if *jsonOut {
+		return cliPrintJSON(report)
+	}
+	fmt.Printf("scanned %d messages, recovered %d, %d recovered before, %d media files copied\n", report.Scanned, report.Recovered, report.Known, report.Media)
+	for _, session := range report.Sessions {
+		fmt.Printf("  %s %s: %d\n", session.UserName, session.NickName, session.Messages)
+	}
+	return nil
+}
+
+// cliMerge 把同一账号在多台电脑上的导出合并成一个新的账号目录。
+func cliMerge(args []string) error {
+	fs, jsonOut := cliFlagSet("merge")
+	out := fs.String("out", "", "new account directory, named after the wxid")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *out == "" || fs.NArg() < 2 {
+		return errors.New("-out and at least two exports are required")
+	}
+
+	report, err := wechat.MergeExports(fs.Args(), *out)
+	if err != nil {
+		return err
+	}
+
+	if *jsonOut {
+		return cliPrintJSON(report)
+	}
+	fmt.Printf("base:     %s\n", report.Base)
+	fmt.Printf("messages: %d in %d shards, %d duplicates dropped\n", report.Messages, report.Shards, report.Duplicates)
+	for _, t := range []string{"Contact", "ChatRoom", "Session", "ContactHeadImgUrl", "OpenIMContact"} {
+		if n := report.Rows[t]; n > 0 {
+			fmt.Printf("  %-18s %d rows added\n", t, n)
+		}
+	}
+	fmt.Printf("media:    %d files, %d bytes copied\n", report.Media, report.MediaBytes)
+	for _, p := range report.Conflicts {
+		fmt.Printf("  conflict %s\n", p)
+	}
+	return nil
+}
+
+// cliSnapshots 列出账户的快照，也可以从导出目录新建快照或按保留策略清理旧快照。
+func cliSnapshots(args []string) error {
+	fs, jsonOut := cliFlagSet("snapshots")
+	root := fs.String("root", "", "snapshot directory of the account, <export dir>/Snapshots/wxid_xxx")
+	create := fs.String("create", "", "exported account directory to take a snapshot of first")
+	prune := fs.Bool("prune", false, "remove the snapshots the -keep-* flags do not keep")
+	dryRun := fs.Bool("dry-run", false, "with -prune, only print what would be removed")
+	retention := cliRetentionFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *root == "" {
+		fs.Usage()
+		return errors.New("-root is required")
+	}
+
+	result := struct {
+		Created   *wechat.SnapshotReport      `json:"created,omitempty"`
+		Pruned    *wechat.SnapshotPruneReport `json:"pruned,omitempty"`
+		Snapshots []wechat.SnapshotInfo       `json:"snapshots"`
+	}{}
+	if *create != "" {
+		report, err := wechat.CreateSnapshot(*create, *root)
+		if err != nil {
+			return err
+		}
+		result.Created = report
+	}
+	if *prune {
+		report, err := wechat.PruneSnapshots(*root, retention(), *dryRun)
+		if err != nil {
+			return err
+		}
+		result.Pruned = report
+	}
+	snapshots, err := wechat.ListSnapshots(*root)
+	if err != nil {
+		return err
+	}
+	result.Snapshots = snapshots
+
+	if *jsonOut {
+		return cliPrintJSON(result)
+	}
+	if result.Created != nil {
+		fmt.Printf("created %s: %d files, %d new (%s), %d already stored\n", result.Created.Name, result.Created.Files,
+			result.Created.Stored, cliBytes(result.Created.StoredBytes), result.Created.Reused)
+	}
+	if result.Pruned != nil {
+		verb := "removed"
+		if *dryRun {
+			verb = "would remove"
+		}
+		fmt.Printf("%s %d snapshots %v, %d stored files (%s)\n", verb, len(result.Pruned.Removed), result.Pruned.Removed,
+			result.Pruned.RemovedBlobs, cliBytes(result.Pruned.FreedBytes))
+	}
+	for _, snapshot := range result.Snapshots {
+		fmt.Printf("%-22s %8d files %10s\n", snapshot.Name, snapshot.Files, cliBytes(snapshot.Bytes))
+	}
+	return nil
+}
+
+// cliHealth 检查数据库的完整性和消息引用的媒体文件是否都在导出目录中，有问题时返回错误。
+func cliHealth(args []string) error {
+	fs, jsonOut := cliFlagSet("health")
+	path := fs.String("path", "", "exported account directory")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	provider, err := cliOpenProvider(*path)
+	if err != nil {
+		return err
+	}
+	defer provider.WechatWechatDataProviderClose()
+
+	report, err := provider.WeChatHealthCheck()
+	if err != nil {
+		return err
+	}
+
+	if *jsonOut {
+		if err := cliPrintJSON(report); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("account:  %s\n", report.UserName)
+		for _, db := range report.DBs {
+			fmt.Printf("  %-28s %s\n", db.Name, db.Integrity)
+		}
+		fmt.Printf("messages: %d with media, %d referenced, %d missing\n", report.Messages, report.Referenced, report.Missing)
+		for _, media := range report.Media {
+			fmt.Printf("  %-8s %8d referenced %8d missing\n", media.Type, media.Referenced, media.Missing)
+		}
+		for _, session := range report.Sessions {
+			fmt.Printf("%s %s: %d missing\n", session.UserName, session.NickName, session.Missing)
+			for _, media := range session.Media {
+				fmt.Printf("  %-8s %d\n", media.Type, media.Missing)
+				for _, p := range media.Paths {
+					fmt.Printf("    %s\n", p)
+				}
+			}
+		}
+	}
+	if !report.Healthy() {
+		return fmt.Errorf("backup is not healthy: %d media files missing", report.Missing)
+	}
+	return nil
+}
+
+// cliVerify 重新计算导出目录中每个文件的 SHA-256，与导出时写入的清单比较，不一致时返回错误。
+func cliVerify(args []string) error {
+	fs, jsonOut := cliFlagSet("verify")
+	path := fs.String("path", "", "exported account directory")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *path == "" {
+		fs.Usage()
+		return errors.New("-path is required")
+	}
+
+	report, err := wechat.VerifyExport(*path)
+	if err != nil {
+		return err
+	}
+
+	if *jsonOut {
+		if err := cliPrintJSON(report); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("manifest: %s, %d files\n", report.Created.Format("2006-01-02 15:04:05"), report.Files)
+		if report.Incomplete {
+			fmt.Println("warning: the last export did not finish, the manifest may be behind")
+		}
+		fmt.Printf("ok:       %d (%s hashed)\n", report.OK, cliBytes(report.Bytes))
+		for _, list := range []struct {
+			name  string
+			paths []string
+		}{{"missing", report.Missing}, {"changed", report.Changed}, {"extra", report.Extra}} {
+			fmt.Printf("%-9s %d\n", list.name+":", len(list.paths))
+			for _, p := range list.paths {
+				fmt.Printf("  %s\n", p)
+			}
+		}
+	}
+	if !report.Intact() {
+		return fmt.Errorf("export does not match its manifest: %d missing, %d changed, %d extra", len(report.Missing), len(report.Changed), len(report.Extra))
+	}
+	return nil
+}
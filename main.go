@@ -12,8 +12,9 @@ import (
 	"gopkg.in/natefinch/lumberjack.v2" // 导入 lumberjack 包，用于日志文件轮转，方便日志管理。
 )
 
-//go:embed all:frontend/dist // 嵌入前端构建后的所有静态文件。
-// assets 变量用于存储嵌入的静态资源，这些资源在编译时会被嵌入到 Go 程序中。
+// assets 变量用于存储嵌入的静态资源（前端构建后的所有静态文件），这些资源在编译时会被嵌入到 Go 程序中。
+//
+//go:embed all:frontend/dist
 var assets embed.FS
 
 // init 函数在 main 函数之前执行，用于初始化操作。
@@ -34,6 +35,14 @@ func main() {
 	}
 	defer logJack.Close() // 使用 defer 确保在 main 函数结束时关闭日志文件，释放资源。
 
+	// 带子命令启动时走命令行模式，不启动界面；日志只写文件，标准输出留给命令结果。
+	if len(os.Args) > 1 && isCLICommand(os.Args[1]) {
+		log.SetOutput(logJack)
+		code := runCLI(os.Args[1:])
+		logJack.Close()
+		os.Exit(code)
+	}
+
 	// 创建一个多重写入器，将日志同时输出到文件和标准输出（控制台），方便查看和管理日志。
 	multiWriter := io.MultiWriter(logJack, os.Stdout)
 	// 设置日志输出目标为多重写入器，将日志同时写入文件和标准输出。
@@ -6,17 +6,13 @@ import (
 	"errors"        // 导入 errors 包，用于创建和处理错误。
 	"fmt"           // 导入 fmt 包，用于格式化输入输出。
 	"io"            // 导入 io 包，提供了基本的 I/O 接口。
-	"log"           // 导入 log 包，用于记录日志。
 	"os"            // 导入 os 包，提供了与操作系统交互的函数。
-	"os/exec"       // 导入 os/exec 包，用于执行外部命令。
 	"path/filepath" // 导入 path/filepath 包，用于处理文件路径。
 	"regexp"        // 导入 regexp 包，用于正则表达式操作。
 	"strings"       // 导入 strings 包，用于字符串操作。
 
-	"github.com/pkg/browser"     // 导入 browser 包，用于在默认浏览器中打开文件或 URL。
 	"github.com/shirou/gopsutil/v3/disk" // 导入 gopsutil/disk 包，用于获取磁盘使用情况。
 	"golang.org/x/net/html"      // 导入 golang.org/x/net/html 包，用于 HTML 解析。
-	"golang.org/x/sys/windows/registry" // 导入 windows/registry 包，用于访问 Windows 注册表。
 )
 
 // PathStat 结构体定义了路径的统计信息。
@@ -28,81 +24,6 @@ type PathStat struct {
 	UsedPercent float64 `json:"usedPercent"` // 已用空间百分比。
 }
 
-// getDefaultProgram 函数用于获取指定文件扩展名的默认打开程序。
-// fileExtension 参数是文件扩展名（不带点）。
-// 返回默认程序的名称和可能发生的错误。
-func getDefaultProgram(fileExtension string) (string, error) {
-	// 打开注册表中的 HKEY_CLASSES_ROOT 键，查找与文件扩展名关联的默认程序。
-	key, err := registry.OpenKey(registry.CLASSES_ROOT, fmt.Sprintf(`.%s`, fileExtension), registry.QUERY_VALUE)
-	if err != nil {
-		return "", err // 如果打开注册表键失败，返回错误。
-	}
-	defer key.Close() // 确保在函数返回前关闭注册表键。
-
-	// 读取默认程序关联值。
-	defaultProgram, _, err := key.GetStringValue("")
-	if err != nil {
-		return "", err // 如果读取字符串值失败，返回错误。
-	}
-
-	return defaultProgram, nil // 返回默认程序名称。
-}
-
-// hasDefaultProgram 函数用于检查指定文件扩展名是否有默认打开程序。
-// fileExtension 参数是文件扩展名（不带点）。
-// 返回一个布尔值，true 表示有默认程序，false 表示没有。
-func hasDefaultProgram(fileExtension string) bool {
-	prog, err := getDefaultProgram(fileExtension) // 获取默认程序。
-	if err != nil {
-		log.Println("getDefaultProgram Error:", err) // 如果获取失败，打印错误日志。
-		return false                                 // 返回 false。
-	}
-
-	if prog == "" {
-		return false // 如果程序名为空，返回 false。
-	}
-
-	return true // 返回 true。
-}
-
-// OpenFileOrExplorer 函数用于打开文件或在资源管理器中显示文件。
-// filePath 参数是文件路径，explorer 参数表示是否在资源管理器中打开（true）或直接打开文件（false）。
-// 返回可能发生的错误。
-func OpenFileOrExplorer(filePath string, explorer bool) error {
-	if _, err := os.Stat(filePath); err != nil {
-		log.Printf("%s %v\n", filePath, err) // 如果文件不存在，打印错误日志。
-		return err                           // 返回错误。
-	}
-
-	canOpen := false
-	fileExtension := ""
-	index := strings.LastIndex(filePath, ".") // 查找文件扩展名的起始位置。
-	if index > 0 {
-		fileExtension = filePath[index+1:] // 提取文件扩展名。
-		canOpen = hasDefaultProgram(fileExtension) // 检查是否有默认程序打开此类型文件。
-	}
-
-	if canOpen && !explorer {
-		return browser.OpenFile(filePath) // 如果有默认程序且不要求在资源管理器中打开，则直接打开文件。
-	}
-
-	commandArgs := []string{"/select,", filePath} // 构建 explorer 命令的参数，用于选择文件。
-	fmt.Println("cmd:", "explorer", commandArgs)  // 打印命令。
-
-	// 创建一个 Cmd 结构体表示要执行的命令。
-	cmd := exec.Command("explorer", commandArgs...)
-
-	// 执行命令并等待它完成。
-	err := cmd.Run()
-	if err != nil {
-		log.Printf("Error executing command: %s\n", err) // 如果执行命令失败，打印错误日志。
-		// return err
-	}
-
-	fmt.Println("Command executed successfully") // 打印命令执行成功信息。
-	return nil                                   // 返回 nil 表示成功。
-}
-
 // GetPathStat 函数用于获取指定路径的磁盘使用情况统计信息。
 // path 参数是需要统计的路径。
 // 返回 PathStat 结构体和可能发生的错误。
@@ -133,15 +54,15 @@ func GetPathStat(path string) (PathStat, error) {
 // 返回一个布尔值，true 表示可写，false 表示不可写。
 func PathIsCanWriteFile(path string) bool {
 
-	filepath := fmt.Sprintf("%s\\CanWrite.txt", path) // 构建一个临时文件路径。
+	testPath := filepath.Join(path, "CanWrite.txt") // 构建一个临时文件路径。
 	// 尝试创建并打开文件，如果成功则表示可写。
-	file, err := os.OpenFile(filepath, os.O_CREATE|os.O_WRONLY, 0644)
+	file, err := os.OpenFile(testPath, os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return false // 如果打开文件失败，返回 false。
 	}
 
-	file.Close()       // 关闭文件。
-	os.Remove(filepath) // 删除临时文件。
+	file.Close()        // 关闭文件。
+	os.Remove(testPath) // 删除临时文件。
 
 	return true // 返回 true 表示可写。
 }
@@ -271,3 +192,14 @@ func Hash256Sum(data []byte) string {
 
 	return hex.EncodeToString(hashSum) // 将哈希值编码为十六进制字符串并返回。
 }
+
+// SlashPath 函数把 Windows 风格的路径（微信数据库中的路径、旧版本导出的路径）转换为以 / 分隔的路径。
+// 导出数据中的媒体路径统一使用这种形式，在不同系统之间拷贝备份后依然可用。
+func SlashPath(p string) string {
+	return strings.ReplaceAll(p, "\\", "/")
+}
+
+// LocalPath 函数把以 / 分隔的相对路径拼接到 root 下，返回当前系统的本地路径。
+func LocalPath(root, p string) string {
+	return filepath.Join(root, filepath.FromSlash(SlashPath(p)))
+}
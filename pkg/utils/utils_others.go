@@ -0,0 +1,26 @@
+//go:build !windows
+
+package utils
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/browser"
+)
+
+// OpenFileOrExplorer 函数用于打开文件或所在目录。
+// 非 Windows 平台没有资源管理器的选中功能，explorer 为 true 时打开文件所在目录。
+func OpenFileOrExplorer(filePath string, explorer bool) error {
+	if _, err := os.Stat(filePath); err != nil {
+		log.Printf("%s %v\n", filePath, err)
+		return err
+	}
+
+	if explorer {
+		return browser.OpenFile(filepath.Dir(filePath))
+	}
+
+	return browser.OpenFile(filePath)
+}
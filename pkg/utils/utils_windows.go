@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/browser"
+	"golang.org/x/sys/windows/registry"
+)
+
+// getDefaultProgram 函数用于获取指定文件扩展名的默认打开程序。
+// fileExtension 参数是文件扩展名（不带点）。
+// 返回默认程序的名称和可能发生的错误。
+func getDefaultProgram(fileExtension string) (string, error) {
+	// 打开注册表中的 HKEY_CLASSES_ROOT 键，查找与文件扩展名关联的默认程序。
+	key, err := registry.OpenKey(registry.CLASSES_ROOT, fmt.Sprintf(`.%s`, fileExtension), registry.QUERY_VALUE)
+	if err != nil {
+		return "", err // 如果打开注册表键失败，返回错误。
+	}
+	defer key.Close() // 确保在函数返回前关闭注册表键。
+
+	// 读取默认程序关联值。
+	defaultProgram, _, err := key.GetStringValue("")
+	if err != nil {
+		return "", err // 如果读取字符串值失败，返回错误。
+	}
+
+	return defaultProgram, nil // 返回默认程序名称。
+}
+
+// hasDefaultProgram 函数用于检查指定文件扩展名是否有默认打开程序。
+// fileExtension 参数是文件扩展名（不带点）。
+// 返回一个布尔值，true 表示有默认程序，false 表示没有。
+func hasDefaultProgram(fileExtension string) bool {
+	prog, err := getDefaultProgram(fileExtension) // 获取默认程序。
+	if err != nil {
+		log.Println("getDefaultProgram Error:", err) // 如果获取失败，打印错误日志。
+		return false                                 // 返回 false。
+	}
+
+	if prog == "" {
+		return false // 如果程序名为空，返回 false。
+	}
+
+	return true // 返回 true。
+}
+
+// OpenFileOrExplorer 函数用于打开文件或在资源管理器中显示文件。
+// filePath 参数是文件路径，explorer 参数表示是否在资源管理器中打开（true）或直接打开文件（false）。
+// 返回可能发生的错误。
+func OpenFileOrExplorer(filePath string, explorer bool) error {
+	if _, err := os.Stat(filePath); err != nil {
+		log.Printf("%s %v\n", filePath, err) // 如果文件不存在，打印错误日志。
+		return err                           // 返回错误。
+	}
+
+	canOpen := false
+	fileExtension := ""
+	index := strings.LastIndex(filePath, ".") // 查找文件扩展名的起始位置。
+	if index > 0 {
+		fileExtension = filePath[index+1:]         // 提取文件扩展名。
+		canOpen = hasDefaultProgram(fileExtension) // 检查是否有默认程序打开此类型文件。
+	}
+
+	if canOpen && !explorer {
+		return browser.OpenFile(filePath) // 如果有默认程序且不要求在资源管理器中打开，则直接打开文件。
+	}
+
+	commandArgs := []string{"/select,", filePath} // 构建 explorer 命令的参数，用于选择文件。
+	fmt.Println("cmd:", "explorer", commandArgs)  // 打印命令。
+
+	// 创建一个 Cmd 结构体表示要执行的命令。
+	cmd := exec.Command("explorer", commandArgs...)
+
+	// 执行命令并等待它完成。
+	err := cmd.Run()
+	if err != nil {
+		log.Printf("Error executing command: %s\n", err) // 如果执行命令失败，打印错误日志。
+		// return err
+	}
+
+	fmt.Println("Command executed successfully") // 打印命令执行成功信息。
+	return nil                                   // 返回 nil 表示成功。
+}
@@ -7,7 +7,7 @@ package wechat // 定义包名为 wechat，包含微信数据处理相关的功
 
 2. 检查Misc.db文件是否存在：
    ```go
-   miscDBPath := fmt.Sprintf("%s\\Msg\\Misc.db", exportPath)
+   miscDBPath := filepath.Join(exportPath, "Msg", "Misc.db")
    _, err := os.Stat(miscDBPath)
    if err != nil {
        log.Println("no exist:", miscDBPath)
@@ -20,7 +20,7 @@ package wechat // 定义包名为 wechat，包含微信数据处理相关的功
 
 3. 检查HeadImage目录是否存在：
    ```go
-   headImgPath := fmt.Sprintf("%s\\FileStorage\\HeadImage", exportPath)
+   headImgPath := filepath.Join(exportPath, "FileStorage", "HeadImage")
    if _, err := os.Stat(headImgPath); err == nil {
        log.Println("has HeadImage")
        return
@@ -83,12 +83,9 @@ package wechat // 定义包名为 wechat，包含微信数据处理相关的功
     *   **通道关闭作为完成信号**: `close(progress)` 是一种常见的模式，用于向消费者 Goroutine 发送任务完成的信号。当通道关闭时，`for range` 循环会完成迭代，从而允许消费者 Goroutine 知道所有数据都已处理完毕。
 **/
 import (
-	"bufio"        // 导入 bufio 包，用于带缓冲的 I/O 操作。
 	"bytes"        // 导入 bytes 包，用于处理字节切片。
-	"crypto/hmac"  // 导入 crypto/hmac 包，用于 HMAC 消息认证码。
-	"crypto/sha1"  // 导入 crypto/sha1 包，用于 SHA-1 哈希算法。
+	"context"      // 导入 context 包，用于取消导出。
 	"database/sql" // 导入 database/sql 包，提供了通用的 SQL 数据库接口。
-	"encoding/binary" // 导入 encoding/binary 包，用于二进制数据的编码和解码。
 	"encoding/hex" // 导入 encoding/hex 包，用于十六进制编码和解码。
 	"errors"       // 导入 errors 包，用于创建和处理错误。
 	"fmt"          // 导入 fmt 包，用于格式化输入输出。
@@ -96,17 +93,15 @@ import (
 	"log"          // 导入 log 包，用于记录日志。
 	"os"           // 导入 os 包，提供了与操作系统交互的函数。
 	"path/filepath" // 导入 path/filepath 包，用于处理文件路径。
+	"sort"         // 导入 sort 包，用于排序。
 	"strings"      // 导入 strings 包，用于字符串操作。
 	"sync"         // 导入 sync 包，提供了基本的同步原语。
-	"sync/atomic"  // 导入 sync/atomic 包，提供了原子操作。
 	"time"         // 导入 time 包，用于时间操作。
-	"unsafe"       // 导入 unsafe 包，用于不安全的操作，如指针转换。
+	"wechatDataBackup/pkg/utils" // 导入 utils 包，用于拷贝文件。
 
 	"github.com/git-jiadong/go-lame" // 导入 go-lame 包，用于 MP3 编码。
 	"github.com/git-jiadong/go-silk" // 导入 go-silk 包，用于 SILK 音频解码。
 	_ "github.com/mattn/go-sqlite3"  // 导入 go-sqlite3 驱动，用于 SQLite 数据库操作。
-	"github.com/shirou/gopsutil/v3/process" // 导入 gopsutil/process 包，用于获取进程信息。
-	"golang.org/x/sys/windows"       // 导入 golang.org/x/sys/windows 包，用于 Windows 系统调用。
 )
 
 // WeChatInfo 结构体定义了单个微信实例的详细信息。
@@ -121,6 +116,14 @@ type WeChatInfo struct {
 	DBKey       string    // 微信数据库的密钥。
 }
 
+// ExportOptions 结构体定义了导出时的可选行为。
+type ExportOptions struct {
+	LazyDat     bool              // 只拷贝 .dat 原文件，不在导出时解码，查看时由 FileLoader 通过 DatCache 解码。
+	Passphrase  []byte            // 不为空时导出结束后用该口令加密 Msg 下的所有数据库，打开前需要 SetBackupPassphrase。
+	SnapshotDir string            // 不为空时导出完成后在该目录下保存一个带日期的快照，见 CreateSnapshot。
+	Retention   SnapshotRetention // 保存快照后按该策略清理旧快照，全为零时保留所有快照。
+}
+
 // WeChatInfoList 结构体定义了微信信息列表，包含多个 WeChatInfo 实例。
 type WeChatInfoList struct {
 	Info  []WeChatInfo `json:"Info"`  // 微信信息切片。
@@ -152,49 +155,204 @@ func GetWeChatAllInfo() *WeChatInfoList {
 	return list // 返回包含所有信息的列表。
 }
 
+// ExportIncompleteFile 在导出开始时写入导出目录，导出完整结束后删除。
+// 存在时说明上次导出被取消或中断，再次导出按 ExportCheckpointFile 跳过已完成的文件，其余的重新导出。
+const ExportIncompleteFile = ".export-incomplete"
+
+// IsExportIncomplete 函数返回 expPath 中的上次导出是否没有完成。
+func IsExportIncomplete(expPath string) bool {
+	_, err := os.Stat(filepath.Join(expPath, ExportIncompleteFile))
+	return err == nil
+}
+
 // ExportWeChatAllData 函数用于导出指定微信账户的所有数据。
-// info 参数是微信信息，expPath 参数是导出路径，progress 通道用于报告导出进度。
-func ExportWeChatAllData(info WeChatInfo, expPath string, progress chan<- string) {
+// ctx 取消后不再开始新的文件，正在处理的文件会完整写完，导出目录标记为未完成，再次导出时继续。
+// info 参数是微信信息，expPath 参数是导出路径，opts 参数是导出选项，progress 通道用于报告导出进度。
+func ExportWeChatAllData(ctx context.Context, info WeChatInfo, expPath string, opts ExportOptions, progress chan<- ProgressEvent) {
 	defer close(progress) // 确保在函数返回时关闭进度通道。
 	fileInfo, err := os.Stat(info.FilePath) // 获取微信文件路径的信息。
 	if err != nil || !fileInfo.IsDir() {
-		progress <- fmt.Sprintf("{\"status\":\"error\", \"result\":\"%s error\"}", info.FilePath) // 如果文件路径无效，发送错误信息。
+		newExportStage(progress, ProgressStageExport, 0, 0).fail(info.FilePath, errors.New("not a WeChat directory")) // 如果文件路径无效，发送错误信息。
+		return
+	}
+
+	markerPath := filepath.Join(expPath, ExportIncompleteFile)
+	if IsExportIncomplete(expPath) {
+		log.Println("resume incomplete export", expPath)
+	}
+	if err := os.WriteFile(markerPath, []byte(time.Now().Format(time.RFC3339)), 0644); err != nil {
+		log.Println("WriteFile:", markerPath, err)
+	}
+
+	// 每完成一个文件就记录到清单中，清单打不开时所有文件都重新导出。
+	cp, err := openExportCheckpoint(expPath)
+	if err != nil {
+		log.Println("openExportCheckpoint failed:", err)
+	}
+	defer cp.Close()
+
+	if !exportWeChatDateBase(ctx, info, expPath, cp, progress) && ctx.Err() == nil { // 导出微信数据库。
+		return
+	}
+
+	stages := []func(){
+		func() { exportWeChatBat(ctx, info, expPath, opts.LazyDat, cp, progress) }, // 导出微信 Dat 文件。
+		func() { exportWeChatVideoAndFile(ctx, info, expPath, cp, progress) },      // 导出微信视频和文件。
+		func() { exportWeChatVoice(ctx, info, expPath, cp, progress) },             // 导出微信语音。
+		func() { exportWeChatHeadImage(ctx, info, expPath, cp, progress) },         // 导出微信头像。
+		func() { exportWeChatSearchIndex(expPath, progress) },                      // 更新全文检索索引。
+	}
+	for _, stage := range stages {
+		if ctx.Err() != nil {
+			break
+		}
+		stage()
+	}
+	if len(opts.Passphrase) > 0 {
+		// 取消时也要加密已经写出的数据库，不在磁盘上留下明文。
+		exportWeChatEncrypt(expPath, opts.Passphrase, progress) // 加密导出的数据库。
+	}
+	if exportWeChatCancelled(ctx, progress) {
+		return
+	}
+
+	manifestOK := exportWeChatManifest(expPath, progress) // 记录本次备份应有的文件，供校验使用。
+	os.Remove(markerPath)
+	if manifestOK && opts.SnapshotDir != "" {
+		exportWeChatSnapshot(expPath, opts, progress) // 快照只接受完整的导出。
+	}
+
+	// 前端以 100 判断导出结束，所以各阶段都停在 100 以下，只在这里发送一次。
+	newExportStage(progress, ProgressStageExport, 100, 100).end("export WeChat all data end")
+}
+
+// exportWeChatSnapshot 函数把完成的导出保存为 opts.SnapshotDir 下的一个快照，再按保留策略清理旧快照。
+// 快照失败不影响本次导出的结果。
+func exportWeChatSnapshot(expPath string, opts ExportOptions, progress chan<- ProgressEvent) {
+	stage := newExportStage(progress, ProgressStageSnapshot, 98, 99)
+	stage.begin("export WeChat snapshot")
+
+	report, err := CreateSnapshot(expPath, opts.SnapshotDir)
+	if err != nil {
+		log.Println("CreateSnapshot failed:", err)
+		stage.fail(opts.SnapshotDir, fmt.Errorf("snapshot failed: %w", err))
 		return
 	}
-	if !exportWeChatDateBase(info, expPath, progress) { // 导出微信数据库。
+	log.Printf("CreateSnapshot %s: %d files, %d stored (%d bytes), %d reused\n", report.Name, report.Files, report.Stored, report.StoredBytes, report.Reused)
+	stage.add(int64(report.Files), report.StoredBytes)
+
+	prune, err := PruneSnapshots(opts.SnapshotDir, opts.Retention, false)
+	if err != nil {
+		log.Println("PruneSnapshots failed:", err)
+		stage.fail(opts.SnapshotDir, fmt.Errorf("prune snapshots failed: %w", err))
 		return
 	}
+	log.Println("PruneSnapshots removed", prune.Removed, prune.RemovedBlobs, prune.FreedBytes)
+
+	stage.end(fmt.Sprintf("export WeChat snapshot %s end, %d new files", report.Name, report.Stored))
+}
+
+// exportWeChatCancelled 函数在 ctx 已取消时发送取消事件并返回 true。
+func exportWeChatCancelled(ctx context.Context, progress chan<- ProgressEvent) bool {
+	if ctx.Err() == nil {
+		return false
+	}
+
+	log.Println("export cancelled:", ctx.Err())
+	stage := newExportStage(progress, ProgressStageExport, 0, 0)
+	event := stage.event(ProgressStatusError, "export cancelled, export again to resume")
+	event.Error = &ProgressError{Message: ctx.Err().Error()}
+	progress <- event
+	return true
+}
+
+// exportTask 是一个待导出的文件，size 用于统计吞吐量，size 和 modTime 也用于判断检查点是否仍然有效。
+type exportTask struct {
+	src     string
+	dst     string
+	size    int64
+	modTime int64
+}
+
+// exportWeChatManifest 函数在导出完成后为导出目录的所有文件写入带 SHA-256 的清单，成功时返回 true。
+func exportWeChatManifest(expPath string, progress chan<- ProgressEvent) bool {
+	stage := newExportStage(progress, ProgressStageManifest, 97, 98)
+	stage.begin("export WeChat manifest")
+
+	manifest, err := WriteExportManifest(expPath)
+	if err != nil {
+		log.Println("WriteExportManifest failed:", err)
+		stage.fail("", fmt.Errorf("write manifest failed: %w", err))
+		return false
+	}
+	log.Println("WriteExportManifest", len(manifest.Files))
+	stage.add(int64(len(manifest.Files)), 0)
 
-	exportWeChatBat(info, expPath, progress)         // 导出微信 Dat 文件。
-	exportWeChatVideoAndFile(info, expPath, progress) // 导出微信视频和文件。
-	exportWeChatVoice(info, expPath, progress)       // 导出微信语音。
-	exportWeChatHeadImage(info, expPath, progress)   // 导出微信头像。
+	stage.end("export WeChat manifest end")
+	return true
+}
+
+// exportWeChatEncrypt 函数用口令把导出的数据库重新加密，磁盘上只保留加密后的文件。
+func exportWeChatEncrypt(expPath string, passphrase []byte, progress chan<- ProgressEvent) {
+	stage := newExportStage(progress, ProgressStageEncrypt, 96, 97)
+	stage.begin("encrypt WeChat database")
+
+	count, err := EncryptExportDataBases(expPath, passphrase)
+	if err != nil {
+		log.Println("EncryptExportDataBases failed:", err)
+		stage.fail("", fmt.Errorf("encrypt database failed: %w", err))
+		return
+	}
+	log.Println("EncryptExportDataBases", count)
+	stage.add(int64(count), 0)
+
+	stage.end("encrypt WeChat database end")
+}
+
+// exportWeChatSearchIndex 函数在导出结束后把新增的消息加入全文检索索引。
+// 索引依赖 FTS5，编译时未开启 sqlite_fts5 时跳过且不创建索引文件，检索会退回逐条扫描。
+func exportWeChatSearchIndex(expPath string, progress chan<- ProgressEvent) {
+	stage := newExportStage(progress, ProgressStageSearch, 95, 96)
+	stage.begin("export WeChat search index")
+
+	count, err := UpdateWeChatSearchIndex(expPath)
+	if errors.Is(err, ErrBackupLocked) {
+		// 上次加密的索引没有口令无法更新，删除后重新建立。
+		os.Remove(filepath.Join(expPath, "Msg", FTSIndexDB))
+		count, err = UpdateWeChatSearchIndex(expPath)
+	}
+	if errors.Is(err, ErrNoFTS5) {
+		// 没有 FTS5 时不建索引文件，直接跳过本阶段。
+		log.Println("UpdateWeChatSearchIndex skipped:", err)
+	} else if err != nil {
+		log.Println("UpdateWeChatSearchIndex failed:", err)
+	} else {
+		log.Println("UpdateWeChatSearchIndex add", count)
+	}
+
+	stage.end("export WeChat search index end")
 }
 
 // exportWeChatHeadImage 函数用于导出微信头像。
 // info 参数是微信信息，expPath 参数是导出路径，progress 通道用于报告导出进度。
-func exportWeChatHeadImage(info WeChatInfo, expPath string, progress chan<- string) {
-	progress <- "{\"status\":\"processing\", \"result\":\"export WeChat Head Image\", \"progress\": 81}" // 发送进度信息。
+func exportWeChatHeadImage(ctx context.Context, info WeChatInfo, expPath string, cp *exportCheckpoint, progress chan<- ProgressEvent) {
+	stage := newExportStage(progress, ProgressStageHeadImg, 81, 94)
+	stage.begin("export WeChat Head Image") // 发送进度信息。
 
-	headImgPath := fmt.Sprintf("%s\\FileStorage\\HeadImage", expPath) // 构建头像导出路径。
+	headImgPath := filepath.Join(expPath, "FileStorage", "HeadImage") // 构建头像导出路径。
 	if _, err := os.Stat(headImgPath); err != nil {
 		if err := os.MkdirAll(headImgPath, 0644); err != nil { // 如果目录不存在，则创建。
 			log.Printf("MkdirAll %s failed: %v\n", headImgPath, err) // 打印创建目录失败日志。
-			progress <- fmt.Sprintf("{\"status\":\"error\", \"result\":\"%v error\"}", err) // 发送错误信息。
+			stage.fail(headImgPath, err) // 发送错误信息。
 			return
 		}
 	}
 
-	handleNumber := int64(0) // 已处理文件数量。
-	fileNumber := int64(0)   // 总文件数量。
-
 	var wg sync.WaitGroup     // 用于等待所有 Goroutine 完成。
-	var reportWg sync.WaitGroup // 用于等待报告 Goroutine 完成。
-	quitChan := make(chan struct{}) // 用于通知报告 Goroutine 退出。
 	MSGChan := make(chan wechatHeadImgMSG, 100) // 消息通道，用于传递头像消息。
 	go func() { // 在新的 Goroutine 中读取数据库并发送消息。
 		for {
-			miscDBPath := fmt.Sprintf("%s\\Msg\\Misc.db", expPath) // 构建 Misc.db 路径。
+			miscDBPath := filepath.Join(expPath, "Msg", "Misc.db") // 构建 Misc.db 路径。
 			_, err := os.Stat(miscDBPath)
 			if err != nil {
 				log.Println("no exist:", miscDBPath) // 如果 Misc.db 不存在，打印日志并退出。
@@ -208,11 +366,13 @@ func exportWeChatHeadImage(info WeChatInfo, expPath string, progress chan<- stri
 			}
 			defer db.Close() // 确保在函数返回时关闭数据库连接。
 
+			fileNumber := int64(0) // 总文件数量。
 			err = db.QueryRow("select count(*) from ContactHeadImg1;").Scan(&fileNumber) // 查询头像总数。
 			if err != nil {
 				log.Println("select count(*) failed", err) // 打印查询失败日志。
 				break
 			}
+			stage.total.Store(fileNumber)
 			log.Println("ContactHeadImg1 fileNumber", fileNumber) // 打印头像总数。
 			rows, err := db.Query("select ifnull(usrName,'') as usrName, ifnull(smallHeadBuf,'') as smallHeadBuf from ContactHeadImg1;") // 查询头像数据。
 			if err != nil {
@@ -228,7 +388,13 @@ func exportWeChatHeadImage(info WeChatInfo, expPath string, progress chan<- stri
 					break
 				}
 
-				MSGChan <- msg // 将消息发送到通道。
+				select {
+				case MSGChan <- msg: // 将消息发送到通道。
+				case <-ctx.Done():
+				}
+				if ctx.Err() != nil {
+					break // 导出已取消。
+				}
 			}
 			break
 		}
@@ -240,71 +406,56 @@ func exportWeChatHeadImage(info WeChatInfo, expPath string, progress chan<- stri
 		go func() {
 			defer wg.Done() // 确保 Goroutine 完成时通知 WaitGroup。
 			for msg := range MSGChan { // 从消息通道接收消息。
-				imgPath := fmt.Sprintf("%s\\%s.headimg", headImgPath, msg.userName) // 构建头像图片路径。
+				if ctx.Err() != nil {
+					continue // 导出已取消，丢弃剩余的消息。
+				}
+				imgPath := filepath.Join(headImgPath, msg.userName+".headimg") // 构建头像图片路径。
 				for {
 					// log.Println("imgPath:", imgPath, len(msg.Buf))
-					_, err := os.Stat(imgPath) // 检查文件是否已存在。
-					if err == nil {
-						break // 如果已存在，则跳过。
+					if cp.done(imgPath, int64(len(msg.Buf)), 0) {
+						break // 如果已完整导出，则跳过。
 					}
 					if len(msg.userName) == 0 || len(msg.Buf) == 0 {
 						break // 如果用户名或缓冲区为空，则跳过。
 					}
-					err = os.WriteFile(imgPath, msg.Buf[:], 0666) // 写入头像文件。
+					err := os.WriteFile(imgPath, msg.Buf[:], 0666) // 写入头像文件。
 					if err != nil {
 						log.Println("WriteFile:", imgPath, err) // 打印写入文件失败日志。
+						break
 					}
+					recordCheckpoint(cp, imgPath, int64(len(msg.Buf)), 0) // 记录到检查点清单。
 					break
 				}
-				atomic.AddInt64(&handleNumber, 1) // 原子增加已处理文件数量。
+				stage.add(1, int64(len(msg.Buf))) // 累计已处理的文件数量和字节数。
 			}
 		}()
 	}
 
-	reportWg.Add(1)
-	go func() { // 在新的 Goroutine 中报告导出进度。
-		defer reportWg.Done() // 确保 Goroutine 完成时通知 WaitGroup。
-		for {
-			select {
-			case <-quitChan: // 接收到退出信号。
-				log.Println("WeChat Head Image report progress end") // 打印退出日志。
-				return
-			default:
-				if fileNumber != 0 {
-					filePercent := float64(handleNumber) / float64(fileNumber) // 计算文件处理百分比。
-					totalPercent := 81 + (filePercent * (100 - 81))            // 计算总进度百分比。
-					totalPercentStr := fmt.Sprintf("{\"status\":\"processing\", \"result\":\"export WeChat Head Image doing\", \"progress\": %d}", int(totalPercent)) // 构建进度信息。
-					progress <- totalPercentStr                                // 发送进度信息。
-				}
-				time.Sleep(time.Second) // 每秒更新一次进度。
-			}
-		}
-	}()
-
+	stopReport := stage.reportEvery(time.Second, "export WeChat Head Image doing") // 每秒报告一次导出进度。
 	wg.Wait()         // 等待所有处理 Goroutine 完成。
-	close(quitChan)   // 关闭退出通道，通知报告 Goroutine 退出。
-	reportWg.Wait()   // 等待报告 Goroutine 完成。
-	progress <- "{\"status\":\"processing\", \"result\":\"export WeChat Head Image end\", \"progress\": 100}" // 发送导出完成信息。
+	stopReport()      // 停止报告进度。
+	stage.end("export WeChat Head Image end") // 发送导出完成信息。
 }
 
 
-func exportWeChatVoice(info WeChatInfo, expPath string, progress chan<- string) {
-	progress <- "{\"status\":\"processing\", \"result\":\"export WeChat voice start\", \"progress\": 61}"
+func exportWeChatVoice(ctx context.Context, info WeChatInfo, expPath string, cp *exportCheckpoint, progress chan<- ProgressEvent) {
+	stage := newExportStage(progress, ProgressStageVoice, 61, 80)
+	stage.begin("export WeChat voice start")
 
-	voicePath := fmt.Sprintf("%s\\FileStorage\\Voice", expPath)
+	voicePath := filepath.Join(expPath, "FileStorage", "Voice")
 	if _, err := os.Stat(voicePath); err != nil {
 		if err := os.MkdirAll(voicePath, 0644); err != nil {
 			log.Printf("MkdirAll %s failed: %v\n", voicePath, err)
-			progress <- fmt.Sprintf("{\"status\":\"error\", \"result\":\"%v error\"}", err)
+			stage.fail(voicePath, err)
 			return
 		}
 	}
 
-	handleNumber := int64(0)
+	// 按 MediaMSG 数据库统计进度。
 	fileNumber := int64(0)
 	index := 0
 	for {
-		mediaMSGDB := fmt.Sprintf("%s\\Msg\\Multi\\MediaMSG%d.db", expPath, index)
+		mediaMSGDB := filepath.Join(expPath, "Msg", "Multi", fmt.Sprintf("MediaMSG%d.db", index))
 		_, err := os.Stat(mediaMSGDB)
 		if err != nil {
 			break
@@ -312,18 +463,17 @@ func exportWeChatVoice(info WeChatInfo, expPath string, progress chan<- string)
 		index += 1
 		fileNumber += 1
 	}
+	stage.total.Store(fileNumber)
 
 	var wg sync.WaitGroup
-	var reportWg sync.WaitGroup
-	quitChan := make(chan struct{})
 	index = -1
 	MSGChan := make(chan wechatMediaMSG, 100)
 	go func() {
 		for {
 			index += 1
-			mediaMSGDB := fmt.Sprintf("%s\\Msg\\Multi\\MediaMSG%d.db", expPath, index)
+			mediaMSGDB := filepath.Join(expPath, "Msg", "Multi", fmt.Sprintf("MediaMSG%d.db", index))
 			_, err := os.Stat(mediaMSGDB)
-			if err != nil {
+			if err != nil || ctx.Err() != nil {
 				break
 			}
 
@@ -348,9 +498,16 @@ func exportWeChatVoice(info WeChatInfo, expPath string, progress chan<- string)
 					break
 				}
 
-				MSGChan <- msg
+				select {
+				case MSGChan <- msg:
+				case <-ctx.Done():
+				}
+				if ctx.Err() != nil {
+					break
+				}
+				stage.add(0, int64(len(msg.Buf)))
 			}
-			atomic.AddInt64(&handleNumber, 1)
+			stage.add(1, 0)
 		}
 		close(MSGChan)
 	}()
@@ -360,63 +517,48 @@ func exportWeChatVoice(info WeChatInfo, expPath string, progress chan<- string)
 		go func() {
 			defer wg.Done()
 			for msg := range MSGChan {
-				mp3Path := fmt.Sprintf("%s\\%d.mp3", voicePath, msg.MsgSvrID)
-				_, err := os.Stat(mp3Path)
-				if err == nil {
+				if ctx.Err() != nil {
+					continue
+				}
+				mp3Path := filepath.Join(voicePath, fmt.Sprintf("%d.mp3", msg.MsgSvrID))
+				if cp.done(mp3Path, int64(len(msg.Buf)), 0) {
 					continue
 				}
 
-				err = silkToMp3(msg.Buf[:], mp3Path)
+				err := silkToMp3(msg.Buf[:], mp3Path)
 				if err != nil {
 					log.Printf("silkToMp3 %s failed: %v\n", mp3Path, err)
+					continue
 				}
+				recordCheckpoint(cp, mp3Path, int64(len(msg.Buf)), 0)
 			}
 		}()
 	}
 
-	reportWg.Add(1)
-	go func() {
-		defer reportWg.Done()
-		for {
-			select {
-			case <-quitChan:
-				log.Println("WeChat voice report progress end")
-				return
-			default:
-				filePercent := float64(handleNumber) / float64(fileNumber)
-				totalPercent := 61 + (filePercent * (80 - 61))
-				totalPercentStr := fmt.Sprintf("{\"status\":\"processing\", \"result\":\"export WeChat voice doing\", \"progress\": %d}", int(totalPercent))
-				progress <- totalPercentStr
-				time.Sleep(time.Second)
-			}
-		}
-	}()
-
+	stopReport := stage.reportEvery(time.Second, "export WeChat voice doing")
 	wg.Wait()
-	close(quitChan)
-	reportWg.Wait()
-	progress <- "{\"status\":\"processing\", \"result\":\"export WeChat voice end\", \"progress\": 80}"
+	stopReport()
+	stage.end("export WeChat voice end")
 }
 
-func exportWeChatVideoAndFile(info WeChatInfo, expPath string, progress chan<- string) {
-	progress <- "{\"status\":\"processing\", \"result\":\"export WeChat Video and File start\", , \"progress\": 41}"
-	videoRootPath := info.FilePath + "\\FileStorage\\Video"
-	fileRootPath := info.FilePath + "\\FileStorage\\File"
-	cacheRootPath := info.FilePath + "\\FileStorage\\Cache"
+func exportWeChatVideoAndFile(ctx context.Context, info WeChatInfo, expPath string, cp *exportCheckpoint, progress chan<- ProgressEvent) {
+	stage := newExportStage(progress, ProgressStageVideo, 41, 60)
+	stage.begin("export WeChat Video and File start")
+	videoRootPath := filepath.Join(info.FilePath, "FileStorage", "Video")
+	fileRootPath := filepath.Join(info.FilePath, "FileStorage", "File")
+	cacheRootPath := filepath.Join(info.FilePath, "FileStorage", "Cache")
 
 	rootPaths := []string{videoRootPath, fileRootPath, cacheRootPath}
 
-	handleNumber := int64(0)
 	fileNumber := int64(0)
 	for _, path := range rootPaths {
 		fileNumber += getPathFileNumber(path, "")
 	}
+	stage.total.Store(fileNumber)
 	log.Println("VideoAndFile ", fileNumber)
 
 	var wg sync.WaitGroup
-	var reportWg sync.WaitGroup
-	quitChan := make(chan struct{})
-	taskChan := make(chan [2]string, 100)
+	taskChan := make(chan exportTask, 100)
 	go func() {
 		for _, rootPath := range rootPaths {
 			log.Println(rootPath)
@@ -430,22 +572,25 @@ func exportWeChatVideoAndFile(info WeChatInfo, expPath string, progress chan<- s
 				}
 
 				if !finfo.IsDir() {
-					expFile := expPath + path[len(info.FilePath):]
+					expFile := filepath.Join(expPath, path[len(filepath.Clean(info.FilePath)):])
 					_, err := os.Stat(filepath.Dir(expFile))
 					if err != nil {
 						os.MkdirAll(filepath.Dir(expFile), 0644)
 					}
 
-					task := [2]string{path, expFile}
-					taskChan <- task
+					select {
+					case taskChan <- exportTask{src: path, dst: expFile, size: finfo.Size(), modTime: finfo.ModTime().UnixNano()}:
+					case <-ctx.Done():
+						return ctx.Err()
+					}
 					return nil
 				}
 
 				return nil
 			})
-			if err != nil {
+			if err != nil && ctx.Err() == nil {
 				log.Println("filepath.Walk:", err)
-				progress <- fmt.Sprintf("{\"status\":\"error\", \"result\":\"%v\"}", err)
+				stage.fail(rootPath, err)
 			}
 		}
 		close(taskChan)
@@ -456,60 +601,49 @@ func exportWeChatVideoAndFile(info WeChatInfo, expPath string, progress chan<- s
 		go func() {
 			defer wg.Done()
 			for task := range taskChan {
-				_, err := os.Stat(task[1])
-				if err == nil {
-					atomic.AddInt64(&handleNumber, 1)
+				if ctx.Err() != nil {
+					continue // 导出已取消，不再开始新的文件。
+				}
+				if cp.done(task.dst, task.size, task.modTime) {
+					stage.add(1, task.size)
 					continue
 				}
-				_, err = copyFile(task[0], task[1])
+				// 没有完整导出记录的文件可能只写了一半，重新拷贝。
+				_, err := copyFile(task.src, task.dst)
 				if err != nil {
 					log.Println("DecryptDat:", err)
-					progress <- fmt.Sprintf("{\"status\":\"error\", \"result\":\"copyFile %v\"}", err)
+					stage.fail(task.src, fmt.Errorf("copyFile %w", err))
+				} else {
+					recordCheckpoint(cp, task.dst, task.size, task.modTime)
 				}
-				atomic.AddInt64(&handleNumber, 1)
+				stage.add(1, task.size)
 			}
 		}()
 	}
-	reportWg.Add(1)
-	go func() {
-		defer reportWg.Done()
-		for {
-			select {
-			case <-quitChan:
-				log.Println("WeChat Video and File report progress end")
-				return
-			default:
-				filePercent := float64(handleNumber) / float64(fileNumber)
-				totalPercent := 41 + (filePercent * (60 - 41))
-				totalPercentStr := fmt.Sprintf("{\"status\":\"processing\", \"result\":\"export WeChat Video and File doing\", \"progress\": %d}", int(totalPercent))
-				progress <- totalPercentStr
-				time.Sleep(time.Second)
-			}
-		}
-	}()
+	stopReport := stage.reportEvery(time.Second, "export WeChat Video and File doing")
 	wg.Wait()
-	close(quitChan)
-	reportWg.Wait()
-	progress <- "{\"status\":\"processing\", \"result\":\"export WeChat Video and File end\", \"progress\": 60}"
+	stopReport()
+	stage.end("export WeChat Video and File end")
 }
 
-func exportWeChatBat(info WeChatInfo, expPath string, progress chan<- string) {
-	progress <- "{\"status\":\"processing\", \"result\":\"export WeChat Dat start\", \"progress\": 21}"
-	datRootPath := info.FilePath + "\\FileStorage\\MsgAttach"
-	imageRootPath := info.FilePath + "\\FileStorage\\Image"
+func exportWeChatBat(ctx context.Context, info WeChatInfo, expPath string, lazy bool, cp *exportCheckpoint, progress chan<- ProgressEvent) {
+	stage := newExportStage(progress, ProgressStageDat, 21, 40)
+	stage.begin("export WeChat Dat start")
+	datRootPath := filepath.Join(info.FilePath, "FileStorage", "MsgAttach")
+	imageRootPath := filepath.Join(info.FilePath, "FileStorage", "Image")
 	rootPaths := []string{datRootPath, imageRootPath}
 
-	handleNumber := int64(0)
 	fileNumber := int64(0)
 	for i := range rootPaths {
 		fileNumber += getPathFileNumber(rootPaths[i], ".dat")
 	}
+	stage.total.Store(fileNumber)
 	log.Println("DatFileNumber ", fileNumber)
 
 	var wg sync.WaitGroup
-	var reportWg sync.WaitGroup
-	quitChan := make(chan struct{})
-	taskChan := make(chan [2]string, 100)
+	taskChan := make(chan exportTask, 100)
+	var failedMtx sync.Mutex
+	failedCount := make(map[string]int) // 按格式版本统计无法解码的文件。
 	go func() {
 		for i := range rootPaths {
 			if _, err := os.Stat(rootPaths[i]); err != nil {
@@ -523,23 +657,26 @@ func exportWeChatBat(info WeChatInfo, expPath string, progress chan<- string) {
 				}
 
 				if !finfo.IsDir() && strings.HasSuffix(path, ".dat") {
-					expFile := expPath + path[len(info.FilePath):]
+					expFile := filepath.Join(expPath, path[len(filepath.Clean(info.FilePath)):])
 					_, err := os.Stat(filepath.Dir(expFile))
 					if err != nil {
 						os.MkdirAll(filepath.Dir(expFile), 0644)
 					}
 
-					task := [2]string{path, expFile}
-					taskChan <- task
+					select {
+					case taskChan <- exportTask{src: path, dst: expFile, size: finfo.Size(), modTime: finfo.ModTime().UnixNano()}:
+					case <-ctx.Done():
+						return ctx.Err()
+					}
 					return nil
 				}
 
 				return nil
 			})
 
-			if err != nil {
+			if err != nil && ctx.Err() == nil {
 				log.Println("filepath.Walk:", err)
-				progress <- fmt.Sprintf("{\"status\":\"error\", \"result\":\"%v\"}", err)
+				stage.fail(rootPaths[i], err)
 			}
 		}
 		close(taskChan)
@@ -550,82 +687,95 @@ func exportWeChatBat(info WeChatInfo, expPath string, progress chan<- string) {
 		go func() {
 			defer wg.Done()
 			for task := range taskChan {
-				_, err := os.Stat(task[1])
-				if err == nil {
-					atomic.AddInt64(&handleNumber, 1)
+				if ctx.Err() != nil {
 					continue
 				}
-				err = DecryptDat(task[0], task[1])
-				if err != nil {
-					log.Println("DecryptDat:", err)
-					progress <- fmt.Sprintf("{\"status\":\"error\", \"result\":\"DecryptDat %v\"}", err)
+				if cp.done(task.dst, task.size, task.modTime) {
+					stage.add(1, task.size)
+					continue
+				}
+				var err error
+				if lazy {
+					// 原样拷贝，查看时再解码。
+					_, err = utils.CopyFile(task.src, task.dst)
+					if err != nil {
+						log.Println("CopyFile:", err)
+						stage.fail(task.src, fmt.Errorf("CopyFile %w", err))
+					}
+				} else {
+					err = DecryptDat(task.src, task.dst)
+					var decErr *DatDecodeError
+					if errors.As(err, &decErr) {
+						// 逐个文件记录到日志，结束时汇总报告。
+						log.Println("DecryptDat:", err)
+						failedMtx.Lock()
+						failedCount[DatVersionName(decErr.Version)] += 1
+						failedMtx.Unlock()
+					} else if err != nil {
+						log.Println("DecryptDat:", err)
+						stage.fail(task.src, fmt.Errorf("DecryptDat %w", err))
+					}
+				}
+				if err == nil {
+					recordCheckpoint(cp, task.dst, task.size, task.modTime)
 				}
-				atomic.AddInt64(&handleNumber, 1)
+				stage.add(1, task.size)
 			}
 		}()
 	}
-	reportWg.Add(1)
-	go func() {
-		defer reportWg.Done()
-		for {
-			select {
-			case <-quitChan:
-				log.Println("WeChat Dat report progress end")
-				return
-			default:
-				filePercent := float64(handleNumber) / float64(fileNumber)
-				totalPercent := 21 + (filePercent * (40 - 21))
-				totalPercentStr := fmt.Sprintf("{\"status\":\"processing\", \"result\":\"export WeChat Dat doing\", \"progress\": %d}", int(totalPercent))
-				progress <- totalPercentStr
-				time.Sleep(time.Second)
-			}
-		}
-	}()
+	stopReport := stage.reportEvery(time.Second, "export WeChat Dat doing")
 	wg.Wait()
-	close(quitChan)
-	reportWg.Wait()
-	progress <- "{\"status\":\"processing\", \"result\":\"export WeChat Dat end\", \"progress\": 40}"
+	stopReport()
+	if len(failedCount) > 0 {
+		versions := make([]string, 0, len(failedCount))
+		for version, count := range failedCount {
+			versions = append(versions, fmt.Sprintf("%s %d", version, count))
+		}
+		sort.Strings(versions)
+		stage.fail("", fmt.Errorf("DecryptDat failed: %s, see app.log for the files", strings.Join(versions, ", ")))
+	}
+	stage.end("export WeChat Dat end")
 }
 
-func exportWeChatDateBase(info WeChatInfo, expPath string, progress chan<- string) bool {
-
-	progress <- "{\"status\":\"processing\", \"result\":\"export WeChat DateBase start\", \"progress\": 1}"
+func exportWeChatDateBase(ctx context.Context, info WeChatInfo, expPath string, cp *exportCheckpoint, progress chan<- ProgressEvent) bool {
+	stage := newExportStage(progress, ProgressStageDataBase, 1, 20)
+	stage.begin("export WeChat DateBase start")
 
 	dbKey, err := hex.DecodeString(info.DBKey)
 	if err != nil {
 		log.Println("DecodeString:", err)
-		progress <- fmt.Sprintf("{\"status\":\"error\", \"result\":\"%v\"}", err)
+		stage.fail("", err)
 		return false
 	}
 
-	handleNumber := int64(0)
-	fileNumber := getPathFileNumber(info.FilePath+"\\Msg", ".db")
+	stage.total.Store(getPathFileNumber(filepath.Join(info.FilePath, "Msg"), ".db"))
 	var wg sync.WaitGroup
-	var reportWg sync.WaitGroup
-	quitChan := make(chan struct{})
-	taskChan := make(chan [2]string, 20)
+	taskChan := make(chan exportTask, 20)
 	go func() {
-		err = filepath.Walk(info.FilePath+"\\Msg", func(path string, finfo os.FileInfo, err error) error {
+		err = filepath.Walk(filepath.Join(info.FilePath, "Msg"), func(path string, finfo os.FileInfo, err error) error {
 			if err != nil {
 				log.Printf("filepath.Walk：%v\n", err)
 				return err
 			}
 			if !finfo.IsDir() && strings.HasSuffix(path, ".db") {
-				expFile := expPath + path[len(info.FilePath):]
+				expFile := filepath.Join(expPath, path[len(filepath.Clean(info.FilePath)):])
 				_, err := os.Stat(filepath.Dir(expFile))
 				if err != nil {
 					os.MkdirAll(filepath.Dir(expFile), 0644)
 				}
 
-				task := [2]string{path, expFile}
-				taskChan <- task
+				select {
+				case taskChan <- exportTask{src: path, dst: expFile, size: finfo.Size(), modTime: finfo.ModTime().UnixNano()}:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
 			}
 
 			return nil
 		})
-		if err != nil {
+		if err != nil && ctx.Err() == nil {
 			log.Println("filepath.Walk:", err)
-			progress <- fmt.Sprintf("{\"status\":\"error\", \"result\":\"%v\"}", err)
+			stage.fail("", err)
 		}
 		close(taskChan)
 	}()
@@ -635,215 +785,53 @@ func exportWeChatDateBase(info WeChatInfo, expPath string, progress chan<- strin
 		go func() {
 			defer wg.Done()
 			for task := range taskChan {
-				if filepath.Base(task[0]) == "xInfo.db" {
-					copyFile(task[0], task[1])
+				if ctx.Err() != nil {
+					continue
+				}
+				// WAL 中的新消息也算作源文件的一部分。
+				sourceSize, sourceTime := sourceStamp(task.src, task.src+DecryptWALSuffix)
+				if cp.done(task.dst, sourceSize, sourceTime) {
+					stage.add(1, task.size)
+					continue
+				}
+				if filepath.Base(task.src) == "xInfo.db" {
+					if _, err := copyFile(task.src, task.dst); err == nil {
+						recordCheckpoint(cp, task.dst, sourceSize, sourceTime)
+					}
 				} else {
-					err = DecryptDataBase(task[0], dbKey, task[1])
+					// 损坏的页写为全零页，其余数据仍然可读；再次导出时只重写变化的页。
+					report, err := DecryptDataBase(task.src, dbKey, task.dst, DecryptOptions{Corrupt: DecryptCorruptZero, QuickCheck: true, Incremental: true, WAL: true})
 					if err != nil {
 						log.Println("DecryptDataBase:", err)
-						progress <- fmt.Sprintf("{\"status\":\"error\", \"result\":\"%s %v\"}", task[0], err)
+						stage.fail(task.src, err)
+					} else {
+						// quick_check 的结果也放到进度里，损坏不中断导出。
+						result := fmt.Sprintf("quick_check %s: %s", filepath.Base(task.src), report.QuickCheck)
+						if report.WALFrames > 0 {
+							// 微信运行中时最新的消息只在 WAL 中。
+							result = fmt.Sprintf("%s, %d WAL frames applied", result, report.WALFrames)
+						}
+						if len(report.BadPages) > 0 {
+							result = fmt.Sprintf("%s, %d of %d pages corrupted %v", result, len(report.BadPages), report.Pages, report.BadPages)
+							log.Println("DecryptDataBase:", task.src, result)
+						}
+						stage.send(result)
+						recordCheckpoint(cp, task.dst, sourceSize, sourceTime)
 					}
 				}
-				atomic.AddInt64(&handleNumber, 1)
+				stage.add(1, task.size)
 			}
 		}()
 	}
 
-	reportWg.Add(1)
-	go func() {
-		defer reportWg.Done()
-		for {
-			select {
-			case <-quitChan:
-				log.Println("WeChat DateBase report progress end")
-				return
-			default:
-				filePercent := float64(handleNumber) / float64(fileNumber)
-				totalPercent := 1 + (filePercent * (20 - 1))
-				totalPercentStr := fmt.Sprintf("{\"status\":\"processing\", \"result\":\"export WeChat DateBase doing\", \"progress\": %d}", int(totalPercent))
-				progress <- totalPercentStr
-				time.Sleep(time.Second)
-			}
-		}
-	}()
+	stopReport := stage.reportEvery(time.Second, "export WeChat DateBase doing")
 	wg.Wait()
-	close(quitChan)
-	reportWg.Wait()
-	progress <- "{\"status\":\"processing\", \"result\":\"export WeChat DateBase end\", \"progress\": 20}"
-	return true
-}
-
-func GetWeChatInfo() (list *WeChatInfoList) {
-	list = &WeChatInfoList{}
-	list.Info = make([]WeChatInfo, 0)
-	list.Total = 0
-
-	processes, err := process.Processes()
-	if err != nil {
-		log.Println("Error getting processes:", err)
-		return
-	}
-
-	for _, p := range processes {
-		name, err := p.Name()
-		if err != nil {
-			continue
-		}
-		info := WeChatInfo{}
-		if name == "WeChat.exe" {
-			info.ProcessID = uint32(p.Pid)
-			info.Is64Bits, _ = Is64BitProcess(info.ProcessID)
-			log.Println("ProcessID", info.ProcessID)
-			files, err := p.OpenFiles()
-			if err != nil {
-				log.Println("OpenFiles failed")
-				continue
-			}
-
-			for _, f := range files {
-				if strings.HasSuffix(f.Path, "\\Media.db") {
-					// fmt.Printf("opened %s\n", f.Path[4:])
-					filePath := f.Path
-					parts := strings.Split(filePath, string(filepath.Separator))
-					if len(parts) < 4 {
-						log.Println("Error filePath " + filePath)
-						break
-					}
-					info.FilePath = strings.Join(parts[:len(parts)-2], string(filepath.Separator))
-					info.AcountName = strings.Join(parts[len(parts)-3:len(parts)-2], string(filepath.Separator))
-				}
-
-			}
-
-			if len(info.FilePath) == 0 {
-				log.Println("wechat not log in")
-				continue
-			}
-
-			hModuleSnap, err := windows.CreateToolhelp32Snapshot(windows.TH32CS_SNAPMODULE|windows.TH32CS_SNAPMODULE32, uint32(p.Pid))
-			if err != nil {
-				log.Println("CreateToolhelp32Snapshot failed", err)
-				continue
-			}
-			defer windows.CloseHandle(hModuleSnap)
-
-			var me32 windows.ModuleEntry32
-			me32.Size = uint32(windows.SizeofModuleEntry32)
-
-			err = windows.Module32First(hModuleSnap, &me32)
-			if err != nil {
-				log.Println("Module32First failed", err)
-				continue
-			}
-
-			for ; err == nil; err = windows.Module32Next(hModuleSnap, &me32) {
-				if windows.UTF16ToString(me32.Module[:]) == "WeChatWin.dll" {
-					// fmt.Printf("MODULE NAME: %s\n", windows.UTF16ToString(me32.Module[:]))
-					// fmt.Printf("executable NAME: %s\n", windows.UTF16ToString(me32.ExePath[:]))
-					// fmt.Printf("base address: 0x%08X\n", me32.ModBaseAddr)
-					// fmt.Printf("base ModBaseSize: %d\n", me32.ModBaseSize)
-					info.DllBaseAddr = me32.ModBaseAddr
-					info.DllBaseSize = me32.ModBaseSize
-
-					var zero windows.Handle
-					driverPath := windows.UTF16ToString(me32.ExePath[:])
-					infoSize, err := windows.GetFileVersionInfoSize(driverPath, &zero)
-					if err != nil {
-						log.Println("GetFileVersionInfoSize failed", err)
-						break
-					}
-					versionInfo := make([]byte, infoSize)
-					if err = windows.GetFileVersionInfo(driverPath, 0, infoSize, unsafe.Pointer(&versionInfo[0])); err != nil {
-						log.Println("GetFileVersionInfo failed", err)
-						break
-					}
-					var fixedInfo *windows.VS_FIXEDFILEINFO
-					fixedInfoLen := uint32(unsafe.Sizeof(*fixedInfo))
-					err = windows.VerQueryValue(unsafe.Pointer(&versionInfo[0]), `\`, (unsafe.Pointer)(&fixedInfo), &fixedInfoLen)
-					if err != nil {
-						log.Println("VerQueryValue failed", err)
-						break
-					}
-					// fmt.Printf("%s: v%d.%d.%d.%d\n", windows.UTF16ToString(me32.Module[:]),
-					// 	(fixedInfo.FileVersionMS>>16)&0xff,
-					// 	(fixedInfo.FileVersionMS>>0)&0xff,
-					// 	(fixedInfo.FileVersionLS>>16)&0xff,
-					// 	(fixedInfo.FileVersionLS>>0)&0xff)
-
-					info.Version = fmt.Sprintf("%d.%d.%d.%d",
-						(fixedInfo.FileVersionMS>>16)&0xff,
-						(fixedInfo.FileVersionMS>>0)&0xff,
-						(fixedInfo.FileVersionLS>>16)&0xff,
-						(fixedInfo.FileVersionLS>>0)&0xff)
-					list.Info = append(list.Info, info)
-					list.Total += 1
-					break
-				}
-			}
-		}
-	}
-	return
-}
-
-func Is64BitProcess(pid uint32) (bool, error) {
-	is64Bit := false
-	handle, err := windows.OpenProcess(windows.PROCESS_QUERY_INFORMATION, false, pid)
-	if err != nil {
-		log.Println("Error opening process:", err)
-		return is64Bit, errors.New("OpenProcess failed")
-	}
-	defer windows.CloseHandle(handle)
-
-	err = windows.IsWow64Process(handle, &is64Bit)
-	if err != nil {
-		log.Println("Error IsWow64Process:", err)
-	}
-	return !is64Bit, err
-}
-
-func GetWeChatKey(info *WeChatInfo) string {
-	mediaDB := info.FilePath + "\\Msg\\Media.db"
-	if _, err := os.Stat(mediaDB); err != nil {
-		log.Printf("open db %s error: %v", mediaDB, err)
-		return ""
-	}
-
-	handle, err := windows.OpenProcess(windows.PROCESS_QUERY_INFORMATION|windows.PROCESS_VM_READ, false, uint32(info.ProcessID))
-	if err != nil {
-		log.Println("Error opening process:", err)
-		return ""
-	}
-	defer windows.CloseHandle(handle)
-
-	buffer := make([]byte, info.DllBaseSize)
-	err = windows.ReadProcessMemory(handle, uintptr(info.DllBaseAddr), &buffer[0], uintptr(len(buffer)), nil)
-	if err != nil {
-		log.Println("Error ReadProcessMemory:", err)
-		return ""
-	}
-
-	offset := 0
-	// searchStr := []byte(info.AcountName)
-	for {
-		index := hasDeviceSybmol(buffer[offset:])
-		if index == -1 {
-			log.Println("has not DeviceSybmol")
-			break
-		}
-		fmt.Printf("hasDeviceSybmol: 0x%X\n", index)
-		keys := findDBKeyPtr(buffer[offset:index], info.Is64Bits)
-		// fmt.Println("keys:", keys)
-
-		key, err := findDBkey(handle, info.FilePath+"\\Msg\\Media.db", keys)
-		if err == nil {
-			// fmt.Println("key:", key)
-			return key
-		}
-
-		offset += (index + 20)
+	stopReport()
+	if ctx.Err() != nil {
+		return false
 	}
-
-	return ""
+	stage.end("export WeChat DateBase end")
+	return true
 }
 
 func hasDeviceSybmol(buffer []byte) int {
@@ -887,64 +875,15 @@ func findDBKeyPtr(buffer []byte, is64Bits bool) [][]byte {
 	return keys
 }
 
-func findDBkey(handle windows.Handle, path string, keys [][]byte) (string, error) {
-	var keyAddrPtr uint64
-	addrBuffer := make([]byte, 0x08)
-	for _, key := range keys {
-		copy(addrBuffer, key)
-		err := binary.Read(bytes.NewReader(addrBuffer), binary.LittleEndian, &keyAddrPtr)
-		if err != nil {
-			log.Println("binary.Read:", err)
-			continue
-		}
-		if keyAddrPtr == 0x00 {
-			continue
-		}
-		log.Printf("keyAddrPtr: 0x%X\n", keyAddrPtr)
-		keyBuffer := make([]byte, 0x20)
-		err = windows.ReadProcessMemory(handle, uintptr(keyAddrPtr), &keyBuffer[0], uintptr(len(keyBuffer)), nil)
-		if err != nil {
-			// fmt.Println("Error ReadProcessMemory:", err)
-			continue
-		}
-		if checkDataBaseKey(path, keyBuffer) {
-			return hex.EncodeToString(keyBuffer), nil
-		}
+// checkDataBaseKey 检查 password 能否解密 path，扫描内存时每个候选值都会调用，
+// 所以只尝试调用方给出的 profile，避免每次都多算一遍其它版本的 PBKDF2。
+func checkDataBaseKey(path string, password []byte, profile *DecryptProfile) bool {
+	_, err := DetectDecryptProfile(path, password, profile)
+	if err != nil && err != ErrIncorrectPassword {
+		log.Println("DetectDecryptProfile:", err)
 	}
 
-	return "", errors.New("not found key")
-}
-
-func checkDataBaseKey(path string, password []byte) bool {
-	fp, err := os.Open(path)
-	if err != nil {
-		return false
-	}
-	defer fp.Close()
-
-	fpReader := bufio.NewReaderSize(fp, defaultPageSize*100)
-
-	buffer := make([]byte, defaultPageSize)
-
-	n, err := fpReader.Read(buffer)
-	if err != nil && n != defaultPageSize {
-		log.Println("read failed:", err, n)
-		return false
-	}
-
-	salt := buffer[:16]
-	key := pbkdf2HMAC(password, salt, defaultIter, keySize)
-
-	page1 := buffer[16:defaultPageSize]
-
-	macSalt := xorBytes(salt, 0x3a)
-	macKey := pbkdf2HMAC(key, macSalt, 2, keySize)
-
-	hashMac := hmac.New(sha1.New, macKey)
-	hashMac.Write(page1[:len(page1)-32])
-	hashMac.Write([]byte{1, 0, 0, 0})
-
-	return hmac.Equal(hashMac.Sum(nil), page1[len(page1)-32:len(page1)-12])
+	return err == nil
 }
 
 func (info WeChatInfo) String() string {
@@ -1028,29 +967,29 @@ func getPathFileNumber(targetPath string, fileSuffix string) int64 {
 }
 
 func ExportWeChatHeadImage(exportPath string) {
-	progress := make(chan string)
+	progress := make(chan ProgressEvent)
 	info := WeChatInfo{}
 
-	miscDBPath := fmt.Sprintf("%s\\Msg\\Misc.db", exportPath)
+	miscDBPath := filepath.Join(exportPath, "Msg", "Misc.db")
 	_, err := os.Stat(miscDBPath)
 	if err != nil {
 		log.Println("no exist:", miscDBPath)
 		return
 	}
 
-	headImgPath := fmt.Sprintf("%s\\FileStorage\\HeadImage", exportPath)
+	headImgPath := filepath.Join(exportPath, "FileStorage", "HeadImage")
 	if _, err := os.Stat(headImgPath); err == nil {
 		log.Println("has HeadImage")
 		return
 	}
 
 	go func() {
-		exportWeChatHeadImage(info, exportPath, progress)
+		exportWeChatHeadImage(context.Background(), info, exportPath, nil, progress)
 		close(progress)
 	}()
 
 	for p := range progress {
-		log.Println(p)
+		log.Println(p.JSON())
 	}
 	log.Println("ExportWeChatHeadImage done")
 }
@@ -0,0 +1,250 @@
+package wechat
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ExportCheckpointFile is the manifest ExportWeChatAllData keeps in the
+// export directory. It has one JSON line per finished file, appended as soon
+// as the file is complete, so after a crash the next export knows which files
+// can be kept and which were half written and have to be redone.
+const ExportCheckpointFile = ".export-checkpoint"
+
+// checkpointSyncInterval bounds how much of the manifest a power loss can
+// take; entries lost that way only cost redoing their files.
+const checkpointSyncInterval = time.Second
+
+// ExportCheckpointEntry is one finished file of an export.
+type ExportCheckpointEntry struct {
+	Path       string `json:"path"`       // relative to the export directory, slash separated.
+	Size       int64  `json:"size"`       // size of the exported file.
+	ModTime    int64  `json:"modTime"`    // mtime of the exported file, unix nanoseconds.
+	SHA256     string `json:"sha256"`     // hex digest of the exported file.
+	SourceSize int64  `json:"sourceSize"` // size of what it was exported from.
+	SourceTime int64  `json:"sourceTime"` // mtime of the source, 0 when the source is a database row.
+}
+
+// exportCheckpoint is the open manifest of an export directory. Its methods
+// may be called from any goroutine.
+type exportCheckpoint struct {
+	mtx      sync.Mutex
+	expPath  string
+	entries  map[string]ExportCheckpointEntry
+	fp       *os.File
+	w        *bufio.Writer
+	lastSync time.Time
+}
+
+// openExportCheckpoint loads the manifest of expPath and opens it for
+// appending. Lines that do not parse, like one torn by a crash, are dropped;
+// the manifest is rewritten without them and without superseded entries.
+func openExportCheckpoint(expPath string) (*exportCheckpoint, error) {
+	entries, err := LoadExportCheckpoint(expPath)
+	if err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(expPath, ExportCheckpointFile)
+	tmpPath := path + ".tmp"
+	fp, err := os.Create(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	c := &exportCheckpoint{expPath: expPath, entries: entries, fp: fp, w: bufio.NewWriter(fp), lastSync: time.Now()}
+	for _, entry := range entries {
+		if err := c.write(entry); err != nil {
+			fp.Close()
+			return nil, err
+		}
+	}
+	if err := c.sync(); err != nil {
+		fp.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		fp.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// LoadExportCheckpoint reads the manifest of expPath, keyed by Path. A
+// missing manifest is an empty one.
+func LoadExportCheckpoint(expPath string) (map[string]ExportCheckpointEntry, error) {
+	entries := make(map[string]ExportCheckpointEntry)
+	fp, err := os.Open(filepath.Join(expPath, ExportCheckpointFile))
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	scanner := bufio.NewScanner(fp)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry ExportCheckpointEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.Path == "" {
+			continue
+		}
+		entries[entry.Path] = entry
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// rel returns the manifest key of dst, a path inside the export directory.
+func (c *exportCheckpoint) rel(dst string) string {
+	rel, err := filepath.Rel(c.expPath, dst)
+	if err != nil {
+		return filepath.ToSlash(dst)
+	}
+
+	return filepath.ToSlash(rel)
+}
+
+// done reports whether dst was finished from a source of the same size and
+// mtime and has not changed since. A file that is missing, truncated or
+// rewritten by anything else is not done.
+func (c *exportCheckpoint) done(dst string, sourceSize, sourceTime int64) bool {
+	if c == nil {
+		return false
+	}
+	c.mtx.Lock()
+	entry, ok := c.entries[c.rel(dst)]
+	c.mtx.Unlock()
+	if !ok || entry.SourceSize != sourceSize || entry.SourceTime != sourceTime {
+		return false
+	}
+
+	info, err := os.Stat(dst)
+	return err == nil && info.Size() == entry.Size && info.ModTime().UnixNano() == entry.ModTime
+}
+
+// record marks dst as finished from a source of sourceSize and sourceTime.
+func (c *exportCheckpoint) record(dst string, sourceSize, sourceTime int64) error {
+	if c == nil {
+		return nil
+	}
+	info, err := os.Stat(dst)
+	if err != nil {
+		return err
+	}
+	sum, err := hashFile(dst)
+	if err != nil {
+		return err
+	}
+	entry := ExportCheckpointEntry{
+		Path:       c.rel(dst),
+		Size:       info.Size(),
+		ModTime:    info.ModTime().UnixNano(),
+		SHA256:     sum,
+		SourceSize: sourceSize,
+		SourceTime: sourceTime,
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.entries[entry.Path] = entry
+	if err := c.write(entry); err != nil {
+		return err
+	}
+	// Flushed entries survive the process crashing, synced ones a power loss.
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	if time.Since(c.lastSync) >= checkpointSyncInterval {
+		return c.sync()
+	}
+
+	return nil
+}
+
+func (c *exportCheckpoint) write(entry ExportCheckpointEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	_, err = c.w.Write(data)
+	return err
+}
+
+func (c *exportCheckpoint) sync() error {
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	c.lastSync = time.Now()
+	return c.fp.Sync()
+}
+
+// Close syncs and closes the manifest.
+func (c *exportCheckpoint) Close() error {
+	if c == nil {
+		return nil
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	err := c.sync()
+	if closeErr := c.fp.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// sourceStamp returns the combined size and latest mtime of the files that
+// make up one source, missing files count as empty.
+func sourceStamp(paths ...string) (int64, int64) {
+	size, modTime := int64(0), int64(0)
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		size += info.Size()
+		if t := info.ModTime().UnixNano(); t > modTime {
+			modTime = t
+		}
+	}
+
+	return size, modTime
+}
+
+// hashFile returns the hex SHA-256 of the file at path.
+func hashFile(path string) (string, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fp.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, fp); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// recordCheckpoint records dst and only logs a failure; the file is then
+// redone by the next export.
+func recordCheckpoint(c *exportCheckpoint, dst string, sourceSize, sourceTime int64) {
+	if err := c.record(dst, sourceSize, sourceTime); err != nil {
+		log.Println("checkpoint:", dst, err)
+	}
+}
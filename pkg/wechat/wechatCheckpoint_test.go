@@ -0,0 +1,137 @@
+package wechat
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExportCheckpointDone(t *testing.T) {
+	dir := t.TempDir()
+	dst := filepath.Join(dir, "Msg", "a.dat")
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dst, []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := openExportCheckpoint(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.done(dst, 10, 5) {
+		t.Fatal("unrecorded file is done")
+	}
+	if err := c.record(dst, 10, 5); err != nil {
+		t.Fatal(err)
+	}
+	if !c.done(dst, 10, 5) {
+		t.Fatal("recorded file is not done")
+	}
+	if c.done(dst, 11, 5) || c.done(dst, 10, 6) {
+		t.Fatal("file of a changed source is done")
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A reopened manifest still knows the file.
+	c, err = openExportCheckpoint(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !c.done(dst, 10, 5) {
+		t.Fatal("file is not done after reopening")
+	}
+
+	// Truncating the file, even back to its old mtime, undoes it.
+	info, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(dst, 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(dst, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if c.done(dst, 10, 5) {
+		t.Fatal("truncated file is done")
+	}
+
+	// So does removing it.
+	if err := os.Remove(dst); err != nil {
+		t.Fatal(err)
+	}
+	if c.done(dst, 10, 5) {
+		t.Fatal("missing file is done")
+	}
+}
+
+func TestOpenExportCheckpointTornLine(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a", "b"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := openExportCheckpoint(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "a"} {
+		if err := c.record(filepath.Join(dir, name), 1, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash tore the last line in half.
+	path := filepath.Join(dir, ExportCheckpointFile)
+	fp, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fp.WriteString(`{"path":"c","size":`); err != nil {
+		t.Fatal(err)
+	}
+	fp.Close()
+
+	c, err = openExportCheckpoint(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := LoadExportCheckpoint(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries["a"].Path != "a" || entries["b"].Path != "b" {
+		t.Fatalf("entries %v, want a and b", entries)
+	}
+
+	// The manifest was rewritten with one line per file and no torn line.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := 0
+	for _, b := range data {
+		if b == '\n' {
+			lines++
+		}
+	}
+	if lines != 2 || data[len(data)-1] != '\n' {
+		t.Fatalf("manifest %q, want two whole lines", data)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("temporary manifest left behind: %v", err)
+	}
+}
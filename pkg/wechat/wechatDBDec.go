@@ -63,127 +63,659 @@ package wechat
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha512"
+	"database/sql"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"log"
 	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 )
 
 const (
 	keySize         = 32
-	defaultIter     = 64000
+	saltSize        = 16
 	defaultPageSize = 4096
+	maxPageSize     = 65536
 )
 
-func DecryptDataBase(path string, password []byte, expPath string) error {
-	sqliteFileHeader := []byte("SQLite format 3")
-	sqliteFileHeader = append(sqliteFileHeader, byte(0))
+// DecryptProfile 是加密数据库的参数。
+// 微信 3.x 使用 SQLCipher 3 的默认参数，微信 4.x 使用 SQLCipher 4 的默认参数。
+type DecryptProfile struct {
+	Name     string
+	PageSize int
+	Iter     int              // 派生 AES 密钥的 PBKDF2 迭代次数。
+	Hash     func() hash.Hash // PBKDF2 和每页 HMAC 使用的哈希算法。
+	Reserve  int              // 每页末尾的保留字节：IV(16) 和 HMAC，对齐到 16 字节。
+}
+
+var (
+	DecryptProfileV3 = &DecryptProfile{Name: "sqlcipher3", PageSize: 4096, Iter: 64000, Hash: sha1.New, Reserve: 48}
+	DecryptProfileV4 = &DecryptProfile{Name: "sqlcipher4", PageSize: 4096, Iter: 256000, Hash: sha512.New, Reserve: 80}
+)
+
+// DecryptProfiles 是自动识别时依次尝试的参数，迭代次数少的排在前面。
+var DecryptProfiles = []*DecryptProfile{DecryptProfileV3, DecryptProfileV4}
+
+// ErrIncorrectPassword 表示所有参数都无法通过第 1 页的 HMAC 校验。
+var ErrIncorrectPassword = errors.New("incorrect password")
+
+// ErrCorruptNotTrailing 表示 DecryptCorruptSkip 时损坏页之后还有正常的页，跳过会让它们的页号前移。
+var ErrCorruptNotTrailing = errors.New("corrupted pages are followed by valid pages, they cannot be skipped")
+
+// DecryptProfileByName 返回 DecryptProfiles 中名为 name 的参数，没有时返回 nil。
+func DecryptProfileByName(name string) *DecryptProfile {
+	for _, profile := range DecryptProfiles {
+		if profile.Name == name {
+			return profile
+		}
+	}
+
+	return nil
+}
+
+func (p *DecryptProfile) String() string {
+	return p.Name
+}
+
+// valid 检查参数是否能用于按页解密。
+func (p *DecryptProfile) valid() error {
+	if p.Hash == nil || p.Iter <= 0 {
+		return fmt.Errorf("profile %s: missing hash or iterations", p.Name)
+	}
+	if p.PageSize < 512 || p.PageSize > maxPageSize || p.PageSize&(p.PageSize-1) != 0 {
+		return fmt.Errorf("profile %s: bad page size %d", p.Name, p.PageSize)
+	}
+	if p.Reserve%aes.BlockSize != 0 || p.Reserve < aes.BlockSize+p.Hash().Size() || p.Reserve >= p.PageSize-saltSize {
+		return fmt.Errorf("profile %s: bad reserve size %d", p.Name, p.Reserve)
+	}
+
+	return nil
+}
+
+// deriveKeys 由密码和 salt 派生 AES 密钥和 HMAC 密钥。
+func (p *DecryptProfile) deriveKeys(password, salt []byte) ([]byte, []byte) {
+	key := pbkdf2HMAC(password, salt, p.Iter, keySize, p.Hash)
+	macKey := pbkdf2HMAC(key, xorBytes(salt, 0x3a), 2, keySize, p.Hash)
+
+	return key, macKey
+}
+
+// detectDecryptProfile 用第 1 页的 HMAC 依次尝试 profiles，返回匹配的参数和派生的密钥。
+// page1 是文件开头的数据，长度不小于候选参数的页大小时才会尝试。
+func detectDecryptProfile(page1 []byte, password []byte, profiles []*DecryptProfile) (*DecryptProfile, []byte, []byte) {
+	for _, profile := range profiles {
+		if len(page1) < profile.PageSize {
+			continue
+		}
+		key, macKey := profile.deriveKeys(password, page1[:saltSize])
+		if checkPageHMAC(profile, macKey, page1[saltSize:profile.PageSize], 1) {
+			return profile, key, macKey
+		}
+	}
+
+	return nil, nil, nil
+}
+
+// DetectDecryptProfile 返回能用 password 解密 path 的参数，都不匹配时返回 ErrIncorrectPassword。
+// 不传 profiles 时依次尝试 DecryptProfiles。
+func DetectDecryptProfile(path string, password []byte, profiles ...*DecryptProfile) (*DecryptProfile, error) {
+	if len(profiles) == 0 {
+		profiles = DecryptProfiles
+	}
 
 	fp, err := os.Open(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer fp.Close()
 
-	fpReader := bufio.NewReaderSize(fp, defaultPageSize*100)
-	// fpReader := bufio.NewReader(fp)
-
-	buffer := make([]byte, defaultPageSize)
+	page1 := make([]byte, maxPageSize)
+	n, err := io.ReadFull(fp, page1)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("read failed: %w", err)
+	}
 
-	n, err := fpReader.Read(buffer)
-	if err != nil && n != defaultPageSize {
-		return fmt.Errorf("read failed")
+	profile, _, _ := detectDecryptProfile(page1[:n], password, profiles)
+	if profile == nil {
+		return nil, ErrIncorrectPassword
 	}
 
-	salt := buffer[:16]
-	key := pbkdf2HMAC(password, salt, defaultIter, keySize)
+	return profile, nil
+}
+
+// 损坏页的处理方式。
+const (
+	DecryptCorruptKeep = iota // 照常解密写入，只记录到报告中。
+	DecryptCorruptZero        // 写入全零页，页号不变，其它页仍然可读。
+	DecryptCorruptSkip        // 不写入该页，只用于损坏页都在文件末尾(如文件被截断)的情况，否则返回 ErrCorruptNotTrailing。
+)
+
+// DecryptOptions 定义了 DecryptDataBase 的可选行为。
+type DecryptOptions struct {
+	Profile     *DecryptProfile // 数据库参数，nil 时用第 1 页依次尝试 DecryptProfiles。
+	Corrupt     int             // 损坏页的处理方式，见 DecryptCorruptKeep 等。
+	QuickCheck  bool            // 解密后执行 PRAGMA quick_check。
+	Incremental bool            // 根据上次记录的每页 HMAC 只重写变化的页，记录保存在 expPath + DecryptPagesSuffix。
+	WAL         bool            // 把 path + DecryptWALSuffix 中已提交的帧解密后合并到 expPath，相当于执行一次 checkpoint。
+}
 
-	page1 := buffer[16:defaultPageSize]
+// DecryptReport 是 DecryptDataBase 的结果。
+type DecryptReport struct {
+	Path       string `json:"Path"`
+	Profile    string `json:"Profile"` // 使用的数据库参数，如 sqlcipher3。
+	Pages      int    `json:"Pages"`
+	BadPages   []int  `json:"BadPages"`   // HMAC 校验失败的页号，从 1 开始。
+	Truncated  bool   `json:"Truncated"`  // 最后一页不完整，也记录在 BadPages 中。
+	QuickCheck string `json:"QuickCheck"` // quick_check 的结果，正常时为 ok。
+	Rewritten  int    `json:"Rewritten"`  // 本次写入的页数，增量解密时只包含变化的页。
+	WALFrames  int    `json:"WALFrames"`  // 从 WAL 合并的帧数。
+}
 
-	macSalt := xorBytes(salt, 0x3a)
-	macKey := pbkdf2HMAC(key, macSalt, 2, keySize)
+// OK 返回数据库是否完整。
+func (r *DecryptReport) OK() bool {
+	return len(r.BadPages) == 0 && (r.QuickCheck == "" || r.QuickCheck == "ok")
+}
 
-	hashMac := hmac.New(sha1.New, macKey)
-	hashMac.Write(page1[:len(page1)-32])
-	hashMac.Write([]byte{1, 0, 0, 0})
+// DecryptDataBase 解密 path 到 expPath，每一页都校验 HMAC。
+// 第 1 页校验失败视为密码错误，其它页校验失败按 opts.Corrupt 处理并记录在报告中。
+// 各页相互独立，按块读取后由多个 goroutine 并行解密，再按原顺序写出，结果与逐页解密完全相同。
+func DecryptDataBase(path string, password []byte, expPath string, opts DecryptOptions) (*DecryptReport, error) {
+	report := &DecryptReport{Path: path, BadPages: make([]int, 0)}
 
-	if !hmac.Equal(hashMac.Sum(nil), page1[len(page1)-32:len(page1)-12]) {
-		return fmt.Errorf("incorrect password")
+	profiles := DecryptProfiles
+	if opts.Profile != nil {
+		if err := opts.Profile.valid(); err != nil {
+			return report, err
+		}
+		profiles = []*DecryptProfile{opts.Profile}
 	}
 
-	outFilePath := expPath
-	outFile, err := os.Create(outFilePath)
+	fp, err := os.Open(path)
 	if err != nil {
-		return err
+		return report, err
 	}
-	defer outFile.Close()
+	defer fp.Close()
 
-	// Write SQLite file header
-	_, err = outFile.Write(sqliteFileHeader)
+	head, err := readDecryptHead(fp, password, profiles)
 	if err != nil {
-		return err
+		return report, err
 	}
+	profile, key, macKey := head.profile, head.key, head.macKey
+	report.Profile = profile.Name
+	page1 := head.page1()
+	salt := append([]byte(nil), page1[:saltSize]...)
 
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		return err
+		return report, err
 	}
 
-	page1 = buffer[16:defaultPageSize]
-	iv := page1[len(page1)-48 : len(page1)-32]
-	stream := cipher.NewCBCDecrypter(block, iv)
-	decrypted := make([]byte, len(page1)-48)
-	stream.CryptBlocks(decrypted, page1[:len(page1)-48])
-	_, err = outFile.Write(decrypted)
-	if err != nil {
-		return err
+	// 跳过损坏页会改变之后的页号，不能增量解密。
+	var prev *decryptPages
+	if opts.Incremental && opts.Corrupt != DecryptCorruptSkip {
+		prev = loadDecryptPages(expPath, salt, opts.Corrupt, profile)
 	}
-	_, err = outFile.Write(page1[len(page1)-48:])
+	// 先删除旧记录，解密中途失败时下次会完整解密。
+	os.Remove(expPath + DecryptPagesSuffix)
+
+	outFilePath := expPath
+	flag := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if prev != nil {
+		flag = os.O_RDWR
+	}
+	outFile, err := os.OpenFile(outFilePath, flag, 0644)
 	if err != nil {
-		return err
+		return report, err
 	}
+	defer outFile.Close()
 
-	for {
-		n, err = fpReader.Read(buffer)
+	dec := newPageDecryptor(profile, block, macKey, opts.Corrupt, prev)
+	if err := dec.run(head.reader(fp), page1, outFile, report); err != nil {
+		return report, err
+	}
+	sort.Ints(report.BadPages)
+
+	// 中间的页被跳过后，之后每一页都不在原来的位置，得到的数据库不能使用。
+	if opts.Corrupt == DecryptCorruptSkip && !trailingPages(report.BadPages, report.Pages) {
+		outFile.Close()
+		os.Remove(expPath)
+		return report, ErrCorruptNotTrailing
+	}
+
+	if prev != nil {
+		// 源文件变小时去掉多出的页。
+		if err := outFile.Truncate(dec.size); err != nil {
+			return report, err
+		}
+	}
+
+	// 跳过损坏页后页号已经改变，WAL 中的页无法对应。
+	if opts.WAL && (opts.Corrupt != DecryptCorruptSkip || len(report.BadPages) == 0) {
+		wal, err := readDecryptWAL(path+DecryptWALSuffix, profile, block, macKey)
 		if err != nil {
-			if err == io.EOF {
+			// WAL 无法读取时仍然保留 .db 中的数据。
+			log.Println("readDecryptWAL failed:", err)
+		} else if wal != nil {
+			if err := wal.apply(outFile, dec.pageSize, dec.macSize, dec.hmacs); err != nil {
+				return report, err
+			}
+			report.WALFrames = wal.frames
+		}
+	}
+	if err := outFile.Close(); err != nil {
+		return report, err
+	}
+
+	if opts.Incremental && opts.Corrupt != DecryptCorruptSkip {
+		if err := saveDecryptPages(expPath, salt, opts.Corrupt, profile, dec.hmacs); err != nil {
+			log.Println("saveDecryptPages failed:", err)
+		}
+	}
+
+	if opts.QuickCheck {
+		report.QuickCheck = quickCheckDataBase(expPath)
+	}
+
+	return report, nil
+}
+
+// trailingPages 返回有序的 pages 是否正好是 1 到 total 中最后的若干页。
+func trailingPages(pages []int, total int) bool {
+	for i, pgno := range pages {
+		if pgno != total-len(pages)+1+i {
+			return false
+		}
+	}
+
+	return true
+}
+
+// decryptHead 是识别出参数的文件开头。
+type decryptHead struct {
+	profile *DecryptProfile
+	key     []byte
+	macKey  []byte
+	data    []byte // 按最大的页读出的数据，可能包含第 2 页之后的部分。
+}
+
+// readDecryptHead 读出文件开头，用第 1 页识别参数并校验密码。
+func readDecryptHead(fp io.Reader, password []byte, profiles []*DecryptProfile) (*decryptHead, error) {
+	// 页大小由参数决定，先按最大的页读出文件开头。
+	data := make([]byte, maxPageSize)
+	n, err := io.ReadFull(fp, data)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("read failed")
+	}
+	data = data[:n]
+
+	profile, key, macKey := detectDecryptProfile(data, password, profiles)
+	if profile == nil {
+		if len(data) < profiles[0].PageSize {
+			return nil, fmt.Errorf("read failed")
+		}
+		return nil, ErrIncorrectPassword
+	}
+
+	return &decryptHead{profile: profile, key: key, macKey: macKey, data: data}, nil
+}
+
+func (h *decryptHead) page1() []byte {
+	return h.data[:h.profile.PageSize]
+}
+
+// reader 把多读出的部分放回 fp 的开头，从第 2 页开始读。
+func (h *decryptHead) reader(fp io.Reader) io.Reader {
+	return io.MultiReader(bytes.NewReader(h.data[h.profile.PageSize:]), fp)
+}
+
+// decryptDataBaseBytes 把 path 解密到内存中，解密结果不写入磁盘。
+// 任何一页校验失败都返回错误，password 为空时不尝试解密。
+func decryptDataBaseBytes(path string, password []byte, profiles []*DecryptProfile) ([]byte, *DecryptReport, error) {
+	report := &DecryptReport{Path: path, BadPages: make([]int, 0)}
+	if len(password) == 0 {
+		return nil, report, ErrIncorrectPassword
+	}
+
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, report, err
+	}
+	defer fp.Close()
+
+	head, err := readDecryptHead(fp, password, profiles)
+	if err != nil {
+		return nil, report, err
+	}
+	report.Profile = head.profile.Name
+
+	block, err := aes.NewCipher(head.key)
+	if err != nil {
+		return nil, report, err
+	}
+
+	out := &bytes.Buffer{}
+	if info, err := fp.Stat(); err == nil {
+		out.Grow(int(info.Size()))
+	}
+	dec := newPageDecryptor(head.profile, block, head.macKey, DecryptCorruptKeep, nil)
+	if err := dec.run(head.reader(fp), head.page1(), out, report); err != nil {
+		return nil, report, err
+	}
+	if len(report.BadPages) > 0 {
+		sort.Ints(report.BadPages)
+		return nil, report, fmt.Errorf("%d pages corrupted %v", len(report.BadPages), report.BadPages)
+	}
+
+	return out.Bytes(), report, nil
+}
+
+// decryptChunkSize 是每次读取的字节数，按页大小分成若干页。
+const decryptChunkSize = 1 << 20
+
+// decryptChunkPool 复用块的读写缓冲区，避免每块都重新分配。
+var decryptChunkPool = sync.Pool{
+	New: func() interface{} {
+		buffer := make([]byte, decryptChunkSize+saltSize)
+		return &buffer
+	},
+}
+
+// decryptChunk 是连续的一组页，index 用于按顺序写出。
+type decryptChunk struct {
+	index     int
+	pgno      int    // 第一页的页号。
+	data      []byte // 加密的页，最后一页可能不完整。
+	out       []byte
+	dirty     []bool // 每页是否需要写出，增量解密时未变化的页为 false。
+	hmacs     []byte
+	badPages  []int
+	truncated bool
+}
+
+var decryptZeroPage = make([]byte, maxPageSize)
+
+// sqliteFileHeader 是明文数据库的开头，加密后这 16 字节存放 salt。
+var sqliteFileHeader = []byte("SQLite format 3\x00")
+
+type pageDecryptor struct {
+	profile  *DecryptProfile
+	pageSize int
+	macSize  int
+	block    cipher.Block
+	macKey   []byte
+	corrupt  int
+	prev     *decryptPages // 上次的页记录，nil 时完整解密。
+
+	size  int64  // 输出文件的大小。
+	hmacs []byte // 本次每页的 HMAC，用于保存新的页记录。
+}
+
+func newPageDecryptor(profile *DecryptProfile, block cipher.Block, macKey []byte, corrupt int, prev *decryptPages) *pageDecryptor {
+	return &pageDecryptor{
+		profile:  profile,
+		pageSize: profile.PageSize,
+		macSize:  profile.Hash().Size(),
+		block:    block,
+		macKey:   macKey,
+		corrupt:  corrupt,
+		prev:     prev,
+	}
+}
+
+// run 读取、并行解密并按顺序写出全部页。page1 是已经读出的第 1 页。
+// 完整解密时顺序写出，增量解密时只把变化的页写到对应的位置，此时 out 还需要实现 io.WriterAt。
+func (d *pageDecryptor) run(fp io.Reader, page1 []byte, out io.Writer, report *DecryptReport) error {
+	chunkPages := decryptChunkSize / d.pageSize
+	workers := runtime.NumCPU()
+	chunkChan := make(chan *decryptChunk, workers)
+	doneChan := make(chan *decryptChunk, workers)
+	quitChan := make(chan struct{})
+	defer close(quitChan)
+
+	var readErr error
+	go func() {
+		defer close(chunkChan)
+		for index, pgno := 0, 1; ; index++ {
+			data := (*decryptChunkPool.Get().(*[]byte))[:chunkPages*d.pageSize]
+			offset := 0
+			if index == 0 {
+				offset = copy(data, page1)
+			}
+			n, err := io.ReadFull(fp, data[offset:])
+			n += offset
+			if n == 0 {
+				if err != io.EOF {
+					readErr = err
+				}
+				return
+			}
+			// 只有第 1 页的数据库在这里读到 io.EOF。
+			if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+				readErr = err
+				return
+			}
+
+			chunk := &decryptChunk{index: index, pgno: pgno, data: data[:n]}
+			select {
+			case chunkChan <- chunk:
+			case <-quitChan:
+				return
+			}
+			if n < len(data) {
+				return
+			}
+			pgno += chunkPages
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range chunkChan {
+				d.decryptChunk(chunk)
+				select {
+				case doneChan <- chunk:
+				case <-quitChan:
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(doneChan)
+	}()
+
+	// 按块的顺序写出，先完成的块暂存在 pending 中。
+	writer := bufio.NewWriterSize(out, decryptChunkSize)
+	pending := make(map[int]*decryptChunk)
+	next := 0
+	for chunk := range doneChan {
+		pending[chunk.index] = chunk
+		for {
+			chunk, ok := pending[next]
+			if !ok {
 				break
 			}
-			return err
-		} else if n < defaultPageSize {
-			return fmt.Errorf("read data to short %d", n)
+			delete(pending, next)
+			next += 1
+
+			var err error
+			if d.prev == nil {
+				_, err = writer.Write(chunk.out)
+				report.Rewritten += len(chunk.dirty)
+			} else {
+				err = d.writeDirty(out.(io.WriterAt), chunk, report)
+			}
+			d.size += int64(len(chunk.out))
+			d.hmacs = append(d.hmacs, chunk.hmacs...)
+			decryptChunkPool.Put(&chunk.data)
+			decryptChunkPool.Put(&chunk.out)
+			if err != nil {
+				return err
+			}
+			report.Pages = chunk.pgno + len(chunk.data)/d.pageSize - 1
+			if chunk.truncated {
+				report.Pages += 1
+				report.Truncated = true
+			}
+			report.BadPages = append(report.BadPages, chunk.badPages...)
 		}
+	}
+	if readErr != nil {
+		return readErr
+	}
 
-		iv := buffer[len(buffer)-48 : len(buffer)-32]
-		stream := cipher.NewCBCDecrypter(block, iv)
-		decrypted := make([]byte, len(buffer)-48)
-		stream.CryptBlocks(decrypted, buffer[:len(buffer)-48])
-		_, err = outFile.Write(decrypted)
-		if err != nil {
-			return err
+	return writer.Flush()
+}
+
+// writeDirty 把一块中变化的页按页号写到输出文件，相邻的页合并为一次写入。
+func (d *pageDecryptor) writeDirty(out io.WriterAt, chunk *decryptChunk, report *DecryptReport) error {
+	pageSize := d.pageSize
+	base := int64(chunk.pgno-1) * int64(pageSize)
+	for start := 0; start < len(chunk.dirty); {
+		if !chunk.dirty[start] {
+			start += 1
+			continue
 		}
-		_, err = outFile.Write(buffer[len(buffer)-48:])
-		if err != nil {
+		end := start
+		for end < len(chunk.dirty) && chunk.dirty[end] {
+			end += 1
+		}
+		if _, err := out.WriteAt(chunk.out[start*pageSize:end*pageSize], base+int64(start*pageSize)); err != nil {
 			return err
 		}
+		report.Rewritten += end - start
+		start = end
 	}
 
 	return nil
 }
 
-func pbkdf2HMAC(password, salt []byte, iter, keyLen int) []byte {
+// decryptChunk 校验并解密一块中的每一页，结果写入 chunk.out。
+func (d *pageDecryptor) decryptChunk(chunk *decryptChunk) {
+	zeroPage := decryptZeroPage[:d.pageSize]
+	zeroMac := decryptZeroPage[:d.macSize]
+	reserve := d.profile.Reserve
+	chunk.out = (*decryptChunkPool.Get().(*[]byte))[:0]
+	for offset := 0; offset < len(chunk.data); offset += d.pageSize {
+		pgno := chunk.pgno + offset/d.pageSize
+		if offset+d.pageSize > len(chunk.data) {
+			// 文件被截断，最后一页不完整。
+			chunk.badPages = append(chunk.badPages, pgno)
+			chunk.truncated = true
+			if d.corrupt == DecryptCorruptZero {
+				chunk.out = append(chunk.out, zeroPage...)
+				chunk.dirty = append(chunk.dirty, true)
+				chunk.hmacs = append(chunk.hmacs, zeroMac...)
+			}
+			break
+		}
+
+		page := chunk.data[offset : offset+d.pageSize]
+		if pgno == 1 {
+			// 第 1 页开头的 salt 换成 SQLite 文件头。
+			chunk.out = append(chunk.out, sqliteFileHeader...)
+			page = page[saltSize:]
+		}
+		mac := page[len(page)-reserve+aes.BlockSize : len(page)-reserve+aes.BlockSize+d.macSize]
+		if !checkPageHMAC(d.profile, d.macKey, page, pgno) {
+			chunk.badPages = append(chunk.badPages, pgno)
+			// 损坏页记录为全零，下次总会重新解密。
+			chunk.hmacs = append(chunk.hmacs, zeroMac...)
+			switch d.corrupt {
+			case DecryptCorruptZero:
+				chunk.out = append(chunk.out, zeroPage...)
+				chunk.dirty = append(chunk.dirty, true)
+				continue
+			case DecryptCorruptSkip:
+				continue
+			}
+		} else {
+			chunk.hmacs = append(chunk.hmacs, mac...)
+			if d.prev != nil && d.prev.same(pgno, mac) {
+				// 未变化的页不解密，只占位。
+				chunk.out = chunk.out[:len(chunk.out)+len(page)]
+				chunk.dirty = append(chunk.dirty, false)
+				continue
+			}
+		}
+		chunk.dirty = append(chunk.dirty, true)
+
+		start := len(chunk.out)
+		chunk.out = append(chunk.out, page...)
+		decrypted := chunk.out[start:]
+		iv := page[len(page)-reserve : len(page)-reserve+aes.BlockSize]
+		stream := cipher.NewCBCDecrypter(d.block, iv)
+		stream.CryptBlocks(decrypted[:len(page)-reserve], page[:len(page)-reserve])
+	}
+}
+
+// checkPageHMAC 校验一页的 HMAC，page 不含第 1 页开头的 salt。
+// HMAC 覆盖密文和 IV，紧跟在保留区的 IV 之后。
+func checkPageHMAC(profile *DecryptProfile, macKey []byte, page []byte, pgno int) bool {
+	offset := len(page) - profile.Reserve + aes.BlockSize
+	hashMac := hmac.New(profile.Hash, macKey)
+	hashMac.Write(page[:offset])
+	hashMac.Write([]byte{byte(pgno), byte(pgno >> 8), byte(pgno >> 16), byte(pgno >> 24)})
+
+	sum := hashMac.Sum(nil)
+	return hmac.Equal(sum, page[offset:offset+len(sum)])
+}
+
+// quickCheckDataBase 对解密后的数据库执行 PRAGMA quick_check，返回以 ; 连接的结果。
+func quickCheckDataBase(path string) string {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err.Error()
+	}
+	defer db.Close()
+
+	rows, err := db.Query("PRAGMA quick_check(20);")
+	if err != nil {
+		return err.Error()
+	}
+	defer rows.Close()
+
+	results := make([]string, 0, 1)
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			return err.Error()
+		}
+		results = append(results, result)
+	}
+	if err := rows.Err(); err != nil {
+		return err.Error()
+	}
+
+	return strings.Join(results, "; ")
+}
+
+func pbkdf2HMAC(password, salt []byte, iter, keyLen int, h func() hash.Hash) []byte {
+	hashSize := h().Size()
 	dk := make([]byte, keyLen)
-	loop := (keyLen + sha1.Size - 1) / sha1.Size
+	loop := (keyLen + hashSize - 1) / hashSize
 	key := make([]byte, 0, len(salt)+4)
-	u := make([]byte, sha1.Size)
+	u := make([]byte, hashSize)
 	for i := 1; i <= loop; i++ {
 		key = key[:0]
 		key = append(key, salt...)
 		key = append(key, byte(i>>24), byte(i>>16), byte(i>>8), byte(i))
-		hmac := hmac.New(sha1.New, password)
+		hmac := hmac.New(h, password)
 		hmac.Write(key)
 		digest := hmac.Sum(nil)
 		copy(u, digest)
@@ -195,7 +727,7 @@ func pbkdf2HMAC(password, salt []byte, iter, keyLen int) []byte {
 				u[k] ^= di
 			}
 		}
-		copy(dk[(i-1)*sha1.Size:], u)
+		copy(dk[(i-1)*hashSize:], u)
 	}
 	return dk
 }
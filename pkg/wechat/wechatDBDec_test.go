@@ -0,0 +1,344 @@
+package wechat
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testPassword = []byte("0123456789abcdef0123456789abcdef")
+
+// testPlainPages returns a plain database of pages pages with the layout of
+// profile. Only the header of page 1 has to be valid, the decryptor never
+// looks at the content of a page.
+func testPlainPages(t *testing.T, pages int, profile *DecryptProfile) []byte {
+	t.Helper()
+
+	plain := make([]byte, pages*profile.PageSize)
+	if _, err := rand.Read(plain); err != nil {
+		t.Fatal(err)
+	}
+	copy(plain, sqliteFileHeader)
+	binary.BigEndian.PutUint16(plain[16:18], uint16(profile.PageSize))
+	plain[18], plain[19], plain[20] = 1, 1, byte(profile.Reserve)
+
+	return plain
+}
+
+// testCipher holds the keys of one encrypted test database, so that WAL
+// frames can be encrypted with the same keys as the database.
+type testCipher struct {
+	profile *DecryptProfile
+	salt    []byte
+	block   cipher.Block
+	macKey  []byte
+}
+
+func newTestCipher(t *testing.T, password []byte, profile *DecryptProfile) *testCipher {
+	t.Helper()
+
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		t.Fatal(err)
+	}
+	key, macKey := profile.deriveKeys(password, salt)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCipher{profile: profile, salt: salt, block: block, macKey: macKey}
+}
+
+// encryptPage encrypts one plain page the way SQLCipher does, independently
+// of encryptPages.
+func (c *testCipher) encryptPage(t *testing.T, pgno int, page []byte) []byte {
+	t.Helper()
+
+	out := make([]byte, len(page))
+	src, dst := page, out
+	if pgno == 1 {
+		copy(out, c.salt)
+		src, dst = page[saltSize:], out[saltSize:]
+	}
+
+	offset := len(dst) - c.profile.Reserve
+	iv := dst[offset : offset+aes.BlockSize]
+	if _, err := rand.Read(iv); err != nil {
+		t.Fatal(err)
+	}
+	cipher.NewCBCEncrypter(c.block, iv).CryptBlocks(dst[:offset], src[:offset])
+
+	mac := hmac.New(c.profile.Hash, c.macKey)
+	mac.Write(dst[:offset+aes.BlockSize])
+	binary.Write(mac, binary.LittleEndian, uint32(pgno))
+	copy(dst[offset+aes.BlockSize:], mac.Sum(nil))
+
+	return out
+}
+
+func (c *testCipher) encrypt(t *testing.T, plain []byte) []byte {
+	t.Helper()
+
+	pageSize := c.profile.PageSize
+	enc := make([]byte, 0, len(plain))
+	for offset := 0; offset < len(plain); offset += pageSize {
+		enc = append(enc, c.encryptPage(t, offset/pageSize+1, plain[offset:offset+pageSize])...)
+	}
+
+	return enc
+}
+
+// legacyDecryptDataBase is DecryptDataBase as it was before pages were
+// decrypted in parallel: WeChat 3.x only, one page at a time.
+func legacyDecryptDataBase(path string, password []byte, expPath string) error {
+	fp, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	fpReader := bufio.NewReaderSize(fp, defaultPageSize*100)
+	buffer := make([]byte, defaultPageSize)
+	n, err := fpReader.Read(buffer)
+	if err != nil && n != defaultPageSize {
+		return fmt.Errorf("read failed")
+	}
+
+	salt := buffer[:16]
+	key := pbkdf2HMAC(password, salt, 64000, keySize, sha1.New)
+	page1 := buffer[16:defaultPageSize]
+	macKey := pbkdf2HMAC(key, xorBytes(salt, 0x3a), 2, keySize, sha1.New)
+
+	hashMac := hmac.New(sha1.New, macKey)
+	hashMac.Write(page1[:len(page1)-32])
+	hashMac.Write([]byte{1, 0, 0, 0})
+	if !hmac.Equal(hashMac.Sum(nil), page1[len(page1)-32:len(page1)-12]) {
+		return fmt.Errorf("incorrect password")
+	}
+
+	outFile, err := os.Create(expPath)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	if _, err := outFile.Write(sqliteFileHeader); err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+
+	page := page1
+	for {
+		iv := page[len(page)-48 : len(page)-32]
+		decrypted := make([]byte, len(page)-48)
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(decrypted, page[:len(page)-48])
+		if _, err := outFile.Write(decrypted); err != nil {
+			return err
+		}
+		if _, err := outFile.Write(page[len(page)-48:]); err != nil {
+			return err
+		}
+
+		n, err = fpReader.Read(buffer)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if n < defaultPageSize {
+			return fmt.Errorf("read data to short %d", n)
+		}
+		page = buffer
+	}
+}
+
+// checkDecryptedPages compares a decrypted database with the plain one it
+// was made from, leaving out the reserved bytes that still hold IV and HMAC.
+func checkDecryptedPages(t *testing.T, got, plain []byte, profile *DecryptProfile) {
+	t.Helper()
+
+	if len(got) != len(plain) {
+		t.Fatalf("decrypted %d bytes, want %d", len(got), len(plain))
+	}
+	pageSize := profile.PageSize
+	for offset := 0; offset < len(plain); offset += pageSize {
+		end := offset + pageSize - profile.Reserve
+		if !bytes.Equal(got[offset:end], plain[offset:end]) {
+			t.Fatalf("page %d differs", offset/pageSize+1)
+		}
+	}
+}
+
+func TestDecryptDataBaseMatchesLegacy(t *testing.T) {
+	chunkPages := decryptChunkSize / DecryptProfileV3.PageSize
+	for _, pages := range []int{1, chunkPages - 1, chunkPages, chunkPages + 1, 2*chunkPages + 37} {
+		t.Run(fmt.Sprint(pages), func(t *testing.T) {
+			dir := t.TempDir()
+			plain := testPlainPages(t, pages, DecryptProfileV3)
+			path := filepath.Join(dir, "MSG0.db")
+			if err := os.WriteFile(path, newTestCipher(t, testPassword, DecryptProfileV3).encrypt(t, plain), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			legacyPath := filepath.Join(dir, "legacy.db")
+			if err := legacyDecryptDataBase(path, testPassword, legacyPath); err != nil {
+				t.Fatal(err)
+			}
+			newPath := filepath.Join(dir, "new.db")
+			report, err := DecryptDataBase(path, testPassword, newPath, DecryptOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Profile != DecryptProfileV3.Name || report.Pages != pages || !report.OK() {
+				t.Fatalf("report %+v", report)
+			}
+
+			legacy, err := os.ReadFile(legacyPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(newPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, legacy) {
+				t.Fatal("output differs from the legacy decryptor")
+			}
+			checkDecryptedPages(t, got, plain, DecryptProfileV3)
+		})
+	}
+}
+
+func TestDecryptDataBaseSQLCipher4(t *testing.T) {
+	dir := t.TempDir()
+	plain := testPlainPages(t, decryptChunkSize/DecryptProfileV4.PageSize+3, DecryptProfileV4)
+	path := filepath.Join(dir, "MSG0.db")
+	if err := os.WriteFile(path, newTestCipher(t, testPassword, DecryptProfileV4).encrypt(t, plain), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	profile, err := DetectDecryptProfile(path, testPassword)
+	if err != nil || profile != DecryptProfileV4 {
+		t.Fatalf("DetectDecryptProfile = %v, %v", profile, err)
+	}
+	if _, err := DetectDecryptProfile(path, testPassword, DecryptProfileV3); !errors.Is(err, ErrIncorrectPassword) {
+		t.Fatalf("DetectDecryptProfile with sqlcipher3 = %v", err)
+	}
+
+	outPath := filepath.Join(dir, "out.db")
+	report, err := DecryptDataBase(path, testPassword, outPath, DecryptOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Profile != DecryptProfileV4.Name || !report.OK() {
+		t.Fatalf("report %+v", report)
+	}
+	got, err := os.ReadFile(outPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDecryptedPages(t, got, plain, DecryptProfileV4)
+
+	if _, err := DecryptDataBase(path, []byte("wrong"), outPath, DecryptOptions{}); !errors.Is(err, ErrIncorrectPassword) {
+		t.Fatalf("wrong password: %v", err)
+	}
+}
+
+func TestDecryptDataBaseCorruptPages(t *testing.T) {
+	const pages = 10
+	profile := DecryptProfileV3
+	pageSize := profile.PageSize
+	dir := t.TempDir()
+	plain := testPlainPages(t, pages, profile)
+	enc := newTestCipher(t, testPassword, profile).encrypt(t, plain)
+
+	// corrupt flips a byte of the ciphertext of every page in pgnos.
+	corrupt := func(pgnos ...int) []byte {
+		data := append([]byte(nil), enc...)
+		for _, pgno := range pgnos {
+			data[(pgno-1)*pageSize+100] ^= 0xff
+		}
+		return data
+	}
+	zero := make([]byte, pageSize)
+
+	tests := []struct {
+		name      string
+		data      []byte
+		corrupt   int
+		bad       []int
+		truncated bool
+		err       error
+		// the plain page at each page of the output: 0 for zeros, -1 when
+		// the page is kept as decrypted garbage
+		want []int
+	}{
+		{"keep", corrupt(4, 7), DecryptCorruptKeep, []int{4, 7}, false, nil, []int{1, 2, 3, -1, 5, 6, -1, 8, 9, 10}},
+		{"zero", corrupt(4, 7), DecryptCorruptZero, []int{4, 7}, false, nil, []int{1, 2, 3, 0, 5, 6, 0, 8, 9, 10}},
+		{"skip middle", corrupt(4, 7), DecryptCorruptSkip, []int{4, 7}, false, ErrCorruptNotTrailing, nil},
+		{"skip trailing", corrupt(9, 10), DecryptCorruptSkip, []int{9, 10}, false, nil, []int{1, 2, 3, 4, 5, 6, 7, 8}},
+		{"zero truncated", enc[:len(enc)-pageSize/2], DecryptCorruptZero, []int{10}, true, nil, []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 0}},
+		{"skip truncated", enc[:len(enc)-pageSize/2], DecryptCorruptSkip, []int{10}, true, nil, []int{1, 2, 3, 4, 5, 6, 7, 8, 9}},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, "MSG0.db")
+		if err := os.WriteFile(path, tt.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		outPath := filepath.Join(dir, tt.name+".db")
+		report, err := DecryptDataBase(path, testPassword, outPath, DecryptOptions{Corrupt: tt.corrupt})
+		if fmt.Sprint(report.BadPages) != fmt.Sprint(tt.bad) || report.Truncated != tt.truncated || report.OK() {
+			t.Fatalf("%s: report %+v", tt.name, report)
+		}
+		if tt.err != nil {
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("%s: %v, want %v", tt.name, err, tt.err)
+			}
+			if _, err := os.Stat(outPath); !os.IsNotExist(err) {
+				t.Fatalf("%s: output left behind: %v", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		got, err := os.ReadFile(outPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(tt.want)*pageSize {
+			t.Fatalf("%s: %d bytes, want %d pages", tt.name, len(got), len(tt.want))
+		}
+		for i, pgno := range tt.want {
+			page := got[i*pageSize : (i+1)*pageSize]
+			switch {
+			case pgno == 0:
+				if !bytes.Equal(page, zero) {
+					t.Fatalf("%s: page %d is not zeroed", tt.name, i+1)
+				}
+			case pgno > 0:
+				want := plain[(pgno-1)*pageSize : pgno*pageSize-profile.Reserve]
+				if !bytes.Equal(page[:len(want)], want) {
+					t.Fatalf("%s: page %d is not plain page %d", tt.name, i+1, pgno)
+				}
+			}
+		}
+	}
+}
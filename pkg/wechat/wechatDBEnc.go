@@ -0,0 +1,381 @@
+package wechat
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// BackupProfile is the format of backups encrypted at rest. It is the
+// SQLCipher 4 default, so an exported database also opens in SQLCipher
+// tools with PRAGMA key = '<passphrase>'.
+var BackupProfile = DecryptProfileV4
+
+// ErrBackupLocked is returned when an encrypted backup database is opened
+// without the passphrase or with a wrong one.
+var ErrBackupLocked = errors.New("backup database is encrypted, wrong or missing passphrase")
+
+var backupPassphrase = struct {
+	mtx        sync.RWMutex
+	passphrase []byte
+}{}
+
+// SetBackupPassphrase sets the passphrase that unlocks backups encrypted at
+// rest. Databases opened afterwards are decrypted into memory only.
+func SetBackupPassphrase(passphrase []byte) {
+	backupPassphrase.mtx.Lock()
+	defer backupPassphrase.mtx.Unlock()
+	backupPassphrase.passphrase = append([]byte(nil), passphrase...)
+}
+
+func getBackupPassphrase() []byte {
+	backupPassphrase.mtx.RLock()
+	defer backupPassphrase.mtx.RUnlock()
+	return backupPassphrase.passphrase
+}
+
+// IsEncryptedDataBase reports whether path holds an encrypted database
+// rather than plain SQLite. Empty files are plain, SQLite creates them.
+func IsEncryptedDataBase(path string) (bool, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer fp.Close()
+
+	header := make([]byte, len(sqliteFileHeader))
+	n, err := io.ReadFull(fp, header)
+	if n == 0 {
+		return false, nil
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+
+	return !bytes.Equal(header[:n], sqliteFileHeader[:n]), nil
+}
+
+// EncryptExportDataBases encrypts every plain database under the Msg
+// directory of an exported account with passphrase, in place. Databases
+// that are already encrypted are left alone. It returns the number of
+// databases encrypted.
+//
+// The plain databases and their DecryptPagesSuffix records are replaced, so
+// the next export of expPath decrypts every database in full again.
+func EncryptExportDataBases(expPath string, passphrase []byte) (int, error) {
+	if len(passphrase) == 0 {
+		return 0, errors.New("empty backup passphrase")
+	}
+
+	count := 0
+	err := filepath.Walk(filepath.Join(expPath, "Msg"), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Ext(path) != ".db" {
+			return nil
+		}
+		if encrypted, err := IsEncryptedDataBase(path); err != nil || encrypted {
+			return err
+		}
+
+		tmpPath := path + ".encrypting"
+		if err := EncryptDataBase(path, passphrase, tmpPath); err != nil {
+			os.Remove(tmpPath)
+			return fmt.Errorf("encrypt %s: %w", path, err)
+		}
+		if err := os.Rename(tmpPath, path); err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+		// The incremental record describes the plain file, which is gone.
+		for _, suffix := range []string{"-wal", "-shm", "-journal", DecryptPagesSuffix} {
+			os.Remove(path + suffix)
+		}
+		count += 1
+		return nil
+	})
+
+	return count, err
+}
+
+// EncryptDataBase encrypts the plain database at path into expPath with
+// BackupProfile. The page layout of path is fixed up in place first when
+// it does not leave room for the IV and HMAC.
+func EncryptDataBase(path string, passphrase []byte, expPath string) error {
+	if err := prepareEncryptLayout(path, BackupProfile); err != nil {
+		return err
+	}
+
+	fp, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	out, err := os.OpenFile(expPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	writer := bufio.NewWriterSize(out, decryptChunkSize)
+	if err := encryptPages(bufio.NewReaderSize(fp, decryptChunkSize), passphrase, BackupProfile, writer); err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+
+	return out.Close()
+}
+
+// encryptLayoutOK reports whether a plain database header already has the
+// page size and reserved bytes of profile and is not in WAL mode.
+func encryptLayoutOK(header []byte, profile *DecryptProfile) bool {
+	if len(header) < 100 || !bytes.HasPrefix(header, sqliteFileHeader) {
+		return false
+	}
+	pageSize := int(binary.BigEndian.Uint16(header[16:18]))
+	if pageSize == 1 {
+		pageSize = 65536
+	}
+
+	return pageSize == profile.PageSize && int(header[20]) == profile.Reserve && header[18] == 1 && header[19] == 1
+}
+
+func prepareEncryptLayout(path string, profile *DecryptProfile) error {
+	fp, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, 100)
+	n, _ := io.ReadFull(fp, header)
+	fp.Close()
+	if _, err := os.Stat(path + "-wal"); err != nil && encryptLayoutOK(header[:n], profile) {
+		return nil
+	}
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "PRAGMA journal_mode=DELETE;"); err != nil {
+		return err
+	}
+	return setEncryptLayout(ctx, conn, profile)
+}
+
+// setEncryptLayout rebuilds the database behind conn with the page size and
+// reserved bytes of profile. Both only take effect through VACUUM, and the
+// reserve has to be set last because PRAGMA page_size resets it.
+func setEncryptLayout(ctx context.Context, conn *sql.Conn, profile *DecryptProfile) error {
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf("PRAGMA page_size=%d;", profile.PageSize)); err != nil {
+		return err
+	}
+	if err := sqliteSetReserve(conn, profile.Reserve); err != nil {
+		return err
+	}
+	_, err := conn.ExecContext(ctx, "VACUUM;")
+
+	return err
+}
+
+// encryptPages is the reverse of pageDecryptor: every page is encrypted with
+// AES-CBC under a fresh IV and followed by its HMAC, page 1 starts with the
+// salt instead of the SQLite header.
+func encryptPages(r io.Reader, passphrase []byte, profile *DecryptProfile, w io.Writer) error {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	key, macKey := profile.deriveKeys(passphrase, salt)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+
+	pageSize, reserve := profile.PageSize, profile.Reserve
+	page := make([]byte, pageSize)
+	out := make([]byte, pageSize)
+	for pgno := 1; ; pgno++ {
+		n, err := io.ReadFull(r, page)
+		if n == 0 && err == io.EOF {
+			if pgno == 1 {
+				return errors.New("empty database")
+			}
+			return nil
+		}
+		if err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return fmt.Errorf("page %d is incomplete", pgno)
+			}
+			return err
+		}
+
+		src, dst := page, out
+		if pgno == 1 {
+			if !encryptLayoutOK(page, profile) {
+				return errors.New("database layout does not match " + profile.Name)
+			}
+			copy(out, salt)
+			src, dst = page[saltSize:], out[saltSize:]
+		}
+
+		offset := len(dst) - reserve
+		iv := dst[offset : offset+aes.BlockSize]
+		if _, err := rand.Read(iv); err != nil {
+			return err
+		}
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(dst[:offset], src[:offset])
+
+		hashMac := hmac.New(profile.Hash, macKey)
+		hashMac.Write(dst[:offset+aes.BlockSize])
+		hashMac.Write([]byte{byte(pgno), byte(pgno >> 8), byte(pgno >> 16), byte(pgno >> 24)})
+		mac := hashMac.Sum(dst[offset+aes.BlockSize : offset+aes.BlockSize])
+		clear(dst[offset+aes.BlockSize+len(mac):])
+
+		if _, err := w.Write(out); err != nil {
+			return err
+		}
+	}
+}
+
+// wechatLockedDB is an encrypted backup database that is decrypted into a
+// shared in-memory database. holder keeps the memory database alive while
+// database/sql opens and closes connections to it. Changes are encrypted
+// back to path when the database is closed.
+type wechatLockedDB struct {
+	path       string
+	passphrase []byte
+	holder     *sql.Conn
+	modified   atomic.Bool
+}
+
+var wechatMemDBSeq int64
+
+// wechatUnlockDB decrypts the backup database at path into memory.
+func wechatUnlockDB(path string, passphrase []byte) (*wechatDB, error) {
+	plain, _, err := decryptDataBaseBytes(path, passphrase, []*DecryptProfile{BackupProfile})
+	if errors.Is(err, ErrIncorrectPassword) {
+		return nil, fmt.Errorf("%s: %w", filepath.Base(path), ErrBackupLocked)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return wechatOpenMemDB(path, plain, passphrase)
+}
+
+// wechatOpenMemDB opens a shared in-memory database loaded with plain, or
+// an empty one when plain is nil. It is saved encrypted to path on Close
+// once something has been written to it.
+func wechatOpenMemDB(path string, plain []byte, passphrase []byte) (*wechatDB, error) {
+	// memdb databases whose name starts with / are shared by all
+	// connections of the process.
+	name := fmt.Sprintf("file:/wdb-%d-%s?vfs=memdb", atomic.AddInt64(&wechatMemDBSeq, 1), url.PathEscape(filepath.Base(path)))
+	db, err := sql.Open("sqlite3", name)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	holder, err := db.Conn(ctx)
+	if err == nil && plain != nil {
+		err = wechatLoadMemDB(ctx, holder, plain)
+	}
+	if err != nil {
+		if holder != nil {
+			holder.Close()
+		}
+		db.Close()
+		return nil, fmt.Errorf("unlock %s: %w", filepath.Base(path), err)
+	}
+
+	w := newWechatDB(db, path)
+	w.locked = &wechatLockedDB{path: path, passphrase: passphrase, holder: holder}
+
+	return w, nil
+}
+
+// save encrypts the memory database back to its file. It goes through a
+// temporary file, so a failed save keeps the previous backup.
+func (l *wechatLockedDB) save() error {
+	ctx := context.Background()
+	plain, err := l.serialize()
+	if err == nil && !encryptLayoutOK(plain, BackupProfile) {
+		if err = setEncryptLayout(ctx, l.holder, BackupProfile); err == nil {
+			plain, err = l.serialize()
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), filepath.Base(l.path)+".encrypting-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := bufio.NewWriterSize(tmp, decryptChunkSize)
+	err = encryptPages(bytes.NewReader(plain), l.passphrase, BackupProfile, writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), l.path)
+}
+
+func (l *wechatLockedDB) serialize() ([]byte, error) {
+	return sqliteSerialize(l.holder)
+}
+
+// close saves the database when it was written to and releases the memory.
+func (l *wechatLockedDB) close() error {
+	var err error
+	if l.modified.Load() {
+		if err = l.save(); err != nil {
+			log.Printf("save %s failed: %v\n", l.path, err)
+		}
+	}
+	l.holder.Close()
+
+	return err
+}
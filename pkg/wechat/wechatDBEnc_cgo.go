@@ -0,0 +1,73 @@
+//go:build cgo
+
+package wechat
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// SQLITE_FCNTL_RESERVE_BYTES, the number of bytes SQLite leaves free at the
+// end of every page for the IV and HMAC.
+const sqliteFcntlReserveBytes = 38
+
+func sqliteSetReserve(conn *sql.Conn, reserve int) error {
+	return conn.Raw(func(driverConn interface{}) error {
+		return driverConn.(*sqlite3.SQLiteConn).SetFileControlInt("main", sqliteFcntlReserveBytes, reserve)
+	})
+}
+
+func sqliteSerialize(conn *sql.Conn) ([]byte, error) {
+	var plain []byte
+	err := conn.Raw(func(driverConn interface{}) error {
+		var err error
+		plain, err = driverConn.(*sqlite3.SQLiteConn).Serialize("main")
+		return err
+	})
+
+	return plain, err
+}
+
+// wechatLoadMemDB copies plain into the memory database behind holder. The
+// bytes are deserialized into a private connection first, because only a
+// memdb opened by name can grow and be shared.
+func wechatLoadMemDB(ctx context.Context, holder *sql.Conn, plain []byte) error {
+	src, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	return srcConn.Raw(func(srcDriver interface{}) error {
+		srcSQLite := srcDriver.(*sqlite3.SQLiteConn)
+		if err := srcSQLite.Deserialize(plain, "main"); err != nil {
+			return err
+		}
+
+		return holder.Raw(func(dstDriver interface{}) error {
+			backup, err := dstDriver.(*sqlite3.SQLiteConn).Backup("main", srcSQLite, "main")
+			if err != nil {
+				return err
+			}
+			_, err = backup.Step(-1)
+			if finishErr := backup.Finish(); err == nil {
+				err = finishErr
+			}
+			var sqliteErr sqlite3.Error
+			if errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrFull {
+				return fmt.Errorf("%d bytes exceed the in-memory database limit: %w", len(plain), err)
+			}
+			return err
+		})
+	})
+}
@@ -0,0 +1,23 @@
+//go:build !cgo
+
+package wechat
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+var errBackupNoCgo = errors.New("encrypted backups need a cgo build")
+
+func sqliteSetReserve(conn *sql.Conn, reserve int) error {
+	return errBackupNoCgo
+}
+
+func sqliteSerialize(conn *sql.Conn) ([]byte, error) {
+	return nil, errBackupNoCgo
+}
+
+func wechatLoadMemDB(ctx context.Context, holder *sql.Conn, plain []byte) error {
+	return errBackupNoCgo
+}
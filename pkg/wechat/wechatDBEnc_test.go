@@ -0,0 +1,186 @@
+package wechat
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testCreatePlainDB(t *testing.T, path string, contents ...string) {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec("CREATE TABLE MSG (localId INTEGER PRIMARY KEY, StrContent TEXT);"); err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range contents {
+		if _, err := db.Exec("INSERT INTO MSG (StrContent) VALUES (?);", content); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func testQueryContents(t *testing.T, db *wechatDB) []string {
+	t.Helper()
+
+	rows, err := db.query("SELECT StrContent FROM MSG ORDER BY localId;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	contents := make([]string, 0)
+	for rows.Next() {
+		var content string
+		if err := rows.Scan(&content); err != nil {
+			t.Fatal(err)
+		}
+		contents = append(contents, content)
+	}
+
+	return contents
+}
+
+func testMSGContents(t *testing.T, path string) []string {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", "file:"+path+"?immutable=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT StrContent FROM MSG ORDER BY localId;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	contents := make([]string, 0)
+	for rows.Next() {
+		var content string
+		if err := rows.Scan(&content); err != nil {
+			t.Fatal(err)
+		}
+		contents = append(contents, content)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return contents
+}
+
+func TestEncryptPagesRoundTrip(t *testing.T) {
+	plain := testPlainPages(t, decryptChunkSize/BackupProfile.PageSize+5, BackupProfile)
+	passphrase := []byte("backup passphrase")
+
+	var enc bytes.Buffer
+	if err := encryptPages(bytes.NewReader(plain), passphrase, BackupProfile, &enc); err != nil {
+		t.Fatal(err)
+	}
+	if enc.Len() != len(plain) || bytes.HasPrefix(enc.Bytes(), sqliteFileHeader) {
+		t.Fatal("output is not an encrypted database of the same size")
+	}
+
+	path := filepath.Join(t.TempDir(), "MSG0.db")
+	if err := os.WriteFile(path, enc.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	got, report, err := decryptDataBaseBytes(path, passphrase, []*DecryptProfile{BackupProfile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Pages != len(plain)/BackupProfile.PageSize {
+		t.Fatalf("decrypted %d pages", report.Pages)
+	}
+	checkDecryptedPages(t, got, plain, BackupProfile)
+
+	// A plain layout without room for IV and HMAC is refused.
+	wrong := testPlainPages(t, 1, DecryptProfileV3)
+	if err := encryptPages(bytes.NewReader(wrong), passphrase, BackupProfile, &bytes.Buffer{}); err == nil {
+		t.Fatal("encrypted a page without the reserved bytes of " + BackupProfile.Name)
+	}
+}
+
+func TestUnlockDBRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	plainPath := filepath.Join(dir, "plain.db")
+	testCreatePlainDB(t, plainPath, "first", "second")
+	passphrase := []byte("backup passphrase")
+
+	path := filepath.Join(dir, "MSG0.db")
+	if err := EncryptDataBase(plainPath, passphrase, path); err != nil {
+		t.Fatal(err)
+	}
+	if encrypted, err := IsEncryptedDataBase(path); err != nil || !encrypted {
+		t.Fatalf("IsEncryptedDataBase = %v, %v", encrypted, err)
+	}
+	if encrypted, err := IsEncryptedDataBase(plainPath); err != nil || encrypted {
+		t.Fatalf("IsEncryptedDataBase(plain) = %v, %v", encrypted, err)
+	}
+
+	if _, err := wechatUnlockDB(path, []byte("wrong")); !errors.Is(err, ErrBackupLocked) {
+		t.Fatalf("wrong passphrase: %v", err)
+	}
+
+	db, err := wechatUnlockDB(path, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := testQueryContents(t, db); len(got) != 2 || got[0] != "first" || got[1] != "second" {
+		t.Fatalf("unlocked rows %q", got)
+	}
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Closing without writes leaves the file alone.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := os.ReadFile(path); !bytes.Equal(before, after) {
+		t.Fatal("database rewritten without changes")
+	}
+
+	db, err = wechatUnlockDB(path, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.exec("INSERT INTO MSG (StrContent) VALUES (?);", "third"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = wechatUnlockDB(path, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if got := testQueryContents(t, db); len(got) != 3 || got[2] != "third" {
+		t.Fatalf("rows after save %q", got)
+	}
+
+	// The saved file is a standard SQLCipher 4 database that other tools open.
+	outPath := filepath.Join(dir, "out.db")
+	report, err := DecryptDataBase(path, passphrase, outPath, DecryptOptions{Profile: BackupProfile, QuickCheck: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("report %+v", report)
+	}
+	if got := testMSGContents(t, outPath); len(got) != 3 {
+		t.Fatalf("decrypted rows %q", got)
+	}
+}
@@ -0,0 +1,110 @@
+package wechat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+)
+
+// DecryptPagesSuffix names the sidecar DecryptDataBase writes next to a
+// decrypted database when DecryptOptions.Incremental is set. It holds the
+// HMAC of every source page, so the next run only decrypts the pages whose
+// HMAC changed and leaves the rest of the decrypted file untouched.
+const DecryptPagesSuffix = ".pages"
+
+var decryptPagesMagic = []byte("WDBPAGES")
+
+const decryptPagesVersion = 2
+
+// version(1) | corrupt(1) | pageSize(4) | macSize(1) | salt(16) | size(8) | modTime(8)
+const decryptPagesHeaderSize = 39
+
+// decryptPages is the sidecar record. size and modTime pin the decrypted
+// file it describes; a file changed by anything else is decrypted in full.
+type decryptPages struct {
+	salt     []byte
+	corrupt  int
+	pageSize int
+	macSize  int
+	size     int64
+	modTime  int64
+	hmacs    []byte // macSize bytes per page, zero for corrupted pages.
+}
+
+// same reports whether page pgno has the same HMAC as in the last run.
+func (p *decryptPages) same(pgno int, mac []byte) bool {
+	offset := (pgno - 1) * p.macSize
+	if offset+p.macSize > len(p.hmacs) {
+		return false
+	}
+
+	return bytes.Equal(p.hmacs[offset:offset+p.macSize], mac)
+}
+
+// loadDecryptPages returns the record of expPath when it still matches the
+// decrypted file, the source salt and the profile, nil otherwise.
+func loadDecryptPages(expPath string, salt []byte, corrupt int, profile *DecryptProfile) *decryptPages {
+	data, err := os.ReadFile(expPath + DecryptPagesSuffix)
+	if err != nil {
+		return nil
+	}
+	pages, err := parseDecryptPages(data)
+	if err != nil {
+		return nil
+	}
+	if !bytes.Equal(pages.salt, salt) || pages.corrupt != corrupt ||
+		pages.pageSize != profile.PageSize || pages.macSize != profile.Hash().Size() {
+		return nil
+	}
+
+	info, err := os.Stat(expPath)
+	if err != nil || info.Size() != pages.size || info.ModTime().UnixNano() != pages.modTime {
+		return nil
+	}
+
+	return pages
+}
+
+func parseDecryptPages(data []byte) (*decryptPages, error) {
+	if !bytes.HasPrefix(data, decryptPagesMagic) {
+		return nil, errors.New("bad pages record")
+	}
+	data = data[len(decryptPagesMagic):]
+	if len(data) < decryptPagesHeaderSize || data[0] != decryptPagesVersion || data[6] == 0 ||
+		(len(data)-decryptPagesHeaderSize)%int(data[6]) != 0 {
+		return nil, errors.New("bad pages record")
+	}
+
+	pages := &decryptPages{}
+	pages.corrupt = int(data[1])
+	pages.pageSize = int(binary.LittleEndian.Uint32(data[2:6]))
+	pages.macSize = int(data[6])
+	pages.salt = append([]byte(nil), data[7:23]...)
+	pages.size = int64(binary.LittleEndian.Uint64(data[23:31]))
+	pages.modTime = int64(binary.LittleEndian.Uint64(data[31:39]))
+	pages.hmacs = data[decryptPagesHeaderSize:]
+
+	return pages, nil
+}
+
+// saveDecryptPages writes the record for the decrypted file at expPath,
+// which must be closed already so that its size and time are final.
+func saveDecryptPages(expPath string, salt []byte, corrupt int, profile *DecryptProfile, hmacs []byte) error {
+	info, err := os.Stat(expPath)
+	if err != nil {
+		return err
+	}
+
+	data := make([]byte, 0, len(decryptPagesMagic)+decryptPagesHeaderSize+len(hmacs))
+	data = append(data, decryptPagesMagic...)
+	data = append(data, decryptPagesVersion, byte(corrupt))
+	data = binary.LittleEndian.AppendUint32(data, uint32(profile.PageSize))
+	data = append(data, byte(profile.Hash().Size()))
+	data = append(data, salt...)
+	data = binary.LittleEndian.AppendUint64(data, uint64(info.Size()))
+	data = binary.LittleEndian.AppendUint64(data, uint64(info.ModTime().UnixNano()))
+	data = append(data, hmacs...)
+
+	return os.WriteFile(expPath+DecryptPagesSuffix, data, 0644)
+}
@@ -0,0 +1,97 @@
+package wechat
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDecryptDataBaseIncremental(t *testing.T) {
+	profile := DecryptProfileV3
+	pageSize := profile.PageSize
+	chunkPages := decryptChunkSize / pageSize
+	pages := 2*chunkPages + 5
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "MSG0.db")
+	outPath := filepath.Join(dir, "out.db")
+	fullPath := filepath.Join(dir, "full.db")
+	c := newTestCipher(t, testPassword, profile)
+	plain := testPlainPages(t, pages, profile)
+	enc := c.encrypt(t, plain)
+
+	// decrypt runs the incremental decryption of enc and checks that it
+	// rewrote rewritten pages and left the same file as a full decryption.
+	decrypt := func(name string, rewritten int) {
+		t.Helper()
+
+		if err := os.WriteFile(path, enc, 0644); err != nil {
+			t.Fatal(err)
+		}
+		report, err := DecryptDataBase(path, testPassword, outPath, DecryptOptions{Incremental: true})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !report.OK() || report.Pages != len(enc)/pageSize || report.Rewritten != rewritten {
+			t.Fatalf("%s: report %+v, want %d pages rewritten", name, report, rewritten)
+		}
+		if _, err := os.Stat(outPath + DecryptPagesSuffix); err != nil {
+			t.Fatalf("%s: no pages record: %v", name, err)
+		}
+
+		if _, err := DecryptDataBase(path, testPassword, fullPath, DecryptOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		got, _ := os.ReadFile(outPath)
+		full, _ := os.ReadFile(fullPath)
+		if !bytes.Equal(got, full) {
+			t.Fatalf("%s: incremental output differs from a full decryption", name)
+		}
+	}
+
+	// reencrypt gives page pgno new content, and so a new IV and HMAC.
+	reencrypt := func(pgno int) {
+		page := plain[(pgno-1)*pageSize : pgno*pageSize]
+		page[200] ^= 0xff
+		copy(enc[(pgno-1)*pageSize:], c.encryptPage(t, pgno, page))
+	}
+
+	decrypt("first", pages)
+	decrypt("unchanged", 0)
+
+	reencrypt(1)
+	reencrypt(chunkPages + 2)
+	reencrypt(pages)
+	decrypt("changed", 3)
+
+	more := testPlainPages(t, 3, profile)
+	for i := 0; i < 3; i++ {
+		enc = append(enc, c.encryptPage(t, pages+i+1, more[i*pageSize:(i+1)*pageSize])...)
+	}
+	decrypt("grown", 3)
+
+	enc = enc[:(pages-4)*pageSize]
+	decrypt("shrunk", 0)
+
+	// Anything else that touches the decrypted file makes the record stale.
+	out, err := os.ReadFile(outPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out[5*pageSize] ^= 0xff
+	if err := os.WriteFile(outPath, out, 0644); err != nil {
+		t.Fatal(err)
+	}
+	stamp := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(outPath, stamp, stamp); err != nil {
+		t.Fatal(err)
+	}
+	decrypt("mtime changed", pages-4)
+
+	if err := os.WriteFile(outPath, append(out, 0), 0644); err != nil {
+		t.Fatal(err)
+	}
+	decrypt("size changed", pages-4)
+}
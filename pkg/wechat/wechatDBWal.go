@@ -0,0 +1,150 @@
+package wechat
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// DecryptWALSuffix names the write-ahead log next to a database. While
+// WeChat is running the newest pages are only in it, not in the .db file.
+const DecryptWALSuffix = "-wal"
+
+const (
+	walHeaderSize      = 32
+	walFrameHeaderSize = 24
+	walMagic           = 0x377f0682 // the low bit selects big-endian checksums.
+)
+
+// walChecksum continues the running WAL checksum s0, s1 over data, which is
+// a multiple of 8 bytes. Words are read in the byte order named by the
+// header magic, the same way SQLite does.
+func walChecksum(bigEndian bool, data []byte, s0, s1 uint32) (uint32, uint32) {
+	var order binary.ByteOrder = binary.LittleEndian
+	if bigEndian {
+		order = binary.BigEndian
+	}
+	for i := 0; i+8 <= len(data); i += 8 {
+		s0 += order.Uint32(data[i:]) + s1
+		s1 += order.Uint32(data[i+4:]) + s0
+	}
+
+	return s0, s1
+}
+
+// walPages is the result of reading a WAL: the decrypted content of every
+// page changed by a committed transaction and the database size in pages
+// after the last commit.
+type walPages struct {
+	frames int
+	size   int
+	pages  map[int][]byte
+}
+
+// readDecryptWAL decrypts the committed frames of the WAL at walPath. Like
+// SQLite recovery it stops at the first frame whose salt or checksum does
+// not match, so a log that is being written to yields its last complete
+// transaction. A frame that fails its HMAC ends the log the same way. A
+// missing WAL returns nil.
+func readDecryptWAL(walPath string, profile *DecryptProfile, block cipher.Block, macKey []byte) (*walPages, error) {
+	fp, err := os.Open(walPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	header := make([]byte, walHeaderSize)
+	if _, err := io.ReadFull(fp, header); err != nil {
+		// An empty or reset log holds nothing.
+		return nil, nil
+	}
+	magic := binary.BigEndian.Uint32(header[0:4])
+	if magic&^1 != walMagic {
+		return nil, fmt.Errorf("%s: bad WAL magic %#x", walPath, magic)
+	}
+	bigEndian := magic&1 == 1
+	if pageSize := int(binary.BigEndian.Uint32(header[8:12])); pageSize != profile.PageSize {
+		return nil, fmt.Errorf("%s: WAL page size %d does not match %s", walPath, pageSize, profile.Name)
+	}
+	s0, s1 := walChecksum(bigEndian, header[:24], 0, 0)
+	if s0 != binary.BigEndian.Uint32(header[24:28]) || s1 != binary.BigEndian.Uint32(header[28:32]) {
+		return nil, nil
+	}
+	salt := header[16:24]
+
+	dec := newPageDecryptor(profile, block, macKey, DecryptCorruptKeep, nil)
+	wal := &walPages{pages: make(map[int][]byte)}
+	pending := make(map[int][]byte)
+	pendingFrames := 0
+	frame := make([]byte, walFrameHeaderSize+profile.PageSize)
+	for {
+		if _, err := io.ReadFull(fp, frame); err != nil {
+			break
+		}
+		pgno := int(binary.BigEndian.Uint32(frame[0:4]))
+		commit := int(binary.BigEndian.Uint32(frame[4:8]))
+		if pgno == 0 || string(frame[8:16]) != string(salt) {
+			break
+		}
+		s0, s1 = walChecksum(bigEndian, frame[:8], s0, s1)
+		s0, s1 = walChecksum(bigEndian, frame[walFrameHeaderSize:], s0, s1)
+		if s0 != binary.BigEndian.Uint32(frame[16:20]) || s1 != binary.BigEndian.Uint32(frame[20:24]) {
+			break
+		}
+
+		chunk := &decryptChunk{pgno: pgno, data: frame[walFrameHeaderSize:]}
+		dec.decryptChunk(chunk)
+		if len(chunk.badPages) > 0 {
+			decryptChunkPool.Put(&chunk.out)
+			break
+		}
+		pending[pgno] = append(pending[pgno][:0], chunk.out...)
+		decryptChunkPool.Put(&chunk.out)
+		pendingFrames += 1
+
+		if commit != 0 {
+			for pgno, page := range pending {
+				wal.pages[pgno] = page
+			}
+			pending = make(map[int][]byte)
+			wal.frames += pendingFrames
+			pendingFrames = 0
+			wal.size = commit
+		}
+	}
+	if wal.frames == 0 {
+		return nil, nil
+	}
+
+	return wal, nil
+}
+
+// apply writes the WAL pages into the decrypted database and cuts it to the
+// size of the last commit, like a checkpoint would. hmacs is the page record
+// of the .db file; the entries of pages that now hold WAL content or were
+// cut off are zeroed, so the next incremental run rewrites them from the
+// source.
+func (wal *walPages) apply(out *os.File, pageSize int, macSize int, hmacs []byte) error {
+	for pgno, page := range wal.pages {
+		if pgno > wal.size {
+			continue
+		}
+		if _, err := out.WriteAt(page, int64(pgno-1)*int64(pageSize)); err != nil {
+			return err
+		}
+		if offset := (pgno - 1) * macSize; offset+macSize <= len(hmacs) {
+			clear(hmacs[offset : offset+macSize])
+		}
+	}
+	if offset := wal.size * macSize; offset < len(hmacs) {
+		clear(hmacs[offset:])
+	}
+
+	return out.Truncate(int64(wal.size) * int64(pageSize))
+}
@@ -0,0 +1,158 @@
+package wechat
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testWALDataBase builds a plain database with the layout of profile in WAL
+// mode. Row 1 is in the .db file, rows 2 and 3 are two more transactions
+// that are only in the WAL. It returns both files as they were before any
+// checkpoint.
+func testWALDataBase(t *testing.T, profile *DecryptProfile) ([]byte, []byte) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "plain.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	statements := []string{
+		"CREATE TABLE MSG (localId INTEGER PRIMARY KEY, StrContent TEXT);",
+		"INSERT INTO MSG (StrContent) VALUES ('in db');",
+	}
+	for _, statement := range statements {
+		if _, err := conn.ExecContext(ctx, statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := setEncryptLayout(ctx, conn, profile); err != nil {
+		t.Fatal(err)
+	}
+	statements = []string{
+		"PRAGMA journal_mode=WAL;",
+		"PRAGMA wal_autocheckpoint=0;",
+		"INSERT INTO MSG (StrContent) VALUES ('in wal 1');",
+		"INSERT INTO MSG (StrContent) VALUES ('in wal 2');",
+	}
+	for _, statement := range statements {
+		if _, err := conn.ExecContext(ctx, statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Read while the connection is open, closing it checkpoints the WAL.
+	plain, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal, err := os.ReadFile(path + DecryptWALSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return plain, wal
+}
+
+// encryptWAL encrypts every frame of a plain WAL and recomputes the frame
+// checksums, which cover the encrypted page.
+func (c *testCipher) encryptWAL(t *testing.T, wal []byte) ([]byte, int) {
+	t.Helper()
+
+	bigEndian := binary.BigEndian.Uint32(wal[0:4])&1 == 1
+	s0, s1 := binary.BigEndian.Uint32(wal[24:28]), binary.BigEndian.Uint32(wal[28:32])
+	enc := append([]byte(nil), wal[:walHeaderSize]...)
+	frameSize := walFrameHeaderSize + c.profile.PageSize
+	frames := 0
+	for offset := walHeaderSize; offset+frameSize <= len(wal); offset += frameSize {
+		header := append([]byte(nil), wal[offset:offset+walFrameHeaderSize]...)
+		pgno := int(binary.BigEndian.Uint32(header[0:4]))
+		page := c.encryptPage(t, pgno, wal[offset+walFrameHeaderSize:offset+frameSize])
+
+		s0, s1 = walChecksum(bigEndian, header[:8], s0, s1)
+		s0, s1 = walChecksum(bigEndian, page, s0, s1)
+		binary.BigEndian.PutUint32(header[16:20], s0)
+		binary.BigEndian.PutUint32(header[20:24], s1)
+		enc = append(enc, header...)
+		enc = append(enc, page...)
+		frames += 1
+	}
+
+	return enc, frames
+}
+
+func TestDecryptDataBaseMergesWAL(t *testing.T) {
+	for _, profile := range DecryptProfiles {
+		t.Run(profile.Name, func(t *testing.T) {
+			plain, plainWAL := testWALDataBase(t, profile)
+			c := newTestCipher(t, testPassword, profile)
+			wal, frames := c.encryptWAL(t, plainWAL)
+
+			dir := t.TempDir()
+			path := filepath.Join(dir, "MSG0.db")
+			if err := os.WriteFile(path, c.encrypt(t, plain), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			tests := []struct {
+				name   string
+				wal    []byte
+				merge  bool
+				frames int
+				want   []string
+			}{
+				{"no wal", nil, true, 0, []string{"in db"}},
+				{"merge", wal, true, frames, []string{"in db", "in wal 1", "in wal 2"}},
+				{"merge off", wal, false, 0, []string{"in db"}},
+				// A torn last frame loses its commit, the last transaction is dropped.
+				{"torn", wal[:len(wal)-100], true, -1, []string{"in db", "in wal 1"}},
+			}
+			for _, tt := range tests {
+				os.Remove(path + DecryptWALSuffix)
+				if tt.wal != nil {
+					if err := os.WriteFile(path+DecryptWALSuffix, tt.wal, 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				outPath := filepath.Join(dir, tt.name+".db")
+				report, err := DecryptDataBase(path, testPassword, outPath, DecryptOptions{WAL: tt.merge, QuickCheck: true})
+				if err != nil {
+					t.Fatalf("%s: %v", tt.name, err)
+				}
+				if !report.OK() {
+					t.Fatalf("%s: report %+v", tt.name, report)
+				}
+				if tt.frames >= 0 && report.WALFrames != tt.frames {
+					t.Fatalf("%s: merged %d frames, want %d", tt.name, report.WALFrames, tt.frames)
+				}
+				if tt.frames < 0 && (report.WALFrames == 0 || report.WALFrames >= frames) {
+					t.Fatalf("%s: merged %d of %d frames", tt.name, report.WALFrames, frames)
+				}
+
+				got := testMSGContents(t, outPath)
+				if len(got) != len(tt.want) {
+					t.Fatalf("%s: rows %q, want %q", tt.name, got, tt.want)
+				}
+				for i := range got {
+					if got[i] != tt.want[i] {
+						t.Fatalf("%s: rows %q, want %q", tt.name, got, tt.want)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package wechat
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DatCacheDefaultSize is the default limit of the decoded image cache.
+const DatCacheDefaultSize = 512 << 20
+
+// DatCache decodes WeChat .dat images on request and keeps the decoded
+// files in a directory bounded to maxSize bytes. Least recently used files
+// are removed first. Exports made with ExportOptions.LazyDat contain raw
+// .dat files that are only readable through this cache.
+type DatCache struct {
+	dir     string
+	maxSize int64
+
+	mtx    sync.Mutex
+	size   int64
+	loaded bool
+}
+
+// NewDatCache returns a cache stored in dir. An empty dir uses the user
+// cache directory, so the cache never ends up inside a backup.
+func NewDatCache(dir string, maxSize int64) *DatCache {
+	if dir == "" {
+		root, err := os.UserCacheDir()
+		if err != nil {
+			root = os.TempDir()
+		}
+		dir = filepath.Join(root, "wechatDataBackup", "dat")
+	}
+	if maxSize <= 0 {
+		maxSize = DatCacheDefaultSize
+	}
+
+	return &DatCache{dir: dir, maxSize: maxSize}
+}
+
+// Decoded returns the path to serve for datPath. Files exported before
+// lazy mode are already decoded and come back unchanged. Files that cannot
+// be decoded return a *DatDecodeError.
+func (c *DatCache) Decoded(datPath string, info os.FileInfo) (string, error) {
+	file, err := os.Open(datPath)
+	if err != nil {
+		return "", err
+	}
+	header := make([]byte, datHeaderSize)
+	n, _ := io.ReadFull(file, header)
+	file.Close()
+	if datVersion(header[:n]) == DatVersionXor && n >= 10 {
+		if decodeByte, _, err := findDecodeByte(header); err == nil && decodeByte == 0 {
+			return datPath, nil
+		}
+	}
+
+	sum := sha1.Sum([]byte(fmt.Sprintf("%s|%d|%d", datPath, info.Size(), info.ModTime().UnixNano())))
+	cachePath := filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+	if _, err := os.Stat(cachePath); err == nil {
+		now := time.Now()
+		os.Chtimes(cachePath, now, now)
+		return cachePath, nil
+	}
+
+	data, err := os.ReadFile(datPath)
+	if err != nil {
+		return "", err
+	}
+	decoded, _, err := decodeDatData(data)
+	if err != nil {
+		return "", &DatDecodeError{Path: datPath, Version: datVersion(data), Err: err}
+	}
+
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return "", err
+	}
+	if err := c.write(cachePath, decoded); err != nil {
+		return "", err
+	}
+	c.add(int64(len(decoded)))
+
+	return cachePath, nil
+}
+
+// write goes through a temporary file so that concurrent requests never
+// read a partial image.
+func (c *DatCache) write(cachePath string, data []byte) error {
+	tmp, err := os.CreateTemp(c.dir, "decode-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), cachePath)
+}
+
+func (c *DatCache) add(size int64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if !c.loaded {
+		c.size = 0
+		entries, _ := os.ReadDir(c.dir)
+		for _, entry := range entries {
+			if info, err := entry.Info(); err == nil && !info.IsDir() {
+				c.size += info.Size()
+			}
+		}
+		c.loaded = true
+	} else {
+		c.size += size
+	}
+
+	if c.size > c.maxSize {
+		c.prune()
+	}
+}
+
+// prune removes the least recently used files until the cache is back to
+// three quarters of its limit, so it is not pruned again on every miss.
+func (c *DatCache) prune() {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		log.Println("DatCache ReadDir failed:", err)
+		return
+	}
+
+	infos := make([]os.FileInfo, 0, len(entries))
+	c.size = 0
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || info.IsDir() || strings.HasPrefix(info.Name(), "decode-") {
+			continue
+		}
+		infos = append(infos, info)
+		c.size += info.Size()
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+
+	target := c.maxSize / 4 * 3
+	for _, info := range infos {
+		if c.size <= target {
+			break
+		}
+		if err := os.Remove(filepath.Join(c.dir, info.Name())); err != nil {
+			continue
+		}
+		c.size -= info.Size()
+	}
+}
@@ -12,7 +12,7 @@ func (P *WechatDataProvider) weChatExportUserDataDBByUserName(userName, exportPa
 
 a. 检查目标文件是否存在：
 ```go
-exUserDataDBPath := exportPath + "\\" + UserDataDB
+exUserDataDBPath := filepath.Join(exportPath, UserDataDB)
 if _, err := os.Stat(exUserDataDBPath); err == nil {
     log.Println("exist", exUserDataDBPath)
     return errors.New("exist " + exUserDataDBPath)
@@ -90,6 +90,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strconv"
@@ -171,6 +172,8 @@ type WeChatSession struct {
 	UserInfo WeChatUserInfo `json:"UserInfo"`
 	Time     uint64         `json:"Time"`
 	IsGroup  bool           `json:"IsGroup"`
+
+	DeletedInClient bool `json:"DeletedInClient"` // 会话只剩找回的消息，微信里已删除
 }
 
 type WeChatSessionList struct {
@@ -260,6 +263,7 @@ type WeChatMessage struct {
 	ChannelsInfo    ChannelsInfo   `json:"ChannelsInfo"`
 	MusicInfo       MusicInfo      `json:"MusicInfo"`
 	LocationInfo    LocationInfo   `json:"LocationInfo"`
+	DeletedInClient bool           `json:"DeletedInClient"` // 只存在于找回的消息中，微信里已删除
 	compressContent []byte
 	bytesExtra      []byte
 }
@@ -323,7 +327,7 @@ type WeChatBookMarkList struct {
 
 type wechatMsgDB struct {
 	path      string
-	db        *sql.DB
+	db        *wechatDB
 	startTime int64
 	endTime   int64
 }
@@ -331,10 +335,13 @@ type wechatMsgDB struct {
 type WechatDataProvider struct {
 	resPath       string
 	prefixResPath string
-	microMsg      *sql.DB
-	openIMContact *sql.DB
-	userData      *sql.DB
+	microMsg      *wechatDB
+	openIMContact *wechatDB
+	userData      *wechatDB
 	msgDBs        []*wechatMsgDB
+	recovered     *wechatDB // 从旧备份找回的消息，没有时为 nil
+	searchBackend wechatSearchBackend
+	contactFTS    *wechatContactFTS
 	userInfoMap   map[string]WeChatUserInfo
 	userInfoMtx   sync.Mutex
 
@@ -376,76 +383,82 @@ func (c byName) Less(i, j int) bool {
 }
 func (c byName) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
 
+// CreateWechatDataProvider 打开导出的账号目录 resPath。加密存放的数据库用 SetBackupPassphrase
+// 设置的口令解密到内存中，口令错误时返回 ErrBackupLocked。
 func CreateWechatDataProvider(resPath string, prefixRes string) (*WechatDataProvider, error) {
 	provider := &WechatDataProvider{}
 	provider.resPath = resPath
-	provider.prefixResPath = prefixRes
+	provider.prefixResPath = strings.TrimSuffix(utils.SlashPath(prefixRes), "/")
 	provider.msgDBs = make([]*wechatMsgDB, 0)
 	log.Println(resPath)
 
 	userName := filepath.Base(resPath)
-	MicroMsgDBPath := resPath + "\\Msg\\" + MicroMsgDB
+	MicroMsgDBPath := filepath.Join(resPath, "Msg", MicroMsgDB)
 	if _, err := os.Stat(MicroMsgDBPath); err != nil {
 		log.Println("CreateWechatDataProvider failed", MicroMsgDBPath, err)
 		return provider, err
 	}
-	microMsg, err := sql.Open("sqlite3", MicroMsgDBPath)
+	microMsg, err := wechatOpenDB(MicroMsgDBPath)
 	if err != nil {
 		log.Printf("open db %s error: %v", MicroMsgDBPath, err)
 		return provider, err
 	}
 
-	var openIMContact *sql.DB
-	OpenIMContactDBPath := resPath + "\\Msg\\" + OpenIMContactDB
+	var openIMContact *wechatDB
+	OpenIMContactDBPath := filepath.Join(resPath, "Msg", OpenIMContactDB)
 	if _, err := os.Stat(OpenIMContactDBPath); err == nil {
-		openIMContact, err = sql.Open("sqlite3", OpenIMContactDBPath)
+		openIMContact, err = wechatOpenDB(OpenIMContactDBPath)
 		if err != nil {
 			log.Printf("open db %s error: %v", OpenIMContactDBPath, err)
 		}
 	}
 
-	UserDataDBPath := resPath + "\\Msg\\" + UserDataDB
-	userData := openUserDataDB(UserDataDBPath)
+	// 快照中的文件是共享的硬链接，书签和恢复的消息要写入自己的副本。
+	for _, name := range []string{UserDataDB, RecoveredDB} {
+		if err := unshareSnapshotFile(resPath, filepath.Join(resPath, "Msg", name)); err != nil {
+			log.Printf("unshare %s error: %v", name, err)
+			return provider, err
+		}
+	}
+
+	UserDataDBPath := filepath.Join(resPath, "Msg", UserDataDB)
+	userData := openUserDataDB(UserDataDBPath, microMsg.locked != nil)
 	if userData == nil {
 		log.Printf("open db %s error: %v", UserDataDBPath, err)
 		return provider, err
 	}
 
-	msgDBPath := fmt.Sprintf("%s\\Msg\\Multi\\MSG.db", provider.resPath)
-	if _, err := os.Stat(msgDBPath); err == nil {
-		log.Println("msgDBPath", msgDBPath)
-		msgDB, err := wechatOpenMsgDB(msgDBPath)
-		if err != nil {
-			log.Printf("open db %s error: %v", msgDBPath, err)
-		} else {
-			provider.msgDBs = append(provider.msgDBs, msgDB)
-			log.Printf("MSG.db start %d - %d end\n", msgDB.startTime, msgDB.endTime)
-			provider.IsShareData = true
-		}
-	}
-
-	index := 0
-	for {
-		msgDBPath := fmt.Sprintf("%s\\Msg\\Multi\\MSG%d.db", provider.resPath, index)
-		if _, err := os.Stat(msgDBPath); err != nil {
-			log.Println("msgDBPath end", msgDBPath)
-			break
-		}
-
+	for _, msgDBPath := range wechatMsgDBPaths(provider.resPath) {
 		msgDB, err := wechatOpenMsgDB(msgDBPath)
 		if err != nil {
 			log.Printf("open db %s error: %v", msgDBPath, err)
-			index += 1
 			continue
 		}
 		provider.msgDBs = append(provider.msgDBs, msgDB)
-		log.Printf("MSG%d.db start %d - %d end\n", index, msgDB.startTime, msgDB.endTime)
-		index += 1
+		log.Printf("%s start %d - %d end\n", filepath.Base(msgDBPath), msgDB.startTime, msgDB.endTime)
+		// 单个会话导出分享的数据只有 MSG.db
+		if filepath.Base(msgDBPath) == "MSG.db" {
+			provider.IsShareData = true
+		}
 	}
 	sort.Sort(byTime(provider.msgDBs))
 	for _, db := range provider.msgDBs {
 		log.Printf("%s start %d - %d end\n", db.path, db.startTime, db.endTime)
 	}
+
+	if recovered, err := wechatOpenRecovered(resPath, false, microMsg.locked != nil); err == nil {
+		provider.recovered = recovered
+	} else if !os.IsNotExist(err) {
+		log.Printf("open db %s error: %v", RecoveredDB, err)
+	}
+
+	provider.searchBackend = wechatOpenSearchBackend(resPath, provider.msgDBs)
+	contactFTSPath := filepath.Join(resPath, "Msg", FTSContactDB)
+	if contactFTS, err := wechatOpenContactFTS(contactFTSPath); err == nil {
+		provider.contactFTS = contactFTS
+	} else if !os.IsNotExist(err) {
+		log.Printf("open db %s error: %v", contactFTSPath, err)
+	}
 	provider.userInfoMap = make(map[string]WeChatUserInfo)
 	provider.microMsg = microMsg
 	provider.openIMContact = openIMContact
@@ -496,6 +509,27 @@ func (P *WechatDataProvider) WechatWechatDataProviderClose() {
 			log.Println("db close:", err)
 		}
 	}
+
+	if P.recovered != nil {
+		err := P.recovered.Close()
+		if err != nil {
+			log.Println("db close:", err)
+		}
+	}
+
+	if P.searchBackend != nil {
+		err := P.searchBackend.Close()
+		if err != nil {
+			log.Println("db close:", err)
+		}
+	}
+
+	if P.contactFTS != nil {
+		err := P.contactFTS.Close()
+		if err != nil {
+			log.Println("db close:", err)
+		}
+	}
 	log.Println("WechatWechatDataProviderClose:", P.resPath)
 }
 
@@ -503,9 +537,9 @@ func (P *WechatDataProvider) WechatGetUserInfoByName(name string) (*WeChatUserIn
 	info := &WeChatUserInfo{}
 
 	var UserName, Alias, ReMark, NickName string
-	querySql := fmt.Sprintf("select ifnull(UserName,'') as UserName, ifnull(Alias,'') as Alias, ifnull(ReMark,'') as ReMark, ifnull(NickName,'') as NickName from Contact where UserName='%s';", name)
+	querySql := "select ifnull(UserName,'') as UserName, ifnull(Alias,'') as Alias, ifnull(ReMark,'') as ReMark, ifnull(NickName,'') as NickName from Contact where UserName=?;"
 	// log.Println(querySql)
-	err := P.microMsg.QueryRow(querySql).Scan(&UserName, &Alias, &ReMark, &NickName)
+	err := P.microMsg.queryRow(querySql, name).Scan(&UserName, &Alias, &ReMark, &NickName)
 	if err != nil {
 		// log.Println("not found User:", err)
 		return info, err
@@ -514,9 +548,9 @@ func (P *WechatDataProvider) WechatGetUserInfoByName(name string) (*WeChatUserIn
 	// log.Printf("UserName %s, Alias %s, ReMark %s, NickName %s\n", UserName, Alias, ReMark, NickName)
 
 	var smallHeadImgUrl, bigHeadImgUrl string
-	querySql = fmt.Sprintf("select ifnull(smallHeadImgUrl,'') as smallHeadImgUrl, ifnull(bigHeadImgUrl,'') as bigHeadImgUrl from ContactHeadImgUrl where usrName='%s';", UserName)
+	querySql = "select ifnull(smallHeadImgUrl,'') as smallHeadImgUrl, ifnull(bigHeadImgUrl,'') as bigHeadImgUrl from ContactHeadImgUrl where usrName=?;"
 	// log.Println(querySql)
-	err = P.microMsg.QueryRow(querySql).Scan(&smallHeadImgUrl, &bigHeadImgUrl)
+	err = P.microMsg.queryRow(querySql, UserName).Scan(&smallHeadImgUrl, &bigHeadImgUrl)
 	if err != nil {
 		log.Println("not find headimg", err)
 	}
@@ -529,8 +563,9 @@ func (P *WechatDataProvider) WechatGetUserInfoByName(name string) (*WeChatUserIn
 	info.BigHeadImgUrl = bigHeadImgUrl
 	info.IsGroup = strings.HasSuffix(UserName, "@chatroom")
 
-	localHeadImgPath := fmt.Sprintf("%s\\FileStorage\\HeadImage\\%s.headimg", P.resPath, name)
-	relativePath := fmt.Sprintf("%s\\FileStorage\\HeadImage\\%s.headimg", P.prefixResPath, name)
+	relativePath := "FileStorage/HeadImage/" + name + ".headimg"
+	localHeadImgPath := P.resLocal(relativePath)
+	relativePath = P.resURL(relativePath)
 	if _, err = os.Stat(localHeadImgPath); err == nil {
 		info.LocalHeadImgUrl = relativePath
 	}
@@ -542,10 +577,10 @@ func (P *WechatDataProvider) WechatGetOpenIMMUserInfoByName(name string) (*WeCha
 	info := &WeChatUserInfo{}
 
 	var UserName, ReMark, NickName string
-	querySql := fmt.Sprintf("select ifnull(UserName,'') as UserName, ifnull(ReMark,'') as ReMark, ifnull(NickName,'') as NickName from OpenIMContact where UserName='%s';", name)
+	querySql := "select ifnull(UserName,'') as UserName, ifnull(ReMark,'') as ReMark, ifnull(NickName,'') as NickName from OpenIMContact where UserName=?;"
 	// log.Println(querySql)
 	if P.openIMContact != nil {
-		err := P.openIMContact.QueryRow(querySql).Scan(&UserName, &ReMark, &NickName)
+		err := P.openIMContact.queryRow(querySql, name).Scan(&UserName, &ReMark, &NickName)
 		if err != nil {
 			log.Println("not found User:", err)
 			return info, err
@@ -555,9 +590,9 @@ func (P *WechatDataProvider) WechatGetOpenIMMUserInfoByName(name string) (*WeCha
 	log.Printf("UserName %s, ReMark %s, NickName %s\n", UserName, ReMark, NickName)
 
 	var smallHeadImgUrl, bigHeadImgUrl string
-	querySql = fmt.Sprintf("select ifnull(smallHeadImgUrl,'') as smallHeadImgUrl, ifnull(bigHeadImgUrl,'') as bigHeadImgUrl from ContactHeadImgUrl where usrName='%s';", UserName)
+	querySql = "select ifnull(smallHeadImgUrl,'') as smallHeadImgUrl, ifnull(bigHeadImgUrl,'') as bigHeadImgUrl from ContactHeadImgUrl where usrName=?;"
 	// log.Println(querySql)
-	err := P.microMsg.QueryRow(querySql).Scan(&smallHeadImgUrl, &bigHeadImgUrl)
+	err := P.microMsg.queryRow(querySql, UserName).Scan(&smallHeadImgUrl, &bigHeadImgUrl)
 	if err != nil {
 		log.Println("not find headimg", err)
 	}
@@ -570,8 +605,9 @@ func (P *WechatDataProvider) WechatGetOpenIMMUserInfoByName(name string) (*WeCha
 	info.BigHeadImgUrl = bigHeadImgUrl
 	info.IsGroup = strings.HasSuffix(UserName, "@chatroom")
 
-	localHeadImgPath := fmt.Sprintf("%s\\FileStorage\\HeadImage\\%s.headimg", P.resPath, name)
-	relativePath := fmt.Sprintf("%s\\FileStorage\\HeadImage\\%s.headimg", P.prefixResPath, name)
+	relativePath := "FileStorage/HeadImage/" + name + ".headimg"
+	localHeadImgPath := P.resLocal(relativePath)
+	relativePath = P.resURL(relativePath)
 	if _, err = os.Stat(localHeadImgPath); err == nil {
 		info.LocalHeadImgUrl = relativePath
 	}
@@ -583,8 +619,8 @@ func (P *WechatDataProvider) WeChatGetSessionList(pageIndex int, pageSize int) (
 	List := &WeChatSessionList{}
 	List.Rows = make([]WeChatSession, 0)
 
-	querySql := fmt.Sprintf("select ifnull(strUsrName,'') as strUsrName,ifnull(strNickName,'') as strNickName,ifnull(strContent,'') as strContent, nMsgType, nTime from Session order by nOrder desc limit %d, %d;", pageIndex*pageSize, pageSize)
-	dbRows, err := P.microMsg.Query(querySql)
+	querySql := "select ifnull(strUsrName,'') as strUsrName,ifnull(strNickName,'') as strNickName,ifnull(strContent,'') as strContent, nMsgType, nTime from Session order by nOrder desc limit ?, ?;"
+	dbRows, err := P.microMsg.query(querySql, pageIndex*pageSize, pageSize)
 	if err != nil {
 		log.Println(err)
 		return List, err
@@ -594,8 +630,10 @@ func (P *WechatDataProvider) WeChatGetSessionList(pageIndex int, pageSize int) (
 	var strUsrName, strNickName, strContent string
 	var nTime uint64
 	var nMsgType int
+	sessionRows := 0
 	for dbRows.Next() {
 		var session WeChatSession
+		sessionRows += 1
 		err = dbRows.Scan(&strUsrName, &strNickName, &strContent, &nMsgType, &nTime)
 		if err != nil {
 			log.Println(err)
@@ -621,6 +659,24 @@ func (P *WechatDataProvider) WeChatGetSessionList(pageIndex int, pageSize int) (
 		List.Total += 1
 	}
 
+	// Session 表翻完后，接着列出微信里整个删掉、只剩找回消息的会话。
+	if sessionRows < pageSize && P.recovered != nil {
+		var sessionCount int
+		if err := P.microMsg.queryRow("select count(*) from Session;").Scan(&sessionCount); err != nil {
+			log.Println(err)
+			return List, err
+		}
+		recovered, err := P.wechatRecoveredSessions()
+		if err != nil {
+			log.Println(err)
+			return List, err
+		}
+		start := min(max(pageIndex*pageSize-sessionCount, 0), len(recovered))
+		end := min(start+pageSize-sessionRows, len(recovered))
+		List.Rows = append(List.Rows, recovered[start:end]...)
+		List.Total += end - start
+	}
+
 	return List, nil
 }
 
@@ -647,6 +703,8 @@ func (P *WechatDataProvider) WeChatGetContactList(pageIndex int, pageSize int) (
 	return List, nil
 }
 
+// WeChatGetMessageListByTime 按时间分页获取会话消息，结果按时间倒序。
+// 从旧备份找回的消息（见 WeChatRecoverMessages）会合并进来，并标记 DeletedInClient。
 func (P *WechatDataProvider) WeChatGetMessageListByTime(userName string, time int64, pageSize int, direction Message_Search_Direction) (*WeChatMessageList, error) {
 
 	List := &WeChatMessageList{}
@@ -657,6 +715,7 @@ func (P *WechatDataProvider) WeChatGetMessageListByTime(userName string, time in
 	if direction == Message_Search_Both {
 		selectpageSize = pageSize / 2
 	}
+	forwardSize := selectpageSize
 	for direction == Message_Search_Forward || direction == Message_Search_Both {
 		selectList, err := P.weChatGetMessageListByTime(userName, selectTime, selectpageSize, Message_Search_Forward)
 		if err != nil {
@@ -676,11 +735,16 @@ func (P *WechatDataProvider) WeChatGetMessageListByTime(userName string, time in
 		}
 		log.Printf("Forward selectTime %d, selectpageSize %d\n", selectTime, selectpageSize)
 	}
+	if direction == Message_Search_Forward || direction == Message_Search_Both {
+		List.Rows = P.wechatMergeRecovered(List.Rows, userName, time, forwardSize, Message_Search_Forward)
+	}
 
 	selectTime = time
 	if direction == Message_Search_Both {
 		selectpageSize = pageSize / 2
 	}
+	backwardSize := selectpageSize
+	backward := make([]WeChatMessage, 0)
 	for direction == Message_Search_Backward || direction == Message_Search_Both {
 		selectList, err := P.weChatGetMessageListByTime(userName, selectTime, selectpageSize, Message_Search_Backward)
 		if err != nil {
@@ -693,13 +757,17 @@ func (P *WechatDataProvider) WeChatGetMessageListByTime(userName string, time in
 
 		selectTime = selectList.Rows[0].CreateTime + 1
 		selectpageSize -= selectList.Total
-		List.Total += selectList.Total
-		List.Rows = append(selectList.Rows, List.Rows...)
+		backward = append(selectList.Rows, backward...)
 		if selectpageSize <= 0 {
 			break
 		}
 		log.Printf("Backward selectTime %d, selectpageSize %d\n", selectTime, selectpageSize)
 	}
+	if direction == Message_Search_Backward || direction == Message_Search_Both {
+		backward = P.wechatMergeRecovered(backward, userName, time, backwardSize, Message_Search_Backward)
+		List.Rows = append(backward, List.Rows...)
+	}
+	List.Total = len(List.Rows)
 
 	return List, nil
 }
@@ -713,53 +781,26 @@ func (P *WechatDataProvider) weChatGetMessageListByTime(userName string, time in
 		return List, nil
 	}
 
-	sqlFormat := "select localId,MsgSvrID,Type,SubType,IsSender,CreateTime,ifnull(StrTalker,'') as StrTalker, ifnull(StrContent,'') as StrContent,ifnull(CompressContent,'') as CompressContent,ifnull(BytesExtra,'') as BytesExtra from MSG Where StrTalker='%s' And CreateTime<=%d order by Sequence desc limit %d;"
+	querySql := "select " + wechatMessageColumns + " from MSG Where StrTalker=? And CreateTime<=? order by Sequence desc limit ?;"
 	if direction == Message_Search_Backward {
-		sqlFormat = "select localId,MsgSvrID,Type,SubType,IsSender,CreateTime,ifnull(StrTalker,'') as StrTalker, ifnull(StrContent,'') as StrContent,ifnull(CompressContent,'') as CompressContent,ifnull(BytesExtra,'') as BytesExtra from ( select localId, MsgSvrID, Type, SubType, IsSender, CreateTime, Sequence, StrTalker, StrContent, CompressContent, BytesExtra FROM MSG Where StrTalker='%s' And CreateTime>%d order by Sequence asc limit %d) AS SubQuery order by Sequence desc;"
+		querySql = "select " + wechatMessageColumns + " from ( select localId, MsgSvrID, Type, SubType, IsSender, CreateTime, Sequence, StrTalker, StrContent, CompressContent, BytesExtra FROM MSG Where StrTalker=? And CreateTime>? order by Sequence asc limit ?) AS SubQuery order by Sequence desc;"
 	}
-	querySql := fmt.Sprintf(sqlFormat, userName, time, pageSize)
-	log.Println(querySql)
+	log.Println(querySql, userName, time, pageSize)
 
-	rows, err := P.msgDBs[index].db.Query(querySql)
+	rows, err := P.msgDBs[index].db.query(querySql, userName, time, pageSize)
 	if err != nil {
 		log.Printf("%s failed %v\n", querySql, err)
 		return List, nil
 	}
 	defer rows.Close()
-	var localId, Type, SubType, IsSender int
-	var MsgSvrID, CreateTime int64
-	var StrTalker, StrContent string
-	var CompressContent, BytesExtra []byte
 
 	for rows.Next() {
-		message := WeChatMessage{}
-		err = rows.Scan(&localId, &MsgSvrID, &Type, &SubType, &IsSender, &CreateTime,
-			&StrTalker, &StrContent, &CompressContent, &BytesExtra)
+		message, err := P.wechatScanMessage(rows.Scan)
 		if err != nil {
 			log.Println("rows.Scan failed", err)
 			return List, err
 		}
 
-		message.LocalId = localId
-		message.MsgSvrId = fmt.Sprintf("%d", MsgSvrID)
-		message.Type = Type
-		message.SubType = SubType
-		message.IsSender = IsSender
-		message.CreateTime = CreateTime
-		message.Talker = StrTalker
-		message.Content = systemMsgParse(Type, StrContent)
-		message.IsChatRoom = strings.HasSuffix(StrTalker, "@chatroom")
-		message.compressContent = make([]byte, len(CompressContent))
-		message.bytesExtra = make([]byte, len(BytesExtra))
-		copy(message.compressContent, CompressContent)
-		copy(message.bytesExtra, BytesExtra)
-		P.wechatMessageExtraHandle(&message)
-		P.wechatMessageGetUserInfo(&message)
-		P.wechatMessageEmojiHandle(&message)
-		P.wechatMessageCompressContentHandle(&message)
-		P.wechatMessageVoipHandle(&message)
-		P.wechatMessageVisitHandke(&message)
-		P.wechatMessageLocationHandke(&message)
 		List.Rows = append(List.Rows, message)
 		List.Total += 1
 	}
@@ -772,11 +813,61 @@ func (P *WechatDataProvider) weChatGetMessageListByTime(userName string, time in
 	return List, nil
 }
 
+// wechatMSGCopyColumns 是复制 MSG 表时带上的全部列，localId 由目标库重新分配。
+const wechatMSGCopyColumns = "TalkerId, MsgSvrID, Type, SubType, IsSender, CreateTime, Sequence, StatusEx, FlagEx, Status, MsgServerSeq, MsgSequence, StrTalker, StrContent, DisplayContent, Reserved0, Reserved1, Reserved2, Reserved3, Reserved4, Reserved5, Reserved6, CompressContent, BytesExtra, BytesTrans"
+
+const wechatMessageColumns = "localId,MsgSvrID,Type,SubType,IsSender,CreateTime,ifnull(StrTalker,'') as StrTalker, ifnull(StrContent,'') as StrContent,ifnull(CompressContent,'') as CompressContent,ifnull(BytesExtra,'') as BytesExtra"
+
+// wechatScanMessage builds a message from a row selected with wechatMessageColumns.
+func (P *WechatDataProvider) wechatScanMessage(scan func(dest ...interface{}) error) (WeChatMessage, error) {
+	message := WeChatMessage{}
+	var localId, Type, SubType, IsSender int
+	var MsgSvrID, CreateTime int64
+	var StrTalker, StrContent string
+	var CompressContent, BytesExtra []byte
+
+	err := scan(&localId, &MsgSvrID, &Type, &SubType, &IsSender, &CreateTime,
+		&StrTalker, &StrContent, &CompressContent, &BytesExtra)
+	if err != nil {
+		return message, err
+	}
+
+	message.LocalId = localId
+	message.MsgSvrId = fmt.Sprintf("%d", MsgSvrID)
+	message.Type = Type
+	message.SubType = SubType
+	message.IsSender = IsSender
+	message.CreateTime = CreateTime
+	message.Talker = StrTalker
+	message.Content = systemMsgParse(Type, StrContent)
+	message.IsChatRoom = strings.HasSuffix(StrTalker, "@chatroom")
+	message.compressContent = make([]byte, len(CompressContent))
+	message.bytesExtra = make([]byte, len(BytesExtra))
+	copy(message.compressContent, CompressContent)
+	copy(message.bytesExtra, BytesExtra)
+	P.wechatMessageExtraHandle(&message)
+	P.wechatMessageGetUserInfo(&message)
+	P.wechatMessageEmojiHandle(&message)
+	P.wechatMessageCompressContentHandle(&message)
+	P.wechatMessageVoipHandle(&message)
+	P.wechatMessageVisitHandke(&message)
+	P.wechatMessageLocationHandke(&message)
+
+	return message, nil
+}
+
 func (P *WechatDataProvider) WeChatGetMessageListByKeyWord(userName string, time int64, keyWord string, msgType string, pageSize int) (*WeChatMessageList, error) {
 	List := &WeChatMessageList{}
 	List.Rows = make([]WeChatMessage, 0)
 	List.KeyWord = keyWord
 	List.MsgType = msgType
+	if keyWord != "" && P.searchBackend != nil {
+		indexList, err := P.wechatGetMessageListByIndex(userName, time, keyWord, msgType, pageSize)
+		if err == nil {
+			return indexList, nil
+		}
+		log.Println("wechatGetMessageListByIndex failed:", err)
+	}
 	_time := time
 	selectPagesize := pageSize
 	if keyWord != "" || msgType != "" {
@@ -909,10 +1000,9 @@ func (P *WechatDataProvider) WeChatGetMessageDate(userName string) (*WeChatMessa
 			return messageData, nil
 		}
 
-		sqlFormat := " SELECT DISTINCT strftime('%%Y-%%m-%%d', datetime(CreateTime+28800, 'unixepoch')) FROM MSG WHERE StrTalker='%s' order by CreateTime desc;"
-		querySql := fmt.Sprintf(sqlFormat, userName)
+		querySql := " SELECT DISTINCT strftime('%Y-%m-%d', datetime(CreateTime+28800, 'unixepoch')) FROM MSG WHERE StrTalker=? order by CreateTime desc;"
 
-		rows, err := P.msgDBs[index].db.Query(querySql)
+		rows, err := P.msgDBs[index].db.query(querySql, userName)
 		if err != nil {
 			log.Printf("%s failed %v\n", querySql, err)
 			return messageData, nil
@@ -951,11 +1041,10 @@ func (P *WechatDataProvider) WeChatGetChatRoomUserList(chatroom string) (*WeChat
 	userList.Users = make([]WeChatUserInfo, 0)
 	userList.Total = 0
 
-	sqlFormat := "select UserNameList from ChatRoom where ChatRoomName='%s';"
-	querySql := fmt.Sprintf(sqlFormat, chatroom)
+	querySql := "select UserNameList from ChatRoom where ChatRoomName=?;"
 
 	var userNameListStr string
-	err := P.microMsg.QueryRow(querySql).Scan(&userNameListStr)
+	err := P.microMsg.queryRow(querySql, chatroom).Scan(&userNameListStr)
 	if err != nil {
 		log.Println("Scan: ", err)
 		return nil, err
@@ -997,30 +1086,30 @@ func (P *WechatDataProvider) wechatMessageExtraHandle(msg *WeChatMessage) {
 		case 3:
 			if len(ext.Field2) > 0 {
 				if msg.Type == Wechat_Message_Type_Picture || msg.Type == Wechat_Message_Type_Video || msg.Type == Wechat_Message_Type_Misc {
-					msg.ThumbPath = P.prefixResPath + ext.Field2[len(P.SelfInfo.UserName):]
+					msg.ThumbPath = P.wechatExtraPath(ext.Field2)
 				}
 
 				if msg.Type == Wechat_Message_Type_Misc && (msg.SubType == Wechat_Misc_Message_Music || msg.SubType == Wechat_Misc_Message_TingListen) {
-					msg.MusicInfo.ThumbPath = P.prefixResPath + ext.Field2[len(P.SelfInfo.UserName):]
+					msg.MusicInfo.ThumbPath = P.wechatExtraPath(ext.Field2)
 				} else if msg.Type == Wechat_Message_Type_Location {
-					msg.LocationInfo.ThumbPath = P.prefixResPath + ext.Field2[len(P.SelfInfo.UserName):]
+					msg.LocationInfo.ThumbPath = P.wechatExtraPath(ext.Field2)
 				}
 			}
 		case 4:
 			if len(ext.Field2) > 0 {
 				if msg.Type == Wechat_Message_Type_Misc && msg.SubType == Wechat_Misc_Message_File {
-					msg.FileInfo.FilePath = P.prefixResPath + ext.Field2[len(P.SelfInfo.UserName):]
-					msg.FileInfo.FileName = filepath.Base(ext.Field2)
+					msg.FileInfo.FilePath = P.wechatExtraPath(ext.Field2)
+					msg.FileInfo.FileName = path.Base(utils.SlashPath(ext.Field2))
 				} else if msg.Type == Wechat_Message_Type_Picture || msg.Type == Wechat_Message_Type_Video || msg.Type == Wechat_Message_Type_Misc {
-					msg.ImagePath = P.prefixResPath + ext.Field2[len(P.SelfInfo.UserName):]
-					msg.VideoPath = P.prefixResPath + ext.Field2[len(P.SelfInfo.UserName):]
+					msg.ImagePath = P.wechatExtraPath(ext.Field2)
+					msg.VideoPath = P.wechatExtraPath(ext.Field2)
 				}
 			}
 		}
 	}
 
 	if msg.Type == Wechat_Message_Type_Voice {
-		msg.VoicePath = fmt.Sprintf("%s\\FileStorage\\Voice\\%s.mp3", P.prefixResPath, msg.MsgSvrId)
+		msg.VoicePath = P.resURL("FileStorage/Voice/" + msg.MsgSvrId + ".mp3")
 	}
 }
 
@@ -1069,25 +1158,35 @@ func (e *xmlDocument) FindElementValue(path string) string {
 	return ""
 }
 
-func (P *WechatDataProvider) wechatMessageCompressContentHandle(msg *WeChatMessage) {
-	if len(msg.compressContent) == 0 {
-		return
-	}
-
-	unCompressContent := make([]byte, len(msg.compressContent)*10)
-	ulen, err := lz4.UncompressBlock(msg.compressContent, unCompressContent)
+func wechatUncompressContent(compressContent []byte) (*xmlDocument, error) {
+	unCompressContent := make([]byte, len(compressContent)*10)
+	ulen, err := lz4.UncompressBlock(compressContent, unCompressContent)
 	if err != nil {
-		log.Println("UncompressBlock failed:", err, msg.MsgSvrId)
-		return
+		return nil, fmt.Errorf("UncompressBlock failed: %v", err)
+	}
+	if ulen == 0 {
+		return nil, errors.New("UncompressBlock empty")
 	}
 
 	compMsg := etree.NewDocument()
 	if err := compMsg.ReadFromBytes(unCompressContent[:ulen-1]); err != nil {
 		// os.WriteFile("D:\\tmp\\"+string(msg.LocalId)+".xml", unCompressContent[:ulen], 0600)
-		log.Println("ReadFromBytes failed:", err)
+		return nil, fmt.Errorf("ReadFromBytes failed: %v", err)
+	}
+
+	return NewxmlDocument(compMsg), nil
+}
+
+func (P *WechatDataProvider) wechatMessageCompressContentHandle(msg *WeChatMessage) {
+	if len(msg.compressContent) == 0 {
+		return
+	}
+
+	root, err := wechatUncompressContent(msg.compressContent)
+	if err != nil {
+		log.Println("wechatUncompressContent failed:", err, msg.MsgSvrId)
 		return
 	}
-	root := NewxmlDocument(compMsg)
 	if msg.Type == Wechat_Message_Type_Misc && isLinkSubType(msg.SubType) {
 		msg.LinkInfo.Title = root.FindElementValue("/msg/appmsg/title")
 		msg.LinkInfo.Description = root.FindElementValue("/msg/appmsg/des")
@@ -1180,8 +1279,9 @@ func (P *WechatDataProvider) wechatMessageVisitHandke(msg *WeChatMessage) {
 		msg.VisitInfo.NickName = attr["nickname"]
 		msg.VisitInfo.SmallHeadImgUrl = attr["smallheadimgurl"]
 		msg.VisitInfo.BigHeadImgUrl = attr["bigheadimgurl"]
-		localHeadImgPath := fmt.Sprintf("%s\\FileStorage\\HeadImage\\%s.headimg", P.resPath, userName)
-		relativePath := fmt.Sprintf("%s\\FileStorage\\HeadImage\\%s.headimg", P.prefixResPath, userName)
+		relativePath := "FileStorage/HeadImage/" + userName + ".headimg"
+		localHeadImgPath := P.resLocal(relativePath)
+		relativePath = P.resURL(relativePath)
 		if _, err = os.Stat(localHeadImgPath); err == nil {
 			msg.VisitInfo.LocalHeadImgUrl = relativePath
 		}
@@ -1232,17 +1332,17 @@ func (P *WechatDataProvider) wechatFindDBIndex(userName string, time int64, dire
 			}
 
 			rowId := 0
-			querySql := fmt.Sprintf("select rowid from Name2ID where UsrName='%s';", userName)
-			err := msgDB.db.QueryRow(querySql).Scan(&rowId)
+			querySql := "select rowid from Name2ID where UsrName=?;"
+			err := msgDB.db.queryRow(querySql, userName).Scan(&rowId)
 			if err != nil {
 				log.Printf("Scan: %v\n", err)
 				index += 1
 				continue
 			}
 
-			querySql = fmt.Sprintf(" select rowid from MSG where StrTalker='%s' AND CreateTime<=%d limit 1;", userName, time)
-			log.Printf("in %s, %s\n", msgDB.path, querySql)
-			err = msgDB.db.QueryRow(querySql).Scan(&rowId)
+			querySql = " select rowid from MSG where StrTalker=? AND CreateTime<=? limit 1;"
+			log.Printf("in %s, %s %s %d\n", msgDB.path, querySql, userName, time)
+			err = msgDB.db.queryRow(querySql, userName, time).Scan(&rowId)
 			if err != nil {
 				log.Printf("Scan: %v\n", err)
 				index += 1
@@ -1266,17 +1366,17 @@ func (P *WechatDataProvider) wechatFindDBIndex(userName string, time int64, dire
 			}
 
 			rowId := 0
-			querySql := fmt.Sprintf("select rowid from Name2ID where UsrName='%s';", userName)
-			err := msgDB.db.QueryRow(querySql).Scan(&rowId)
+			querySql := "select rowid from Name2ID where UsrName=?;"
+			err := msgDB.db.queryRow(querySql, userName).Scan(&rowId)
 			if err != nil {
 				log.Printf("Scan: %v\n", err)
 				index -= 1
 				continue
 			}
 
-			querySql = fmt.Sprintf(" select rowid from MSG where StrTalker='%s' AND CreateTime>%d limit 1;", userName, time)
-			log.Printf("in %s, %s\n", msgDB.path, querySql)
-			err = msgDB.db.QueryRow(querySql).Scan(&rowId)
+			querySql = " select rowid from MSG where StrTalker=? AND CreateTime>? limit 1;"
+			log.Printf("in %s, %s %s %d\n", msgDB.path, querySql, userName, time)
+			err = msgDB.db.queryRow(querySql, userName, time).Scan(&rowId)
 			if err != nil {
 				log.Printf("Scan: %v\n", err)
 				index -= 1
@@ -1293,10 +1393,9 @@ func (P *WechatDataProvider) wechatGetLastMessageCreateTime(userName string, ind
 	if index >= len(P.msgDBs) {
 		return -1
 	}
-	sqlFormat := "SELECT CreateTime FROM MSG WHERE StrTalker='%s' order by CreateTime asc limit 1;"
-	querySql := fmt.Sprintf(sqlFormat, userName)
+	querySql := "SELECT CreateTime FROM MSG WHERE StrTalker=? order by CreateTime asc limit 1;"
 	var lastTime int64
-	err := P.msgDBs[index].db.QueryRow(querySql).Scan(&lastTime)
+	err := P.msgDBs[index].db.queryRow(querySql, userName).Scan(&lastTime)
 	if err != nil {
 		log.Println("select DB lastTime failed:", index, ":", err)
 		return -1
@@ -1355,7 +1454,7 @@ func weChatMessageTypeFilter(msg *WeChatMessage, msgType string) bool {
 func wechatOpenMsgDB(path string) (*wechatMsgDB, error) {
 	msgDB := wechatMsgDB{}
 
-	db, err := sql.Open("sqlite3", path)
+	db, err := wechatOpenDB(path)
 	if err != nil {
 		log.Printf("open db %s error: %v", path, err)
 		return nil, err
@@ -1363,7 +1462,7 @@ func wechatOpenMsgDB(path string) (*wechatMsgDB, error) {
 	msgDB.db = db
 	msgDB.path = path
 	querySql := "select CreateTime from MSG order by CreateTime asc limit 1;"
-	err = msgDB.db.QueryRow(querySql).Scan(&msgDB.startTime)
+	err = msgDB.db.queryRow(querySql).Scan(&msgDB.startTime)
 	if err != nil {
 		log.Println("select DB startTime failed:", path, ":", err)
 		msgDB.db.Close()
@@ -1371,7 +1470,7 @@ func wechatOpenMsgDB(path string) (*wechatMsgDB, error) {
 	}
 
 	querySql = "select CreateTime from MSG order by CreateTime desc limit 1;"
-	err = msgDB.db.QueryRow(querySql).Scan(&msgDB.endTime)
+	err = msgDB.db.queryRow(querySql).Scan(&msgDB.endTime)
 	if err != nil {
 		log.Println("select DB endTime failed:", path, ":", err)
 		msgDB.db.Close()
@@ -1414,8 +1513,8 @@ func (P *WechatDataProvider) wechatGetAllContact() (*WeChatContactList, error) {
 	List := &WeChatContactList{}
 	List.Users = make([]WeChatContact, 0)
 
-	querySql := fmt.Sprintf("select ifnull(UserName,'') as UserName,Reserved1,Reserved2,ifnull(PYInitial,'') as PYInitial,ifnull(QuanPin,'') as QuanPin,ifnull(RemarkPYInitial,'') as RemarkPYInitial,ifnull(RemarkQuanPin,'') as RemarkQuanPin from Contact desc;")
-	dbRows, err := P.microMsg.Query(querySql)
+	querySql := "select ifnull(UserName,'') as UserName,Reserved1,Reserved2,ifnull(PYInitial,'') as PYInitial,ifnull(QuanPin,'') as QuanPin,ifnull(RemarkPYInitial,'') as RemarkPYInitial,ifnull(RemarkQuanPin,'') as RemarkQuanPin from Contact desc;"
+	dbRows, err := P.microMsg.query(querySql)
 	if err != nil {
 		log.Println(err)
 		return List, err
@@ -1454,13 +1553,13 @@ func (P *WechatDataProvider) wechatGetAllContact() (*WeChatContactList, error) {
 }
 
 func WechatGetAccountInfo(resPath, prefixRes, accountName string) (*WeChatAccountInfo, error) {
-	MicroMsgDBPath := resPath + "\\Msg\\" + MicroMsgDB
+	MicroMsgDBPath := filepath.Join(resPath, "Msg", MicroMsgDB)
 	if _, err := os.Stat(MicroMsgDBPath); err != nil {
 		log.Println("MicroMsgDBPath:", MicroMsgDBPath, err)
 		return nil, err
 	}
 
-	microMsg, err := sql.Open("sqlite3", MicroMsgDBPath)
+	microMsg, err := wechatOpenDB(MicroMsgDBPath)
 	if err != nil {
 		log.Printf("open db %s error: %v", MicroMsgDBPath, err)
 		return nil, err
@@ -1470,9 +1569,9 @@ func WechatGetAccountInfo(resPath, prefixRes, accountName string) (*WeChatAccoun
 	info := &WeChatAccountInfo{}
 
 	var UserName, Alias, ReMark, NickName string
-	querySql := fmt.Sprintf("select ifnull(UserName,'') as UserName, ifnull(Alias,'') as Alias, ifnull(ReMark,'') as ReMark, ifnull(NickName,'') as NickName from Contact where UserName='%s';", accountName)
+	querySql := "select ifnull(UserName,'') as UserName, ifnull(Alias,'') as Alias, ifnull(ReMark,'') as ReMark, ifnull(NickName,'') as NickName from Contact where UserName=?;"
 	// log.Println(querySql)
-	err = microMsg.QueryRow(querySql).Scan(&UserName, &Alias, &ReMark, &NickName)
+	err = microMsg.queryRow(querySql, accountName).Scan(&UserName, &Alias, &ReMark, &NickName)
 	if err != nil {
 		log.Println("not found User:", err)
 		return nil, err
@@ -1481,9 +1580,9 @@ func WechatGetAccountInfo(resPath, prefixRes, accountName string) (*WeChatAccoun
 	log.Printf("UserName %s, Alias %s, ReMark %s, NickName %s\n", UserName, Alias, ReMark, NickName)
 
 	var smallHeadImgUrl, bigHeadImgUrl string
-	querySql = fmt.Sprintf("select ifnull(smallHeadImgUrl,'') as smallHeadImgUrl, ifnull(bigHeadImgUrl,'') as bigHeadImgUrl from ContactHeadImgUrl where usrName='%s';", UserName)
+	querySql = "select ifnull(smallHeadImgUrl,'') as smallHeadImgUrl, ifnull(bigHeadImgUrl,'') as bigHeadImgUrl from ContactHeadImgUrl where usrName=?;"
 	// log.Println(querySql)
-	err = microMsg.QueryRow(querySql).Scan(&smallHeadImgUrl, &bigHeadImgUrl)
+	err = microMsg.queryRow(querySql, UserName).Scan(&smallHeadImgUrl, &bigHeadImgUrl)
 	if err != nil {
 		log.Println("not find headimg", err)
 	}
@@ -1495,8 +1594,8 @@ func WechatGetAccountInfo(resPath, prefixRes, accountName string) (*WeChatAccoun
 	info.SmallHeadImgUrl = smallHeadImgUrl
 	info.BigHeadImgUrl = bigHeadImgUrl
 
-	localHeadImgPath := fmt.Sprintf("%s\\FileStorage\\HeadImage\\%s.headimg", resPath, accountName)
-	relativePath := fmt.Sprintf("%s\\FileStorage\\HeadImage\\%s.headimg", prefixRes, accountName)
+	localHeadImgPath := filepath.Join(resPath, "FileStorage", "HeadImage", accountName+".headimg")
+	relativePath := path.Join(utils.SlashPath(prefixRes), "FileStorage/HeadImage", accountName+".headimg")
 	if _, err = os.Stat(localHeadImgPath); err == nil {
 		info.LocalHeadImgUrl = relativePath
 	}
@@ -1516,16 +1615,38 @@ func (P *WechatDataProvider) urlconvertCacheName(url string, timestamp int64) st
 	t := time.Unix(timestamp, 0)
 	yearMonth := t.Format("2006-01")
 	md5String := utils.Hash256Sum([]byte(url))
-	realPath := fmt.Sprintf("%s\\FileStorage\\Cache\\%s\\%s.jpg", P.resPath, yearMonth, md5String)
-	path := fmt.Sprintf("%s\\FileStorage\\Cache\\%s\\%s.jpg", P.prefixResPath, yearMonth, md5String)
+	relPath := path.Join("FileStorage/Cache", yearMonth, md5String+".jpg")
 
-	if _, err := os.Stat(realPath); err == nil {
-		return path
+	if _, err := os.Stat(P.resLocal(relPath)); err == nil {
+		return P.resURL(relPath)
 	}
 
 	return url
 }
 
+// resURL turns a slash path relative to the account root into the path
+// handed to the frontend: the account prefix, e.g. /User/wxid_xxx, joined
+// with relPath. FileLoader serves it below the export directory.
+func (P *WechatDataProvider) resURL(relPath string) string {
+	return path.Join(P.prefixResPath, relPath)
+}
+
+// resLocal resolves a slash path relative to the account root on disk.
+func (P *WechatDataProvider) resLocal(relPath string) string {
+	return utils.LocalPath(P.resPath, relPath)
+}
+
+// wechatExtraPath makes a media path stored by WeChat ("wxid_xxx\FileStorage\...")
+// relative to the account root.
+func (P *WechatDataProvider) wechatExtraPath(field string) string {
+	relPath := utils.SlashPath(field)
+	if P.SelfInfo != nil {
+		relPath = strings.TrimPrefix(relPath, P.SelfInfo.UserName)
+	}
+
+	return P.resURL(relPath)
+}
+
 func isLinkSubType(subType int) bool {
 	targetSubTypes := map[int]bool{
 		Wechat_Misc_Message_CardLink:   true,
@@ -1538,18 +1659,26 @@ func isLinkSubType(subType int) bool {
 	return targetSubTypes[subType]
 }
 
-func openUserDataDB(path string) *sql.DB {
+// openUserDataDB 打开或新建 UserData.db。locked 表示备份是加密存放的，
+// 新建的库只放在内存中，关闭时加密写入 path，磁盘上不会出现明文。
+func openUserDataDB(path string, locked bool) *wechatDB {
 	if _, err := os.Stat(path); err == nil {
-		sql, err := sql.Open("sqlite3", path)
+		db, err := wechatOpenDB(path)
 		if err != nil {
 			log.Printf("open db %s error: %v", path, err)
 			return nil
 		}
 
-		return sql
+		return db
 	}
 
-	db, err := sql.Open("sqlite3", path)
+	var db *wechatDB
+	var err error
+	if locked {
+		db, err = wechatOpenMemDB(path, nil, getBackupPassphrase())
+	} else {
+		db, err = wechatOpenDB(path)
+	}
 	if err != nil {
 		log.Printf("open db %s error: %v", path, err)
 		return nil
@@ -1567,7 +1696,7 @@ func openUserDataDB(path string) *sql.DB {
 		Reserved3 TEXT
 	);`
 
-	_, err = db.Exec(createLastTimeTable)
+	_, err = db.exec(createLastTimeTable)
 	if err != nil {
 		log.Printf("create lastTime table failed: %v", err)
 		db.Close()
@@ -1587,7 +1716,7 @@ func openUserDataDB(path string) *sql.DB {
 		Reserved3 TEXT
 	);`
 
-	_, err = db.Exec(createBookMarkTable)
+	_, err = db.exec(createBookMarkTable)
 	if err != nil {
 		log.Printf("create bookMark table failed: %v", err)
 		db.Close()
@@ -1606,8 +1735,8 @@ func (P *WechatDataProvider) WeChatGetSessionLastTime(userName string) *WeChatLa
 
 	var timestamp int64
 	var messageId string
-	querySql := fmt.Sprintf("select timestamp, messageId from lastTime where userName='%s';", userName)
-	err := P.userData.QueryRow(querySql).Scan(&timestamp, &messageId)
+	querySql := "select timestamp, messageId from lastTime where userName=?;"
+	err := P.userData.queryRow(querySql, userName).Scan(&timestamp, &messageId)
 	if err != nil {
 		log.Println("select DB timestamp failed:", err)
 		return lastTime
@@ -1621,20 +1750,20 @@ func (P *WechatDataProvider) WeChatGetSessionLastTime(userName string) *WeChatLa
 
 func (P *WechatDataProvider) WeChatSetSessionLastTime(lastTime *WeChatLastTime) error {
 	var count int
-	querySql := fmt.Sprintf("select COUNT(*) from lastTime where userName='%s';", lastTime.UserName)
-	err := P.userData.QueryRow(querySql).Scan(&count)
+	querySql := "select COUNT(*) from lastTime where userName=?;"
+	err := P.userData.queryRow(querySql, lastTime.UserName).Scan(&count)
 	if err != nil {
 		log.Println("select DB timestamp count failed:", err)
 		return err
 	}
 
 	if count > 0 {
-		_, err := P.userData.Exec("UPDATE lastTime SET timestamp = ?, messageId = ? WHERE userName = ?", lastTime.Timestamp, lastTime.MessageId, lastTime.UserName)
+		_, err := P.userData.exec("UPDATE lastTime SET timestamp = ?, messageId = ? WHERE userName = ?", lastTime.Timestamp, lastTime.MessageId, lastTime.UserName)
 		if err != nil {
 			return fmt.Errorf("update timestamp failed: %v", err)
 		}
 	} else {
-		_, err := P.userData.Exec("INSERT INTO lastTime (userName, timestamp, messageId) VALUES (?, ?, ?)", lastTime.UserName, lastTime.Timestamp, lastTime.MessageId)
+		_, err := P.userData.exec("INSERT INTO lastTime (userName, timestamp, messageId) VALUES (?, ?, ?)", lastTime.UserName, lastTime.Timestamp, lastTime.MessageId)
 		if err != nil {
 			return fmt.Errorf("insert failed: %v", err)
 		}
@@ -1646,10 +1775,10 @@ func (P *WechatDataProvider) WeChatSetSessionLastTime(lastTime *WeChatLastTime)
 
 func (P *WechatDataProvider) WeChatSetSessionBookMask(userName, tag, info string) error {
 	markId := utils.Hash256Sum([]byte(info))
-	querySql := fmt.Sprintf("select COUNT(*) from bookMark where markId='%s';", markId)
+	querySql := "select COUNT(*) from bookMark where markId=?;"
 	var count int
 
-	err := P.userData.QueryRow(querySql).Scan(&count)
+	err := P.userData.queryRow(querySql, markId).Scan(&count)
 	if err != nil {
 		log.Println("select DB markId count failed:", err)
 		return err
@@ -1660,7 +1789,7 @@ func (P *WechatDataProvider) WeChatSetSessionBookMask(userName, tag, info string
 		return nil
 	}
 
-	_, err = P.userData.Exec("INSERT INTO bookMark (userName, markId, tag, info) VALUES (?, ?, ?, ?)", userName, markId, tag, info)
+	_, err = P.userData.exec("INSERT INTO bookMark (userName, markId, tag, info) VALUES (?, ?, ?, ?)", userName, markId, tag, info)
 	if err != nil {
 		return fmt.Errorf("insert failed: %v", err)
 	}
@@ -1669,17 +1798,17 @@ func (P *WechatDataProvider) WeChatSetSessionBookMask(userName, tag, info string
 }
 
 func (P *WechatDataProvider) WeChatDelSessionBookMask(markId string) error {
-	querySql := fmt.Sprintf("select COUNT(*) from bookMark where markId='%s';", markId)
+	querySql := "select COUNT(*) from bookMark where markId=?;"
 	var count int
 
-	err := P.userData.QueryRow(querySql).Scan(&count)
+	err := P.userData.queryRow(querySql, markId).Scan(&count)
 	if err != nil {
 		log.Println("select DB markId count failed:", err)
 		return err
 	}
 
 	if count > 0 {
-		_, err = P.userData.Exec("DELETE from bookMark where markId=?", markId)
+		_, err = P.userData.exec("DELETE from bookMark where markId=?", markId)
 		if err != nil {
 			return fmt.Errorf("delete failed: %v", err)
 		}
@@ -1695,10 +1824,10 @@ func (P *WechatDataProvider) WeChatGetSessionBookMaskList(userName string) (*WeC
 	markList.Marks = make([]WeChatBookMark, 0)
 	markList.Total = 0
 
-	querySql := fmt.Sprintf("select markId, tag, info from bookMark where userName='%s';", userName)
-	log.Println("querySql:", querySql)
+	querySql := "select markId, tag, info from bookMark where userName=?;"
+	log.Println("querySql:", querySql, userName)
 
-	rows, err := P.userData.Query(querySql)
+	rows, err := P.userData.query(querySql, userName)
 	if err != nil {
 		log.Printf("%s failed %v\n", querySql, err)
 		return markList, err
@@ -1743,8 +1872,8 @@ func (P *WechatDataProvider) WeChatExportDataByUserName(userName, exportPath str
 }
 
 func (P *WechatDataProvider) WeChatExportDBByUserName(userName, exportPath string) error {
-	msgPath := fmt.Sprintf("%s\\User\\%s\\Msg", exportPath, P.SelfInfo.UserName)
-	multiPath := fmt.Sprintf("%s\\Multi", msgPath)
+	msgPath := filepath.Join(exportPath, "User", P.SelfInfo.UserName, "Msg")
+	multiPath := filepath.Join(msgPath, "Multi")
 	if _, err := os.Stat(multiPath); err != nil {
 		if err := os.MkdirAll(multiPath, 0644); err != nil {
 			log.Printf("MkdirAll %s failed: %v\n", multiPath, err)
@@ -1780,7 +1909,7 @@ func (P *WechatDataProvider) WeChatExportDBByUserName(userName, exportPath strin
 }
 
 func (P *WechatDataProvider) weChatExportMicroMsgDBByUserName(userName, exportPath string) error {
-	exMicroMsgDBPath := exportPath + "\\" + MicroMsgDB
+	exMicroMsgDBPath := filepath.Join(exportPath, MicroMsgDB)
 	if _, err := os.Stat(exMicroMsgDBPath); err == nil {
 		log.Println("exist", exMicroMsgDBPath)
 		return errors.New("exist " + exMicroMsgDBPath)
@@ -1877,7 +2006,7 @@ func (P *WechatDataProvider) weChatExportMicroMsgDBByUserName(userName, exportPa
 }
 
 func (P *WechatDataProvider) weChatExportMsgDBByUserName(userName, exportPath string) error {
-	exMsgDBPath := exportPath + "\\" + "MSG.db"
+	exMsgDBPath := filepath.Join(exportPath, "MSG.db")
 	if _, err := os.Stat(exMsgDBPath); err == nil {
 		log.Println("exist", exMsgDBPath)
 		return errors.New("exist " + exMsgDBPath)
@@ -1901,16 +2030,15 @@ func (P *WechatDataProvider) weChatExportMsgDBByUserName(userName, exportPath st
 		return err
 	}
 
-	columns := "TalkerId, MsgSvrID, Type, SubType, IsSender, CreateTime, Sequence, StatusEx, FlagEx, Status, MsgServerSeq, MsgSequence, StrTalker, StrContent, DisplayContent, Reserved0, Reserved1, Reserved2, Reserved3, Reserved4, Reserved5, Reserved6, CompressContent, BytesExtra, BytesTrans"
 	for _, msgDB := range P.msgDBs {
-		err = wechatCopyTableData(exMsgDB, msgDB.db, "MSG", columns, "StrTalker", []string{userName})
+		err = wechatCopyTableData(exMsgDB, msgDB.db, "MSG", wechatMSGCopyColumns, "StrTalker", []string{userName})
 		if err != nil {
 			log.Println("wechatCopyTableData MSG:", err)
 			return err
 		}
 	}
 
-	columns = "UsrName"
+	columns := "UsrName"
 	for _, msgDB := range P.msgDBs {
 		err = wechatCopyTableData(exMsgDB, msgDB.db, "Name2ID", columns, "UsrName", []string{userName})
 		if err != nil {
@@ -1923,7 +2051,7 @@ func (P *WechatDataProvider) weChatExportMsgDBByUserName(userName, exportPath st
 }
 
 func (P *WechatDataProvider) weChatExportUserDataDBByUserName(userName, exportPath string) error {
-	exUserDataDBPath := exportPath + "\\" + UserDataDB
+	exUserDataDBPath := filepath.Join(exportPath, UserDataDB)
 	if _, err := os.Stat(exUserDataDBPath); err == nil {
 		log.Println("exist", exUserDataDBPath)
 		return errors.New("exist " + exUserDataDBPath)
@@ -1988,7 +2116,7 @@ func (P *WechatDataProvider) weChatExportOpenIMContactDBByUserName(userName, exp
 		return nil
 	}
 
-	exOpenIMContactDBPath := exportPath + "\\" + OpenIMContactDB
+	exOpenIMContactDBPath := filepath.Join(exportPath, OpenIMContactDB)
 	if _, err := os.Stat(exOpenIMContactDBPath); err == nil {
 		log.Println("exist", exOpenIMContactDBPath)
 		return errors.New("exist " + exOpenIMContactDBPath)
@@ -2037,13 +2165,12 @@ func (P *WechatDataProvider) weChatExportOpenIMContactDBByUserName(userName, exp
 	return nil
 }
 
-func wechatCopyDBTables(dts, src *sql.DB, tables []string) error {
+func wechatCopyDBTables(dts *sql.DB, src *wechatDB, tables []string) error {
 	for _, tab := range tables {
-		querySql := fmt.Sprintf("SELECT sql FROM sqlite_master WHERE tbl_name='%s';", tab)
+		querySql := "SELECT sql FROM sqlite_master WHERE tbl_name=?;"
 		// log.Println("querySql:", querySql)
-		rows, err := src.Query(querySql)
+		rows, err := src.query(querySql, tab)
 		if err != nil {
-			rows.Close()
 			log.Println("src.Query", err)
 			continue
 		}
@@ -2081,13 +2208,13 @@ func wechatCopyDBTables(dts, src *sql.DB, tables []string) error {
 	return nil
 }
 
-func wechatCopyTableData(dts, src *sql.DB, tableName, columns, conditionField string, conditionValue []string) error {
-	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s = '%s'", columns, tableName, conditionField, conditionValue[0])
+func wechatCopyTableData(dts *sql.DB, src *wechatDB, tableName, columns, conditionField string, conditionValue []string) error {
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s = ?", columns, tableName, conditionField)
 	if len(conditionValue) > 1 {
-		query = fmt.Sprintf("SELECT %s FROM %s WHERE %s IN ('%s')", columns, tableName, conditionField, strings.Join(conditionValue, "','"))
+		query = fmt.Sprintf("SELECT %s FROM %s WHERE %s IN (%s)", columns, tableName, conditionField, sqlPlaceholders(len(conditionValue)))
 	}
 	// log.Println("query:", query)
-	rows, err := src.Query(query)
+	rows, err := src.query(query, sqlArgs(conditionValue)...)
 	if err != nil {
 		return fmt.Errorf("query src failed: %v", err)
 	}
@@ -2148,13 +2275,13 @@ func (P *WechatDataProvider) WeChatExportFileByUserName(userName, exportPath str
 		if path == "" {
 			return
 		}
-		srcFile := topDir + path
+		srcFile := utils.LocalPath(topDir, path)
 		if _, err := os.Stat(srcFile); err != nil {
 			// log.Println("no exist:", srcFile)
 			return
 		}
 
-		dstFile := exportPath + path
+		dstFile := utils.LocalPath(exportPath, path)
 		dstDir := filepath.Dir(dstFile)
 		if _, err := os.Stat(dstDir); err != nil {
 			os.MkdirAll(dstDir, os.ModePerm)
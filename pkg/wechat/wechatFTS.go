@@ -0,0 +1,618 @@
+package wechat
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+	"wechatDataBackup/pkg/utils"
+
+	"github.com/beevik/etree"
+)
+
+// FTSIndexDB is our own full-text index, kept next to UserData.db. It
+// needs sqlite built with FTS5 (go build -tags sqlite_fts5); without it
+// the index is never created and searches fall back to scanning MSG.
+const FTSIndexDB = "FTSIndex.db"
+
+// ErrNoFTS5 is returned by UpdateWeChatSearchIndex when sqlite was built
+// without FTS5.
+var ErrNoFTS5 = errors.New("sqlite built without FTS5 (-tags sqlite_fts5)")
+
+var (
+	wechatFTS5Once sync.Once
+	wechatFTS5     bool
+)
+
+// wechatHasFTS5 reports whether the linked sqlite has the FTS5 trigram
+// tokenizer, by creating the index table in a throwaway memory database.
+func wechatHasFTS5() bool {
+	wechatFTS5Once.Do(func() {
+		db, err := sql.Open("sqlite3", ":memory:")
+		if err != nil {
+			return
+		}
+		defer db.Close()
+
+		_, err = db.Exec("CREATE VIRTUAL TABLE probe USING fts5(content, tokenize='trigram');")
+		wechatFTS5 = err == nil
+	})
+
+	return wechatFTS5
+}
+
+// the trigram tokenizer can only match keywords of at least three runes,
+// shorter ones use LIKE on the plain text table instead
+const wechatFTSMinRunes = 3
+
+// Indexed rows are checked against MSG in blocks of this many localIds.
+// WeChat rewrites rows in place when a message is recalled and deletes
+// them when the user does, a block whose signature changed is indexed
+// again.
+const wechatFTSBlockRows = 4096
+
+// wechatFTSBlockSig is the signature of every block of a shard, computed
+// without reading the message text.
+const wechatFTSBlockSig = "select localId/? as block, count(*)||':'||total(MsgSvrID%1000000007)||':'||total(Type)||':'||total(SubType)||':'||total(length(StrContent))||':'||total(length(CompressContent)) from MSG where localId<=? group by block;"
+
+type wechatFTSIndex struct {
+	db *wechatDB
+}
+
+type wechatFTSRef struct {
+	shard      string
+	localId    int64
+	msgSvrID   int64
+	talker     string
+	createTime int64
+	msgType    int
+	subType    int
+	isSender   int
+	content    string
+}
+
+func wechatOpenFTSIndex(path string, create bool) (*wechatFTSIndex, error) {
+	_, err := os.Stat(path)
+	if err != nil && !create {
+		return nil, err
+	}
+	created := err != nil
+
+	db, err := wechatOpenDB(path)
+	if err != nil {
+		return nil, err
+	}
+	index := &wechatFTSIndex{db: db}
+
+	if create {
+		err = index.createTables()
+	} else {
+		var count int
+		err = db.queryRow("select count(*) from sqlite_master where name='msgTextFTS';").Scan(&count)
+		if err == nil && count == 0 {
+			err = errors.New("msgTextFTS not exist")
+		}
+	}
+	if err != nil {
+		db.Close()
+		if created {
+			// leave no half-built index behind for the next open to trip on
+			os.Remove(path)
+		}
+		return nil, err
+	}
+
+	return index, nil
+}
+
+func (idx *wechatFTSIndex) createTables() error {
+	tables := []string{
+		`CREATE TABLE IF NOT EXISTS msgText (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			shard TEXT,
+			localId INTEGER,
+			msgSvrId INTEGER,
+			talker TEXT,
+			createTime INTEGER,
+			type INTEGER,
+			subType INTEGER,
+			isSender INTEGER,
+			content TEXT
+		);`,
+		`CREATE INDEX IF NOT EXISTS msgText_talker_time ON msgText (talker, createTime);`,
+		`CREATE INDEX IF NOT EXISTS msgText_time ON msgText (createTime);`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS msgText_shard_local ON msgText (shard, localId);`,
+		`CREATE VIRTUAL TABLE IF NOT EXISTS msgTextFTS USING fts5(content, content='msgText', content_rowid='id', tokenize='trigram');`,
+		`CREATE TABLE IF NOT EXISTS indexState (
+			shard TEXT PRIMARY KEY,
+			lastLocalId INTEGER
+		);`,
+		`CREATE TABLE IF NOT EXISTS indexBlock (
+			shard TEXT,
+			block INTEGER,
+			sig TEXT,
+			PRIMARY KEY (shard, block)
+		);`,
+	}
+
+	for _, table := range tables {
+		if _, err := idx.db.Exec(table); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (idx *wechatFTSIndex) Close() error {
+	return idx.db.Close()
+}
+
+// UpdateWeChatSearchIndex adds the MSG rows that are not indexed yet to
+// the full-text index of the exported account at resPath, indexes again the
+// blocks of rows WeChat changed or deleted since, and returns how many rows
+// were added.
+func UpdateWeChatSearchIndex(resPath string) (int, error) {
+	if !wechatHasFTS5() {
+		return 0, ErrNoFTS5
+	}
+	if err := unshareSnapshotFile(resPath, filepath.Join(resPath, "Msg", FTSIndexDB)); err != nil {
+		return 0, err
+	}
+	index, err := wechatOpenFTSIndex(filepath.Join(resPath, "Msg", FTSIndexDB), true)
+	if err != nil {
+		return 0, err
+	}
+	defer index.Close()
+
+	total := 0
+	for _, path := range wechatMsgDBPaths(resPath) {
+		count, err := index.updateShard(path)
+		if err != nil {
+			log.Printf("index %s failed: %v\n", path, err)
+			continue
+		}
+		log.Printf("index %s add %d\n", path, count)
+		total += count
+	}
+
+	return total, nil
+}
+
+func wechatMsgDBPaths(resPath string) []string {
+	paths := make([]string, 0)
+	msgDBPath := filepath.Join(resPath, "Msg", "Multi", "MSG.db")
+	if _, err := os.Stat(msgDBPath); err == nil {
+		paths = append(paths, msgDBPath)
+	}
+
+	for index := 0; ; index++ {
+		msgDBPath := filepath.Join(resPath, "Msg", "Multi", fmt.Sprintf("MSG%d.db", index))
+		if _, err := os.Stat(msgDBPath); err != nil {
+			break
+		}
+		paths = append(paths, msgDBPath)
+	}
+
+	return paths
+}
+
+func (idx *wechatFTSIndex) updateShard(path string) (int, error) {
+	shard := filepath.Base(path)
+	msgDB, err := wechatOpenDB(path)
+	if err != nil {
+		return 0, err
+	}
+	defer msgDB.Close()
+
+	var lastLocalId, maxLocalId int64
+	err = idx.db.queryRow("select lastLocalId from indexState where shard=?;", shard).Scan(&lastLocalId)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+
+	err = msgDB.queryRow("select ifnull(max(localId), 0) from MSG;").Scan(&maxLocalId)
+	if err != nil {
+		return 0, err
+	}
+
+	if maxLocalId < lastLocalId {
+		// the shard was replaced by an unrelated one, index it again
+		log.Printf("%s localId %d < %d, rebuild index\n", shard, maxLocalId, lastLocalId)
+		if err := idx.removeShard(shard); err != nil {
+			return 0, err
+		}
+		lastLocalId = 0
+	}
+
+	sigs, err := wechatFTSBlockSigs(msgDB, maxLocalId)
+	if err != nil {
+		return 0, err
+	}
+	stale, err := idx.staleBlocks(shard, sigs, lastLocalId)
+	if err != nil {
+		return 0, err
+	}
+	if maxLocalId == lastLocalId && len(stale) == 0 {
+		return 0, nil
+	}
+
+	tx, err := idx.db.begin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	count := 0
+	for _, block := range stale {
+		from, to := block*wechatFTSBlockRows, (block+1)*wechatFTSBlockRows
+		if to > lastLocalId+1 {
+			to = lastLocalId + 1
+		}
+		if err = idx.removeRange(tx, shard, from, to); err != nil {
+			return count, err
+		}
+		var n int
+		n, _, err = idx.indexRows(tx, msgDB, shard, from, to)
+		if err != nil {
+			return count, err
+		}
+		count += n
+	}
+	if len(stale) > 0 {
+		log.Printf("%s reindex %d changed blocks\n", shard, len(stale))
+	}
+
+	n, last, err := idx.indexRows(tx, msgDB, shard, lastLocalId+1, maxLocalId+1)
+	if err != nil {
+		return count, err
+	}
+	count += n
+	if last > lastLocalId {
+		lastLocalId = last
+	}
+
+	_, err = tx.Exec("INSERT OR REPLACE INTO indexState (shard, lastLocalId) VALUES (?, ?);", shard, lastLocalId)
+	if err != nil {
+		return count, err
+	}
+	_, err = tx.Exec("DELETE FROM indexBlock WHERE shard=?;", shard)
+	if err != nil {
+		return count, err
+	}
+	for block, sig := range sigs {
+		_, err = tx.Exec("INSERT INTO indexBlock (shard, block, sig) VALUES (?, ?, ?);", shard, block, sig)
+		if err != nil {
+			return count, err
+		}
+	}
+
+	err = tx.Commit()
+	return count, err
+}
+
+// wechatFTSBlockSigs returns the signature of every block of msgDB up to
+// localId maxLocalId.
+func wechatFTSBlockSigs(msgDB *wechatDB, maxLocalId int64) (map[int64]string, error) {
+	sigs := make(map[int64]string)
+	rows, err := msgDB.query(wechatFTSBlockSig, wechatFTSBlockRows, maxLocalId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var block int64
+		var sig string
+		if err := rows.Scan(&block, &sig); err != nil {
+			return nil, err
+		}
+		sigs[block] = sig
+	}
+
+	return sigs, rows.Err()
+}
+
+// staleBlocks returns the blocks of shard with rows up to lastLocalId that
+// were indexed and no longer have the signature they had then. An index
+// made before blocks were recorded has none and is redone once.
+func (idx *wechatFTSIndex) staleBlocks(shard string, sigs map[int64]string, lastLocalId int64) ([]int64, error) {
+	stale := make([]int64, 0)
+	if lastLocalId == 0 {
+		return stale, nil
+	}
+
+	indexed := make(map[int64]string)
+	rows, err := idx.db.query("select block, sig from indexBlock where shard=?;", shard)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var block int64
+		var sig string
+		if err := rows.Scan(&block, &sig); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		indexed[block] = sig
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	for block := int64(0); block <= lastLocalId/wechatFTSBlockRows; block++ {
+		sig, ok := indexed[block]
+		if !ok || sig != sigs[block] {
+			// The last block also changes when rows were appended to it,
+			// redoing it costs at most one block.
+			stale = append(stale, block)
+		}
+	}
+
+	return stale, nil
+}
+
+// indexRows indexes the MSG rows of shard with from <= localId < to and
+// returns how many were added and the last localId read.
+func (idx *wechatFTSIndex) indexRows(tx *sql.Tx, msgDB *wechatDB, shard string, from, to int64) (int, int64, error) {
+	rows, err := msgDB.query("select localId,MsgSvrID,Type,SubType,IsSender,CreateTime,ifnull(StrTalker,'') as StrTalker,ifnull(StrContent,'') as StrContent,ifnull(CompressContent,'') as CompressContent from MSG where localId>=? and localId<? order by localId asc;", from, to)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rows.Close()
+
+	insText, err := tx.Prepare("INSERT OR IGNORE INTO msgText (shard, localId, msgSvrId, talker, createTime, type, subType, isSender, content) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer insText.Close()
+
+	insFTS, err := tx.Prepare("INSERT INTO msgTextFTS (rowid, content) VALUES (?, ?);")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer insFTS.Close()
+
+	count := 0
+	last := int64(0)
+	var compressContent []byte
+	for rows.Next() {
+		ref := wechatFTSRef{shard: shard}
+		err = rows.Scan(&ref.localId, &ref.msgSvrID, &ref.msgType, &ref.subType, &ref.isSender, &ref.createTime, &ref.talker, &ref.content, &compressContent)
+		if err != nil {
+			return count, last, err
+		}
+		last = ref.localId
+
+		text := wechatMessageSearchText(ref.msgType, ref.subType, ref.content, compressContent)
+		if text == "" {
+			continue
+		}
+
+		res, err := insText.Exec(ref.shard, ref.localId, ref.msgSvrID, ref.talker, ref.createTime, ref.msgType, ref.subType, ref.isSender, text)
+		if err != nil {
+			return count, last, err
+		}
+		if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+			continue
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return count, last, err
+		}
+		if _, err := insFTS.Exec(id, text); err != nil {
+			return count, last, err
+		}
+		count += 1
+	}
+
+	return count, last, rows.Err()
+}
+
+// removeRange drops the entries of shard with from <= localId < to.
+func (idx *wechatFTSIndex) removeRange(tx *sql.Tx, shard string, from, to int64) error {
+	_, err := tx.Exec("INSERT INTO msgTextFTS (msgTextFTS, rowid, content) SELECT 'delete', id, content FROM msgText WHERE shard=? AND localId>=? AND localId<?;", shard, from, to)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM msgText WHERE shard=? AND localId>=? AND localId<?;", shard, from, to)
+	return err
+}
+
+func (idx *wechatFTSIndex) removeShard(shard string) error {
+	_, err := idx.db.exec("INSERT INTO msgTextFTS (msgTextFTS, rowid, content) SELECT 'delete', id, content FROM msgText WHERE shard=?;", shard)
+	if err != nil {
+		return err
+	}
+
+	_, err = idx.db.exec("DELETE FROM msgText WHERE shard=?;", shard)
+	if err != nil {
+		return err
+	}
+
+	_, err = idx.db.exec("DELETE FROM indexBlock WHERE shard=?;", shard)
+	return err
+}
+
+// search returns index entries after cursor, in wechatSearchCursor order.
+// An empty talker searches every session.
+func (idx *wechatFTSIndex) search(talker, keyWord string, cursor wechatSearchCursor, limit int) ([]wechatFTSRef, error) {
+	refs := make([]wechatFTSRef, 0)
+	querySql, args := idx.matchQuery("t.shard, t.localId, t.msgSvrId, t.talker, t.createTime, t.type, t.subType, t.isSender, t.content", talker, keyWord)
+	querySql += " and (t.createTime<? or (t.createTime=? and (t.shard<? or (t.shard=? and t.localId<?)))) order by t.createTime desc, t.shard desc, t.localId desc limit ?;"
+	args = append(args, cursor.createTime, cursor.createTime, cursor.shard, cursor.shard, cursor.localId, limit)
+
+	rows, err := idx.db.query(querySql, args...)
+	if err != nil {
+		return refs, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		ref := wechatFTSRef{}
+		err = rows.Scan(&ref.shard, &ref.localId, &ref.msgSvrID, &ref.talker, &ref.createTime, &ref.msgType, &ref.subType, &ref.isSender, &ref.content)
+		if err != nil {
+			return refs, err
+		}
+		refs = append(refs, ref)
+	}
+
+	return refs, rows.Err()
+}
+
+func (idx *wechatFTSIndex) counts(keyWord string) (map[string]int, error) {
+	counts := make(map[string]int)
+	querySql, args := idx.matchQuery("t.talker, count(*)", "", keyWord)
+	rows, err := idx.db.query(querySql+" group by t.talker;", args...)
+	if err != nil {
+		return counts, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var talker string
+		var count int
+		if err := rows.Scan(&talker, &count); err != nil {
+			return counts, err
+		}
+		counts[talker] = count
+	}
+
+	return counts, rows.Err()
+}
+
+func (idx *wechatFTSIndex) matchQuery(columns, talker, keyWord string) (string, []interface{}) {
+	var querySql string
+	args := make([]interface{}, 0, 6)
+	if utf8.RuneCountInString(keyWord) >= wechatFTSMinRunes {
+		querySql = "select " + columns + " from msgTextFTS f join msgText t on t.id=f.rowid where msgTextFTS match ?"
+		args = append(args, `"`+strings.ReplaceAll(keyWord, `"`, `""`)+`"`)
+	} else {
+		querySql = "select " + columns + " from msgText t where t.content like ? escape '\\'"
+		args = append(args, wechatLikePattern(keyWord))
+	}
+
+	if talker != "" {
+		querySql += " and t.talker=?"
+		args = append(args, talker)
+	}
+
+	return querySql, args
+}
+
+// wechatMessageSearchText is the text a message can be found by: plain
+// text, and for app messages the title, description and quoted content
+// stored in CompressContent.
+func wechatMessageSearchText(msgType, subType int, content string, compressContent []byte) string {
+	switch msgType {
+	case Wechat_Message_Type_Text:
+		return content
+	case Wechat_Message_Type_System:
+		return systemMsgParse(msgType, content)
+	case Wechat_Message_Type_Location:
+		attr := utils.HtmlMsgGetAttr(content, "location")
+		return strings.TrimSpace(attr["label"] + " " + attr["poiname"])
+	case Wechat_Message_Type_Misc:
+		if len(compressContent) == 0 {
+			return ""
+		}
+		root, err := wechatUncompressContent(compressContent)
+		if err != nil {
+			return ""
+		}
+
+		parts := []string{root.FindElementValue("/msg/appmsg/title")}
+		switch subType {
+		case Wechat_Misc_Message_Refer:
+			referContent := root.FindElementValue("/msg/appmsg/refermsg/content")
+			if root.FindElementValue("/msg/appmsg/refermsg/type") == strconv.Itoa(Wechat_Message_Type_Misc) {
+				contentXML := etree.NewDocument()
+				if err := contentXML.ReadFromString(referContent); err == nil {
+					referContent = NewxmlDocument(contentXML).FindElementValue("/msg/appmsg/title")
+				}
+			}
+			parts = append(parts, referContent)
+		case Wechat_Misc_Message_File:
+		default:
+			parts = append(parts, root.FindElementValue("/msg/appmsg/des"), root.FindElementValue("/msg/appmsg/sourcedisplayname"))
+		}
+
+		text := make([]string, 0, len(parts))
+		for _, part := range parts {
+			if part = strings.TrimSpace(part); part != "" {
+				text = append(text, part)
+			}
+		}
+		return strings.Join(text, " ")
+	default:
+		return ""
+	}
+}
+
+func (P *WechatDataProvider) wechatGetMessageListByIndex(userName string, time int64, keyWord string, msgType string, pageSize int) (*WeChatMessageList, error) {
+	List := &WeChatMessageList{}
+	List.Rows = make([]WeChatMessage, 0)
+	List.KeyWord = keyWord
+	List.MsgType = msgType
+
+	selectPagesize := pageSize
+	if msgType != "" {
+		selectPagesize = 600
+	}
+	cursor := wechatSearchCursorAt(time)
+	for {
+		refs, err := P.searchBackend.search(userName, keyWord, cursor, selectPagesize)
+		if err != nil {
+			return List, err
+		}
+
+		for _, ref := range refs {
+			message, err := P.wechatGetMessageByRef(ref)
+			if err != nil {
+				log.Printf("wechatGetMessageByRef %s %d failed: %v\n", ref.shard, ref.localId, err)
+				continue
+			}
+			if weChatMessageTypeFilter(&message, msgType) {
+				List.Rows = append(List.Rows, message)
+				List.Total += 1
+				if List.Total >= pageSize {
+					return List, nil
+				}
+			}
+		}
+
+		if len(refs) < selectPagesize {
+			break
+		}
+		last := refs[len(refs)-1]
+		cursor = wechatSearchCursor{last.createTime, last.shard, last.localId}
+	}
+
+	return List, nil
+}
+
+func (P *WechatDataProvider) wechatGetMessageByRef(ref wechatFTSRef) (WeChatMessage, error) {
+	for _, msgDB := range P.msgDBs {
+		if filepath.Base(msgDB.path) != ref.shard {
+			continue
+		}
+
+		querySql := "select " + wechatMessageColumns + " from MSG where localId=?;"
+		return P.wechatScanMessage(msgDB.db.queryRow(querySql, ref.localId).Scan)
+	}
+
+	return WeChatMessage{}, errors.New("not found " + ref.shard)
+}
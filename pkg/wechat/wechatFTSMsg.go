@@ -0,0 +1,446 @@
+package wechat
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// WeChat keeps its own full-text databases next to MicroMsg.db. They are
+// decrypted together with the rest of Msg, but the tables are built with
+// WeChat's private tokenizer, so only the plain _content and _MetaData
+// tables can be read here and MATCH is not available.
+//
+// The layout is not documented by WeChat. What is read here is:
+//
+//	<prefix>N_content  docid, c0..cN text columns; c0 is searched
+//	<prefix>N_MetaData docid and msgId (FTSChatMsg) or entityId
+//	                   (FTSContact); FTSChatMsg also needs CreateTime,
+//	                   and entityId to filter by talker
+//	NameToId           rowid is the entityId, userName is the wxid
+//
+// None of it is taken for granted: wechatFindFTSTables and
+// wechatOpenMsgFTS check the columns when the database is opened, and a
+// database without them is not used, so searches scan MSG as before. The
+// talker filter and per-session counts also need NameToId.
+//
+// LIKE on _content is still a full scan of that table, without an index.
+// It is cheaper than the MSG scan because _content only holds the text,
+// but the real speedup comes from FTSIndex.db.
+const (
+	FTSMSGDB     = "FTSMSG.db"
+	FTSContactDB = "FTSContact.db"
+)
+
+// ids sent to MSG in one "MsgSvrID in (...)" query
+const wechatMsgFTSBatch = 500
+
+type wechatMsgFTS struct {
+	db         *wechatDB
+	content    string
+	metaData   string
+	column     string
+	timeColumn string
+	nameToId   bool // entityId of _MetaData points at NameToId, so talkers filter in SQL
+	msgDBs     []*wechatMsgDB
+}
+
+type wechatContactFTS struct {
+	db       *wechatDB
+	content  string
+	metaData string
+	columns  []string
+}
+
+func wechatOpenMsgFTS(path string, msgDBs []*wechatMsgDB) (*wechatMsgFTS, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+
+	db, err := wechatOpenDB(path)
+	if err != nil {
+		return nil, err
+	}
+
+	content, metaData, columns, err := wechatFindFTSTables(db, "FTSChatMsg", "msgId")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// Without a time column results could only be ordered after resolving
+	// all of them, which is what the MSG scan does anyway.
+	metaColumns := wechatTableColumns(db, metaData)
+	timeColumn := ""
+	for _, column := range metaColumns {
+		if strings.EqualFold(column, "CreateTime") {
+			timeColumn = column
+		}
+	}
+	if timeColumn == "" {
+		db.Close()
+		return nil, fmt.Errorf("%s has no CreateTime", metaData)
+	}
+
+	msgFTS := &wechatMsgFTS{
+		db:         db,
+		content:    content,
+		metaData:   metaData,
+		column:     columns[0],
+		timeColumn: timeColumn,
+		nameToId:   wechatHasColumn(metaColumns, "entityId") && wechatHasColumn(wechatTableColumns(db, "NameToId"), "userName"),
+		msgDBs:     msgDBs,
+	}
+
+	return msgFTS, nil
+}
+
+func wechatOpenContactFTS(path string) (*wechatContactFTS, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+
+	db, err := wechatOpenDB(path)
+	if err != nil {
+		return nil, err
+	}
+
+	content, metaData, columns, err := wechatFindFTSTables(db, "FTSContact", "entityId")
+	if err == nil && len(wechatTableColumns(db, "NameToId")) == 0 {
+		err = errors.New("NameToId not exist")
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	contactFTS := &wechatContactFTS{
+		db:       db,
+		content:  content,
+		metaData: metaData,
+		columns:  columns,
+	}
+
+	return contactFTS, nil
+}
+
+// wechatFindFTSTables looks for a <prefix>N_content table whose
+// <prefix>N_MetaData has docid and idColumn, and returns the text columns
+// of the content table.
+func wechatFindFTSTables(db *wechatDB, prefix, idColumn string) (string, string, []string, error) {
+	rows, err := db.query("select name from sqlite_master where type='table' and name like ? escape '\\' order by name;", prefix+"%\\_content")
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	names := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return "", "", nil, err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+
+	for _, content := range names {
+		metaData := strings.TrimSuffix(content, "_content") + "_MetaData"
+		metaColumns := wechatTableColumns(db, metaData)
+		if !wechatHasColumn(metaColumns, "docid") || !wechatHasColumn(metaColumns, idColumn) {
+			continue
+		}
+
+		columns := make([]string, 0)
+		for _, column := range wechatTableColumns(db, content) {
+			if strings.HasPrefix(column, "c") && column != "docid" {
+				columns = append(columns, column)
+			}
+		}
+		if len(columns) > 0 {
+			return content, metaData, columns, nil
+		}
+	}
+
+	return "", "", nil, fmt.Errorf("%s tables not exist", prefix)
+}
+
+func wechatTableColumns(db *wechatDB, table string) []string {
+	columns := make([]string, 0)
+	rows, err := db.query("select name from pragma_table_info(?);", table)
+	if err != nil {
+		return columns
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			break
+		}
+		columns = append(columns, name)
+	}
+
+	return columns
+}
+
+func wechatHasColumn(columns []string, name string) bool {
+	for _, column := range columns {
+		if strings.EqualFold(column, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *wechatMsgFTS) Close() error {
+	return m.db.Close()
+}
+
+// search walks _MetaData newest first, one LIMIT page at a time, and only
+// looks up the msgIds of that page in MSG. A page always ends with every
+// match of its last CreateTime, so the MSG rows it resolves to can be put
+// in cursor order without looking at the next page. Rows whose MSG row is
+// gone or belongs to another talker are skipped, so it keeps paging until
+// limit refs are found or the matches run out.
+func (m *wechatMsgFTS) search(talker, keyWord string, cursor wechatSearchCursor, limit int) ([]wechatFTSRef, error) {
+	refs := make([]wechatFTSRef, 0, limit)
+	maxTime := cursor.createTime
+	for len(refs) < limit {
+		ids, texts, err := m.page(talker, keyWord, math.MinInt64, maxTime, limit)
+		if err != nil {
+			return refs, err
+		}
+		if len(ids) == 0 {
+			break
+		}
+
+		lastTime := ids[len(ids)-1].createTime
+		full := len(ids) == limit
+		if full {
+			// the matches of lastTime may go on past limit
+			group, groupTexts, err := m.page(talker, keyWord, lastTime, lastTime, -1)
+			if err != nil {
+				return refs, err
+			}
+			for len(ids) > 0 && ids[len(ids)-1].createTime == lastTime {
+				ids = ids[:len(ids)-1]
+			}
+			ids = append(ids, group...)
+			for id, text := range groupTexts {
+				texts[id] = text
+			}
+		}
+
+		for _, ref := range m.resolve(ids, texts) {
+			if talker != "" && ref.talker != talker {
+				continue
+			}
+			if !cursor.older(ref.createTime, ref.shard, ref.localId) {
+				continue
+			}
+			refs = append(refs, ref)
+		}
+
+		if !full || lastTime == math.MinInt64 {
+			break
+		}
+		maxTime = lastTime - 1
+	}
+
+	if len(refs) > limit {
+		refs = refs[:limit]
+	}
+	return refs, nil
+}
+
+// counts groups the matches by talker, which needs NameToId.
+func (m *wechatMsgFTS) counts(keyWord string) (map[string]int, error) {
+	counts := make(map[string]int)
+	if !m.nameToId {
+		return counts, errors.New("NameToId not exist")
+	}
+
+	querySql := fmt.Sprintf("select n.userName, count(*) from %s m join %s c on c.docid=m.docid join NameToId n on n.rowid=m.entityId where c.%s like ? escape '\\' group by n.userName;", m.metaData, m.content, m.column)
+	rows, err := m.db.query(querySql, wechatLikePattern(keyWord))
+	if err != nil {
+		return counts, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userName string
+		var count int
+		if err := rows.Scan(&userName, &count); err != nil {
+			return counts, err
+		}
+		counts[userName] = count
+	}
+
+	return counts, rows.Err()
+}
+
+// page returns up to limit matches with minTime <= CreateTime <= maxTime,
+// newest first, as (CreateTime, msgId) pairs together with their text. A
+// negative limit returns all of them.
+func (m *wechatMsgFTS) page(talker, keyWord string, minTime, maxTime int64, limit int) ([]wechatFTSRef, map[int64]string, error) {
+	join, where := "", ""
+	args := []interface{}{wechatLikePattern(keyWord), minTime, maxTime}
+	if talker != "" && m.nameToId {
+		join = " join NameToId n on n.rowid=m.entityId"
+		where = " and n.userName=?"
+		args = append(args, talker)
+	}
+	args = append(args, limit)
+
+	querySql := fmt.Sprintf("select m.%[1]s, m.msgId, ifnull(c.%[2]s,'') from %[3]s m join %[4]s c on c.docid=m.docid%[5]s where c.%[2]s like ? escape '\\' and m.%[1]s>=? and m.%[1]s<=?%[6]s order by m.%[1]s desc limit ?;",
+		m.timeColumn, m.column, m.metaData, m.content, join, where)
+	rows, err := m.db.query(querySql, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]wechatFTSRef, 0)
+	texts := make(map[int64]string)
+	for rows.Next() {
+		var ref wechatFTSRef
+		var text string
+		if err := rows.Scan(&ref.createTime, &ref.msgSvrID, &text); err != nil {
+			return nil, nil, err
+		}
+		ids = append(ids, ref)
+		texts[ref.msgSvrID] = text
+	}
+
+	return ids, texts, rows.Err()
+}
+
+// resolve maps one page of msgIds to their MSG rows across all shards.
+func (m *wechatMsgFTS) resolve(page []wechatFTSRef, texts map[int64]string) []wechatFTSRef {
+	ids := make([]interface{}, 0, len(page))
+	for _, ref := range page {
+		ids = append(ids, ref.msgSvrID)
+	}
+
+	refs := make([]wechatFTSRef, 0, len(ids))
+	for _, msgDB := range m.msgDBs {
+		for start := 0; start < len(ids); start += wechatMsgFTSBatch {
+			end := start + wechatMsgFTSBatch
+			if end > len(ids) {
+				end = len(ids)
+			}
+			dbRefs, err := m.lookupMsgDB(msgDB, ids[start:end], texts)
+			if err != nil {
+				log.Printf("lookup %s failed: %v\n", msgDB.path, err)
+				break
+			}
+			refs = append(refs, dbRefs...)
+		}
+	}
+
+	sort.Slice(refs, func(i, j int) bool {
+		return wechatSearchCursor{refs[i].createTime, refs[i].shard, refs[i].localId}.older(refs[j].createTime, refs[j].shard, refs[j].localId)
+	})
+
+	return refs
+}
+
+func (m *wechatMsgFTS) lookupMsgDB(msgDB *wechatMsgDB, ids []interface{}, texts map[int64]string) ([]wechatFTSRef, error) {
+	refs := make([]wechatFTSRef, 0)
+	querySql := "select localId,MsgSvrID,Type,SubType,IsSender,CreateTime,ifnull(StrTalker,'') as StrTalker from MSG where MsgSvrID in (" + sqlPlaceholders(len(ids)) + ");"
+	rows, err := msgDB.db.query(querySql, ids...)
+	if err != nil {
+		return refs, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		ref := wechatFTSRef{shard: filepath.Base(msgDB.path)}
+		err := rows.Scan(&ref.localId, &ref.msgSvrID, &ref.msgType, &ref.subType, &ref.isSender, &ref.createTime, &ref.talker)
+		if err != nil {
+			return refs, err
+		}
+		ref.content = texts[ref.msgSvrID]
+		refs = append(refs, ref)
+	}
+
+	return refs, rows.Err()
+}
+
+func (c *wechatContactFTS) Close() error {
+	return c.db.Close()
+}
+
+func (c *wechatContactFTS) search(keyWord string) ([]string, error) {
+	userNames := make([]string, 0)
+	conditions := make([]string, len(c.columns))
+	args := make([]interface{}, len(c.columns))
+	for i, column := range c.columns {
+		conditions[i] = "c." + column + " like ? escape '\\'"
+		args[i] = wechatLikePattern(keyWord)
+	}
+
+	querySql := fmt.Sprintf("select distinct n.userName from %s c join %s m on m.docid=c.docid join NameToId n on n.rowid=m.entityId where %s;", c.content, c.metaData, strings.Join(conditions, " or "))
+	rows, err := c.db.query(querySql, args...)
+	if err != nil {
+		return userNames, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userName string
+		if err := rows.Scan(&userName); err != nil {
+			return userNames, err
+		}
+		userNames = append(userNames, userName)
+	}
+
+	return userNames, rows.Err()
+}
+
+// WeChatSearchContacts finds contacts whose name, remark or alias contains
+// keyWord, through FTSContact.db when it was exported.
+func (P *WechatDataProvider) WeChatSearchContacts(keyWord string) (*WeChatUserList, error) {
+	List := &WeChatUserList{}
+	List.Users = make([]WeChatUserInfo, 0)
+	if keyWord == "" {
+		return List, nil
+	}
+
+	if P.contactFTS != nil {
+		userNames, err := P.contactFTS.search(keyWord)
+		if err == nil {
+			for _, userName := range userNames {
+				info, err := P.WechatGetUserInfoByNameOnCache(userName)
+				if err != nil {
+					continue
+				}
+				List.Users = append(List.Users, *info)
+				List.Total += 1
+			}
+			return List, nil
+		}
+		log.Println("contactFTS search failed:", err)
+	}
+
+	lowerKeyWord := strings.ToLower(keyWord)
+	for _, contact := range P.ContactList.Users {
+		fields := []string{contact.UserName, contact.Alias, contact.ReMark, contact.NickName, contact.QuanPin, contact.RemarkQuanPin}
+		for _, field := range fields {
+			if strings.Contains(strings.ToLower(field), lowerKeyWord) {
+				List.Users = append(List.Users, contact.WeChatUserInfo)
+				List.Total += 1
+				break
+			}
+		}
+	}
+
+	return List, nil
+}
@@ -0,0 +1,138 @@
+package wechat
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type testFTSMsgRow struct {
+	msgId      int64
+	talker     string
+	createTime int64
+	text       string
+}
+
+// testCreateFTSMSG writes an FTSMSG.db with the tables wechatOpenMsgFTS
+// looks for. timeColumn is left out when empty.
+func testCreateFTSMSG(t *testing.T, path string, timeColumn string, rows ...testFTSMsgRow) {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	metaColumns := "docid INTEGER PRIMARY KEY, msgId INT, entityId INT, type INT"
+	if timeColumn != "" {
+		metaColumns += ", " + timeColumn + " INT"
+	}
+	statements := []string{
+		"CREATE TABLE FTSChatMsg2_content (docid INTEGER PRIMARY KEY, c0content TEXT, c1talker TEXT);",
+		"CREATE TABLE FTSChatMsg2_MetaData (" + metaColumns + ");",
+		"CREATE TABLE NameToId (userName TEXT);",
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entityIds := make(map[string]int64)
+	for i, row := range rows {
+		entityId, ok := entityIds[row.talker]
+		if !ok {
+			res, err := db.Exec("INSERT INTO NameToId (userName) VALUES (?);", row.talker)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entityId, _ = res.LastInsertId()
+			entityIds[row.talker] = entityId
+		}
+		if _, err := db.Exec("INSERT INTO FTSChatMsg2_content (docid, c0content, c1talker) VALUES (?, ?, ?);", i+1, row.text, row.talker); err != nil {
+			t.Fatal(err)
+		}
+		if timeColumn == "" {
+			_, err = db.Exec("INSERT INTO FTSChatMsg2_MetaData (docid, msgId, entityId, type) VALUES (?, ?, ?, 1);", i+1, row.msgId, entityId)
+		} else {
+			_, err = db.Exec("INSERT INTO FTSChatMsg2_MetaData (docid, msgId, entityId, type, "+timeColumn+") VALUES (?, ?, ?, 1, ?);", i+1, row.msgId, entityId, row.createTime)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMsgFTSSearch(t *testing.T) {
+	dir := t.TempDir()
+	shards := []string{filepath.Join(dir, "MSG0.db"), filepath.Join(dir, "MSG1.db")}
+	testCreateMsgShard(t, shards[0],
+		testMsg{11, Wechat_Message_Type_Text, "a", 100, "hello 1"},
+		testMsg{12, Wechat_Message_Type_Text, "b", 100, "hello 2"},
+		testMsg{13, Wechat_Message_Type_Text, "a", 90, "bye"},
+	)
+	testCreateMsgShard(t, shards[1],
+		testMsg{21, Wechat_Message_Type_Text, "a", 100, "hello 3"},
+		testMsg{22, Wechat_Message_Type_Text, "b", 80, "hello 4"},
+	)
+	rows := []testFTSMsgRow{
+		{11, "a", 100, "hello 1"},
+		{12, "b", 100, "hello 2"},
+		{13, "a", 90, "bye"},
+		{21, "a", 100, "hello 3"},
+		{22, "b", 80, "hello 4"},
+		// deleted from MSG after WeChat indexed it
+		{99, "a", 95, "hello gone"},
+	}
+	want := []string{"MSG1.db/1", "MSG0.db/2", "MSG0.db/1", "MSG1.db/2"}
+
+	P := testSearchProvider(t, shards, "a", "b")
+	ftsPath := filepath.Join(dir, FTSMSGDB)
+	testCreateFTSMSG(t, ftsPath, "CreateTime", rows...)
+	msgFTS, err := wechatOpenMsgFTS(ftsPath, P.msgDBs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer msgFTS.Close()
+	if msgFTS.content != "FTSChatMsg2_content" || msgFTS.column != "c0content" || !msgFTS.nameToId {
+		t.Fatalf("found %s.%s, NameToId %v", msgFTS.content, msgFTS.column, msgFTS.nameToId)
+	}
+	P.searchBackend = msgFTS
+
+	for pageSize := 1; pageSize <= len(want)+1; pageSize++ {
+		got, counts, _ := testSearchPages(t, P, "hello", pageSize, want)
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Fatalf("page size %d: hits %q, want %q", pageSize, got, want)
+		}
+		// Counts are of FTSMSG rows, the deleted message included.
+		for talker, count := range counts {
+			if count != map[string]int{"a": 3, "b": 2}[talker] {
+				t.Fatalf("page size %d: counts %v", pageSize, counts)
+			}
+		}
+	}
+
+	refs, err := msgFTS.search("a", "hello", wechatSearchCursorAt(100), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0)
+	for _, ref := range refs {
+		got = append(got, fmt.Sprintf("%s/%d %s", ref.shard, ref.localId, ref.content))
+	}
+	if strings.Join(got, ",") != "MSG1.db/1 hello 3,MSG0.db/1 hello 1" {
+		t.Fatalf("talker a: %q", got)
+	}
+
+	// Without CreateTime in _MetaData the results cannot be ordered before
+	// they are resolved, so the database is not used.
+	noTimePath := filepath.Join(t.TempDir(), FTSMSGDB)
+	testCreateFTSMSG(t, noTimePath, "", rows...)
+	if msgFTS, err := wechatOpenMsgFTS(noTimePath, P.msgDBs); err == nil {
+		msgFTS.Close()
+		t.Fatal("opened FTSMSG without CreateTime")
+	}
+}
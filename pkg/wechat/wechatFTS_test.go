@@ -0,0 +1,35 @@
+package wechat
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpdateSearchIndexFTS5(t *testing.T) {
+	resPath := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(resPath, "Msg", "Multi"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	testCreateMsgShard(t, filepath.Join(resPath, "Msg", "Multi", "MSG0.db"),
+		testMsg{1, Wechat_Message_Type_Text, "a", 100, "hello"},
+		testMsg{2, Wechat_Message_Type_Picture, "a", 101, "<img/>"},
+	)
+
+	count, err := UpdateWeChatSearchIndex(resPath)
+	_, statErr := os.Stat(filepath.Join(resPath, "Msg", FTSIndexDB))
+	if !wechatHasFTS5() {
+		// Without FTS5 the stage is skipped and no index file is made.
+		if !errors.Is(err, ErrNoFTS5) || !os.IsNotExist(statErr) {
+			t.Fatalf("without FTS5: %v, index file %v", err, statErr)
+		}
+		return
+	}
+	if err != nil || count != 1 || statErr != nil {
+		t.Fatalf("indexed %d: %v, index file %v", count, err, statErr)
+	}
+	if count, err := UpdateWeChatSearchIndex(resPath); err != nil || count != 0 {
+		t.Fatalf("second update indexed %d: %v", count, err)
+	}
+}
@@ -0,0 +1,242 @@
+package wechat
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Media kinds counted by WeChatHealthCheck, one per resolved path field.
+const (
+	WeChatMediaThumb    = "thumb"    // ThumbPath
+	WeChatMediaImage    = "image"    // ImagePath of pictures
+	WeChatMediaVideo    = "video"    // VideoPath of videos
+	WeChatMediaVoice    = "voice"    // VoicePath
+	WeChatMediaFile     = "file"     // FileInfo.FilePath
+	WeChatMediaLocation = "location" // LocationInfo.ThumbPath
+)
+
+// healthMaxPaths caps the missing paths listed per session and kind; the
+// counts are always complete.
+const healthMaxPaths = 20
+
+type WeChatDBHealth struct {
+	Name      string `json:"Name"`      // relative to the account directory.
+	Integrity string `json:"Integrity"` // result of PRAGMA integrity_check, ok when intact.
+}
+
+type WeChatMediaHealth struct {
+	Type       string   `json:"Type"`
+	Referenced int      `json:"Referenced"`
+	Missing    int      `json:"Missing"`
+	Paths      []string `json:"Paths,omitempty"` // the first missing paths, as the provider resolves them.
+}
+
+type WeChatSessionHealth struct {
+	UserName string              `json:"UserName"`
+	NickName string              `json:"NickName"`
+	Missing  int                 `json:"Missing"`
+	Media    []WeChatMediaHealth `json:"Media"` // only kinds with something missing.
+}
+
+type WeChatHealthReport struct {
+	UserName   string                `json:"UserName"`
+	DBs        []WeChatDBHealth      `json:"DBs"`
+	Messages   int                   `json:"Messages"` // messages that reference media.
+	Referenced int                   `json:"Referenced"`
+	Missing    int                   `json:"Missing"`
+	Media      []WeChatMediaHealth   `json:"Media"`    // totals per kind, without Paths.
+	Sessions   []WeChatSessionHealth `json:"Sessions"` // sessions with missing media, most missing first.
+}
+
+// Healthy reports whether every database is intact and no media is missing.
+func (r *WeChatHealthReport) Healthy() bool {
+	for _, db := range r.DBs {
+		if db.Integrity != "ok" {
+			return false
+		}
+	}
+
+	return r.Missing == 0
+}
+
+// healthMediaKinds is the order kinds are reported in.
+var healthMediaKinds = []string{WeChatMediaThumb, WeChatMediaImage, WeChatMediaVideo, WeChatMediaVoice, WeChatMediaFile, WeChatMediaLocation}
+
+// healthQuery selects the message types whose paths WeChatHealthCheck checks.
+var healthQuery = "select " + wechatMessageColumns + " from MSG where Type in (3,34,43,48,49);"
+
+// WeChatHealthCheck runs PRAGMA integrity_check on every database the
+// provider opened and checks that each media path it resolves for a message
+// exists in the export. Remote thumbnails are not counted.
+func (P *WechatDataProvider) WeChatHealthCheck() (*WeChatHealthReport, error) {
+	report := &WeChatHealthReport{DBs: make([]WeChatDBHealth, 0), Media: make([]WeChatMediaHealth, 0), Sessions: make([]WeChatSessionHealth, 0)}
+	if P.SelfInfo != nil {
+		report.UserName = P.SelfInfo.UserName
+	}
+
+	dbs := []*wechatDB{P.microMsg, P.openIMContact, P.userData, P.recovered}
+	for _, msgDB := range P.msgDBs {
+		dbs = append(dbs, msgDB.db)
+	}
+	for _, db := range dbs {
+		if db != nil {
+			report.DBs = append(report.DBs, P.wechatIntegrityCheck(db))
+		}
+	}
+
+	totals := make(map[string]*WeChatMediaHealth)
+	sessions := make(map[string]map[string]*WeChatMediaHealth)
+	check := func(msg *WeChatMessage, kind string, resolved string) {
+		local, ok := P.resolvedLocal(resolved)
+		if !ok {
+			return
+		}
+		total := totals[kind]
+		if total == nil {
+			total = &WeChatMediaHealth{Type: kind}
+			totals[kind] = total
+		}
+		total.Referenced += 1
+		report.Referenced += 1
+		if _, err := os.Stat(local); err == nil {
+			return
+		}
+
+		total.Missing += 1
+		report.Missing += 1
+		session := sessions[msg.Talker]
+		if session == nil {
+			session = make(map[string]*WeChatMediaHealth)
+			sessions[msg.Talker] = session
+		}
+		media := session[kind]
+		if media == nil {
+			media = &WeChatMediaHealth{Type: kind, Paths: make([]string, 0)}
+			session[kind] = media
+		}
+		media.Missing += 1
+		if len(media.Paths) < healthMaxPaths {
+			media.Paths = append(media.Paths, resolved)
+		}
+	}
+
+	for _, msgDB := range P.msgDBs {
+		rows, err := msgDB.db.query(healthQuery)
+		if err != nil {
+			return report, err
+		}
+		for rows.Next() {
+			msg, err := P.wechatScanMessage(rows.Scan)
+			if err != nil {
+				rows.Close()
+				return report, err
+			}
+			report.Messages += 1
+
+			check(&msg, WeChatMediaThumb, msg.ThumbPath)
+			switch msg.Type {
+			case Wechat_Message_Type_Picture:
+				check(&msg, WeChatMediaImage, msg.ImagePath)
+			case Wechat_Message_Type_Video:
+				check(&msg, WeChatMediaVideo, msg.VideoPath)
+			case Wechat_Message_Type_Voice:
+				check(&msg, WeChatMediaVoice, msg.VoicePath)
+			case Wechat_Message_Type_Location:
+				check(&msg, WeChatMediaLocation, msg.LocationInfo.ThumbPath)
+			case Wechat_Message_Type_Misc:
+				check(&msg, WeChatMediaFile, msg.FileInfo.FilePath)
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return report, err
+		}
+	}
+
+	for _, kind := range healthMediaKinds {
+		if total := totals[kind]; total != nil {
+			report.Media = append(report.Media, *total)
+		}
+	}
+	for userName, media := range sessions {
+		session := WeChatSessionHealth{UserName: userName, Media: make([]WeChatMediaHealth, 0)}
+		if info, err := P.WechatGetUserInfoByNameOnCache(userName); err == nil {
+			session.NickName = info.NickName
+			if info.ReMark != "" {
+				session.NickName = info.ReMark
+			}
+		}
+		for _, kind := range healthMediaKinds {
+			if m := media[kind]; m != nil {
+				session.Missing += m.Missing
+				session.Media = append(session.Media, *m)
+			}
+		}
+		report.Sessions = append(report.Sessions, session)
+	}
+	sort.Slice(report.Sessions, func(i, j int) bool {
+		if report.Sessions[i].Missing != report.Sessions[j].Missing {
+			return report.Sessions[i].Missing > report.Sessions[j].Missing
+		}
+		return report.Sessions[i].UserName < report.Sessions[j].UserName
+	})
+
+	return report, nil
+}
+
+// wechatIntegrityCheck runs PRAGMA integrity_check on db, which for a backup
+// encrypted at rest is its decrypted copy in memory.
+func (P *WechatDataProvider) wechatIntegrityCheck(db *wechatDB) WeChatDBHealth {
+	health := WeChatDBHealth{Name: filepath.Base(db.path)}
+	if rel, err := filepath.Rel(P.resPath, db.path); err == nil {
+		health.Name = filepath.ToSlash(rel)
+	}
+
+	rows, err := db.query("PRAGMA integrity_check(20);")
+	if err != nil {
+		health.Integrity = err.Error()
+		return health
+	}
+	defer rows.Close()
+
+	results := make([]string, 0, 1)
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			health.Integrity = err.Error()
+			return health
+		}
+		results = append(results, result)
+	}
+	if err := rows.Err(); err != nil {
+		health.Integrity = err.Error()
+		return health
+	}
+	health.Integrity = strings.Join(results, "; ")
+	if health.Integrity != "ok" {
+		log.Println("integrity_check", db.path, health.Integrity)
+	}
+
+	return health
+}
+
+// resolvedLocal maps a path resolved by the provider back to the file in the
+// export, false for empty paths and remote URLs.
+func (P *WechatDataProvider) resolvedLocal(resolved string) (string, bool) {
+	if resolved == "" || strings.Contains(resolved, "://") {
+		return "", false
+	}
+	relPath := resolved
+	if P.prefixResPath != "" {
+		if !strings.HasPrefix(resolved, P.prefixResPath+"/") {
+			return "", false
+		}
+		relPath = strings.TrimPrefix(resolved, P.prefixResPath+"/")
+	}
+
+	return P.resLocal(relPath), true
+}
@@ -0,0 +1,64 @@
+package wechat
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHealthCheckMissingMedia(t *testing.T) {
+	dir := t.TempDir()
+	shard := filepath.Join(dir, "MSG0.db")
+	testCreateMsgShard(t, shard,
+		testMsg{11, Wechat_Message_Type_Voice, "a", 100, ""},
+		testMsg{12, Wechat_Message_Type_Voice, "a", 101, ""},
+		testMsg{13, Wechat_Message_Type_Voice, "b", 102, ""},
+		testMsg{14, Wechat_Message_Type_Text, "b", 103, "no media"},
+	)
+	voiceDir := filepath.Join(dir, "FileStorage", "Voice")
+	if err := os.MkdirAll(voiceDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(voiceDir, "11.mp3"), []byte("mp3"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	P := testSearchProvider(t, []string{shard}, "a", "b")
+	P.resPath = dir
+	report, err := P.WeChatHealthCheck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.DBs) != 1 || report.DBs[0].Name != "MSG0.db" || report.DBs[0].Integrity != "ok" {
+		t.Fatalf("databases %+v", report.DBs)
+	}
+	if report.Healthy() || report.Messages != 3 || report.Referenced != 3 || report.Missing != 2 {
+		t.Fatalf("messages %d referenced %d missing %d", report.Messages, report.Referenced, report.Missing)
+	}
+	if len(report.Media) != 1 || report.Media[0].Type != WeChatMediaVoice || report.Media[0].Missing != 2 || report.Media[0].Paths != nil {
+		t.Fatalf("media %+v", report.Media)
+	}
+
+	// Sessions are listed most missing first, with the paths that are gone.
+	if len(report.Sessions) != 2 || report.Sessions[0].UserName != "a" || report.Sessions[1].UserName != "b" {
+		t.Fatalf("sessions %+v", report.Sessions)
+	}
+	a := report.Sessions[0]
+	if a.Missing != 1 || len(a.Media) != 1 || len(a.Media[0].Paths) != 1 || a.Media[0].Paths[0] != "FileStorage/Voice/12.mp3" {
+		t.Fatalf("session a %+v", a)
+	}
+
+	if err := os.WriteFile(filepath.Join(voiceDir, "12.mp3"), []byte("mp3"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(voiceDir, "13.mp3"), []byte("mp3"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	report, err = P.WeChatHealthCheck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Healthy() || len(report.Sessions) != 0 {
+		t.Fatalf("complete backup is not healthy: %+v", report)
+	}
+}
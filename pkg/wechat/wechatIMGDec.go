@@ -108,49 +108,21 @@ func DecryptDatByDir(inDir, outDir string) error {
 	return nil
 }
 
+// DecryptDat 把 inFile 解码后写入 outFile，支持旧版单字节异或和新版 V1/V2 格式。
+// 无法解码时返回 *DatDecodeError，其中包含文件名和格式版本。
 func DecryptDat(inFile string, outFile string) error {
-
-	sourceFile, err := os.Open(inFile)
+	data, err := os.ReadFile(inFile)
 	if err != nil {
 		log.Println(err.Error())
 		return err
 	}
 
-	var preTenBts = make([]byte, 10)
-	_, _ = sourceFile.Read(preTenBts)
-	decodeByte, _, er := findDecodeByte(preTenBts)
-	if er != nil {
-		log.Println(er.Error())
-		return err
-	}
-
-	distFile, er := os.Create(outFile)
-	if er != nil {
-		log.Println(er.Error())
-		return err
-	}
-	writer := bufio.NewWriter(distFile)
-	_, _ = sourceFile.Seek(0, 0)
-	var rBts = make([]byte, 1024)
-	for {
-		n, er := sourceFile.Read(rBts)
-		if er != nil {
-			if er == io.EOF {
-				break
-			}
-			log.Println("error: ", er.Error())
-			return err
-		}
-		for i := 0; i < n; i++ {
-			_ = writer.WriteByte(rBts[i] ^ decodeByte)
-		}
+	decoded, _, err := decodeDatData(data)
+	if err != nil {
+		return &DatDecodeError{Path: inFile, Version: datVersion(data), Err: err}
 	}
-	_ = writer.Flush()
-	_ = distFile.Close()
-	_ = sourceFile.Close()
-	// fmt.Println("output file：", distFile.Name())
 
-	return nil
+	return os.WriteFile(outFile, decoded, 0644)
 }
 
 func handlerOne(info os.FileInfo, dir string, outputDir string) {
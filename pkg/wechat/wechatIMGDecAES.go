@@ -0,0 +1,198 @@
+package wechat
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Newer WeChat clients write .dat images as
+//
+//	header(15) = signature(6) | aesSize(4, LE) | xorSize(4, LE) | 1 byte
+//	body       = AES-ECB(head, PKCS7) | raw middle | XOR(tail, xorSize)
+//
+// V1 files use a fixed AES key, V2 files use a per-account key that has to
+// be supplied with SetDatImageKey.
+const (
+	DatVersionXor = 0
+	DatVersionV1  = 1
+	DatVersionV2  = 2
+
+	datHeaderSize = 15
+)
+
+var (
+	datV1Signature = []byte{0x07, 0x08, 0x56, 0x31, 0x08, 0x07}
+	datV2Signature = []byte{0x07, 0x08, 0x56, 0x32, 0x08, 0x07}
+	datV1AESKey    = []byte("cfcd208495d565ef")
+
+	ErrDatNoAESKey = errors.New("V2 .dat needs the image AES key")
+	ErrDatUnknown  = errors.New("unknown .dat format")
+)
+
+var datImageKey = struct {
+	mtx     sync.RWMutex
+	aesKey  []byte
+	xorByte int
+}{xorByte: -1}
+
+// DatDecodeError reports a .dat file that could not be decoded.
+type DatDecodeError struct {
+	Path    string
+	Version int
+	Err     error
+}
+
+func (e *DatDecodeError) Error() string {
+	return fmt.Sprintf("decode %s (%s) failed: %v", e.Path, DatVersionName(e.Version), e.Err)
+}
+
+func (e *DatDecodeError) Unwrap() error {
+	return e.Err
+}
+
+// DatVersionName returns the name of a .dat format version for reports.
+func DatVersionName(version int) string {
+	switch version {
+	case DatVersionV1:
+		return "V1"
+	case DatVersionV2:
+		return "V2"
+	}
+
+	return "XOR"
+}
+
+// SetDatImageKey sets the AES key of V2 .dat files and the XOR byte of their
+// tail. aesKey may be empty when only V1 and XOR files are expected; a
+// negative xorByte guesses the byte from the end of the image.
+func SetDatImageKey(aesKey []byte, xorByte int) error {
+	if len(aesKey) != 0 && len(aesKey) != 16 && len(aesKey) != 24 && len(aesKey) != 32 {
+		return fmt.Errorf("image AES key must be 16, 24 or 32 bytes, got %d", len(aesKey))
+	}
+	if xorByte > 0xff {
+		return fmt.Errorf("image XOR byte %d out of range", xorByte)
+	}
+
+	datImageKey.mtx.Lock()
+	defer datImageKey.mtx.Unlock()
+	datImageKey.aesKey = append([]byte(nil), aesKey...)
+	datImageKey.xorByte = xorByte
+
+	return nil
+}
+
+func datVersion(data []byte) int {
+	if bytes.HasPrefix(data, datV1Signature) {
+		return DatVersionV1
+	}
+	if bytes.HasPrefix(data, datV2Signature) {
+		return DatVersionV2
+	}
+
+	return DatVersionXor
+}
+
+// decodeDatData decodes a whole .dat file and returns the image and its
+// extension. The signatures of V1/V2 are checked first because their
+// header also matches the two byte BMP prefix of the XOR format.
+func decodeDatData(data []byte) ([]byte, string, error) {
+	version := datVersion(data)
+	if version == DatVersionXor {
+		if len(data) < 10 {
+			return nil, "", ErrDatUnknown
+		}
+		decodeByte, ext, err := findDecodeByte(data[:10])
+		if err != nil {
+			return nil, "", ErrDatUnknown
+		}
+		decoded := make([]byte, len(data))
+		for i := range data {
+			decoded[i] = data[i] ^ decodeByte
+		}
+		return decoded, ext, nil
+	}
+
+	datImageKey.mtx.RLock()
+	aesKey := datImageKey.aesKey
+	xorByte := datImageKey.xorByte
+	datImageKey.mtx.RUnlock()
+	if version == DatVersionV1 {
+		aesKey = datV1AESKey
+	}
+	if len(aesKey) == 0 {
+		return nil, "", ErrDatNoAESKey
+	}
+
+	return decodeDatAES(data, aesKey, xorByte)
+}
+
+func decodeDatAES(data []byte, aesKey []byte, xorByte int) ([]byte, string, error) {
+	if len(data) < datHeaderSize {
+		return nil, "", errors.New("file too short")
+	}
+	aesSize := int64(binary.LittleEndian.Uint32(data[6:10]))
+	xorSize := int64(binary.LittleEndian.Uint32(data[10:14]))
+	body := data[datHeaderSize:]
+	bodySize := int64(len(body))
+
+	// PKCS7 always pads, so an aligned head still gains a full block.
+	aesBlockSize := aesSize/aes.BlockSize*aes.BlockSize + aes.BlockSize
+	if aesBlockSize > bodySize {
+		aesBlockSize = bodySize / aes.BlockSize * aes.BlockSize
+	}
+	if aesSize > aesBlockSize || xorSize > bodySize-aesBlockSize {
+		return nil, "", fmt.Errorf("bad sizes aes %d xor %d body %d", aesSize, xorSize, bodySize)
+	}
+
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, "", err
+	}
+	decoded := make([]byte, 0, bodySize)
+	head := make([]byte, aesBlockSize)
+	for i := int64(0); i < aesBlockSize; i += aes.BlockSize {
+		block.Decrypt(head[i:i+aes.BlockSize], body[i:i+aes.BlockSize])
+	}
+	decoded = append(decoded, head[:aesSize]...)
+
+	if len(decoded) < 10 {
+		return nil, "", errors.New("image head too short")
+	}
+	decodeByte, ext, err := findDecodeByte(decoded)
+	if err != nil || decodeByte != 0 {
+		return nil, "", errors.New("wrong image AES key")
+	}
+
+	decoded = append(decoded, body[aesBlockSize:bodySize-xorSize]...)
+	if xorSize > 0 {
+		tail := body[bodySize-xorSize:]
+		if xorByte < 0 {
+			xorByte = datGuessXorByte(ext, tail)
+		}
+		for _, b := range tail {
+			decoded = append(decoded, b^byte(xorByte))
+		}
+	}
+
+	return decoded, ext, nil
+}
+
+// datGuessXorByte derives the XOR byte from the last byte of the image,
+// which is fixed for the common formats.
+func datGuessXorByte(ext string, tail []byte) int {
+	last := tail[len(tail)-1]
+	switch ext {
+	case ".jpeg":
+		return int(last ^ 0xd9)
+	case ".png":
+		return int(last ^ 0x82)
+	case ".gif":
+		return int(last ^ 0x3b)
+	}
+
+	return 0x37
+}
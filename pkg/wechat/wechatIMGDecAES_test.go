@@ -0,0 +1,127 @@
+package wechat
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testJPEG returns size bytes that start and end like a JPEG.
+func testJPEG(t *testing.T, size int) []byte {
+	t.Helper()
+
+	image := make([]byte, size)
+	if _, err := rand.Read(image); err != nil {
+		t.Fatal(err)
+	}
+	copy(image, []byte{0xff, 0xd8, 0xff, 0xe0})
+	copy(image[size-2:], []byte{0xff, 0xd9})
+
+	return image
+}
+
+// encodeDatAES is the reverse of decodeDatAES: the first aesSize bytes are
+// AES-ECB encrypted with PKCS7 padding and the last xorSize bytes XORed.
+func encodeDatAES(t *testing.T, signature []byte, image []byte, aesKey []byte, aesSize int, xorSize int, xorByte byte) []byte {
+	t.Helper()
+
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pad := aes.BlockSize - aesSize%aes.BlockSize
+	head := append(append([]byte(nil), image[:aesSize]...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	for i := 0; i < len(head); i += aes.BlockSize {
+		block.Encrypt(head[i:i+aes.BlockSize], head[i:i+aes.BlockSize])
+	}
+
+	data := append([]byte(nil), signature...)
+	data = binary.LittleEndian.AppendUint32(data, uint32(aesSize))
+	data = binary.LittleEndian.AppendUint32(data, uint32(xorSize))
+	data = append(data, 1)
+	data = append(data, head...)
+	data = append(data, image[aesSize:len(image)-xorSize]...)
+	for _, b := range image[len(image)-xorSize:] {
+		data = append(data, b^xorByte)
+	}
+
+	return data
+}
+
+func TestDecodeDatRoundTrip(t *testing.T) {
+	t.Cleanup(func() { SetDatImageKey(nil, -1) })
+
+	image := testJPEG(t, 5000)
+	v2Key := []byte("0123456789abcdef")
+	xorData := make([]byte, len(image))
+	for i := range image {
+		xorData[i] = image[i] ^ 0x5a
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		key     []byte
+		xorByte int
+		version int
+	}{
+		{"xor", xorData, nil, -1, DatVersionXor},
+		{"v1", encodeDatAES(t, datV1Signature, image, datV1AESKey, 1000, 300, 0x4c), nil, -1, DatVersionV1},
+		// An aligned head still gets a whole block of padding.
+		{"v1 aligned", encodeDatAES(t, datV1Signature, image, datV1AESKey, 1024, 0, 0), nil, -1, DatVersionV1},
+		{"v2 guessed xor", encodeDatAES(t, datV2Signature, image, v2Key, 1024, 1000, 0x91), v2Key, -1, DatVersionV2},
+		{"v2 given xor", encodeDatAES(t, datV2Signature, image, v2Key, 77, 1, 0x13), v2Key, 0x13, DatVersionV2},
+		{"v2 all aes", encodeDatAES(t, datV2Signature, image, v2Key, len(image), 0, 0), v2Key, -1, DatVersionV2},
+	}
+	for _, tt := range tests {
+		if err := SetDatImageKey(tt.key, tt.xorByte); err != nil {
+			t.Fatal(err)
+		}
+		if version := datVersion(tt.data); version != tt.version {
+			t.Fatalf("%s: version %s", tt.name, DatVersionName(version))
+		}
+		got, ext, err := decodeDatData(tt.data)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if ext != ".jpeg" || !bytes.Equal(got, image) {
+			t.Fatalf("%s: decoded %d bytes as %s, not the image", tt.name, len(got), ext)
+		}
+	}
+}
+
+func TestDecodeDatV2Key(t *testing.T) {
+	t.Cleanup(func() { SetDatImageKey(nil, -1) })
+
+	image := testJPEG(t, 3000)
+	data := encodeDatAES(t, datV2Signature, image, []byte("0123456789abcdef"), 1024, 100, 0x20)
+	path := filepath.Join(t.TempDir(), "image.dat")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	SetDatImageKey(nil, -1)
+	err := DecryptDat(path, path+".jpg")
+	var decodeErr *DatDecodeError
+	if !errors.As(err, &decodeErr) || decodeErr.Version != DatVersionV2 || !errors.Is(err, ErrDatNoAESKey) {
+		t.Fatalf("without key: %v", err)
+	}
+
+	SetDatImageKey([]byte("fedcba9876543210"), -1)
+	if err := DecryptDat(path, path+".jpg"); err == nil {
+		t.Fatal("decoded with a wrong key")
+	}
+
+	SetDatImageKey([]byte("0123456789abcdef"), -1)
+	if err := DecryptDat(path, path+".jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(path + ".jpg"); !bytes.Equal(got, image) {
+		t.Fatal("decoded file is not the image")
+	}
+}
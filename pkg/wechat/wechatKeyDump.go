@@ -0,0 +1,347 @@
+package wechat
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// KeyDumpOptions controls FindDBKeyInDump.
+type KeyDumpOptions struct {
+	Is64Bits  bool            // pointer size of the dumped process.
+	Base      uint64          // virtual address of the first byte of a raw dump; minidumps carry their own map.
+	Profile   *DecryptProfile // nil means DecryptProfileV3, WeChat 3.x; every candidate pays one key derivation of it.
+	ScanBytes bool            // also try aligned random-looking 32-byte runs as the key itself. Slow.
+}
+
+// KeyDumpResult is a key found by FindDBKeyInDump.
+type KeyDumpResult struct {
+	Key     string `json:"Key"`     // hex, the same form as WeChatInfo.DBKey.
+	Profile string `json:"Profile"` // database parameters the key matched.
+	Source  string `json:"Source"`  // "pointer" or "bytes".
+	Offset  int64  `json:"Offset"`  // file offset of the key bytes in the dump.
+	Tried   int    `json:"Tried"`   // candidates checked before the key was found.
+}
+
+// ErrKeyNotInDump is returned when no candidate in the dump opens the database.
+var ErrKeyNotInDump = errors.New("key not found in dump")
+
+// dumpRegion maps a range of the dumped address space to the dump file.
+type dumpRegion struct {
+	addr   uint64
+	offset int64
+	size   int64
+}
+
+type memoryDump struct {
+	fp      *os.File
+	size    int64
+	regions []dumpRegion // sorted by addr.
+}
+
+const (
+	minidumpSignature        = "MDMP"
+	minidumpMemoryListStream = 5
+	minidumpMemory64Stream   = 9
+	dumpScanChunk            = 4 << 20
+)
+
+// openMemoryDump opens a Windows minidump, using its memory list to resolve
+// pointers, or any other file as one raw region starting at base.
+func openMemoryDump(path string, base uint64) (*memoryDump, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+
+	dump := &memoryDump{fp: fp, size: info.Size()}
+	header := make([]byte, 32)
+	if _, err := fp.ReadAt(header, 0); err == nil && string(header[:4]) == minidumpSignature {
+		if err := dump.readMinidumpRegions(header); err != nil {
+			fp.Close()
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	} else {
+		dump.regions = []dumpRegion{{addr: base, offset: 0, size: dump.size}}
+	}
+	sort.Slice(dump.regions, func(i, j int) bool { return dump.regions[i].addr < dump.regions[j].addr })
+
+	return dump, nil
+}
+
+func (d *memoryDump) readMinidumpRegions(header []byte) error {
+	streams := int64(binary.LittleEndian.Uint32(header[8:12]))
+	dirRva := int64(binary.LittleEndian.Uint32(header[12:16]))
+	// Both come from the file, check them before allocating.
+	if dirRva > d.size || streams > (d.size-dirRva)/12 {
+		return errors.New("minidump stream directory out of range")
+	}
+	dir := make([]byte, streams*12)
+	if _, err := d.fp.ReadAt(dir, dirRva); err != nil {
+		return errors.New("bad minidump stream directory")
+	}
+
+	for i := 0; i+12 <= len(dir); i += 12 {
+		streamType := binary.LittleEndian.Uint32(dir[i:])
+		dataSize := int64(binary.LittleEndian.Uint32(dir[i+4:]))
+		rva := int64(binary.LittleEndian.Uint32(dir[i+8:]))
+		if rva+dataSize > d.size {
+			return errors.New("minidump stream out of range")
+		}
+		data := make([]byte, dataSize)
+		if _, err := d.fp.ReadAt(data, rva); err != nil {
+			return err
+		}
+
+		switch streamType {
+		case minidumpMemoryListStream:
+			// count(4), then start(8) size(4) rva(4) per range.
+			if len(data) < 4 {
+				continue
+			}
+			count := int(binary.LittleEndian.Uint32(data))
+			for j := 0; j < count && 4+j*16+16 <= len(data); j++ {
+				entry := data[4+j*16:]
+				d.regions = append(d.regions, dumpRegion{
+					addr:   binary.LittleEndian.Uint64(entry),
+					size:   int64(binary.LittleEndian.Uint32(entry[8:])),
+					offset: int64(binary.LittleEndian.Uint32(entry[12:])),
+				})
+			}
+		case minidumpMemory64Stream:
+			// count(8) baseRva(8), then start(8) size(8) per range stored back to back.
+			if len(data) < 16 {
+				continue
+			}
+			count := int(binary.LittleEndian.Uint64(data))
+			offset := int64(binary.LittleEndian.Uint64(data[8:]))
+			for j := 0; j < count && 16+j*16+16 <= len(data); j++ {
+				entry := data[16+j*16:]
+				region := dumpRegion{
+					addr:   binary.LittleEndian.Uint64(entry),
+					size:   int64(binary.LittleEndian.Uint64(entry[8:])),
+					offset: offset,
+				}
+				d.regions = append(d.regions, region)
+				offset += region.size
+			}
+		}
+	}
+	if len(d.regions) == 0 {
+		return errors.New("minidump has no memory list")
+	}
+
+	return nil
+}
+
+// resolve returns the file offset of n bytes at addr, -1 when they are not
+// in the dump.
+func (d *memoryDump) resolve(addr uint64, n int) int64 {
+	i := sort.Search(len(d.regions), func(i int) bool { return d.regions[i].addr > addr }) - 1
+	if i < 0 {
+		return -1
+	}
+	region := d.regions[i]
+	if addr-region.addr+uint64(n) > uint64(region.size) {
+		return -1
+	}
+	offset := region.offset + int64(addr-region.addr)
+	if offset+int64(n) > d.size {
+		return -1
+	}
+
+	return offset
+}
+
+// scan calls fn with the dump in chunks. Consecutive chunks overlap by
+// overlap bytes so that a pattern is never split; base is the file offset
+// of the chunk.
+func (d *memoryDump) scan(ctx context.Context, overlap int, fn func(chunk []byte, base int64)) error {
+	buffer := make([]byte, dumpScanChunk+overlap)
+	for offset := int64(0); offset < d.size; offset += dumpScanChunk {
+		if ctx.Err() != nil {
+			return nil
+		}
+		start := offset - int64(overlap)
+		if start < 0 {
+			start = 0
+		}
+		n, err := d.fp.ReadAt(buffer[:offset-start+dumpScanChunk], start)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		fn(buffer[:n], start)
+	}
+
+	return nil
+}
+
+// plausibleKey filters out candidates that cannot be a random AES key, such
+// as pointers, text and zero padding. 32 random bytes almost never have
+// fewer than minDistinct different values.
+func plausibleKey(key []byte, minDistinct int) bool {
+	var seen [256]bool
+	distinct := 0
+	for _, b := range key {
+		if !seen[b] {
+			seen[b] = true
+			distinct += 1
+		}
+	}
+
+	return distinct >= minDistinct
+}
+
+type dumpKeyCandidate struct {
+	key    []byte
+	offset int64
+	source string
+}
+
+// FindDBKeyInDump searches a memory dump of a WeChat process for the key of
+// the database at dbPath, usually MicroMsg.db. It looks for the same
+// pointer-then-length-32 pattern as the live search, follows each pointer
+// inside the dump and checks the 32 bytes it points to against the page 1
+// HMAC of dbPath. It runs on any platform, so dumps taken on Windows can be
+// examined elsewhere.
+func FindDBKeyInDump(dumpPath string, dbPath string, opts KeyDumpOptions) (*KeyDumpResult, error) {
+	fp, err := os.Open(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	page1 := make([]byte, maxPageSize)
+	n, err := io.ReadFull(fp, page1)
+	fp.Close()
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("read %s failed: %w", dbPath, err)
+	}
+	page1 = page1[:n]
+
+	// Unlike a known key, candidates are not tried against every profile:
+	// most of them are wrong, and each wrong one would pay the 256000
+	// iterations of SQLCipher 4 on top of the 64000 of SQLCipher 3.
+	profile := opts.Profile
+	if profile == nil {
+		profile = DecryptProfileV3
+	}
+	if err := profile.valid(); err != nil {
+		return nil, err
+	}
+	profiles := []*DecryptProfile{profile}
+
+	dump, err := openMemoryDump(dumpPath, opts.Base)
+	if err != nil {
+		return nil, err
+	}
+	defer dump.fp.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var found *KeyDumpResult
+	var tried int64
+	var foundOnce sync.Once
+	candidates := make(chan dumpKeyCandidate, 64)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for candidate := range candidates {
+				if ctx.Err() != nil {
+					continue
+				}
+				count := atomic.AddInt64(&tried, 1)
+				matched, _, _ := detectDecryptProfile(page1, candidate.key, profiles)
+				if matched == nil {
+					continue
+				}
+				foundOnce.Do(func() {
+					found = &KeyDumpResult{
+						Key:     hex.EncodeToString(candidate.key),
+						Profile: matched.Name,
+						Source:  candidate.source,
+						Offset:  candidate.offset,
+						Tried:   int(count),
+					}
+					cancel()
+				})
+			}
+		}()
+	}
+
+	seen := make(map[string]bool)
+	send := func(candidate dumpKeyCandidate) {
+		if seen[string(candidate.key)] {
+			return
+		}
+		seen[string(candidate.key)] = true
+		select {
+		case candidates <- candidate:
+		case <-ctx.Done():
+		}
+	}
+
+	step := 8
+	if !opts.Is64Bits {
+		step = 4
+	}
+	err = dump.scan(ctx, 2*step, func(chunk []byte, base int64) {
+		// findDBKeyPtr walks back from the end in steps, keep it aligned.
+		chunk = chunk[:len(chunk)/step*step]
+		if len(chunk) < 2*step {
+			return
+		}
+		pointer := make([]byte, 8)
+		for _, ptr := range findDBKeyPtr(chunk, opts.Is64Bits) {
+			copy(pointer, ptr)
+			addr := binary.LittleEndian.Uint64(pointer)
+			if addr == 0 {
+				continue
+			}
+			offset := dump.resolve(addr, keySize)
+			if offset < 0 {
+				continue
+			}
+			key := make([]byte, keySize)
+			if _, err := dump.fp.ReadAt(key, offset); err != nil || !plausibleKey(key, 20) {
+				continue
+			}
+			send(dumpKeyCandidate{key: key, offset: offset, source: "pointer"})
+		}
+	})
+	if err == nil && opts.ScanBytes {
+		// Keys are heap allocations, aligned to the pointer size.
+		err = dump.scan(ctx, keySize, func(chunk []byte, base int64) {
+			for i := 0; i+keySize <= len(chunk) && ctx.Err() == nil; i += step {
+				if !plausibleKey(chunk[i:i+keySize], 26) {
+					continue
+				}
+				send(dumpKeyCandidate{key: append([]byte(nil), chunk[i:i+keySize]...), offset: base + int64(i), source: "bytes"})
+			}
+		})
+	}
+	close(candidates)
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%w, %d candidates tried", ErrKeyNotInDump, tried)
+	}
+
+	return found, nil
+}
@@ -0,0 +1,136 @@
+package wechat
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testDumpAddr = 0x7ff612340000
+
+// testDumpRegion is 256 bytes of process memory at testDumpAddr. It holds
+// the pointer-then-length-32 pattern pointing at key, one pointing at a
+// wrong key and one pointing outside the dump.
+func testDumpRegion(t *testing.T, key []byte) []byte {
+	t.Helper()
+
+	region := bytes.Repeat([]byte{0x11}, 256)
+	wrong := make([]byte, keySize)
+	if _, err := rand.Read(wrong); err != nil {
+		t.Fatal(err)
+	}
+	pattern := func(offset int, addr uint64) {
+		binary.LittleEndian.PutUint64(region[offset:], addr)
+		binary.LittleEndian.PutUint64(region[offset+8:], keySize)
+	}
+	pattern(16, 0x1000)
+	pattern(48, testDumpAddr+96)
+	copy(region[96:], wrong)
+	pattern(64, testDumpAddr+160)
+	copy(region[160:], key)
+
+	return region
+}
+
+// testMinidump wraps region in a minidump with one Memory64List stream.
+func testMinidump(region []byte) []byte {
+	dump := make([]byte, 80)
+	copy(dump, minidumpSignature)
+	binary.LittleEndian.PutUint32(dump[8:], 1)   // streams
+	binary.LittleEndian.PutUint32(dump[12:], 32) // directory rva
+	binary.LittleEndian.PutUint32(dump[32:], minidumpMemory64Stream)
+	binary.LittleEndian.PutUint32(dump[36:], 32) // data size
+	binary.LittleEndian.PutUint32(dump[40:], 48) // data rva
+	binary.LittleEndian.PutUint64(dump[48:], 1)  // ranges
+	binary.LittleEndian.PutUint64(dump[56:], 80) // rva of the first range
+	binary.LittleEndian.PutUint64(dump[64:], testDumpAddr)
+	binary.LittleEndian.PutUint64(dump[72:], uint64(len(region)))
+
+	return append(dump, region...)
+}
+
+func TestFindDBKeyInDump(t *testing.T) {
+	dir := t.TempDir()
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	dbPath := filepath.Join(dir, "MicroMsg.db")
+	enc := newTestCipher(t, key, DecryptProfileV3).encrypt(t, testPlainPages(t, 2, DecryptProfileV3))
+	if err := os.WriteFile(dbPath, enc, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	region := testDumpRegion(t, key)
+	tests := []struct {
+		name   string
+		dump   []byte
+		opts   KeyDumpOptions
+		offset int64
+	}{
+		{"minidump", testMinidump(region), KeyDumpOptions{Is64Bits: true}, 80 + 160},
+		{"raw", region, KeyDumpOptions{Is64Bits: true, Base: testDumpAddr}, 160},
+	}
+	for _, tt := range tests {
+		dumpPath := filepath.Join(dir, tt.name+".dmp")
+		if err := os.WriteFile(dumpPath, tt.dump, 0644); err != nil {
+			t.Fatal(err)
+		}
+		result, err := FindDBKeyInDump(dumpPath, dbPath, tt.opts)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if result.Key != hex.EncodeToString(key) || result.Profile != DecryptProfileV3.Name || result.Source != "pointer" || result.Offset != tt.offset {
+			t.Fatalf("%s: result %+v", tt.name, result)
+		}
+	}
+
+	// A raw dump at the wrong base resolves no pointer.
+	rawPath := filepath.Join(dir, "raw.dmp")
+	if _, err := FindDBKeyInDump(rawPath, dbPath, KeyDumpOptions{Is64Bits: true}); !errors.Is(err, ErrKeyNotInDump) {
+		t.Fatalf("wrong base: %v", err)
+	}
+}
+
+func TestOpenMemoryDumpBounds(t *testing.T) {
+	dir := t.TempDir()
+	good := testMinidump(make([]byte, 64))
+
+	// huge stream count, stream past the end of the file, and a memory
+	// range list whose count is larger than the stream
+	streams := append([]byte(nil), good...)
+	binary.LittleEndian.PutUint32(streams[8:], 0xffffffff)
+	outside := append([]byte(nil), good...)
+	binary.LittleEndian.PutUint32(outside[40:], uint32(len(good)))
+	ranges := append([]byte(nil), good...)
+	binary.LittleEndian.PutUint64(ranges[48:], 1<<40)
+
+	for name, data := range map[string][]byte{"streams": streams, "outside": outside} {
+		path := filepath.Join(dir, name+".dmp")
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if dump, err := openMemoryDump(path, 0); err == nil {
+			dump.fp.Close()
+			t.Fatalf("%s: opened a broken minidump", name)
+		}
+	}
+
+	path := filepath.Join(dir, "ranges.dmp")
+	if err := os.WriteFile(path, ranges, 0644); err != nil {
+		t.Fatal(err)
+	}
+	dump, err := openMemoryDump(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dump.fp.Close()
+	if len(dump.regions) != 1 || dump.resolve(testDumpAddr, 64) != 80 || dump.resolve(testDumpAddr+1, 64) != -1 {
+		t.Fatalf("regions %+v", dump.regions)
+	}
+}
@@ -0,0 +1,268 @@
+package wechat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ExportManifestFile is written to the export directory at the end of every
+// export that runs to completion. It lists what the backup is supposed to
+// contain, so VerifyExport can later tell whether it still does.
+const ExportManifestFile = ".export-manifest.json"
+
+const exportManifestVersion = 1
+
+// ErrNoExportManifest is returned by VerifyExport for an export directory
+// that has never been exported to completion.
+var ErrNoExportManifest = errors.New("export has no manifest")
+
+// ExportManifest lists every file of an export, including the decrypted
+// databases and their sidecars.
+type ExportManifest struct {
+	Version int                   `json:"version"`
+	Created time.Time             `json:"created"`
+	Files   []ExportManifestEntry `json:"files"` // sorted by Path.
+}
+
+// ExportManifestEntry is one file of an export.
+type ExportManifestEntry struct {
+	Path    string `json:"path"` // relative to the export directory, slash separated.
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"modTime"` // unix nanoseconds.
+	SHA256  string `json:"sha256"`
+}
+
+// ExportVerifyReport is the result of VerifyExport. Paths are relative to
+// the export directory.
+type ExportVerifyReport struct {
+	Created    time.Time `json:"created"`    // when the manifest was written.
+	Incomplete bool      `json:"incomplete"` // a later export was interrupted, the manifest may be behind.
+	Files      int       `json:"files"`      // files in the manifest.
+	OK         int       `json:"ok"`
+	Missing    []string  `json:"missing"`
+	Changed    []string  `json:"changed"` // size or content differs from the manifest.
+	Extra      []string  `json:"extra"`   // present but not in the manifest.
+	Bytes      int64     `json:"bytes"`   // bytes hashed.
+}
+
+// Intact reports whether the export matches its manifest exactly.
+func (r *ExportVerifyReport) Intact() bool {
+	return len(r.Missing) == 0 && len(r.Changed) == 0 && len(r.Extra) == 0
+}
+
+// isExportBookkeeping reports whether rel is one of the files an export keeps
+// about itself rather than backed up data. Msg/UserData.db is included: it
+// holds the bookmarks and read positions of whoever browses the backup, is
+// created the first time the account is opened and changes with every
+// bookmark, so it would never match the manifest.
+func isExportBookkeeping(rel string) bool {
+	switch rel {
+	case ExportIncompleteFile, ExportCheckpointFile, ExportCheckpointFile + ".tmp", ExportManifestFile, ExportManifestFile + ".tmp":
+		return true
+	}
+
+	userData := "Msg/" + UserDataDB
+	if rel == userData || strings.HasPrefix(rel, userData+".encrypting-") {
+		return true
+	}
+	for _, suffix := range []string{"-wal", "-shm", "-journal"} {
+		if rel == userData+suffix {
+			return true
+		}
+	}
+
+	return false
+}
+
+// listExportFiles returns the data files under expPath by relative path.
+func listExportFiles(expPath string) (map[string]os.FileInfo, error) {
+	files := make(map[string]os.FileInfo)
+	err := filepath.Walk(expPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(expPath, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if !isExportBookkeeping(rel) {
+			files[rel] = info
+		}
+		return nil
+	})
+
+	return files, err
+}
+
+// hashExportFiles hashes the given files of expPath in parallel and calls fn
+// with each result, never concurrently.
+func hashExportFiles(expPath string, rels []string, fn func(rel string, sum string, err error)) {
+	var mtx sync.Mutex
+	var wg sync.WaitGroup
+	relChan := make(chan string, 100)
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rel := range relChan {
+				sum, err := hashFile(filepath.Join(expPath, filepath.FromSlash(rel)))
+				mtx.Lock()
+				fn(rel, sum, err)
+				mtx.Unlock()
+			}
+		}()
+	}
+	for _, rel := range rels {
+		relChan <- rel
+	}
+	close(relChan)
+	wg.Wait()
+}
+
+// WriteExportManifest hashes the export at expPath and writes its manifest.
+// Files the checkpoint manifest already hashed and that have not changed
+// since are not read again.
+func WriteExportManifest(expPath string) (*ExportManifest, error) {
+	checkpoint, err := LoadExportCheckpoint(expPath)
+	if err != nil {
+		return nil, err
+	}
+	files, err := listExportFiles(expPath)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &ExportManifest{Version: exportManifestVersion, Created: time.Now(), Files: make([]ExportManifestEntry, 0, len(files))}
+	rehash := make([]string, 0)
+	for rel, info := range files {
+		entry := ExportManifestEntry{Path: rel, Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+		if cp, ok := checkpoint[rel]; ok && cp.Size == entry.Size && cp.ModTime == entry.ModTime {
+			entry.SHA256 = cp.SHA256
+			manifest.Files = append(manifest.Files, entry)
+			continue
+		}
+		rehash = append(rehash, rel)
+	}
+
+	var hashErr error
+	hashExportFiles(expPath, rehash, func(rel string, sum string, err error) {
+		if err != nil {
+			hashErr = err
+			return
+		}
+		info := files[rel]
+		manifest.Files = append(manifest.Files, ExportManifestEntry{Path: rel, Size: info.Size(), ModTime: info.ModTime().UnixNano(), SHA256: sum})
+	})
+	if hashErr != nil {
+		return nil, hashErr
+	}
+	sort.Slice(manifest.Files, func(i, j int) bool { return manifest.Files[i].Path < manifest.Files[j].Path })
+
+	data, err := json.MarshalIndent(manifest, "", " ")
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(expPath, ExportManifestFile)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// LoadExportManifest reads the manifest of expPath.
+func LoadExportManifest(expPath string) (*ExportManifest, error) {
+	data, err := os.ReadFile(filepath.Join(expPath, ExportManifestFile))
+	if os.IsNotExist(err) {
+		return nil, ErrNoExportManifest
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &ExportManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("%s: %w", ExportManifestFile, err)
+	}
+	if manifest.Version != exportManifestVersion {
+		return nil, fmt.Errorf("%s: unsupported version %d", ExportManifestFile, manifest.Version)
+	}
+
+	return manifest, nil
+}
+
+// VerifyExport re-hashes every file of the export at expPath and compares
+// the result with its manifest. A file whose content is unchanged counts as
+// OK even when its mtime is not.
+func VerifyExport(expPath string) (*ExportVerifyReport, error) {
+	manifest, err := LoadExportManifest(expPath)
+	if err != nil {
+		return nil, err
+	}
+	files, err := listExportFiles(expPath)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ExportVerifyReport{
+		Created:    manifest.Created,
+		Incomplete: IsExportIncomplete(expPath),
+		Files:      len(manifest.Files),
+		Missing:    make([]string, 0),
+		Changed:    make([]string, 0),
+		Extra:      make([]string, 0),
+	}
+	expected := make(map[string]ExportManifestEntry, len(manifest.Files))
+	rehash := make([]string, 0, len(manifest.Files))
+	for _, entry := range manifest.Files {
+		expected[entry.Path] = entry
+		info, ok := files[entry.Path]
+		switch {
+		case !ok:
+			report.Missing = append(report.Missing, entry.Path)
+		case info.Size() != entry.Size:
+			report.Changed = append(report.Changed, entry.Path)
+		default:
+			rehash = append(rehash, entry.Path)
+		}
+	}
+	for rel := range files {
+		if _, ok := expected[rel]; !ok {
+			report.Extra = append(report.Extra, rel)
+		}
+	}
+
+	hashExportFiles(expPath, rehash, func(rel string, sum string, err error) {
+		if err != nil {
+			// Unreadable counts as missing, the backup cannot be restored from it.
+			report.Missing = append(report.Missing, rel)
+			return
+		}
+		report.Bytes += expected[rel].Size
+		if sum != expected[rel].SHA256 {
+			report.Changed = append(report.Changed, rel)
+			return
+		}
+		report.OK += 1
+	})
+	sort.Strings(report.Missing)
+	sort.Strings(report.Changed)
+	sort.Strings(report.Extra)
+
+	return report, nil
+}
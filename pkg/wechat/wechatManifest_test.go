@@ -0,0 +1,80 @@
+package wechat
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifyExport(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := VerifyExport(dir); err != ErrNoExportManifest {
+		t.Fatalf("verify without manifest: %v, want %v", err, ErrNoExportManifest)
+	}
+
+	files := map[string]string{
+		"Msg/MicroMsg.db":   "micro",
+		"Msg/Multi/MSG0.db": "msg0",
+		"FileStorage/a.jpg": "aaaa",
+		"FileStorage/b.jpg": "bbbb",
+		"FileStorage/c.jpg": "cccc",
+	}
+	for rel, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manifest, err := WriteExportManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Files) != len(files) {
+		t.Fatalf("manifest has %d files, want %d", len(manifest.Files), len(files))
+	}
+
+	report, err := VerifyExport(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Intact() || report.OK != len(files) {
+		t.Fatalf("fresh export: %+v", report)
+	}
+
+	write := func(rel, content string) {
+		if err := os.WriteFile(filepath.Join(dir, filepath.FromSlash(rel)), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Browsing the backup creates UserData.db, which is not backed up data.
+	write("Msg/"+UserDataDB, "bookmarks")
+	if err := os.Remove(filepath.Join(dir, "FileStorage", "a.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	write("FileStorage/b.jpg", "BBBB") // same size, other content.
+	write("FileStorage/c.jpg", "c")
+	write("FileStorage/d.jpg", "dddd")
+
+	report, err = VerifyExport(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Intact() {
+		t.Fatal("damaged export is intact")
+	}
+	check := func(name string, got []string, want string) {
+		if strings.Join(got, " ") != want {
+			t.Errorf("%s %q, want %q", name, got, want)
+		}
+	}
+	check("missing", report.Missing, "FileStorage/a.jpg")
+	check("changed", report.Changed, "FileStorage/b.jpg FileStorage/c.jpg")
+	check("extra", report.Extra, "FileStorage/d.jpg")
+	if report.Files != len(files) || report.OK != 2 {
+		t.Errorf("files %d ok %d, want %d and 2", report.Files, report.OK, len(files))
+	}
+}
@@ -0,0 +1,696 @@
+package wechat
+
+import (
+	"container/heap"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// mergeShardMessages is how many messages MergeExports writes to one MSG
+// shard before starting the next, a variable so tests can roll over early.
+var mergeShardMessages = 200000
+
+// Indexes into the columns of wechatMSGCopyColumns that the merge looks at.
+const (
+	mergeColTalkerId   = 0
+	mergeColMsgSvrID   = 1
+	mergeColType       = 2
+	mergeColIsSender   = 4
+	mergeColCreateTime = 5
+	mergeColSequence   = 6
+	mergeColStrTalker  = 12
+	mergeColStrContent = 13
+)
+
+// mergeTables are the account tables MergeExports unions. Rows are matched
+// on key; a row already in the merged database is kept unless newer is set
+// and the other source has a larger value in it.
+var mergeTables = []struct {
+	db, table, key, newer string
+}{
+	{MicroMsgDB, "Contact", "UserName", ""},
+	{MicroMsgDB, "ContactHeadImgUrl", "usrName", ""},
+	{MicroMsgDB, "ChatRoom", "ChatRoomName", ""},
+	{MicroMsgDB, "Session", "strUsrName", "nTime"},
+	{OpenIMContactDB, "OpenIMContact", "UserName", ""},
+}
+
+// MergeReport is the result of MergeExports.
+type MergeReport struct {
+	Sources    []string       `json:"sources"`    // in merge order, Base first.
+	Base       string         `json:"base"`       // the export used last, its account databases win.
+	Messages   int            `json:"messages"`   // messages in the merged shards.
+	Duplicates int            `json:"duplicates"` // messages dropped because an earlier source had them.
+	Shards     int            `json:"shards"`
+	Rows       map[string]int `json:"rows"`  // rows each table got from the other sources.
+	Media      int            `json:"media"` // FileStorage files copied.
+	MediaBytes int64          `json:"mediaBytes"`
+	Conflicts  []string       `json:"conflicts"` // FileStorage paths whose size differs between sources, the first copy is kept.
+}
+
+// MergeExports merges exports or snapshots of the same account made on
+// different machines into a new account directory at dstPath, which must
+// not exist and must be named after the account. Messages are deduplicated on
+// MsgSvrID, or on talker, time and content for local ones without it, and
+// written to new MSG shards in time order. Contact, ChatRoom and Session
+// rows and FileStorage files are unioned. The result is built next to
+// dstPath and only renamed into place once complete, then gets a search
+// index and a manifest like a finished export.
+func MergeExports(srcPaths []string, dstPath string) (*MergeReport, error) {
+	if len(srcPaths) < 2 {
+		return nil, errors.New("merge needs at least two exports")
+	}
+	dstPath = filepath.Clean(dstPath)
+	account := filepath.Base(dstPath)
+	if _, err := os.Stat(dstPath); err == nil {
+		return nil, fmt.Errorf("%s already exists", dstPath)
+	}
+
+	report := &MergeReport{Rows: make(map[string]int), Conflicts: make([]string, 0)}
+	var lastActive int64
+	for _, src := range srcPaths {
+		src = filepath.Clean(src)
+		if IsExportIncomplete(src) {
+			return nil, fmt.Errorf("%s: export is incomplete", src)
+		}
+		active, err := mergeLastActive(src, account)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", src, err)
+		}
+		if report.Base == "" || active > lastActive {
+			report.Base, lastActive = src, active
+		}
+		report.Sources = append(report.Sources, src)
+	}
+	sources := []string{report.Base}
+	for _, src := range report.Sources {
+		if src != report.Base {
+			sources = append(sources, src)
+		}
+	}
+	report.Sources = sources
+
+	tmpPath := filepath.Join(filepath.Dir(dstPath), ".merging-"+account)
+	if err := os.RemoveAll(tmpPath); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(tmpPath, "Msg", "Multi"), 0755); err != nil {
+		return nil, err
+	}
+	done := false
+	defer func() {
+		if !done {
+			os.RemoveAll(tmpPath)
+		}
+	}()
+
+	if err := mergeAccountDBs(tmpPath, sources, report); err != nil {
+		return report, err
+	}
+	if err := mergeMessages(tmpPath, sources, report); err != nil {
+		return report, err
+	}
+	if err := mergeFileStorage(tmpPath, sources, report); err != nil {
+		return report, err
+	}
+	if err := os.Rename(tmpPath, dstPath); err != nil {
+		return report, err
+	}
+	done = true
+
+	// Before the manifest, which has to list the index. Without one,
+	// searches scan the MSG shards.
+	if count, err := UpdateWeChatSearchIndex(dstPath); errors.Is(err, ErrNoFTS5) {
+		log.Println("UpdateWeChatSearchIndex skipped:", err)
+	} else if err != nil {
+		log.Println("UpdateWeChatSearchIndex failed:", err)
+	} else {
+		log.Println("UpdateWeChatSearchIndex add", count)
+	}
+	if _, err := WriteExportManifest(dstPath); err != nil {
+		return report, err
+	}
+
+	return report, nil
+}
+
+// mergeLastActive checks that src, an export or snapshot, is one of account
+// and returns the time of its newest session, which tells the machine used
+// last.
+func mergeLastActive(src string, account string) (int64, error) {
+	db, err := wechatOpenDB(filepath.Join(src, "Msg", MicroMsgDB))
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var count int
+	if err := db.queryRow("select count(*) from Contact where UserName=?;", account).Scan(&count); err != nil {
+		return 0, err
+	}
+	if count == 0 {
+		return 0, fmt.Errorf("not an export of %s", account)
+	}
+
+	var nTime int64
+	err = db.queryRow("select ifnull(max(nTime),0) from Session;").Scan(&nTime)
+	return nTime, err
+}
+
+// mergeAccountDBs copies the databases of the Msg directory from the first
+// source that has them, then unions mergeTables from the others into them.
+// Search indexes are left out: FTSMSG.db and FTSContact.db index the rows
+// of one source only, and FTSIndex.db is rebuilt by MergeExports from the
+// merged messages. Recovered messages are left out as well, they can be
+// recovered again from the sources.
+func mergeAccountDBs(dstPath string, sources []string, report *MergeReport) error {
+	for _, src := range sources {
+		paths, err := filepath.Glob(filepath.Join(src, "Msg", "*.db"))
+		if err != nil {
+			return err
+		}
+		for _, path := range paths {
+			name := filepath.Base(path)
+			if name == FTSIndexDB || name == FTSMSGDB || name == FTSContactDB || name == RecoveredDB {
+				continue
+			}
+			dst := filepath.Join(dstPath, "Msg", name)
+			if _, err := os.Stat(dst); err == nil {
+				continue
+			}
+			if _, err := copyFile(path, dst); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, name := range []string{MicroMsgDB, OpenIMContactDB} {
+		dstDBPath := filepath.Join(dstPath, "Msg", name)
+		if _, err := os.Stat(dstDBPath); err != nil {
+			continue
+		}
+		dst, err := wechatOpenDB(dstDBPath)
+		if err != nil {
+			return err
+		}
+		err = func() error {
+			for _, src := range sources[1:] {
+				srcDBPath := filepath.Join(src, "Msg", name)
+				if _, err := os.Stat(srcDBPath); err != nil {
+					continue
+				}
+				srcDB, err := wechatOpenDB(srcDBPath)
+				if err != nil {
+					return err
+				}
+				for _, t := range mergeTables {
+					if t.db != name {
+						continue
+					}
+					n, err := mergeTableRows(dst, srcDB, t.table, t.key, t.newer)
+					if err != nil {
+						srcDB.Close()
+						return fmt.Errorf("%s %s: %w", srcDBPath, t.table, err)
+					}
+					report.Rows[t.table] += n
+				}
+				srcDB.Close()
+			}
+			return nil
+		}()
+		if closeErr := dst.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// tableColumns returns the column names of table, none when it does not
+// exist.
+func tableColumns(db *wechatDB, table string) ([]string, error) {
+	rows, err := db.query("select name from pragma_table_info(?);", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns = append(columns, name)
+	}
+
+	return columns, rows.Err()
+}
+
+// mergeTableRows adds the rows of table in src whose key dst does not have,
+// or has with a smaller value in newer, and returns how many it wrote. Only
+// the columns both sides have are copied, so exports of different WeChat
+// versions merge.
+func mergeTableRows(dst, src *wechatDB, table, key, newer string) (int, error) {
+	dstColumns, err := tableColumns(dst, table)
+	if err != nil {
+		return 0, err
+	}
+	srcColumns, err := tableColumns(src, table)
+	if err != nil {
+		return 0, err
+	}
+	has := make(map[string]bool, len(srcColumns))
+	for _, column := range srcColumns {
+		has[column] = true
+	}
+	columns := make([]string, 0, len(dstColumns))
+	keyIndex, newerIndex := -1, -1
+	for _, column := range dstColumns {
+		if !has[column] {
+			continue
+		}
+		switch column {
+		case key:
+			keyIndex = len(columns)
+		case newer:
+			newerIndex = len(columns)
+		}
+		columns = append(columns, column)
+	}
+	if keyIndex < 0 {
+		return 0, nil
+	}
+
+	newerExpr := "0"
+	if newerIndex >= 0 {
+		newerExpr = "ifnull(" + newer + ",0)"
+	}
+	existing := make(map[string]int64)
+	rows, err := dst.query(fmt.Sprintf("select ifnull(%s,''), %s from %s;", key, newerExpr, table))
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var k string
+		var t int64
+		if err := rows.Scan(&k, &t); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		existing[k] = t
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	if dst.locked != nil {
+		dst.locked.modified.Store(true)
+	}
+	tx, err := dst.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	list := strings.Join(columns, ", ")
+	ins, err := tx.Prepare(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s);", table, list, sqlPlaceholders(len(columns))))
+	if err != nil {
+		return 0, err
+	}
+	defer ins.Close()
+	del, err := tx.Prepare(fmt.Sprintf("DELETE FROM %s WHERE %s=?;", table, key))
+	if err != nil {
+		return 0, err
+	}
+	defer del.Close()
+
+	srcRows, err := src.query(fmt.Sprintf("select %s from %s;", list, table))
+	if err != nil {
+		return 0, err
+	}
+	defer srcRows.Close()
+
+	count := 0
+	for srcRows.Next() {
+		values, err := mergeScanValues(srcRows, len(columns))
+		if err != nil {
+			return count, err
+		}
+		k := mergeString(values[keyIndex])
+		if k == "" {
+			continue
+		}
+		var t int64
+		if newerIndex >= 0 {
+			t = mergeInt(values[newerIndex])
+		}
+		if have, ok := existing[k]; ok {
+			if newerIndex < 0 || t <= have {
+				continue
+			}
+			if _, err := del.Exec(k); err != nil {
+				return count, err
+			}
+		}
+		if _, err := ins.Exec(values...); err != nil {
+			return count, err
+		}
+		existing[k] = t
+		count += 1
+	}
+	if err := srcRows.Err(); err != nil {
+		return count, err
+	}
+
+	return count, tx.Commit()
+}
+
+func mergeScanValues(rows *sql.Rows, n int) ([]interface{}, error) {
+	values := make([]interface{}, n)
+	dest := make([]interface{}, n)
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	err := rows.Scan(dest...)
+
+	return values, err
+}
+
+func mergeString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case nil:
+		return ""
+	}
+
+	return fmt.Sprint(v)
+}
+
+func mergeInt(v interface{}) int64 {
+	switch v := v.(type) {
+	case int64:
+		return v
+	case float64:
+		return int64(v)
+	case string, []byte:
+		n, _ := strconv.ParseInt(mergeString(v), 10, 64)
+		return n
+	}
+
+	return 0
+}
+
+// mergeCursor reads the messages of one source shard in time order.
+type mergeCursor struct {
+	db         *wechatDB
+	rows       *sql.Rows
+	source     int
+	values     []interface{}
+	createTime int64
+	sequence   int64
+}
+
+func (c *mergeCursor) next() (bool, error) {
+	if !c.rows.Next() {
+		return false, c.rows.Err()
+	}
+	values, err := mergeScanValues(c.rows, len(c.values))
+	if err != nil {
+		return false, err
+	}
+	c.values = values
+	c.createTime = mergeInt(values[mergeColCreateTime])
+	c.sequence = mergeInt(values[mergeColSequence])
+
+	return true, nil
+}
+
+// mergeHeap orders cursors by their current message, so popping it yields
+// the messages of every shard as one time ordered stream.
+type mergeHeap []*mergeCursor
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].createTime != h[j].createTime {
+		return h[i].createTime < h[j].createTime
+	}
+	if h[i].sequence != h[j].sequence {
+		return h[i].sequence < h[j].sequence
+	}
+	return h[i].source < h[j].source
+}
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(*mergeCursor)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// mergeMessages writes the messages of every source, without duplicates,
+// to new MSG shards of dstPath. The shards are encrypted at rest when the
+// merged MicroMsg.db is.
+func mergeMessages(dstPath string, sources []string, report *MergeReport) error {
+	cursors := make([]*mergeCursor, 0)
+	defer func() {
+		for _, c := range cursors {
+			c.rows.Close()
+			c.db.Close()
+		}
+	}()
+
+	columns := len(strings.Split(wechatMSGCopyColumns, ","))
+	h := &mergeHeap{}
+	for i, src := range sources {
+		for _, path := range wechatMsgDBPaths(src) {
+			db, err := wechatOpenDB(path)
+			if err != nil {
+				return err
+			}
+			rows, err := db.query("select " + wechatMSGCopyColumns + " from MSG order by CreateTime, Sequence;")
+			if err != nil {
+				db.Close()
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			c := &mergeCursor{db: db, rows: rows, source: i, values: make([]interface{}, columns)}
+			cursors = append(cursors, c)
+			ok, err := c.next()
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			if ok {
+				heap.Push(h, c)
+			}
+		}
+	}
+	if len(cursors) == 0 {
+		return nil
+	}
+
+	locked, _ := IsEncryptedDataBase(filepath.Join(dstPath, "Msg", MicroMsgDB))
+	w := &mergeShardWriter{dir: filepath.Join(dstPath, "Msg", "Multi"), schema: cursors[0].db, locked: locked}
+	defer w.close()
+	seen := make(map[int64]struct{})
+	seenLocal := make(map[string]struct{})
+	for h.Len() > 0 {
+		c := (*h)[0]
+		values := c.values
+		duplicate := false
+		if msgSvrID := mergeInt(values[mergeColMsgSvrID]); msgSvrID != 0 {
+			_, duplicate = seen[msgSvrID]
+			seen[msgSvrID] = struct{}{}
+		} else {
+			key := fmt.Sprintf("%s|%d|%d|%d|%s", mergeString(values[mergeColStrTalker]), c.createTime,
+				mergeInt(values[mergeColIsSender]), mergeInt(values[mergeColType]), mergeString(values[mergeColStrContent]))
+			_, duplicate = seenLocal[key]
+			seenLocal[key] = struct{}{}
+		}
+		if duplicate {
+			report.Duplicates += 1
+		} else {
+			if err := w.write(values); err != nil {
+				return err
+			}
+			report.Messages += 1
+		}
+
+		ok, err := c.next()
+		if err != nil {
+			return fmt.Errorf("%s: %w", c.db.path, err)
+		}
+		if ok {
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+	}
+	report.Shards = w.shards
+
+	return w.close()
+}
+
+// mergeShardWriter writes messages to MSG0.db, MSG1.db, ... in turn, each
+// with its own Name2ID table.
+type mergeShardWriter struct {
+	dir    string
+	schema *wechatDB // a source shard to copy the MSG and Name2ID tables from.
+	locked bool
+	shards int
+	rows   int
+	db     *wechatDB
+	tx     *sql.Tx
+	ins    *sql.Stmt
+	name   *sql.Stmt
+	names  map[string]int64
+}
+
+func (w *mergeShardWriter) open() error {
+	path := filepath.Join(w.dir, fmt.Sprintf("MSG%d.db", w.shards))
+	var err error
+	if w.locked {
+		w.db, err = wechatOpenMemDB(path, nil, getBackupPassphrase())
+	} else {
+		w.db, err = wechatOpenDB(path)
+	}
+	if err != nil {
+		return err
+	}
+	w.shards += 1
+	w.rows = 0
+	w.names = make(map[string]int64)
+	if w.db.locked != nil {
+		w.db.locked.modified.Store(true)
+	}
+
+	if err := wechatCopyDBTables(w.db.DB, w.schema, []string{"MSG", "Name2ID"}); err != nil {
+		return err
+	}
+	if w.tx, err = w.db.Begin(); err != nil {
+		return err
+	}
+	if w.ins, err = w.tx.Prepare("INSERT INTO MSG (" + wechatMSGCopyColumns + ") VALUES (" + sqlPlaceholders(len(strings.Split(wechatMSGCopyColumns, ","))) + ");"); err != nil {
+		return err
+	}
+	w.name, err = w.tx.Prepare("INSERT INTO Name2ID (UsrName) VALUES (?);")
+
+	return err
+}
+
+// write adds one message, TalkerId is remapped to the Name2ID of the shard.
+func (w *mergeShardWriter) write(values []interface{}) error {
+	if w.db == nil {
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+
+	talker := mergeString(values[mergeColStrTalker])
+	id, ok := w.names[talker]
+	if !ok {
+		res, err := w.name.Exec(talker)
+		if err != nil {
+			return err
+		}
+		if id, err = res.LastInsertId(); err != nil {
+			return err
+		}
+		w.names[talker] = id
+	}
+	values[mergeColTalkerId] = id
+	if _, err := w.ins.Exec(values...); err != nil {
+		return err
+	}
+
+	w.rows += 1
+	if w.rows >= mergeShardMessages {
+		return w.close()
+	}
+	return nil
+}
+
+// close finishes the current shard; the next write starts a new one.
+func (w *mergeShardWriter) close() error {
+	if w.db == nil {
+		return nil
+	}
+	var err error
+	if w.ins != nil {
+		w.ins.Close()
+	}
+	if w.name != nil {
+		w.name.Close()
+	}
+	if w.tx != nil {
+		err = w.tx.Commit()
+	}
+	if closeErr := w.db.Close(); err == nil {
+		err = closeErr
+	}
+	w.db, w.tx, w.ins, w.name = nil, nil, nil, nil
+
+	return err
+}
+
+// mergeFileStorage copies every FileStorage file of the sources that the
+// merged account does not have yet. Files keep their mtime.
+func mergeFileStorage(dstPath string, sources []string, report *MergeReport) error {
+	for _, src := range sources {
+		root := filepath.Join(src, "FileStorage")
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				if path == root && os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			rel, err := filepath.Rel(src, path)
+			if err != nil {
+				return err
+			}
+
+			dst := filepath.Join(dstPath, rel)
+			if have, err := os.Stat(dst); err == nil {
+				if have.Size() != info.Size() {
+					report.Conflicts = append(report.Conflicts, filepath.ToSlash(rel))
+				}
+				return nil
+			}
+			if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+				return err
+			}
+			n, err := copyFile(path, dst)
+			if err != nil {
+				return err
+			}
+			if err := os.Chtimes(dst, info.ModTime(), info.ModTime()); err != nil {
+				log.Println("mergeFileStorage:", err)
+			}
+			report.Media += 1
+			report.MediaBytes += n
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,261 @@
+package wechat
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testCreateMergeSource writes an export of account with the given contacts
+// and sessions ("name:nTime:content") and one MSG shard per entry of shards.
+func testCreateMergeSource(t *testing.T, path string, account string, contacts []string, sessions []string, shards ...[]testMsg) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Join(path, "Msg", "Multi"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", filepath.Join(path, "Msg", MicroMsgDB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec(`CREATE TABLE Contact (UserName TEXT PRIMARY KEY, NickName TEXT);
+		CREATE TABLE Session (strUsrName TEXT PRIMARY KEY, strContent TEXT, nTime INT);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, contact := range append([]string{account}, contacts...) {
+		if _, err := db.Exec("INSERT INTO Contact VALUES (?, ?);", contact, contact); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, session := range sessions {
+		var name, content string
+		var nTime int64
+		parts := strings.SplitN(session, ":", 3)
+		name, content = parts[0], parts[2]
+		fmt.Sscan(parts[1], &nTime)
+		if _, err := db.Exec("INSERT INTO Session VALUES (?, ?, ?);", name, content, nTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, msgs := range shards {
+		testCreateMsgShard(t, filepath.Join(path, "Msg", "Multi", fmt.Sprintf("MSG%d.db", i)), msgs...)
+	}
+}
+
+func testWriteFile(t *testing.T, path string, content string) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMergeExports(t *testing.T) {
+	defer func(n int) { mergeShardMessages = n }(mergeShardMessages)
+	mergeShardMessages = 2
+
+	dir := t.TempDir()
+	account := "wxid_me"
+	older := filepath.Join(dir, "pc1")
+	newer := filepath.Join(dir, "pc2")
+	testCreateMergeSource(t, older, account, []string{"x"}, []string{"x:100:old"},
+		[]testMsg{
+			{1, Wechat_Message_Type_Text, "x", 100, "one"},
+			{0, Wechat_Message_Type_Text, "x", 150, "local"},
+			{2, Wechat_Message_Type_Text, "x", 200, "two"},
+		},
+		[]testMsg{{3, Wechat_Message_Type_Text, "y", 250, "three"}},
+	)
+	testCreateMergeSource(t, newer, account, []string{"y"}, []string{"x:300:new", "y:250:three"},
+		[]testMsg{
+			{0, Wechat_Message_Type_Text, "x", 150, "local"},
+			{0, Wechat_Message_Type_Text, "x", 160, "other local"},
+			{2, Wechat_Message_Type_Text, "x", 200, "two"},
+			{4, Wechat_Message_Type_Text, "x", 300, "four"},
+		},
+	)
+	// WeChat's own index and an old FTSIndex.db only cover one source.
+	testWriteFile(t, filepath.Join(older, "Msg", FTSMSGDB), "fts")
+	testWriteFile(t, filepath.Join(older, "Msg", FTSIndexDB), "index")
+	testWriteFile(t, filepath.Join(older, "FileStorage", "a.jpg"), "aaaa")
+	testWriteFile(t, filepath.Join(newer, "FileStorage", "a.jpg"), "a")
+	testWriteFile(t, filepath.Join(newer, "FileStorage", "b.jpg"), "bbbb")
+
+	dstPath := filepath.Join(dir, "merged", account)
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	report, err := MergeExports([]string{older, newer}, dstPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Base != newer || report.Messages != 6 || report.Duplicates != 2 || report.Shards != 3 {
+		t.Fatalf("report %+v", report)
+	}
+	if report.Media != 2 || strings.Join(report.Conflicts, " ") != "FileStorage/a.jpg" {
+		t.Fatalf("media %d, conflicts %q", report.Media, report.Conflicts)
+	}
+
+	// Messages are in time order across the shards, each shard with its
+	// own Name2ID.
+	got := make([]string, 0)
+	for _, path := range wechatMsgDBPaths(dstPath) {
+		db, err := wechatOpenDB(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows, err := db.query("select MSG.MsgSvrID, MSG.CreateTime, MSG.StrContent, Name2ID.UsrName=MSG.StrTalker from MSG left join Name2ID on Name2ID.rowid=MSG.TalkerId order by MSG.localId;")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msgSvrID, createTime int64
+		var content string
+		var talkerOK sql.NullBool
+		for rows.Next() {
+			if err := rows.Scan(&msgSvrID, &createTime, &content, &talkerOK); err != nil {
+				t.Fatal(err)
+			}
+			if !talkerOK.Bool {
+				t.Fatalf("%s: TalkerId of %q does not match StrTalker", filepath.Base(path), content)
+			}
+			got = append(got, fmt.Sprintf("%d:%d:%s", msgSvrID, createTime, content))
+		}
+		rows.Close()
+		db.Close()
+		got = append(got, "|")
+	}
+	want := "1:100:one 0:150:local | 0:160:other local 2:200:two | 3:250:three 4:300:four |"
+	if strings.Join(got, " ") != want {
+		t.Fatalf("messages %q, want %q", strings.Join(got, " "), want)
+	}
+
+	// Contacts are unioned, sessions take the newer row.
+	db, err := wechatOpenDB(filepath.Join(dstPath, "Msg", MicroMsgDB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var contacts int
+	var content string
+	if err := db.queryRow("select count(*) from Contact;").Scan(&contacts); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.queryRow("select strContent from Session where strUsrName='x';").Scan(&content); err != nil {
+		t.Fatal(err)
+	}
+	if contacts != 3 || content != "new" {
+		t.Fatalf("contacts %d, session x %q", contacts, content)
+	}
+
+	if _, err := os.Stat(filepath.Join(dstPath, "Msg", FTSMSGDB)); !os.IsNotExist(err) {
+		t.Fatalf("%s was copied: %v", FTSMSGDB, err)
+	}
+	manifest, err := LoadExportManifest(dstPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed := false
+	for _, file := range manifest.Files {
+		listed = listed || file.Path == "Msg/"+FTSIndexDB
+	}
+	if wechatHasFTS5() != listed {
+		t.Fatalf("FTS5 %v, index in manifest %v", wechatHasFTS5(), listed)
+	}
+	verify, err := VerifyExport(dstPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verify.Intact() {
+		t.Fatalf("merged export %+v", verify)
+	}
+	if wechatHasFTS5() {
+		// The rebuilt index covers the merged messages, not the stale copy.
+		index, err := wechatOpenFTSIndex(filepath.Join(dstPath, "Msg", FTSIndexDB), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer index.Close()
+		counts, err := index.counts("local")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if counts["x"] != 2 {
+			t.Fatalf("index counts %v", counts)
+		}
+	}
+}
+
+func TestMergeTableRows(t *testing.T) {
+	dir := t.TempDir()
+	open := func(name, schema string, rows ...string) *wechatDB {
+		db, err := wechatOpenDB(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		if _, err := db.Exec(schema); err != nil {
+			t.Fatal(err)
+		}
+		for _, row := range rows {
+			if _, err := db.Exec(row); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return db
+	}
+	// The sources come from different WeChat versions, each with a column
+	// the other lacks.
+	dst := open("dst.db", "CREATE TABLE Session (strUsrName TEXT, strContent TEXT, nTime INT, dstOnly TEXT);",
+		"INSERT INTO Session VALUES ('a', 'a old', 100, 'keep'), ('b', 'b dst', 300, 'keep');")
+	src := open("src.db", "CREATE TABLE Session (strUsrName TEXT, strContent TEXT, nTime INT, srcOnly TEXT);",
+		"INSERT INTO Session VALUES ('a', 'a new', 200, 'x'), ('b', 'b old', 100, 'x'), ('c', 'c', 50, 'x'), ('', 'no key', 900, 'x');")
+	rows := func(db *wechatDB) string {
+		dbRows, err := db.query("select strUsrName, strContent, nTime from Session order by strUsrName;")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dbRows.Close()
+		got := make([]string, 0)
+		for dbRows.Next() {
+			var name, content string
+			var nTime int64
+			if err := dbRows.Scan(&name, &content, &nTime); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, fmt.Sprintf("%s:%s:%d", name, content, nTime))
+		}
+		return strings.Join(got, " ")
+	}
+
+	// Without a newer column rows the merged database has are kept.
+	n, err := mergeTableRows(dst, src, "Session", "strUsrName", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rows(dst); n != 1 || got != "a:a old:100 b:b dst:300 c:c:50" {
+		t.Fatalf("keep: %d rows, %s", n, got)
+	}
+
+	// With one, a newer row replaces an older one and an older row does not.
+	n, err = mergeTableRows(dst, src, "Session", "strUsrName", "nTime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rows(dst); n != 1 || got != "a:a new:200 b:b dst:300 c:c:50" {
+		t.Fatalf("newer: %d rows, %s", n, got)
+	}
+
+	// A table the source does not have adds nothing.
+	n, err = mergeTableRows(dst, src, "ChatRoom", "ChatRoomName", "")
+	if err != nil || n != 0 {
+		t.Fatalf("missing table: %d rows, %v", n, err)
+	}
+}
@@ -0,0 +1,284 @@
+package wechat
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Status values of ProgressEvent.
+const (
+	ProgressStatusProcessing = "processing"
+	ProgressStatusError      = "error"
+)
+
+// Stages of ExportWeChatAllData, in order.
+const (
+	ProgressStageExport   = "export"
+	ProgressStageDataBase = "database"
+	ProgressStageDat      = "dat"
+	ProgressStageVideo    = "video"
+	ProgressStageVoice    = "voice"
+	ProgressStageHeadImg  = "headimage"
+	ProgressStageSearch   = "search"
+	ProgressStageEncrypt  = "encrypt"
+	ProgressStageManifest = "manifest"
+	ProgressStageSnapshot = "snapshot"
+)
+
+// ProgressEvent is one progress report of an export. status, result and
+// progress keep the keys the UI has always read.
+type ProgressEvent struct {
+	Status      string         `json:"status"`
+	Result      string         `json:"result"`   // human readable summary.
+	Progress    int            `json:"progress"` // percent of the whole export.
+	Stage       string         `json:"stage"`
+	FilesDone   int64          `json:"filesDone"`
+	FilesTotal  int64          `json:"filesTotal"`
+	Bytes       int64          `json:"bytes"`       // bytes handled in the stage so far.
+	BytesPerSec int64          `json:"bytesPerSec"` // average since the stage started.
+	ETA         int64          `json:"eta"`         // seconds left in the stage, -1 when unknown.
+	Error       *ProgressError `json:"error,omitempty"`
+	Time        time.Time      `json:"time"`
+}
+
+// ProgressError describes a failure inside a stage. Path is empty when the
+// error is not about a single file.
+type ProgressError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// JSON returns the event the way it is sent to the UI and SSE clients.
+func (e ProgressEvent) JSON() string {
+	data, _ := json.Marshal(e)
+	return string(data)
+}
+
+// ProgressSink receives export progress. Send must not block for long, the
+// export waits for it.
+type ProgressSink interface {
+	Send(event ProgressEvent)
+}
+
+// ProgressSinkFunc adapts a function to ProgressSink.
+type ProgressSinkFunc func(event ProgressEvent)
+
+func (f ProgressSinkFunc) Send(event ProgressEvent) {
+	f(event)
+}
+
+// ProgressSinks sends every event to each of its sinks in order.
+type ProgressSinks []ProgressSink
+
+func (s ProgressSinks) Send(event ProgressEvent) {
+	for _, sink := range s {
+		sink.Send(event)
+	}
+}
+
+// DrainProgress sends everything read from progress to sink until the
+// channel is closed, and returns the number of error events.
+func DrainProgress(progress <-chan ProgressEvent, sink ProgressSink) int {
+	errCount := 0
+	for event := range progress {
+		if event.Status == ProgressStatusError {
+			errCount += 1
+		}
+		sink.Send(event)
+	}
+
+	return errCount
+}
+
+// ProgressJSONLog writes one JSON object per event, for log files and
+// scripts that tail them.
+type ProgressJSONLog struct {
+	mtx sync.Mutex
+	w   io.Writer
+}
+
+func NewProgressJSONLog(w io.Writer) *ProgressJSONLog {
+	return &ProgressJSONLog{w: w}
+}
+
+func (l *ProgressJSONLog) Send(event ProgressEvent) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	fmt.Fprintln(l.w, event.JSON())
+}
+
+// ProgressSSE serves the events as text/event-stream to any number of HTTP
+// clients. A client that falls behind loses events instead of slowing the
+// export down; a new client first gets the latest event.
+type ProgressSSE struct {
+	mtx     sync.Mutex
+	clients map[chan ProgressEvent]struct{}
+	last    *ProgressEvent
+}
+
+func NewProgressSSE() *ProgressSSE {
+	return &ProgressSSE{clients: make(map[chan ProgressEvent]struct{})}
+}
+
+func (s *ProgressSSE) Send(event ProgressEvent) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.last = &event
+	for client := range s.clients {
+		select {
+		case client <- event:
+		default:
+		}
+	}
+}
+
+func (s *ProgressSSE) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	flusher, ok := res.(http.Flusher)
+	if !ok {
+		http.Error(res, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	client := make(chan ProgressEvent, 64)
+	s.mtx.Lock()
+	s.clients[client] = struct{}{}
+	if s.last != nil {
+		client <- *s.last
+	}
+	s.mtx.Unlock()
+	defer func() {
+		s.mtx.Lock()
+		delete(s.clients, client)
+		s.mtx.Unlock()
+	}()
+
+	res.Header().Set("Content-Type", "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case event := <-client:
+			if _, err := fmt.Fprintf(res, "event: progress\ndata: %s\n\n", event.JSON()); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// exportStage builds the events of one export stage, which covers the
+// overall percent range from..to. The counters may be updated from any
+// goroutine.
+type exportStage struct {
+	progress chan<- ProgressEvent
+	name     string
+	from, to int
+	start    time.Time
+	total    atomic.Int64
+	done     atomic.Int64
+	bytes    atomic.Int64
+}
+
+func newExportStage(progress chan<- ProgressEvent, name string, from, to int) *exportStage {
+	return &exportStage{progress: progress, name: name, from: from, to: to, start: time.Now()}
+}
+
+// add counts files handled and their size in bytes.
+func (s *exportStage) add(files, bytes int64) {
+	s.done.Add(files)
+	s.bytes.Add(bytes)
+}
+
+func (s *exportStage) event(status string, result string) ProgressEvent {
+	event := ProgressEvent{
+		Status:     status,
+		Result:     result,
+		Progress:   s.from,
+		Stage:      s.name,
+		FilesDone:  s.done.Load(),
+		FilesTotal: s.total.Load(),
+		Bytes:      s.bytes.Load(),
+		ETA:        -1,
+		Time:       time.Now(),
+	}
+	elapsed := event.Time.Sub(s.start).Seconds()
+	if elapsed > 0 {
+		event.BytesPerSec = int64(float64(event.Bytes) / elapsed)
+	}
+	if event.FilesTotal > 0 {
+		done := event.FilesDone
+		if done > event.FilesTotal {
+			done = event.FilesTotal
+		}
+		event.Progress = s.from + int(float64(done)/float64(event.FilesTotal)*float64(s.to-s.from))
+		if done > 0 {
+			event.ETA = int64(elapsed / float64(done) * float64(event.FilesTotal-done))
+		}
+	}
+
+	return event
+}
+
+// send reports the current state of the stage.
+func (s *exportStage) send(result string) {
+	s.progress <- s.event(ProgressStatusProcessing, result)
+}
+
+// begin and end report the edges of the stage's percent range.
+func (s *exportStage) begin(result string) {
+	event := s.event(ProgressStatusProcessing, result)
+	event.Progress = s.from
+	s.progress <- event
+}
+
+func (s *exportStage) end(result string) {
+	event := s.event(ProgressStatusProcessing, result)
+	event.Progress = s.to
+	event.ETA = 0
+	s.progress <- event
+}
+
+// fail reports an error of the stage, path is the file it is about if any.
+func (s *exportStage) fail(path string, err error) {
+	result := err.Error()
+	if path != "" {
+		result = path + " " + result
+	}
+	event := s.event(ProgressStatusError, result)
+	event.Error = &ProgressError{Path: path, Message: err.Error()}
+	s.progress <- event
+}
+
+// reportEvery sends result once per interval until the returned function
+// is called, which waits for the reporter to stop.
+func (s *exportStage) reportEvery(interval time.Duration, result string) func() {
+	quit := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+				s.send(result)
+			}
+		}
+	}()
+
+	return func() {
+		close(quit)
+		wg.Wait()
+	}
+}
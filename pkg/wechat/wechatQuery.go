@@ -0,0 +1,231 @@
+package wechat
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// queries slower than this are logged together with the database they ran on
+const wechatSlowQuery = 500 * time.Millisecond
+
+// prepared statements kept per database. Queries with IN lists differ in
+// their text for every list length, so once the cache is full further
+// queries are prepared for one use only.
+const wechatStmtCacheSize = 64
+
+// wechatDB wraps a sqlite handle and caches one prepared statement per
+// query text, up to wechatStmtCacheSize, so every query goes through bound
+// parameters and shares the same timing and error context.
+type wechatDB struct {
+	*sql.DB
+	path   string
+	mtx    sync.Mutex
+	stmts  map[string]*sql.Stmt
+	locked *wechatLockedDB // set when path is encrypted at rest and only decrypted in memory
+}
+
+type wechatRow struct {
+	db    *wechatDB
+	row   *sql.Row
+	query string
+	start time.Time
+	err   error
+}
+
+func newWechatDB(db *sql.DB, path string) *wechatDB {
+	return &wechatDB{
+		DB:    db,
+		path:  path,
+		stmts: make(map[string]*sql.Stmt),
+	}
+}
+
+// wechatOpenDB opens path, unlocking it into memory with the backup
+// passphrase when it is encrypted at rest. The whole database stays in
+// memory until Close, and an account opens all of its MSG shards at once,
+// so an encrypted backup needs about as much RAM as its Msg directory.
+func wechatOpenDB(path string) (*wechatDB, error) {
+	if encrypted, err := IsEncryptedDataBase(path); err == nil && encrypted {
+		return wechatUnlockDB(path, getBackupPassphrase())
+	}
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+
+	return newWechatDB(db, path), nil
+}
+
+// prepare returns the cached statement of query. It returns nil without
+// an error when the cache is full, the caller then runs query directly.
+func (w *wechatDB) prepare(query string) (*sql.Stmt, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if stmt, ok := w.stmts[query]; ok {
+		return stmt, nil
+	}
+	if len(w.stmts) >= wechatStmtCacheSize {
+		return nil, nil
+	}
+
+	stmt, err := w.DB.Prepare(query)
+	if err != nil {
+		return nil, w.queryError(query, err)
+	}
+	w.stmts[query] = stmt
+
+	return stmt, nil
+}
+
+func (w *wechatDB) query(query string, args ...interface{}) (*sql.Rows, error) {
+	stmt, err := w.prepare(query)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	var rows *sql.Rows
+	if stmt != nil {
+		rows, err = stmt.Query(args...)
+	} else {
+		rows, err = w.DB.Query(query, args...)
+	}
+	w.trace(query, start, err)
+	if err != nil {
+		return nil, w.queryError(query, err)
+	}
+
+	return rows, nil
+}
+
+func (w *wechatDB) queryRow(query string, args ...interface{}) *wechatRow {
+	r := &wechatRow{db: w, query: query, start: time.Now()}
+	stmt, err := w.prepare(query)
+	if err != nil {
+		r.err = err
+		return r
+	}
+
+	if stmt != nil {
+		r.row = stmt.QueryRow(args...)
+	} else {
+		r.row = w.DB.QueryRow(query, args...)
+	}
+	return r
+}
+
+func (r *wechatRow) Scan(dest ...interface{}) error {
+	if r.err != nil {
+		return r.err
+	}
+
+	err := r.row.Scan(dest...)
+	r.db.trace(r.query, r.start, err)
+	if err != nil {
+		return r.db.queryError(r.query, err)
+	}
+
+	return nil
+}
+
+func (w *wechatDB) exec(query string, args ...interface{}) (sql.Result, error) {
+	stmt, err := w.prepare(query)
+	if err != nil {
+		return nil, err
+	}
+
+	if w.locked != nil {
+		w.locked.modified.Store(true)
+	}
+	start := time.Now()
+	var res sql.Result
+	if stmt != nil {
+		res, err = stmt.Exec(args...)
+	} else {
+		res, err = w.DB.Exec(query, args...)
+	}
+	w.trace(query, start, err)
+	if err != nil {
+		return nil, w.queryError(query, err)
+	}
+
+	return res, nil
+}
+
+// begin starts a transaction; like exec it marks a database unlocked into
+// memory as modified, so what is committed gets saved on Close.
+func (w *wechatDB) begin() (*sql.Tx, error) {
+	if w.locked != nil {
+		w.locked.modified.Store(true)
+	}
+
+	return w.DB.Begin()
+}
+
+func (w *wechatDB) Close() error {
+	w.mtx.Lock()
+	for query, stmt := range w.stmts {
+		stmt.Close()
+		delete(w.stmts, query)
+	}
+	w.mtx.Unlock()
+
+	var err error
+	if w.locked != nil {
+		err = w.locked.close()
+	}
+	if closeErr := w.DB.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func (w *wechatDB) trace(query string, start time.Time, err error) {
+	elapsed := time.Since(start)
+	if elapsed >= wechatSlowQuery {
+		log.Printf("slow query %v in %s: %s\n", elapsed, filepath.Base(w.path), query)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("query failed in %s: %s: %v\n", filepath.Base(w.path), query, err)
+	}
+}
+
+// queryError keeps the original error reachable through errors.Is, so
+// callers can still test for sql.ErrNoRows.
+func (w *wechatDB) queryError(query string, err error) error {
+	return fmt.Errorf("%s [%s]: %w", filepath.Base(w.path), query, err)
+}
+
+func sqlPlaceholders(n int) string {
+	if n <= 0 {
+		return ""
+	}
+
+	buf := make([]byte, 0, n*3)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			buf = append(buf, ", "...)
+		}
+		buf = append(buf, '?')
+	}
+
+	return string(buf)
+}
+
+func sqlArgs(values []string) []interface{} {
+	args := make([]interface{}, len(values))
+	for i := range values {
+		args[i] = values[i]
+	}
+
+	return args
+}
@@ -0,0 +1,43 @@
+package wechat
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestWechatDBStmtCacheBounded(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "MSG0.db")
+	testCreatePlainDB(t, path, "a", "b", "c")
+	db, err := wechatOpenDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Every IN list length is a new query text.
+	for n := 1; n <= 2*wechatStmtCacheSize; n++ {
+		args := make([]interface{}, n)
+		for i := range args {
+			args[i] = i + 1
+		}
+		count := 0
+		err := db.queryRow("select count(*) from MSG where localId in ("+sqlPlaceholders(n)+");", args...).Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := min(n, 3); count != want {
+			t.Fatalf("in list of %d: count %d, want %d", n, count, want)
+		}
+	}
+	if len(db.stmts) > wechatStmtCacheSize {
+		t.Fatalf("%d statements cached", len(db.stmts))
+	}
+
+	columns := wechatTableColumns(db, "MSG")
+	if len(columns) != 2 || columns[0] != "localId" || columns[1] != "StrContent" {
+		t.Fatalf("columns %q", columns)
+	}
+	if columns := wechatTableColumns(db, "no'such"); len(columns) != 0 {
+		t.Fatalf("columns of a missing table %q", columns)
+	}
+}
@@ -0,0 +1,399 @@
+package wechat
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// RecoveredDB is the overlay WeChatRecoverMessages writes into the Msg
+// directory of the newer export. Incremental exports leave it alone; a full
+// export starts the directory over and the messages have to be recovered
+// again.
+const RecoveredDB = "Recovered.db"
+
+// The overlay MSG table has the columns wechatMessageColumns selects, so
+// recovered rows go through the same wechatScanMessage as any other.
+const createRecoveredTable = `
+	CREATE TABLE IF NOT EXISTS MSG (
+		localId INTEGER PRIMARY KEY AUTOINCREMENT,
+		MsgSvrID INT UNIQUE,
+		Type INT,
+		SubType INT,
+		IsSender INT,
+		CreateTime INT,
+		Sequence INT,
+		StrTalker TEXT,
+		StrContent TEXT,
+		CompressContent BLOB,
+		BytesExtra BLOB,
+		Source TEXT,
+		RecoveredTime INT
+	);
+	CREATE INDEX IF NOT EXISTS MSG_Talker_CreateTime ON MSG (StrTalker, CreateTime);`
+
+type WeChatRecoverSession struct {
+	UserName string `json:"UserName"`
+	NickName string `json:"NickName"`
+	Messages int    `json:"Messages"`
+}
+
+// WeChatRecoverReport is the result of WeChatRecoverMessages.
+type WeChatRecoverReport struct {
+	From      string                 `json:"From"`
+	Scanned   int                    `json:"Scanned"`   // messages with a MsgSvrID in the older export.
+	Recovered int                    `json:"Recovered"` // added to the overlay by this run.
+	Known     int                    `json:"Known"`     // missing from the newer export but recovered before.
+	Media     int                    `json:"Media"`     // media files copied from the older export.
+	Sessions  []WeChatRecoverSession `json:"Sessions"`  // sessions that got messages back, most first.
+}
+
+// wechatOpenRecovered opens the overlay of resPath, creating it when create
+// is set. Like UserData.db it stays encrypted on disk when the backup is.
+func wechatOpenRecovered(resPath string, create bool, locked bool) (*wechatDB, error) {
+	path := filepath.Join(resPath, "Msg", RecoveredDB)
+	if _, err := os.Stat(path); err == nil {
+		return wechatOpenDB(path)
+	} else if !create {
+		return nil, err
+	}
+
+	var db *wechatDB
+	var err error
+	if locked {
+		db, err = wechatOpenMemDB(path, nil, getBackupPassphrase())
+	} else {
+		db, err = wechatOpenDB(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if db.locked != nil {
+		db.locked.modified.Store(true)
+	}
+	if _, err := db.Exec(createRecoveredTable); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// wechatMsgSvrIDs returns the sorted MsgSvrIDs of every message in dbs.
+func wechatMsgSvrIDs(dbs []*wechatDB) ([]int64, error) {
+	ids := make([]int64, 0)
+	for _, db := range dbs {
+		rows, err := db.query("select MsgSvrID from MSG where MsgSvrID!=0;")
+		if err != nil {
+			return nil, err
+		}
+		var id int64
+		for rows.Next() {
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			ids = append(ids, id)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	return ids, nil
+}
+
+func containsMsgSvrID(ids []int64, id int64) bool {
+	i := sort.Search(len(ids), func(i int) bool { return ids[i] >= id })
+	return i < len(ids) && ids[i] == id
+}
+
+// WeChatRecoverMessages finds the messages of the export at olderPath, an
+// earlier export or snapshot of the same account, that are gone from this
+// one because they were deleted in WeChat. They are kept in the RecoveredDB
+// overlay and returned by WeChatGetMessageListByTime with DeletedInClient
+// set. Media they refer to is copied over when this export lacks it.
+// Messages are matched by MsgSvrID, local-only messages without one are
+// skipped.
+func (P *WechatDataProvider) WeChatRecoverMessages(olderPath string) (*WeChatRecoverReport, error) {
+	report := &WeChatRecoverReport{From: olderPath, Sessions: make([]WeChatRecoverSession, 0)}
+
+	dbs := make([]*wechatDB, 0, len(P.msgDBs)+1)
+	for _, msgDB := range P.msgDBs {
+		dbs = append(dbs, msgDB.db)
+	}
+	present, err := wechatMsgSvrIDs(dbs)
+	if err != nil {
+		return report, err
+	}
+
+	if P.recovered == nil {
+		P.recovered, err = wechatOpenRecovered(P.resPath, true, P.microMsg != nil && P.microMsg.locked != nil)
+		if err != nil {
+			return report, err
+		}
+	}
+	recovered, err := wechatMsgSvrIDs([]*wechatDB{P.recovered})
+	if err != nil {
+		return report, err
+	}
+
+	if P.recovered.locked != nil {
+		P.recovered.locked.modified.Store(true)
+	}
+	tx, err := P.recovered.Begin()
+	if err != nil {
+		return report, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	ins, err := tx.Prepare("INSERT OR IGNORE INTO MSG (MsgSvrID, Type, SubType, IsSender, CreateTime, Sequence, StrTalker, StrContent, CompressContent, BytesExtra, Source, RecoveredTime) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, strftime('%s','now'));")
+	if err != nil {
+		return report, err
+	}
+	defer ins.Close()
+
+	added := make([]int64, 0)
+	sessions := make(map[string]int)
+	for _, path := range wechatMsgDBPaths(olderPath) {
+		var older *wechatDB
+		older, err = wechatOpenDB(path)
+		if err != nil {
+			return report, err
+		}
+		err = func() error {
+			defer older.Close()
+			rows, err := older.query("select MsgSvrID, Type, SubType, IsSender, CreateTime, Sequence, ifnull(StrTalker,''), ifnull(StrContent,''), ifnull(CompressContent,''), ifnull(BytesExtra,'') from MSG where MsgSvrID!=0;")
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+
+			source := filepath.Base(path)
+			var msgSvrID, createTime, sequence int64
+			var msgType, subType, isSender int
+			var talker, content string
+			var compressContent, bytesExtra []byte
+			for rows.Next() {
+				if err := rows.Scan(&msgSvrID, &msgType, &subType, &isSender, &createTime, &sequence, &talker, &content, &compressContent, &bytesExtra); err != nil {
+					return err
+				}
+				report.Scanned += 1
+				if containsMsgSvrID(present, msgSvrID) {
+					continue
+				}
+				if containsMsgSvrID(recovered, msgSvrID) {
+					report.Known += 1
+					continue
+				}
+
+				res, err := ins.Exec(msgSvrID, msgType, subType, isSender, createTime, sequence, talker, content, compressContent, bytesExtra, source)
+				if err != nil {
+					return err
+				}
+				if affected, _ := res.RowsAffected(); affected > 0 {
+					report.Recovered += 1
+					sessions[talker] += 1
+					added = append(added, msgSvrID)
+				}
+			}
+			return rows.Err()
+		}()
+		if err != nil {
+			return report, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return report, err
+	}
+	if P.recovered.locked != nil {
+		// Saved now rather than on close, a crash must not lose what was
+		// recovered from a snapshot that may be pruned next.
+		if err := P.recovered.locked.save(); err != nil {
+			return report, err
+		}
+	}
+
+	report.Media = P.wechatRecoverMedia(olderPath, added)
+	if _, err := LoadExportManifest(P.resPath); err == nil && !IsExportIncomplete(P.resPath) {
+		// The overlay and copied media are part of the backup now, keep
+		// VerifyExport and snapshots in line with them.
+		if _, err := WriteExportManifest(P.resPath); err != nil {
+			log.Println("WriteExportManifest:", err)
+		}
+	}
+	for userName, count := range sessions {
+		session := WeChatRecoverSession{UserName: userName, Messages: count}
+		if info, err := P.WechatGetUserInfoByNameOnCache(userName); err == nil {
+			session.NickName = info.NickName
+			if info.ReMark != "" {
+				session.NickName = info.ReMark
+			}
+		}
+		report.Sessions = append(report.Sessions, session)
+	}
+	sort.Slice(report.Sessions, func(i, j int) bool {
+		if report.Sessions[i].Messages != report.Sessions[j].Messages {
+			return report.Sessions[i].Messages > report.Sessions[j].Messages
+		}
+		return report.Sessions[i].UserName < report.Sessions[j].UserName
+	})
+
+	return report, nil
+}
+
+// wechatRecoverMedia copies the media of the recovered messages ids from
+// olderPath when this export does not have it, and returns how many files
+// were copied.
+func (P *WechatDataProvider) wechatRecoverMedia(olderPath string, ids []int64) int {
+	copied := 0
+	for _, id := range ids {
+		row := P.recovered.queryRow("select "+wechatMessageColumns+" from MSG where MsgSvrID=?;", id)
+		msg, err := P.wechatScanMessage(row.Scan)
+		if err != nil {
+			log.Println("wechatRecoverMedia:", err)
+			continue
+		}
+
+		for _, resolved := range []string{msg.ThumbPath, msg.ImagePath, msg.VideoPath, msg.VoicePath, msg.FileInfo.FilePath, msg.LocationInfo.ThumbPath} {
+			local, ok := P.resolvedLocal(resolved)
+			if !ok {
+				continue
+			}
+			if _, err := os.Stat(local); err == nil {
+				continue
+			}
+			rel, err := filepath.Rel(P.resPath, local)
+			if err != nil {
+				continue
+			}
+			src := filepath.Join(olderPath, rel)
+			if _, err := os.Stat(src); err != nil {
+				continue
+			}
+			if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+				log.Println("wechatRecoverMedia:", err)
+				continue
+			}
+			if _, err := copyFile(src, local); err != nil {
+				log.Println("wechatRecoverMedia:", err)
+				continue
+			}
+			copied += 1
+		}
+	}
+
+	return copied
+}
+
+// wechatRecoveredSessions returns the sessions of recovered messages that
+// have no row in the Session table, newest first. Those are chats deleted in
+// WeChat as a whole, WeChatGetSessionList lists them after the Session table.
+func (P *WechatDataProvider) wechatRecoveredSessions() ([]WeChatSession, error) {
+	sessions := make([]WeChatSession, 0)
+	if P.recovered == nil {
+		return sessions, nil
+	}
+
+	// SQLite takes the bare columns from the row max() picked, the newest
+	// message of each talker.
+	rows, err := P.recovered.query("select StrTalker, max(CreateTime), Type, SubType, ifnull(StrContent,''), ifnull(CompressContent,'') from MSG where StrTalker!='' group by StrTalker order by 2 desc, StrTalker;")
+	if err != nil {
+		return sessions, err
+	}
+	defer rows.Close()
+
+	var talker, content string
+	var createTime int64
+	var msgType, subType int
+	var compressContent []byte
+	for rows.Next() {
+		if err := rows.Scan(&talker, &createTime, &msgType, &subType, &content, &compressContent); err != nil {
+			return sessions, err
+		}
+		var count int
+		if err := P.microMsg.queryRow("select count(*) from Session where strUsrName=?;", talker).Scan(&count); err != nil {
+			return sessions, err
+		}
+		if count > 0 {
+			continue
+		}
+
+		session := WeChatSession{
+			UserName:        talker,
+			Content:         wechatMessageSearchText(msgType, subType, content, compressContent),
+			Time:            uint64(createTime),
+			IsGroup:         strings.HasSuffix(talker, "@chatroom"),
+			DeletedInClient: true,
+		}
+		// The contact may be gone with the chat.
+		session.UserInfo = WeChatUserInfo{UserName: talker}
+		if info, err := P.WechatGetUserInfoByNameOnCache(talker); err == nil {
+			session.UserInfo = *info
+		}
+		session.NickName = session.UserInfo.NickName
+		if session.UserInfo.ReMark != "" {
+			session.NickName = session.UserInfo.ReMark
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+// wechatMergeRecovered merges the recovered messages of userName into rows,
+// a page of at most limit messages newest first read from the MSG shards in
+// direction from time. Both sources are sorted, so the page stays the limit
+// messages nearest to time.
+func (P *WechatDataProvider) wechatMergeRecovered(rows []WeChatMessage, userName string, time int64, limit int, direction Message_Search_Direction) []WeChatMessage {
+	if P.recovered == nil || limit <= 0 {
+		return rows
+	}
+
+	querySql := "select " + wechatMessageColumns + " from MSG where StrTalker=? and CreateTime<=? order by CreateTime desc, Sequence desc limit ?;"
+	if direction == Message_Search_Backward {
+		querySql = "select " + wechatMessageColumns + " from MSG where StrTalker=? and CreateTime>? order by CreateTime asc, Sequence asc limit ?;"
+	}
+	dbRows, err := P.recovered.query(querySql, userName, time, limit)
+	if err != nil {
+		log.Println("wechatMergeRecovered:", err)
+		return rows
+	}
+	defer dbRows.Close()
+
+	extra := make([]WeChatMessage, 0)
+	for dbRows.Next() {
+		msg, err := P.wechatScanMessage(dbRows.Scan)
+		if err != nil {
+			log.Println("wechatMergeRecovered:", err)
+			return rows
+		}
+		msg.DeletedInClient = true
+		extra = append(extra, msg)
+	}
+	if len(extra) == 0 {
+		return rows
+	}
+
+	merged := append(append(make([]WeChatMessage, 0, len(rows)+len(extra)), rows...), extra...)
+	sort.SliceStable(merged, func(i, j int) bool { return merged[i].CreateTime > merged[j].CreateTime })
+	if len(merged) > limit {
+		if direction == Message_Search_Backward {
+			// The nearest to time are the oldest, at the end.
+			merged = merged[len(merged)-limit:]
+		} else {
+			merged = merged[:limit]
+		}
+	}
+
+	return merged
+}
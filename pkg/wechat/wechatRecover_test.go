@@ -0,0 +1,223 @@
+package wechat
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testRecoverExports writes an older and a newer export of the same account.
+// Chat c and some messages of a and b were deleted in between.
+func testRecoverExports(t *testing.T) (string, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	olderPath := filepath.Join(dir, "older")
+	newerPath := filepath.Join(dir, "newer")
+	for _, path := range []string{olderPath, newerPath} {
+		if err := os.MkdirAll(filepath.Join(path, "Msg", "Multi"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testCreateMsgShard(t, filepath.Join(olderPath, "Msg", "Multi", "MSG0.db"),
+		testMsg{1, Wechat_Message_Type_Text, "a", 100, "a1"},
+		testMsg{2, Wechat_Message_Type_Text, "a", 200, "a2 deleted"},
+		testMsg{3, Wechat_Message_Type_Text, "a", 300, "a3"},
+		testMsg{4, Wechat_Message_Type_Voice, "b", 150, ""},
+		testMsg{0, Wechat_Message_Type_Text, "b", 160, "local only"},
+	)
+	testCreateMsgShard(t, filepath.Join(olderPath, "Msg", "Multi", "MSG1.db"),
+		testMsg{5, Wechat_Message_Type_Text, "a", 400, "a4 deleted"},
+		testMsg{6, Wechat_Message_Type_Text, "c", 250, "c1"},
+		testMsg{7, Wechat_Message_Type_Text, "c", 350, "c2"},
+	)
+	testCreateMsgShard(t, filepath.Join(newerPath, "Msg", "Multi", "MSG0.db"),
+		testMsg{1, Wechat_Message_Type_Text, "a", 100, "a1"},
+		testMsg{3, Wechat_Message_Type_Text, "a", 300, "a3"},
+		testMsg{8, Wechat_Message_Type_Text, "b", 500, "b2"},
+	)
+
+	voicePath := filepath.Join(olderPath, "FileStorage", "Voice", "4.mp3")
+	if err := os.MkdirAll(filepath.Dir(voicePath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(voicePath, []byte("mp3"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return olderPath, newerPath
+}
+
+// testRecoverProvider opens the newer export with a Session table that has
+// lost chat c.
+func testRecoverProvider(t *testing.T, newerPath string) *WechatDataProvider {
+	t.Helper()
+
+	P := testSearchProvider(t, []string{filepath.Join(newerPath, "Msg", "Multi", "MSG0.db")}, "a", "b", "c")
+	P.resPath = newerPath
+	microMsg, err := wechatOpenDB(filepath.Join(newerPath, "Msg", "MicroMsg.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { microMsg.Close() })
+	_, err = microMsg.Exec(`CREATE TABLE Session (strUsrName TEXT, strNickName TEXT, strContent TEXT, nMsgType INT, nTime INT, nOrder INT);
+		INSERT INTO Session VALUES ('b', 'b', 'b2', 1, 500, 2), ('a', 'a', 'a3', 1, 300, 1);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	P.microMsg = microMsg
+	t.Cleanup(func() {
+		if P.recovered != nil {
+			P.recovered.Close()
+		}
+	})
+
+	return P
+}
+
+func TestRecoverMessages(t *testing.T) {
+	olderPath, newerPath := testRecoverExports(t)
+	P := testRecoverProvider(t, newerPath)
+
+	report, err := P.WeChatRecoverMessages(olderPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Scanned != 7 || report.Recovered != 5 || report.Known != 0 || report.Media != 1 {
+		t.Fatalf("report %+v", report)
+	}
+	sessions := make([]string, 0)
+	for _, session := range report.Sessions {
+		sessions = append(sessions, fmt.Sprintf("%s:%d", session.UserName, session.Messages))
+	}
+	if strings.Join(sessions, " ") != "a:2 c:2 b:1" {
+		t.Fatalf("sessions %q", sessions)
+	}
+	if _, err := os.Stat(filepath.Join(newerPath, "FileStorage", "Voice", "4.mp3")); err != nil {
+		t.Fatalf("voice not copied: %v", err)
+	}
+
+	// A second run finds the same messages already recovered.
+	report, err = P.WeChatRecoverMessages(olderPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Recovered != 0 || report.Known != 5 || report.Media != 0 {
+		t.Fatalf("second run %+v", report)
+	}
+
+	// The overlay is found again when the export is reopened.
+	P.recovered.Close()
+	P.recovered, err = wechatOpenRecovered(newerPath, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := P.WeChatGetMessageListByTime("c", 1000, 10, Message_Search_Forward)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.Total != 2 || !list.Rows[0].DeletedInClient || list.Rows[0].Content != "c2" {
+		t.Fatalf("chat c %+v", list.Rows)
+	}
+}
+
+func TestRecoverMessagesPagedMerge(t *testing.T) {
+	olderPath, newerPath := testRecoverExports(t)
+	P := testRecoverProvider(t, newerPath)
+	if _, err := P.WeChatRecoverMessages(olderPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// "*" marks a recovered message.
+	page := func(time int64, pageSize int, direction Message_Search_Direction) string {
+		list, err := P.WeChatGetMessageListByTime("a", time, pageSize, direction)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if list.Total != len(list.Rows) {
+			t.Fatalf("total %d of %d rows", list.Total, len(list.Rows))
+		}
+		rows := make([]string, 0, len(list.Rows))
+		for _, msg := range list.Rows {
+			row := fmt.Sprint(msg.CreateTime)
+			if msg.DeletedInClient {
+				row += "*"
+			}
+			rows = append(rows, row)
+		}
+		return strings.Join(rows, " ")
+	}
+
+	tests := []struct {
+		time      int64
+		pageSize  int
+		direction Message_Search_Direction
+		want      string
+	}{
+		{1000, 10, Message_Search_Forward, "400* 300 200* 100"},
+		{1000, 2, Message_Search_Forward, "400* 300"},
+		{299, 2, Message_Search_Forward, "200* 100"},
+		{99, 2, Message_Search_Forward, ""},
+		{0, 2, Message_Search_Backward, "200* 100"},
+		{200, 2, Message_Search_Backward, "400* 300"},
+		{250, 4, Message_Search_Both, "400* 300 200* 100"},
+		{250, 2, Message_Search_Both, "300 200*"},
+	}
+	for _, test := range tests {
+		if got := page(test.time, test.pageSize, test.direction); got != test.want {
+			t.Errorf("time %d size %d direction %d: %q, want %q", test.time, test.pageSize, test.direction, got, test.want)
+		}
+	}
+}
+
+func TestRecoveredSessionList(t *testing.T) {
+	olderPath, newerPath := testRecoverExports(t)
+	P := testRecoverProvider(t, newerPath)
+
+	list := func(pageIndex, pageSize int) string {
+		sessions, err := P.WeChatGetSessionList(pageIndex, pageSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sessions.Total != len(sessions.Rows) {
+			t.Fatalf("total %d of %d rows", sessions.Total, len(sessions.Rows))
+		}
+		names := make([]string, 0, len(sessions.Rows))
+		for _, session := range sessions.Rows {
+			name := session.UserName
+			if session.DeletedInClient {
+				name += "*:" + session.Content
+			}
+			names = append(names, name)
+		}
+		return strings.Join(names, " ")
+	}
+
+	if got := list(0, 10); got != "b a" {
+		t.Fatalf("before recovery: %q", got)
+	}
+	if _, err := P.WeChatRecoverMessages(olderPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// Chat c has no Session row any more and is listed after the table, a
+	// and b keep theirs.
+	if got := list(0, 10); got != "b a c*:c2" {
+		t.Fatalf("one page: %q", got)
+	}
+	pages := make([]string, 0)
+	for pageIndex := 0; pageIndex < 3; pageIndex++ {
+		pages = append(pages, list(pageIndex, 2))
+	}
+	if strings.Join(pages, "|") != "b a|c*:c2|" {
+		t.Fatalf("pages %q", pages)
+	}
+	if got := list(1, 1); got != "a" {
+		t.Fatalf("page 1 of size 1: %q", got)
+	}
+	if got := list(2, 1); got != "c*:c2" {
+		t.Fatalf("page 2 of size 1: %q", got)
+	}
+}
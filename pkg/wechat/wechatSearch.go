@@ -0,0 +1,371 @@
+package wechat
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const wechatSnippetRunes = 20
+
+// wechatSearchBackend answers keyword queries without scanning MSG. refs
+// come back in wechatSearchCursor order and always point at a row of an
+// opened MSG shard.
+type wechatSearchBackend interface {
+	search(talker, keyWord string, cursor wechatSearchCursor, limit int) ([]wechatFTSRef, error)
+	counts(keyWord string) (map[string]int, error)
+	Close() error
+}
+
+// wechatSearchCursor is where a search page ended. Hits are ordered by
+// CreateTime, then shard, then localId, all descending. shard and localId
+// name exactly one row, so a page boundary neither skips nor repeats a
+// hit when messages share a CreateTime or a MsgSvrID.
+type wechatSearchCursor struct {
+	createTime int64
+	shard      string
+	localId    int64
+}
+
+// older reports whether the row at (createTime, shard, localId) comes after
+// the cursor.
+func (c wechatSearchCursor) older(createTime int64, shard string, localId int64) bool {
+	if createTime != c.createTime {
+		return createTime < c.createTime
+	}
+	if shard != c.shard {
+		return shard < c.shard
+	}
+	return localId < c.localId
+}
+
+// localIdBound is the localId a row of shard at the cursor time must stay
+// below to come after the cursor.
+func (c wechatSearchCursor) localIdBound(shard string) int64 {
+	switch {
+	case shard < c.shard:
+		return math.MaxInt64
+	case shard == c.shard:
+		return c.localId
+	default:
+		return math.MinInt64
+	}
+}
+
+// wechatSearchCursorAt returns the cursor every row up to and including
+// createTime comes after.
+func wechatSearchCursorAt(createTime int64) wechatSearchCursor {
+	if createTime < math.MaxInt64 {
+		createTime += 1
+	}
+	return wechatSearchCursor{createTime: createTime}
+}
+
+func (c wechatSearchCursor) String() string {
+	return fmt.Sprintf("%d:%s:%d", c.createTime, c.shard, c.localId)
+}
+
+// wechatOpenSearchBackend prefers our own index, then the FTSMSG database
+// WeChat keeps itself. nil means searches scan MSG.
+func wechatOpenSearchBackend(resPath string, msgDBs []*wechatMsgDB) wechatSearchBackend {
+	ftsIndexPath := filepath.Join(resPath, "Msg", FTSIndexDB)
+	ftsIndex, err := wechatOpenFTSIndex(ftsIndexPath, false)
+	if err == nil {
+		log.Println("search backend:", ftsIndexPath)
+		return ftsIndex
+	} else if !os.IsNotExist(err) {
+		log.Printf("open db %s error: %v", ftsIndexPath, err)
+	}
+
+	msgFTSPath := filepath.Join(resPath, "Msg", FTSMSGDB)
+	msgFTS, err := wechatOpenMsgFTS(msgFTSPath, msgDBs)
+	if err == nil {
+		log.Println("search backend:", msgFTSPath)
+		return msgFTS
+	} else if !os.IsNotExist(err) {
+		log.Printf("open db %s error: %v", msgFTSPath, err)
+	}
+
+	return nil
+}
+
+type WeChatSearchHit struct {
+	LocalId    int    `json:"LocalId"`
+	MsgSvrId   string `json:"MsgSvrId"`
+	Type       int    `json:"type"`
+	SubType    int    `json:"SubType"`
+	IsSender   int    `json:"IsSender"`
+	CreateTime int64  `json:"createTime"`
+	Talker     string `json:"talker"`
+	Snippet    string `json:"Snippet"`
+	shard      string
+}
+
+type WeChatSearchSession struct {
+	UserName string            `json:"UserName"`
+	UserInfo WeChatUserInfo    `json:"UserInfo"`
+	Count    int               `json:"Count"`
+	Hits     []WeChatSearchHit `json:"Hits"`
+}
+
+// WeChatSearchResult is one page of hits. Total and the Count of each
+// session are over all pages; they are counted once, for the first page,
+// and are 0 on the pages after it.
+type WeChatSearchResult struct {
+	KeyWord  string                `json:"KeyWord"`
+	Total    int                   `json:"Total"`
+	Sessions []WeChatSearchSession `json:"Sessions"`
+	Cursor   string                `json:"Cursor"`
+}
+
+// WeChatSearchAllMessages searches every session in every MSG shard. Hits
+// are returned newest first, pageSize at a time, grouped by session. Pass
+// the returned Cursor back to get the next page; an empty Cursor means
+// there is nothing left.
+func (P *WechatDataProvider) WeChatSearchAllMessages(keyWord string, cursor string, pageSize int) (*WeChatSearchResult, error) {
+	result := &WeChatSearchResult{}
+	result.KeyWord = keyWord
+	result.Sessions = make([]WeChatSearchSession, 0)
+	if keyWord == "" || pageSize <= 0 {
+		return result, nil
+	}
+
+	searchCursor, err := wechatParseSearchCursor(cursor)
+	if err != nil {
+		return result, err
+	}
+
+	hits, err := P.wechatSearchIndex(keyWord, searchCursor, pageSize+1)
+	if err != nil {
+		if P.searchBackend != nil {
+			log.Println("wechatSearchIndex failed:", err)
+		}
+		hits = make([]WeChatSearchHit, 0, pageSize)
+		for _, msgDB := range P.msgDBs {
+			if msgDB.startTime > searchCursor.createTime {
+				continue
+			}
+			dbHits, err := P.wechatSearchMsgDB(msgDB, keyWord, searchCursor, pageSize+1)
+			if err != nil {
+				log.Printf("search %s failed: %v\n", msgDB.path, err)
+				continue
+			}
+			hits = append(hits, dbHits...)
+		}
+	}
+
+	sort.Slice(hits, func(i, j int) bool {
+		return wechatSearchCursor{hits[i].CreateTime, hits[i].shard, int64(hits[i].LocalId)}.older(hits[j].CreateTime, hits[j].shard, int64(hits[j].LocalId))
+	})
+
+	if len(hits) > pageSize {
+		last := hits[pageSize-1]
+		result.Cursor = wechatSearchCursor{last.CreateTime, last.shard, int64(last.LocalId)}.String()
+		hits = hits[:pageSize]
+	}
+
+	var counts map[string]int
+	if cursor == "" {
+		counts = P.wechatSearchCounts(keyWord)
+		for _, count := range counts {
+			result.Total += count
+		}
+	}
+
+	sessionIndex := make(map[string]int)
+	for _, hit := range hits {
+		index, ok := sessionIndex[hit.Talker]
+		if !ok {
+			session := WeChatSearchSession{UserName: hit.Talker}
+			session.Hits = make([]WeChatSearchHit, 0)
+			if info, err := P.WechatGetUserInfoByNameOnCache(hit.Talker); err == nil {
+				session.UserInfo = *info
+			}
+			session.Count = counts[hit.Talker]
+			index = len(result.Sessions)
+			sessionIndex[hit.Talker] = index
+			result.Sessions = append(result.Sessions, session)
+		}
+		result.Sessions[index].Hits = append(result.Sessions[index].Hits, hit)
+	}
+
+	return result, nil
+}
+
+// wechatSearchMsgDBSql selects the rows of the types the index covers that
+// may hold keyWord. Text, system and location messages are searched in
+// StrContent their text is taken from; app messages keep theirs in
+// CompressContent, which can only be checked after uncompressing it.
+const wechatSearchMsgDBSql = "select localId,MsgSvrID,Type,SubType,IsSender,CreateTime,ifnull(StrTalker,'') as StrTalker,ifnull(StrContent,'') as StrContent,ifnull(CompressContent,'') as CompressContent from MSG where ((Type in (?,?,?) and StrContent like ? escape '\\') or (Type=? and CompressContent is not null))"
+
+func wechatSearchMsgDBArgs(keyWord string) []interface{} {
+	return []interface{}{Wechat_Message_Type_Text, Wechat_Message_Type_System, Wechat_Message_Type_Location, wechatLikePattern(keyWord), Wechat_Message_Type_Misc}
+}
+
+// wechatSearchMsgDBRows calls fn with every row of msgDB whose search text,
+// as the index would store it, contains keyWord, until fn returns false.
+func wechatSearchMsgDBRows(msgDB *wechatMsgDB, querySql string, args []interface{}, keyWord string, fn func(ref wechatFTSRef) bool) error {
+	rows, err := msgDB.db.query(querySql, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	lowerKeyWord := strings.ToLower(keyWord)
+	var compressContent []byte
+	for rows.Next() {
+		ref := wechatFTSRef{shard: filepath.Base(msgDB.path)}
+		err = rows.Scan(&ref.localId, &ref.msgSvrID, &ref.msgType, &ref.subType, &ref.isSender, &ref.createTime, &ref.talker, &ref.content, &compressContent)
+		if err != nil {
+			return err
+		}
+		ref.content = wechatMessageSearchText(ref.msgType, ref.subType, ref.content, compressContent)
+		if !strings.Contains(strings.ToLower(ref.content), lowerKeyWord) {
+			continue
+		}
+		if !fn(ref) {
+			break
+		}
+	}
+
+	return rows.Err()
+}
+
+func (P *WechatDataProvider) wechatSearchMsgDB(msgDB *wechatMsgDB, keyWord string, cursor wechatSearchCursor, limit int) ([]WeChatSearchHit, error) {
+	hits := make([]WeChatSearchHit, 0)
+	querySql := wechatSearchMsgDBSql + " and (CreateTime<? or (CreateTime=? and localId<?)) order by CreateTime desc, localId desc;"
+	args := append(wechatSearchMsgDBArgs(keyWord), cursor.createTime, cursor.createTime, cursor.localIdBound(filepath.Base(msgDB.path)))
+
+	err := wechatSearchMsgDBRows(msgDB, querySql, args, keyWord, func(ref wechatFTSRef) bool {
+		hits = append(hits, wechatSearchHitFromRef(ref, keyWord))
+		return len(hits) < limit
+	})
+
+	return hits, err
+}
+
+func (P *WechatDataProvider) wechatSearchIndex(keyWord string, cursor wechatSearchCursor, limit int) ([]WeChatSearchHit, error) {
+	hits := make([]WeChatSearchHit, 0)
+	if P.searchBackend == nil {
+		return hits, errors.New("search backend not exist")
+	}
+
+	refs, err := P.searchBackend.search("", keyWord, cursor, limit)
+	if err != nil {
+		return hits, err
+	}
+
+	for _, ref := range refs {
+		hits = append(hits, wechatSearchHitFromRef(ref, keyWord))
+	}
+
+	return hits, nil
+}
+
+func wechatSearchHitFromRef(ref wechatFTSRef, keyWord string) WeChatSearchHit {
+	hit := WeChatSearchHit{}
+	hit.LocalId = int(ref.localId)
+	hit.MsgSvrId = strconv.FormatInt(ref.msgSvrID, 10)
+	hit.Type = ref.msgType
+	hit.SubType = ref.subType
+	hit.IsSender = ref.isSender
+	hit.CreateTime = ref.createTime
+	hit.Talker = ref.talker
+	hit.Snippet = wechatSearchSnippet(ref.content, keyWord)
+	hit.shard = ref.shard
+
+	return hit
+}
+
+// wechatSearchCounts returns the number of matches of every session, with
+// one grouped query instead of one per session.
+func (P *WechatDataProvider) wechatSearchCounts(keyWord string) map[string]int {
+	if P.searchBackend != nil {
+		counts, err := P.searchBackend.counts(keyWord)
+		if err == nil {
+			return counts
+		}
+		log.Println("search backend counts failed:", err)
+	}
+
+	counts := make(map[string]int)
+	for _, msgDB := range P.msgDBs {
+		err := wechatSearchMsgDBRows(msgDB, wechatSearchMsgDBSql+";", wechatSearchMsgDBArgs(keyWord), keyWord, func(ref wechatFTSRef) bool {
+			counts[ref.talker] += 1
+			return true
+		})
+		if err != nil {
+			log.Printf("count %s failed: %v\n", msgDB.path, err)
+		}
+	}
+
+	return counts
+}
+
+func wechatParseSearchCursor(cursor string) (wechatSearchCursor, error) {
+	if cursor == "" {
+		return wechatSearchCursorAt(math.MaxInt64), nil
+	}
+
+	parts := strings.Split(cursor, ":")
+	if len(parts) != 3 {
+		return wechatSearchCursor{}, errors.New("invalid search cursor " + cursor)
+	}
+	createTime, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return wechatSearchCursor{}, fmt.Errorf("invalid search cursor %s: %v", cursor, err)
+	}
+	localId, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return wechatSearchCursor{}, fmt.Errorf("invalid search cursor %s: %v", cursor, err)
+	}
+
+	return wechatSearchCursor{createTime: createTime, shard: parts[1], localId: localId}, nil
+}
+
+func wechatLikePattern(keyWord string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return "%" + replacer.Replace(keyWord) + "%"
+}
+
+func wechatSearchSnippet(content, keyWord string) string {
+	runes := []rune(content)
+	lowerRunes := []rune(strings.ToLower(content))
+	keyRunes := []rune(strings.ToLower(keyWord))
+
+	index := -1
+	for i := 0; i+len(keyRunes) <= len(lowerRunes); i++ {
+		if string(lowerRunes[i:i+len(keyRunes)]) == string(keyRunes) {
+			index = i
+			break
+		}
+	}
+	if index == -1 {
+		index = 0
+	}
+
+	start := index - wechatSnippetRunes
+	if start < 0 {
+		start = 0
+	}
+	end := index + len(keyRunes) + wechatSnippetRunes
+	if end > len(runes) {
+		end = len(runes)
+	}
+
+	snippet := string(runes[start:end])
+	if start > 0 {
+		snippet = "..." + snippet
+	}
+	if end < len(runes) {
+		snippet = snippet + "..."
+	}
+
+	return snippet
+}
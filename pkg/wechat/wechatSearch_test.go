@@ -0,0 +1,211 @@
+package wechat
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+type testMsg struct {
+	svrID      int64
+	msgType    int
+	talker     string
+	createTime int64
+	content    string
+}
+
+// testCreateMsgShard writes msgs to a new MSG shard with the columns the
+// provider reads and the merge copies, localId counting from 1. Every talker gets a Name2ID row,
+// which TalkerId points at.
+func testCreateMsgShard(t *testing.T, path string, msgs ...testMsg) {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`CREATE TABLE MSG (
+		localId INTEGER PRIMARY KEY AUTOINCREMENT,
+		TalkerId INT,
+		MsgSvrID INT,
+		Type INT,
+		SubType INT,
+		IsSender INT,
+		CreateTime INT,
+		Sequence INT,
+		StatusEx INT,
+		FlagEx INT,
+		Status INT,
+		MsgServerSeq INT,
+		MsgSequence INT,
+		StrTalker TEXT,
+		StrContent TEXT,
+		DisplayContent TEXT,
+		Reserved0 INT,
+		Reserved1 INT,
+		Reserved2 INT,
+		Reserved3 INT,
+		Reserved4 INT,
+		Reserved5 INT,
+		Reserved6 TEXT,
+		CompressContent BLOB,
+		BytesExtra BLOB,
+		BytesTrans BLOB
+	);
+	CREATE TABLE Name2ID (UsrName TEXT PRIMARY KEY);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range msgs {
+		if _, err := db.Exec("INSERT OR IGNORE INTO Name2ID (UsrName) VALUES (?);", msg.talker); err != nil {
+			t.Fatal(err)
+		}
+		_, err := db.Exec("INSERT INTO MSG (TalkerId, MsgSvrID, Type, SubType, IsSender, CreateTime, Sequence, StrTalker, StrContent) VALUES ((select rowid from Name2ID where UsrName=?), ?, ?, 0, 0, ?, ?, ?, ?);",
+			msg.talker, msg.svrID, msg.msgType, msg.createTime, msg.createTime*1000, msg.talker, msg.content)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// testSearchProvider opens the shards of dir as a provider that knows the
+// given talkers without a MicroMsg.db.
+func testSearchProvider(t *testing.T, shards []string, talkers ...string) *WechatDataProvider {
+	t.Helper()
+
+	P := &WechatDataProvider{}
+	P.userInfoMap = make(map[string]WeChatUserInfo)
+	for _, talker := range talkers {
+		P.userInfoMap[talker] = WeChatUserInfo{UserName: talker}
+	}
+	for _, path := range shards {
+		msgDB, err := wechatOpenMsgDB(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { msgDB.db.Close() })
+		P.msgDBs = append(P.msgDBs, msgDB)
+	}
+
+	return P
+}
+
+// testSearchPages reads every page of keyWord and returns the hits as
+// "shard/localId". A page groups its hits by session, so they are put back
+// in the order of want before the page is appended.
+func testSearchPages(t *testing.T, P *WechatDataProvider, keyWord string, pageSize int, want []string) ([]string, map[string]int, int) {
+	t.Helper()
+
+	order := make(map[string]int)
+	for i, hit := range want {
+		order[hit] = i
+	}
+	got := make([]string, 0)
+	counts := make(map[string]int)
+	total := 0
+	cursor := ""
+	for page := 0; ; page++ {
+		result, err := P.WeChatSearchAllMessages(keyWord, cursor, pageSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hits := make([]string, 0)
+		for _, session := range result.Sessions {
+			if page == 0 {
+				counts[session.UserName] = session.Count
+			} else if session.Count != 0 {
+				t.Fatalf("page %d counted %s again", page, session.UserName)
+			}
+			for _, hit := range session.Hits {
+				hits = append(hits, fmt.Sprintf("%s/%d", hit.shard, hit.LocalId))
+			}
+		}
+		if page == 0 {
+			total = result.Total
+		}
+		if len(hits) > pageSize {
+			t.Fatalf("page %d has %d hits", page, len(hits))
+		}
+		sort.SliceStable(hits, func(i, j int) bool { return order[hits[i]] < order[hits[j]] })
+		got = append(got, hits...)
+		if result.Cursor == "" {
+			break
+		}
+		if page > 100 {
+			t.Fatal("search does not end")
+		}
+		cursor = result.Cursor
+	}
+
+	return got, counts, total
+}
+
+func TestSearchAllMessagesPaging(t *testing.T) {
+	dir := t.TempDir()
+	shards := []string{filepath.Join(dir, "MSG0.db"), filepath.Join(dir, "MSG1.db")}
+
+	// Every message has the same CreateTime and no MsgSvrID, which used to
+	// repeat or drop hits at the page boundaries.
+	location := `<msg><location x="1" y="2" label="Hello street" poiname="cafe" /></msg>`
+	testCreateMsgShard(t, shards[0],
+		testMsg{0, Wechat_Message_Type_Text, "a", 100, "hello 1"},
+		testMsg{0, Wechat_Message_Type_Text, "b", 100, "HELLO 2"},
+		testMsg{0, Wechat_Message_Type_Text, "a", 100, "bye"},
+		testMsg{0, Wechat_Message_Type_Location, "b", 100, location},
+		testMsg{0, Wechat_Message_Type_Picture, "a", 100, `<img hello="1"/>`},
+	)
+	testCreateMsgShard(t, shards[1],
+		testMsg{0, Wechat_Message_Type_Text, "a", 100, "hello 3"},
+		testMsg{0, Wechat_Message_Type_System, "a", 100, "you said hello"},
+		testMsg{7, Wechat_Message_Type_Text, "b", 200, "hello 4"},
+		testMsg{7, Wechat_Message_Type_Text, "b", 50, "hello 5"},
+	)
+	want := []string{"MSG1.db/3", "MSG1.db/2", "MSG1.db/1", "MSG0.db/4", "MSG0.db/2", "MSG0.db/1", "MSG1.db/4"}
+	wantCounts := map[string]int{"a": 3, "b": 4}
+
+	P := testSearchProvider(t, shards, "a", "b")
+	for pageSize := 1; pageSize <= len(want)+1; pageSize++ {
+		got, counts, total := testSearchPages(t, P, "hello", pageSize, want)
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Fatalf("page size %d: hits %q, want %q", pageSize, got, want)
+		}
+		if total != len(want) {
+			t.Fatalf("page size %d: total %d, want %d", pageSize, total, len(want))
+		}
+		for talker, count := range counts {
+			if count != wantCounts[talker] {
+				t.Fatalf("page size %d: %s counted %d, want %d", pageSize, talker, count, wantCounts[talker])
+			}
+		}
+	}
+
+	// The index finds the same hits in the same order.
+	if !wechatHasFTS5() {
+		t.Skip(ErrNoFTS5)
+	}
+	index, err := wechatOpenFTSIndex(filepath.Join(dir, FTSIndexDB), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	P.searchBackend = index
+	defer index.Close()
+	for _, shard := range shards {
+		if _, err := index.updateShard(shard); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, keyWord := range []string{"hello", "he"} {
+		got, counts, total := testSearchPages(t, P, keyWord, 2, want)
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Fatalf("index %s: hits %q, want %q", keyWord, got, want)
+		}
+		if total != len(want) || counts["a"] != wantCounts["a"] || counts["b"] != wantCounts["b"] {
+			t.Fatalf("index %s: total %d, counts %v", keyWord, total, counts)
+		}
+	}
+}
@@ -0,0 +1,448 @@
+package wechat
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Snapshots of an account live in one directory, usually
+// <export dir>/Snapshots/wxid_xxx:
+//
+//	store/ab/abcdef...          file contents by SHA-256, read-only
+//	2024-05-01_203000/          one export tree per snapshot, every file a
+//	  .export-manifest.json     hard link into store, plus its manifest
+//
+// A snapshot only stores the files that no earlier snapshot had, and each
+// one opens like a normal export directory.
+const (
+	SnapshotStoreDir   = "store"
+	SnapshotTimeFormat = "2006-01-02_150405"
+)
+
+const (
+	snapshotLockFile  = ".lock"
+	snapshotTmpPrefix = ".tmp-"
+	snapshotDelPrefix = ".deleting-"
+	// A lock older than this was left by a crash and is taken over.
+	snapshotStaleLock = 12 * time.Hour
+)
+
+// ErrSnapshotBusy is returned when another snapshot or prune of the same
+// account is running.
+var ErrSnapshotBusy = errors.New("snapshot directory is busy")
+
+// SnapshotInfo describes one snapshot.
+type SnapshotInfo struct {
+	Name  string    `json:"name"`
+	Time  time.Time `json:"time"`
+	Files int       `json:"files"`
+	Bytes int64     `json:"bytes"` // size of the export, not what it adds to the store.
+}
+
+// SnapshotReport is the result of CreateSnapshot.
+type SnapshotReport struct {
+	Name        string `json:"name"`
+	Files       int    `json:"files"`
+	Reused      int    `json:"reused"` // files already in the store.
+	Stored      int    `json:"stored"` // files added to the store.
+	StoredBytes int64  `json:"storedBytes"`
+	Copied      int    `json:"copied"` // files copied because the file system cannot hard link.
+}
+
+// SnapshotRetention selects the snapshots PruneSnapshots keeps: the KeepLast
+// newest, and the newest of each of the KeepDaily last days, KeepWeekly last
+// ISO weeks and KeepMonthly last months that have a snapshot. A policy of
+// all zeros keeps everything, and the newest snapshot is always kept.
+type SnapshotRetention struct {
+	KeepLast    int `json:"keepLast"`
+	KeepDaily   int `json:"keepDaily"`
+	KeepWeekly  int `json:"keepWeekly"`
+	KeepMonthly int `json:"keepMonthly"`
+}
+
+func (r SnapshotRetention) empty() bool {
+	return r.KeepLast <= 0 && r.KeepDaily <= 0 && r.KeepWeekly <= 0 && r.KeepMonthly <= 0
+}
+
+// SnapshotPruneReport is the result of PruneSnapshots.
+type SnapshotPruneReport struct {
+	Kept         []string `json:"kept"`
+	Removed      []string `json:"removed"`
+	RemovedBlobs int      `json:"removedBlobs"`
+	FreedBytes   int64    `json:"freedBytes"`
+}
+
+// snapshotLock serializes snapshot and prune runs on one account, within the
+// process and across processes.
+type snapshotLock struct {
+	path string
+}
+
+var snapshotMtx sync.Mutex
+
+func lockSnapshots(snapRoot string) (*snapshotLock, error) {
+	if err := os.MkdirAll(snapRoot, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(snapRoot, snapshotLockFile)
+	fp, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		info, statErr := os.Stat(path)
+		if statErr != nil || time.Since(info.ModTime()) < snapshotStaleLock {
+			return nil, fmt.Errorf("%w: %s exists", ErrSnapshotBusy, path)
+		}
+		log.Println("take over stale snapshot lock", path)
+		os.Remove(path)
+		fp, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(fp, "%d %s\n", os.Getpid(), time.Now().Format(time.RFC3339))
+	fp.Close()
+
+	// Leftovers of a run that crashed can go now that nothing else runs.
+	entries, _ := os.ReadDir(snapRoot)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), snapshotTmpPrefix) || strings.HasPrefix(entry.Name(), snapshotDelPrefix) {
+			os.RemoveAll(filepath.Join(snapRoot, entry.Name()))
+		}
+	}
+
+	return &snapshotLock{path: path}, nil
+}
+
+func (l *snapshotLock) unlock() {
+	os.Remove(l.path)
+}
+
+// blobPath returns where the content with hex digest sum is stored.
+func blobPath(snapRoot string, sum string) string {
+	return filepath.Join(snapRoot, SnapshotStoreDir, sum[:2], sum)
+}
+
+// storeBlob copies src into the store as sum, checking that it still has
+// that digest. The copy is what snapshots link to: the export keeps being
+// rewritten in place, which must not reach files shared with snapshots.
+func storeBlob(snapRoot string, src string, sum string) (int64, error) {
+	dst := blobPath(snapRoot, sum)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return 0, err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	out, err := os.CreateTemp(filepath.Dir(dst), snapshotTmpPrefix)
+	if err != nil {
+		return 0, err
+	}
+	tmpPath := out.Name()
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(out, hash), in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && hex.EncodeToString(hash.Sum(nil)) != sum {
+		err = fmt.Errorf("%s changed since the manifest was written", src)
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, 0444)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, dst)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// IsSnapshot reports whether expPath is a snapshot, whose files are hard
+// links into the store shared by all snapshots of the account.
+func IsSnapshot(expPath string) bool {
+	info, err := os.Stat(filepath.Join(filepath.Dir(expPath), SnapshotStoreDir))
+	if err != nil || !info.IsDir() {
+		return false
+	}
+	_, err = os.Stat(filepath.Join(expPath, ExportManifestFile))
+	return err == nil
+}
+
+// unshareSnapshotFile gives path, a file of a snapshot that is about to be
+// written to, a copy of its own. Writing through the hard link would change
+// the store blob under every snapshot that shares it, and the read-only
+// mode of the blob does not stop root. Files outside snapshots and files
+// that do not exist are left alone.
+func unshareSnapshotFile(expPath string, path string) error {
+	if !IsSnapshot(expPath) {
+		return nil
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	tmpPath := path + ".unshare"
+	if _, err := copyFile(path, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Chmod(tmpPath, 0644); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return nil
+}
+
+// CreateSnapshot records the export at expPath as a new snapshot under
+// snapRoot. It needs the manifest of a finished export, and only copies the
+// files whose content is not in the store yet.
+func CreateSnapshot(expPath string, snapRoot string) (*SnapshotReport, error) {
+	if IsExportIncomplete(expPath) {
+		return nil, errors.New("export is incomplete, finish it before taking a snapshot")
+	}
+	manifest, err := LoadExportManifest(expPath)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshotMtx.Lock()
+	defer snapshotMtx.Unlock()
+	lock, err := lockSnapshots(snapRoot)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.unlock()
+
+	name := manifest.Created.Local().Format(SnapshotTimeFormat)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(filepath.Join(snapRoot, name)); os.IsNotExist(err) {
+			break
+		}
+		name = manifest.Created.Local().Format(SnapshotTimeFormat) + "-" + strconv.Itoa(i)
+	}
+	report := &SnapshotReport{Name: name, Files: len(manifest.Files)}
+
+	// Built under a temporary name, so a snapshot either exists complete or
+	// not at all.
+	tmpDir := filepath.Join(snapRoot, snapshotTmpPrefix+name)
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return nil, err
+	}
+	for _, entry := range manifest.Files {
+		src := filepath.Join(expPath, filepath.FromSlash(entry.Path))
+		blob := blobPath(snapRoot, entry.SHA256)
+		if _, err := os.Stat(blob); err == nil {
+			report.Reused += 1
+		} else {
+			n, err := storeBlob(snapRoot, src, entry.SHA256)
+			if err != nil {
+				os.RemoveAll(tmpDir)
+				return nil, err
+			}
+			report.Stored += 1
+			report.StoredBytes += n
+		}
+
+		dst := filepath.Join(tmpDir, filepath.FromSlash(entry.Path))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			os.RemoveAll(tmpDir)
+			return nil, err
+		}
+		if err := os.Link(blob, dst); err != nil {
+			// FAT and exFAT have no hard links, keep a full copy instead.
+			if _, err := copyFile(blob, dst); err != nil {
+				os.RemoveAll(tmpDir)
+				return nil, err
+			}
+			report.Copied += 1
+		}
+	}
+	if _, err := copyFile(filepath.Join(expPath, ExportManifestFile), filepath.Join(tmpDir, ExportManifestFile)); err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, err
+	}
+	if err := os.Rename(tmpDir, filepath.Join(snapRoot, name)); err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// ListSnapshots returns the snapshots under snapRoot, oldest first.
+func ListSnapshots(snapRoot string) ([]SnapshotInfo, error) {
+	snapshots := make([]SnapshotInfo, 0)
+	entries, err := os.ReadDir(snapRoot)
+	if os.IsNotExist(err) {
+		return snapshots, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		info := SnapshotInfo{Name: entry.Name()}
+		// A "-N" suffix tells apart snapshots taken in the same second.
+		stamp := entry.Name()
+		if len(stamp) > len(SnapshotTimeFormat) {
+			stamp = stamp[:len(SnapshotTimeFormat)]
+		}
+		if info.Time, err = time.ParseInLocation(SnapshotTimeFormat, stamp, time.Local); err != nil {
+			continue // store/ and anything else that is not a snapshot.
+		}
+		if manifest, err := LoadExportManifest(filepath.Join(snapRoot, entry.Name())); err == nil {
+			info.Files = len(manifest.Files)
+			for _, file := range manifest.Files {
+				info.Bytes += file.Size
+			}
+		}
+		snapshots = append(snapshots, info)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		if !snapshots[i].Time.Equal(snapshots[j].Time) {
+			return snapshots[i].Time.Before(snapshots[j].Time)
+		}
+		return snapshots[i].Name < snapshots[j].Name
+	})
+
+	return snapshots, nil
+}
+
+// keepSnapshots returns the names policy keeps out of snapshots, which are
+// sorted oldest first.
+func keepSnapshots(snapshots []SnapshotInfo, policy SnapshotRetention) map[string]bool {
+	keep := make(map[string]bool)
+	if len(snapshots) == 0 {
+		return keep
+	}
+	if policy.empty() {
+		for _, snapshot := range snapshots {
+			keep[snapshot.Name] = true
+		}
+		return keep
+	}
+
+	keep[snapshots[len(snapshots)-1].Name] = true
+	buckets := []struct {
+		count int
+		key   func(snapshot SnapshotInfo) string
+	}{
+		{policy.KeepLast, func(snapshot SnapshotInfo) string { return snapshot.Name }},
+		{policy.KeepDaily, func(snapshot SnapshotInfo) string { return snapshot.Time.Format("2006-01-02") }},
+		{policy.KeepWeekly, func(snapshot SnapshotInfo) string {
+			year, week := snapshot.Time.ISOWeek()
+			return fmt.Sprintf("%d-%02d", year, week)
+		}},
+		{policy.KeepMonthly, func(snapshot SnapshotInfo) string { return snapshot.Time.Format("2006-01") }},
+	}
+	for _, bucket := range buckets {
+		seen := make(map[string]bool)
+		for i := len(snapshots) - 1; i >= 0 && len(seen) < bucket.count; i-- {
+			key := bucket.key(snapshots[i])
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			keep[snapshots[i].Name] = true
+		}
+	}
+
+	return keep
+}
+
+// PruneSnapshots removes the snapshots under snapRoot that policy does not
+// keep, then deletes the stored files no remaining snapshot refers to. With
+// dryRun set it only reports what it would remove. Store files are only
+// deleted when the manifest of every remaining snapshot could be read.
+func PruneSnapshots(snapRoot string, policy SnapshotRetention, dryRun bool) (*SnapshotPruneReport, error) {
+	snapshotMtx.Lock()
+	defer snapshotMtx.Unlock()
+	if !dryRun {
+		lock, err := lockSnapshots(snapRoot)
+		if err != nil {
+			return nil, err
+		}
+		defer lock.unlock()
+	}
+
+	snapshots, err := ListSnapshots(snapRoot)
+	if err != nil {
+		return nil, err
+	}
+	keep := keepSnapshots(snapshots, policy)
+	report := &SnapshotPruneReport{Kept: make([]string, 0), Removed: make([]string, 0)}
+	for _, snapshot := range snapshots {
+		if keep[snapshot.Name] {
+			report.Kept = append(report.Kept, snapshot.Name)
+			continue
+		}
+		report.Removed = append(report.Removed, snapshot.Name)
+		if dryRun {
+			continue
+		}
+		// Renamed first, so a crash never leaves a half deleted snapshot
+		// that still looks like one.
+		path := filepath.Join(snapRoot, snapshot.Name)
+		delPath := filepath.Join(snapRoot, snapshotDelPrefix+snapshot.Name)
+		if err := os.Rename(path, delPath); err != nil {
+			return report, err
+		}
+		if err := os.RemoveAll(delPath); err != nil {
+			return report, err
+		}
+	}
+
+	referenced := make(map[string]bool)
+	for _, name := range report.Kept {
+		manifest, err := LoadExportManifest(filepath.Join(snapRoot, name))
+		if err != nil {
+			return report, fmt.Errorf("%s: %w, store not cleaned", name, err)
+		}
+		for _, file := range manifest.Files {
+			referenced[file.SHA256] = true
+		}
+	}
+	err = filepath.Walk(filepath.Join(snapRoot, SnapshotStoreDir), func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || referenced[info.Name()] {
+			return nil
+		}
+		report.RemovedBlobs += 1
+		report.FreedBytes += info.Size()
+		if dryRun {
+			return nil
+		}
+		return os.Remove(path)
+	})
+
+	return report, err
+}
@@ -0,0 +1,144 @@
+package wechat
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeepSnapshots(t *testing.T) {
+	times := []time.Time{
+		time.Date(2024, 1, 15, 10, 0, 0, 0, time.Local), // January, week 3
+		time.Date(2024, 2, 10, 10, 0, 0, 0, time.Local), // week 6
+		time.Date(2024, 2, 26, 9, 0, 0, 0, time.Local),  // Monday of week 9
+		time.Date(2024, 2, 28, 9, 0, 0, 0, time.Local),  // last of February
+		time.Date(2024, 3, 1, 8, 0, 0, 0, time.Local),
+		time.Date(2024, 3, 1, 20, 0, 0, 0, time.Local), // last of March 1st
+		time.Date(2024, 3, 2, 10, 0, 0, 0, time.Local), // newest, still week 9
+	}
+	snapshots := make([]SnapshotInfo, 0, len(times))
+	for _, tm := range times {
+		snapshots = append(snapshots, SnapshotInfo{Name: tm.Format(SnapshotTimeFormat), Time: tm})
+	}
+
+	tests := []struct {
+		name   string
+		policy SnapshotRetention
+		want   string
+	}{
+		{"all zeros keeps everything", SnapshotRetention{}, "2024-01-15_100000 2024-02-10_100000 2024-02-26_090000 2024-02-28_090000 2024-03-01_080000 2024-03-01_200000 2024-03-02_100000"},
+		{"last", SnapshotRetention{KeepLast: 2}, "2024-03-01_200000 2024-03-02_100000"},
+		{"daily", SnapshotRetention{KeepDaily: 3}, "2024-02-28_090000 2024-03-01_200000 2024-03-02_100000"},
+		{"weekly", SnapshotRetention{KeepWeekly: 2}, "2024-02-10_100000 2024-03-02_100000"},
+		{"monthly", SnapshotRetention{KeepMonthly: 3}, "2024-01-15_100000 2024-02-28_090000 2024-03-02_100000"},
+		{"more buckets than snapshots", SnapshotRetention{KeepMonthly: 12}, "2024-01-15_100000 2024-02-28_090000 2024-03-02_100000"},
+		{"union", SnapshotRetention{KeepDaily: 1, KeepWeekly: 3, KeepMonthly: 1}, "2024-01-15_100000 2024-02-10_100000 2024-03-02_100000"},
+	}
+	for _, test := range tests {
+		keep := keepSnapshots(snapshots, test.policy)
+		got := make([]string, 0, len(keep))
+		for name := range keep {
+			got = append(got, name)
+		}
+		sort.Strings(got)
+		if strings.Join(got, " ") != test.want {
+			t.Errorf("%s: kept %q, want %s", test.name, got, test.want)
+		}
+	}
+
+	if keep := keepSnapshots(nil, SnapshotRetention{KeepLast: 1}); len(keep) != 0 {
+		t.Errorf("kept %v of no snapshots", keep)
+	}
+}
+
+func TestPruneSnapshotsSharedBlobs(t *testing.T) {
+	dir := t.TempDir()
+	expPath := filepath.Join(dir, "export")
+	snapRoot := filepath.Join(dir, "Snapshots")
+	write := func(rel, content string) {
+		path := filepath.Join(expPath, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapshot := func() *SnapshotReport {
+		if _, err := WriteExportManifest(expPath); err != nil {
+			t.Fatal(err)
+		}
+		report, err := CreateSnapshot(expPath, snapRoot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+	blobs := func() int {
+		n := 0
+		filepath.Walk(filepath.Join(snapRoot, SnapshotStoreDir), func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				n++
+			}
+			return nil
+		})
+		return n
+	}
+
+	write("Msg/MicroMsg.db", "shared")
+	write("FileStorage/a.jpg", "old")
+	first := snapshot()
+	if first.Stored != 2 || first.Reused != 0 {
+		t.Fatalf("first snapshot %+v", first)
+	}
+	write("FileStorage/a.jpg", "new")
+	second := snapshot()
+	if second.Stored != 1 || second.Reused != 1 || second.Name == first.Name {
+		t.Fatalf("second snapshot %+v", second)
+	}
+	if blobs() != 3 {
+		t.Fatalf("store has %d blobs, want 3", blobs())
+	}
+
+	policy := SnapshotRetention{KeepLast: 1}
+	report, err := PruneSnapshots(snapRoot, policy, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(report.Removed, " ") != first.Name || report.RemovedBlobs != 1 || report.FreedBytes != 3 {
+		t.Fatalf("dry run %+v", report)
+	}
+	if _, err := os.Stat(filepath.Join(snapRoot, first.Name)); err != nil || blobs() != 3 {
+		t.Fatalf("dry run removed something: %v, %d blobs", err, blobs())
+	}
+
+	report, err = PruneSnapshots(snapRoot, policy, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(report.Kept, " ") != second.Name || strings.Join(report.Removed, " ") != first.Name || report.RemovedBlobs != 1 {
+		t.Fatalf("prune %+v", report)
+	}
+	if _, err := os.Stat(filepath.Join(snapRoot, first.Name)); !os.IsNotExist(err) {
+		t.Fatalf("pruned snapshot still there: %v", err)
+	}
+
+	// The blob the pruned snapshot shared with the kept one is still there,
+	// so the kept snapshot is whole.
+	if blobs() != 2 {
+		t.Fatalf("store has %d blobs, want 2", blobs())
+	}
+	verify, err := VerifyExport(filepath.Join(snapRoot, second.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verify.Intact() || verify.OK != 2 {
+		t.Fatalf("kept snapshot %+v", verify)
+	}
+	if _, err := os.Stat(filepath.Join(snapRoot, snapshotLockFile)); !os.IsNotExist(err) {
+		t.Fatalf("lock left behind: %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package wechat
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+type WeChatTypeStats struct {
+	Type  int `json:"Type"`
+	Count int `json:"Count"`
+}
+
+type WeChatDBStats struct {
+	Name      string `json:"Name"`
+	Size      int64  `json:"Size"`
+	Messages  int    `json:"Messages"`
+	StartTime int64  `json:"StartTime"`
+	EndTime   int64  `json:"EndTime"`
+}
+
+type WeChatStats struct {
+	UserName  string            `json:"UserName"`
+	Contacts  int               `json:"Contacts"`
+	Sessions  int               `json:"Sessions"`
+	Messages  int               `json:"Messages"`
+	StartTime int64             `json:"StartTime"`
+	EndTime   int64             `json:"EndTime"`
+	Types     []WeChatTypeStats `json:"Types"`
+	DBs       []WeChatDBStats   `json:"DBs"`
+}
+
+// WeChatGetStats counts contacts, sessions and messages of the opened
+// account, per message type and per MSG shard.
+func (P *WechatDataProvider) WeChatGetStats() (*WeChatStats, error) {
+	stats := &WeChatStats{}
+	stats.Types = make([]WeChatTypeStats, 0)
+	stats.DBs = make([]WeChatDBStats, 0)
+	if P.SelfInfo != nil {
+		stats.UserName = P.SelfInfo.UserName
+	}
+	if P.ContactList != nil {
+		stats.Contacts = P.ContactList.Total
+	}
+
+	err := P.microMsg.queryRow("select count(*) from Session where ifnull(strContent,'')!='';").Scan(&stats.Sessions)
+	if err != nil {
+		return stats, err
+	}
+
+	typeCount := make(map[int]int)
+	querySql := "select Type, count(*), ifnull(min(CreateTime),0), ifnull(max(CreateTime),0) from MSG group by Type;"
+	for _, msgDB := range P.msgDBs {
+		dbStats := WeChatDBStats{Name: filepath.Base(msgDB.path)}
+		if info, err := os.Stat(msgDB.path); err == nil {
+			dbStats.Size = info.Size()
+		}
+
+		rows, err := msgDB.db.query(querySql)
+		if err != nil {
+			log.Printf("stats %s failed: %v\n", msgDB.path, err)
+			continue
+		}
+
+		var msgType, count int
+		var startTime, endTime int64
+		for rows.Next() {
+			if err := rows.Scan(&msgType, &count, &startTime, &endTime); err != nil {
+				log.Println("rows.Scan failed", err)
+				break
+			}
+			typeCount[msgType] += count
+			dbStats.Messages += count
+			if dbStats.StartTime == 0 || startTime < dbStats.StartTime {
+				dbStats.StartTime = startTime
+			}
+			if endTime > dbStats.EndTime {
+				dbStats.EndTime = endTime
+			}
+		}
+		rows.Close()
+
+		stats.Messages += dbStats.Messages
+		if dbStats.Messages > 0 {
+			if stats.StartTime == 0 || dbStats.StartTime < stats.StartTime {
+				stats.StartTime = dbStats.StartTime
+			}
+			if dbStats.EndTime > stats.EndTime {
+				stats.EndTime = dbStats.EndTime
+			}
+		}
+		stats.DBs = append(stats.DBs, dbStats)
+	}
+
+	for msgType, count := range typeCount {
+		stats.Types = append(stats.Types, WeChatTypeStats{Type: msgType, Count: count})
+	}
+	sort.Slice(stats.Types, func(i, j int) bool {
+		return stats.Types[i].Count > stats.Types[j].Count
+	})
+
+	return stats, nil
+}
@@ -0,0 +1,25 @@
+//go:build !windows
+
+package wechat
+
+import (
+	"errors"
+	"log"
+)
+
+// GetWeChatInfo 只能在 Windows 上读取正在运行的微信进程，其他平台返回空列表，
+// 需要先在 Windows 上拿到密钥，再把 WeChat Files 目录拷贝过来导出。
+func GetWeChatInfo() (list *WeChatInfoList) {
+	list = &WeChatInfoList{}
+	list.Info = make([]WeChatInfo, 0)
+	log.Println("GetWeChatInfo is only supported on windows")
+	return
+}
+
+func Is64BitProcess(pid uint32) (bool, error) {
+	return false, errors.New("Is64BitProcess is only supported on windows")
+}
+
+func GetWeChatKey(info *WeChatInfo) string {
+	return ""
+}
@@ -0,0 +1,218 @@
+package wechat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"github.com/shirou/gopsutil/v3/process"
+	"golang.org/x/sys/windows"
+)
+
+func GetWeChatInfo() (list *WeChatInfoList) {
+	list = &WeChatInfoList{}
+	list.Info = make([]WeChatInfo, 0)
+	list.Total = 0
+
+	processes, err := process.Processes()
+	if err != nil {
+		log.Println("Error getting processes:", err)
+		return
+	}
+
+	for _, p := range processes {
+		name, err := p.Name()
+		if err != nil {
+			continue
+		}
+		info := WeChatInfo{}
+		if name == "WeChat.exe" {
+			info.ProcessID = uint32(p.Pid)
+			info.Is64Bits, _ = Is64BitProcess(info.ProcessID)
+			log.Println("ProcessID", info.ProcessID)
+			files, err := p.OpenFiles()
+			if err != nil {
+				log.Println("OpenFiles failed")
+				continue
+			}
+
+			for _, f := range files {
+				if strings.HasSuffix(f.Path, "\\Media.db") {
+					// fmt.Printf("opened %s\n", f.Path[4:])
+					filePath := f.Path
+					parts := strings.Split(filePath, string(filepath.Separator))
+					if len(parts) < 4 {
+						log.Println("Error filePath " + filePath)
+						break
+					}
+					info.FilePath = strings.Join(parts[:len(parts)-2], string(filepath.Separator))
+					info.AcountName = strings.Join(parts[len(parts)-3:len(parts)-2], string(filepath.Separator))
+				}
+
+			}
+
+			if len(info.FilePath) == 0 {
+				log.Println("wechat not log in")
+				continue
+			}
+
+			hModuleSnap, err := windows.CreateToolhelp32Snapshot(windows.TH32CS_SNAPMODULE|windows.TH32CS_SNAPMODULE32, uint32(p.Pid))
+			if err != nil {
+				log.Println("CreateToolhelp32Snapshot failed", err)
+				continue
+			}
+			defer windows.CloseHandle(hModuleSnap)
+
+			var me32 windows.ModuleEntry32
+			me32.Size = uint32(windows.SizeofModuleEntry32)
+
+			err = windows.Module32First(hModuleSnap, &me32)
+			if err != nil {
+				log.Println("Module32First failed", err)
+				continue
+			}
+
+			for ; err == nil; err = windows.Module32Next(hModuleSnap, &me32) {
+				if windows.UTF16ToString(me32.Module[:]) == "WeChatWin.dll" {
+					// fmt.Printf("MODULE NAME: %s\n", windows.UTF16ToString(me32.Module[:]))
+					// fmt.Printf("executable NAME: %s\n", windows.UTF16ToString(me32.ExePath[:]))
+					// fmt.Printf("base address: 0x%08X\n", me32.ModBaseAddr)
+					// fmt.Printf("base ModBaseSize: %d\n", me32.ModBaseSize)
+					info.DllBaseAddr = me32.ModBaseAddr
+					info.DllBaseSize = me32.ModBaseSize
+
+					var zero windows.Handle
+					driverPath := windows.UTF16ToString(me32.ExePath[:])
+					infoSize, err := windows.GetFileVersionInfoSize(driverPath, &zero)
+					if err != nil {
+						log.Println("GetFileVersionInfoSize failed", err)
+						break
+					}
+					versionInfo := make([]byte, infoSize)
+					if err = windows.GetFileVersionInfo(driverPath, 0, infoSize, unsafe.Pointer(&versionInfo[0])); err != nil {
+						log.Println("GetFileVersionInfo failed", err)
+						break
+					}
+					var fixedInfo *windows.VS_FIXEDFILEINFO
+					fixedInfoLen := uint32(unsafe.Sizeof(*fixedInfo))
+					err = windows.VerQueryValue(unsafe.Pointer(&versionInfo[0]), `\`, (unsafe.Pointer)(&fixedInfo), &fixedInfoLen)
+					if err != nil {
+						log.Println("VerQueryValue failed", err)
+						break
+					}
+					// fmt.Printf("%s: v%d.%d.%d.%d\n", windows.UTF16ToString(me32.Module[:]),
+					// 	(fixedInfo.FileVersionMS>>16)&0xff,
+					// 	(fixedInfo.FileVersionMS>>0)&0xff,
+					// 	(fixedInfo.FileVersionLS>>16)&0xff,
+					// 	(fixedInfo.FileVersionLS>>0)&0xff)
+
+					info.Version = fmt.Sprintf("%d.%d.%d.%d",
+						(fixedInfo.FileVersionMS>>16)&0xff,
+						(fixedInfo.FileVersionMS>>0)&0xff,
+						(fixedInfo.FileVersionLS>>16)&0xff,
+						(fixedInfo.FileVersionLS>>0)&0xff)
+					list.Info = append(list.Info, info)
+					list.Total += 1
+					break
+				}
+			}
+		}
+	}
+	return
+}
+
+func Is64BitProcess(pid uint32) (bool, error) {
+	is64Bit := false
+	handle, err := windows.OpenProcess(windows.PROCESS_QUERY_INFORMATION, false, pid)
+	if err != nil {
+		log.Println("Error opening process:", err)
+		return is64Bit, errors.New("OpenProcess failed")
+	}
+	defer windows.CloseHandle(handle)
+
+	err = windows.IsWow64Process(handle, &is64Bit)
+	if err != nil {
+		log.Println("Error IsWow64Process:", err)
+	}
+	return !is64Bit, err
+}
+
+func GetWeChatKey(info *WeChatInfo) string {
+	mediaDB := info.FilePath + "\\Msg\\Media.db"
+	if _, err := os.Stat(mediaDB); err != nil {
+		log.Printf("open db %s error: %v", mediaDB, err)
+		return ""
+	}
+
+	handle, err := windows.OpenProcess(windows.PROCESS_QUERY_INFORMATION|windows.PROCESS_VM_READ, false, uint32(info.ProcessID))
+	if err != nil {
+		log.Println("Error opening process:", err)
+		return ""
+	}
+	defer windows.CloseHandle(handle)
+
+	buffer := make([]byte, info.DllBaseSize)
+	err = windows.ReadProcessMemory(handle, uintptr(info.DllBaseAddr), &buffer[0], uintptr(len(buffer)), nil)
+	if err != nil {
+		log.Println("Error ReadProcessMemory:", err)
+		return ""
+	}
+
+	offset := 0
+	// searchStr := []byte(info.AcountName)
+	for {
+		index := hasDeviceSybmol(buffer[offset:])
+		if index == -1 {
+			log.Println("has not DeviceSybmol")
+			break
+		}
+		fmt.Printf("hasDeviceSybmol: 0x%X\n", index)
+		keys := findDBKeyPtr(buffer[offset:index], info.Is64Bits)
+		// fmt.Println("keys:", keys)
+
+		key, err := findDBkey(handle, info.FilePath+"\\Msg\\Media.db", keys)
+		if err == nil {
+			// fmt.Println("key:", key)
+			return key
+		}
+
+		offset += (index + 20)
+	}
+
+	return ""
+}
+
+func findDBkey(handle windows.Handle, path string, keys [][]byte) (string, error) {
+	var keyAddrPtr uint64
+	addrBuffer := make([]byte, 0x08)
+	for _, key := range keys {
+		copy(addrBuffer, key)
+		err := binary.Read(bytes.NewReader(addrBuffer), binary.LittleEndian, &keyAddrPtr)
+		if err != nil {
+			log.Println("binary.Read:", err)
+			continue
+		}
+		if keyAddrPtr == 0x00 {
+			continue
+		}
+		log.Printf("keyAddrPtr: 0x%X\n", keyAddrPtr)
+		keyBuffer := make([]byte, 0x20)
+		err = windows.ReadProcessMemory(handle, uintptr(keyAddrPtr), &keyBuffer[0], uintptr(len(keyBuffer)), nil)
+		if err != nil {
+			// fmt.Println("Error ReadProcessMemory:", err)
+			continue
+		}
+		if checkDataBaseKey(path, keyBuffer, DecryptProfileV3) {
+			return hex.EncodeToString(keyBuffer), nil
+		}
+	}
+
+	return "", errors.New("not found key")
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const apiPrefix = "/api/v1/"
+
+const (
+	serveReadTimeout  = 30 * time.Second // 读取整个请求的超时时间，接口都是 GET，不需要更长。
+	serveWriteTimeout = 10 * time.Minute // 写回响应的超时时间，要够局域网内传完一个较大的视频。
+	serveIdleTimeout  = 2 * time.Minute  // keep-alive 连接空闲多久后关闭。
+)
+
+// apiServer 把 App 的只读接口以 JSON 形式提供给浏览器，媒体文件仍由 FileLoader 处理，
+// 这样放在 NAS 上的备份可以在局域网内直接浏览。
+type apiServer struct {
+	app *App
+	mux *http.ServeMux
+}
+
+type apiHandler func(req *http.Request) string
+
+func newAPIServer(a *App) *apiServer {
+	s := &apiServer{app: a, mux: http.NewServeMux()}
+
+	s.handle("version", func(req *http.Request) string {
+		return fmt.Sprintf("{\"version\":\"%s\"}", a.GetAppVersion())
+	})
+	s.handle("accounts", func(req *http.Request) string {
+		return a.GetWechatLocalAccountInfo()
+	})
+	s.handle("self", func(req *http.Request) string {
+		if a.provider == nil || a.provider.SelfInfo == nil {
+			return ""
+		}
+		infoStr, _ := json.Marshal(a.provider.SelfInfo)
+		return string(infoStr)
+	})
+	s.handle("stats", func(req *http.Request) string {
+		if a.provider == nil {
+			return ""
+		}
+		stats, err := a.provider.WeChatGetStats()
+		if err != nil {
+			log.Println("WeChatGetStats failed:", err)
+			return ""
+		}
+		statsStr, _ := json.Marshal(stats)
+		return string(statsStr)
+	})
+	s.handle("sessions", func(req *http.Request) string {
+		return a.GetWechatSessionList(apiInt(req, "page", 0), apiInt(req, "size", 30))
+	})
+	s.handle("sessions/lasttime", func(req *http.Request) string {
+		return a.GetSessionLastTime(req.FormValue("user"))
+	})
+	s.handle("contacts", func(req *http.Request) string {
+		return a.GetWechatContactList(apiInt(req, "page", 0), apiInt(req, "size", 30))
+	})
+	s.handle("contacts/search", func(req *http.Request) string {
+		return a.GetWechatSearchContacts(req.FormValue("keyword"))
+	})
+	s.handle("rooms/members", func(req *http.Request) string {
+		if a.provider == nil {
+			return ""
+		}
+		return a.GetWeChatRoomUserList(req.FormValue("room"))
+	})
+	s.handle("messages", func(req *http.Request) string {
+		return a.GetWechatMessageListByTime(req.FormValue("user"), apiTime(req), apiInt(req, "size", 30), apiDirection(req))
+	})
+	s.handle("messages/type", func(req *http.Request) string {
+		return a.GetWechatMessageListByType(req.FormValue("user"), apiTime(req), apiInt(req, "size", 30), req.FormValue("type"), apiDirection(req))
+	})
+	s.handle("messages/keyword", func(req *http.Request) string {
+		return a.GetWechatMessageListByKeyWord(req.FormValue("user"), apiTime(req), req.FormValue("keyword"), req.FormValue("type"), apiInt(req, "size", 30))
+	})
+	s.handle("messages/date", func(req *http.Request) string {
+		return a.GetWechatMessageDate(req.FormValue("user"))
+	})
+	s.handle("search", func(req *http.Request) string {
+		return a.GetWechatSearchAllMessages(req.FormValue("keyword"), req.FormValue("cursor"), apiInt(req, "size", 30))
+	})
+	s.handle("bookmarks", func(req *http.Request) string {
+		return a.GetSessionBookMaskList(req.FormValue("user"))
+	})
+
+	s.mux.HandleFunc("/User/", s.serveMedia)
+	return s
+}
+
+func (s *apiServer) handle(name string, handler apiHandler) {
+	s.mux.HandleFunc(apiPrefix+name, func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			apiError(res, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		result := handler(req)
+		if result == "" {
+			apiError(res, http.StatusInternalServerError, "request failed")
+			return
+		}
+		if !strings.HasPrefix(result, "{") && !strings.HasPrefix(result, "[") {
+			apiError(res, http.StatusBadRequest, result)
+			return
+		}
+
+		res.Header().Set("Content-Type", "application/json; charset=utf-8")
+		res.Write([]byte(result))
+	})
+}
+
+func (s *apiServer) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	s.mux.ServeHTTP(res, req)
+	log.Printf("%s %s %s %v\n", req.RemoteAddr, req.Method, req.URL.RequestURI(), time.Since(start))
+}
+
+// serveMedia 只放行当前打开账号 /User/<账号>/FileStorage 下的文件，
+// 解密后的数据库和导出目录中其他账号的文件都不对外提供。
+func (s *apiServer) serveMedia(res http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(path.Clean(req.URL.Path), "/"), "/")
+	if len(parts) < 4 || parts[0] != "User" || parts[1] != s.app.defaultUser || parts[2] != "FileStorage" {
+		http.NotFound(res, req)
+		return
+	}
+
+	s.app.FLoader.ServeHTTP(res, req)
+}
+
+func apiError(res http.ResponseWriter, code int, msg string) {
+	errStr, _ := json.Marshal(ErrorMessage{ErrorStr: msg})
+	res.Header().Set("Content-Type", "application/json; charset=utf-8")
+	res.WriteHeader(code)
+	res.Write(errStr)
+}
+
+func apiInt(req *http.Request, name string, def int) int {
+	value, err := strconv.Atoi(req.FormValue(name))
+	if err != nil {
+		return def
+	}
+
+	return value
+}
+
+func apiTime(req *http.Request) int64 {
+	value, err := strconv.ParseInt(req.FormValue("time"), 10, 64)
+	if err != nil {
+		return time.Now().Unix()
+	}
+
+	return value
+}
+
+func apiDirection(req *http.Request) string {
+	if direction := req.FormValue("direction"); direction != "" {
+		return direction
+	}
+
+	return "forward"
+}
+
+// serveOpenAccount 打开 root/User 下的账号，account 为空时使用配置中的默认账号，
+// 没有配置时使用找到的第一个账号。不会改写配置文件。
+func (a *App) serveOpenAccount(root, account string) error {
+	if root != "" {
+		a.FLoader.SetFilePrefix(root)
+	}
+
+	userPath := filepath.Join(a.FLoader.FilePrefix, "User")
+	if account == "" {
+		account = a.defaultUser
+	}
+	if account == "" {
+		dirs, err := os.ReadDir(userPath)
+		if err != nil {
+			return err
+		}
+		for i := range dirs {
+			if dirs[i].IsDir() {
+				account = dirs[i].Name()
+				break
+			}
+		}
+	}
+	if account == "" {
+		return errors.New("no account found in " + userPath)
+	}
+
+	hasUser := false
+	for _, user := range a.users {
+		if user == account {
+			hasUser = true
+			break
+		}
+	}
+	if !hasUser {
+		a.users = append(a.users, account)
+	}
+	a.defaultUser = account
+
+	return a.createWechatDataProvider(filepath.Join(userPath, account), "/User/"+account)
+}
+
+// cliServe 启动 HTTP 服务，接口见 newAPIServer，默认只监听本机。
+func cliServe(args []string) error {
+	fs, _ := cliFlagSet("serve")
+	addr := fs.String("addr", "127.0.0.1:8080", "listen address, use :8080 to serve the LAN")
+	root := fs.String("root", "", "export directory that contains User (default: export path in config.json)")
+	account := fs.String("account", "", "account to open (default: default account in config.json)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	a := NewApp()
+	if err := a.serveOpenAccount(*root, *account); err != nil {
+		return err
+	}
+	defer a.provider.WechatWechatDataProviderClose()
+
+	server := &http.Server{
+		Addr:              *addr,
+		Handler:           newAPIServer(a),
+		ReadHeaderTimeout: serveReadTimeout,
+		ReadTimeout:       serveReadTimeout,
+		WriteTimeout:      serveWriteTimeout,
+		IdleTimeout:       serveIdleTimeout,
+	}
+	fmt.Printf("serving %s on http://%s%s\n", a.defaultUser, *addr, apiPrefix)
+	return server.ListenAndServe()
+}